@@ -8,13 +8,21 @@ import (
 	"net/http"
 	"os"
 	"os/signal"
+	"remnawave-tg-shop-bot/internal/cache"
 	"remnawave-tg-shop-bot/internal/config"
+	"remnawave-tg-shop-bot/internal/cryptopay"
 	"remnawave-tg-shop-bot/internal/database"
 	"remnawave-tg-shop-bot/internal/handler"
+	"remnawave-tg-shop-bot/internal/notification"
+	"remnawave-tg-shop-bot/internal/payment"
+	"remnawave-tg-shop-bot/internal/promo"
+	"remnawave-tg-shop-bot/internal/referral"
 	"remnawave-tg-shop-bot/internal/remnawave"
+	"remnawave-tg-shop-bot/internal/scheduler"
 	"remnawave-tg-shop-bot/internal/sync"
 	"remnawave-tg-shop-bot/internal/translation"
 	"remnawave-tg-shop-bot/internal/tribute"
+	"remnawave-tg-shop-bot/internal/yookasa"
 	"time"
 
 	"github.com/go-telegram/bot"
@@ -52,6 +60,21 @@ func main() {
 	customerRepository := database.NewCustomerRepository(pool)
 	subscriptionRepository := database.NewSubscriptionRepository(pool)
 	referralRepository := database.NewReferralRepository(pool)
+	purchaseRepository := database.NewPurchaseRepository(pool)
+	trialUsageRepository := database.NewTrialUsageRepository(pool)
+	referralRewardRepository := database.NewReferralRewardRepository(pool)
+	campaignRepository := database.NewCampaignRepository(pool)
+	promoRepository := database.NewPromoRepository(pool)
+
+	var cryptoPayClient *cryptopay.Client
+	if config.IsCryptoPayEnabled() {
+		cryptoPayClient = cryptopay.NewCryptoPayClient(config.CryptoPayUrl(), config.CryptoPayToken())
+	}
+	var yookasaClient *yookasa.Client
+	if config.IsYookasaEnabled() {
+		yookasaClient = yookasa.NewClient(config.YookasaUrl(), config.YookasaShopId(), config.YookasaSecretKey())
+	}
+	cache := cache.NewCache(30 * time.Minute)
 
 	rw := remnawave.NewClient(config.RemnawaveUrl(), config.RemnawaveToken(), config.RemnawaveMode())
 	b, err := bot.New(config.TelegramToken(), bot.WithWorkers(3))
@@ -59,8 +82,13 @@ func main() {
 		panic(err)
 	}
 
-	syncService := sync.NewSyncService(rw, customerRepository)
-	h := handler.NewHandler(syncService, nil, tm, customerRepository, nil, subscriptionRepository, nil, nil, referralRepository, nil)
+	usageCache := remnawave.NewUsageCache(rw, time.Duration(config.TrafficUsageCacheTTL())*time.Second)
+	referralService := referral.NewService(referralRepository, referralRewardRepository, customerRepository, purchaseRepository, subscriptionRepository, rw, tm, b, config.ReferralRules())
+	promoService := promo.NewService(promoRepository, subscriptionRepository, rw, usageCache)
+	paymentService := payment.NewPaymentService(tm, purchaseRepository, rw, customerRepository, subscriptionRepository, referralService, promoService, b, cryptoPayClient, yookasaClient, cache, usageCache)
+	jobs := scheduler.New()
+	syncService := sync.NewSyncService(rw, customerRepository, subscriptionRepository, tm)
+	h := handler.NewHandler(syncService, paymentService, tm, customerRepository, purchaseRepository, subscriptionRepository, cryptoPayClient, yookasaClient, referralRepository, trialUsageRepository, cache, usageCache, rw, referralRewardRepository, referralService, campaignRepository, promoRepository, promoService, jobs)
 
 	me, err := b.GetMe(ctx)
 	if err != nil {
@@ -74,18 +102,47 @@ func main() {
 	b.RegisterHandler(bot.HandlerTypeMessageText, "/start", bot.MatchTypePrefix, h.StartCommandHandler, h.SuspiciousUserFilterMiddleware)
 	b.RegisterHandler(bot.HandlerTypeMessageText, "/connect", bot.MatchTypeExact, h.ConnectCommandHandler, h.SuspiciousUserFilterMiddleware, h.CreateCustomerIfNotExistMiddleware)
 	b.RegisterHandler(bot.HandlerTypeMessageText, "/sync", bot.MatchTypeExact, h.SyncUsersCommandHandler, isAdminMiddleware)
+	b.RegisterHandler(bot.HandlerTypeMessageText, "/sync_dry", bot.MatchTypeExact, h.SyncDryRunCommandHandler, isAdminMiddleware)
+	b.RegisterHandler(bot.HandlerTypeMessageText, "/jobs", bot.MatchTypeExact, h.JobsCommandHandler, isAdminMiddleware)
+	b.RegisterHandler(bot.HandlerTypeMessageText, "/reset_trial", bot.MatchTypePrefix, h.ResetTrialCommandHandler, isAdminMiddleware)
+	b.RegisterHandler(bot.HandlerTypeMessageText, "/campaign_add", bot.MatchTypePrefix, h.CampaignAddCommandHandler, isAdminMiddleware)
+	b.RegisterHandler(bot.HandlerTypeMessageText, "/campaigns", bot.MatchTypeExact, h.CampaignsCommandHandler, isAdminMiddleware)
+	b.RegisterHandler(bot.HandlerTypeMessageText, "/promo_add", bot.MatchTypePrefix, h.PromoAddCommandHandler, isAdminMiddleware)
+	b.RegisterHandler(bot.HandlerTypeMessageText, "/promo", bot.MatchTypePrefix, h.PromoCommandHandler, h.SuspiciousUserFilterMiddleware, h.CreateCustomerIfNotExistMiddleware)
+	b.RegisterHandler(bot.HandlerTypeCallbackQueryData, handler.CallbackSyncConfirm, bot.MatchTypePrefix, h.SyncConfirmCallbackHandler, isAdminMiddleware)
+	b.RegisterHandler(bot.HandlerTypeCallbackQueryData, handler.CallbackSyncCancel, bot.MatchTypeExact, h.SyncCancelCallbackHandler, isAdminMiddleware)
 
-	b.RegisterHandler(bot.HandlerTypeCallbackQueryData, handler.CallbackReferral, bot.MatchTypeExact, h.ReferralCallbackHandler, h.SuspiciousUserFilterMiddleware, h.CreateCustomerIfNotExistMiddleware)
+	b.RegisterHandler(bot.HandlerTypeCallbackQueryData, handler.CallbackReferral, bot.MatchTypePrefix, h.ReferralCallbackHandler, h.SuspiciousUserFilterMiddleware, h.CreateCustomerIfNotExistMiddleware)
+	b.RegisterHandler(bot.HandlerTypeCallbackQueryData, handler.CallbackPromoApply, bot.MatchTypePrefix, h.PromoApplyCallbackHandler, h.SuspiciousUserFilterMiddleware, h.CreateCustomerIfNotExistMiddleware)
+	b.RegisterHandler(bot.HandlerTypeCallbackQueryData, handler.CallbackPromo, bot.MatchTypeExact, h.PromoCallbackHandler, h.SuspiciousUserFilterMiddleware, h.CreateCustomerIfNotExistMiddleware)
 	b.RegisterHandler(bot.HandlerTypeCallbackQueryData, handler.CallbackTrial, bot.MatchTypeExact, h.TrialCallbackHandler, h.SuspiciousUserFilterMiddleware, h.CreateCustomerIfNotExistMiddleware)
 	b.RegisterHandler(bot.HandlerTypeCallbackQueryData, handler.CallbackStart, bot.MatchTypeExact, h.StartCallbackHandler, h.SuspiciousUserFilterMiddleware, h.CreateCustomerIfNotExistMiddleware)
 	b.RegisterHandler(bot.HandlerTypeCallbackQueryData, handler.CallbackConnect, bot.MatchTypeExact, h.ConnectCallbackHandler, h.SuspiciousUserFilterMiddleware, h.CreateCustomerIfNotExistMiddleware)
 
+	// Purchase flow
+	b.RegisterHandler(bot.HandlerTypeCallbackQueryData, handler.CallbackBuy, bot.MatchTypePrefix, h.BuyCallbackHandler, h.SuspiciousUserFilterMiddleware, h.CreateCustomerIfNotExistMiddleware)
+	b.RegisterHandler(bot.HandlerTypeCallbackQueryData, handler.CallbackSell, bot.MatchTypePrefix, h.SellCallbackHandler, h.SuspiciousUserFilterMiddleware, h.CreateCustomerIfNotExistMiddleware)
+	b.RegisterHandler(bot.HandlerTypeCallbackQueryData, handler.CallbackPayment, bot.MatchTypePrefix, h.PaymentCallbackHandler, h.SuspiciousUserFilterMiddleware, h.CreateCustomerIfNotExistMiddleware)
+
+	// Telegram Stars: регистрируются до текстового обработчика, который перехватывает любые сообщения
+	b.RegisterHandlerMatchFunc(func(update *models.Update) bool { return update.PreCheckoutQuery != nil }, h.PreCheckoutQueryHandler)
+	b.RegisterHandlerMatchFunc(func(update *models.Update) bool {
+		return update.Message != nil && update.Message.SuccessfulPayment != nil
+	}, h.SuccessfulPaymentHandler)
+
 	// Multiple subscriptions
 	b.RegisterHandler(bot.HandlerTypeCallbackQueryData, handler.CallbackMySubscriptions, bot.MatchTypeExact, h.MySubscriptionsCallbackHandler, h.SuspiciousUserFilterMiddleware, h.CreateCustomerIfNotExistMiddleware)
 	b.RegisterHandler(bot.HandlerTypeCallbackQueryData, handler.CallbackOpenSubscription, bot.MatchTypePrefix, h.OpenSubscriptionCallbackHandler, h.SuspiciousUserFilterMiddleware, h.CreateCustomerIfNotExistMiddleware)
 	b.RegisterHandler(bot.HandlerTypeCallbackQueryData, handler.CallbackDeactivateSubscription, bot.MatchTypePrefix, h.DeactivateSubscriptionCallbackHandler, h.SuspiciousUserFilterMiddleware, h.CreateCustomerIfNotExistMiddleware)
 	b.RegisterHandler(bot.HandlerTypeCallbackQueryData, handler.CallbackRenameSubscription, bot.MatchTypePrefix, h.RenameSubscriptionCallbackHandler, h.SuspiciousUserFilterMiddleware, h.CreateCustomerIfNotExistMiddleware)
 
+	// Traffic packages
+	b.RegisterHandler(bot.HandlerTypeCallbackQueryData, handler.CallbackTrafficPackages, bot.MatchTypePrefix, h.TrafficPackagesCallbackHandler, h.SuspiciousUserFilterMiddleware, h.CreateCustomerIfNotExistMiddleware)
+	b.RegisterHandler(bot.HandlerTypeCallbackQueryData, handler.CallbackTrafficSell, bot.MatchTypePrefix, h.TrafficSellCallbackHandler, h.SuspiciousUserFilterMiddleware, h.CreateCustomerIfNotExistMiddleware)
+	b.RegisterHandler(bot.HandlerTypeCallbackQueryData, handler.CallbackTrafficPayment, bot.MatchTypePrefix, h.TrafficPaymentCallbackHandler, h.SuspiciousUserFilterMiddleware, h.CreateCustomerIfNotExistMiddleware)
+	b.RegisterHandler(bot.HandlerTypeCallbackQueryData, handler.CallbackDeviceUnbind, bot.MatchTypePrefix, h.DeviceUnbindCallbackHandler, h.SuspiciousUserFilterMiddleware, h.CreateCustomerIfNotExistMiddleware)
+	b.RegisterHandler(bot.HandlerTypeCallbackQueryData, handler.CallbackDevices, bot.MatchTypePrefix, h.DevicesCallbackHandler, h.SuspiciousUserFilterMiddleware, h.CreateCustomerIfNotExistMiddleware)
+
 	// Text handler: сначала проверка переименования, затем остальное
 	b.RegisterHandlerMatchFunc(func(update *models.Update) bool { return update.Message != nil }, h.TextMessageHandler)
 
@@ -100,10 +157,43 @@ func main() {
 	mux := http.NewServeMux()
 	mux.Handle("/healthcheck", fullHealthHandler(pool, rw))
 	if config.GetTributeWebHookUrl() != "" {
-		tributeHandler := tribute.NewClient(nil, nil)
+		tributeHandler := tribute.NewClient(config.GetTributeAPIKey(), paymentService, customerRepository, purchaseRepository)
 		mux.Handle(config.GetTributeWebHookUrl(), tributeHandler.WebHookHandler())
 	}
 
+	notificationService := notification.NewSubscriptionService(customerRepository, subscriptionRepository, database.NewNotificationLogRepository(pool), purchaseRepository, paymentService, b, tm)
+	mustAddJob(jobs, "expiration_notifications", config.ExpirationNotificationsSchedule(), notificationService.ProcessSubscriptionExpiration)
+	expiredService := notification.NewExpiredSubscriptionService(customerRepository, subscriptionRepository, rw, b, tm)
+	mustAddJob(jobs, "deactivate_expired", config.ExpiredSubscriptionsSchedule(), expiredService.DeactivateExpired)
+	trafficService := notification.NewTrafficNotificationService(customerRepository, subscriptionRepository, database.NewNotificationLogRepository(pool), rw, b, tm)
+	mustAddJob(jobs, "traffic_notifications", config.TrafficNotificationsSchedule(), trafficService.NotifyTrafficUsage)
+	mustAddJob(jobs, "sync", config.SyncSchedule(), func(ctx context.Context) error {
+		return h.ScheduledSync(ctx, b)
+	})
+
+	if yookasaClient != nil {
+		yookasaConfirmer := yookasa.NewPaymentConfirmer(yookasaClient, purchaseRepository, paymentService, config.YookasaTrustForwardedFor())
+		if config.YookasaWebhookUrl() != "" {
+			mux.Handle(config.YookasaWebhookUrl(), yookasaConfirmer.WebHookHandler())
+		}
+		mustAddJob(jobs, "yookasa_check", everySeconds(config.YookasaCheckInterval()), yookasaConfirmer.CheckPending)
+	}
+
+	if cryptoPayClient != nil {
+		invoiceChecker := cryptopay.NewInvoiceChecker(cryptoPayClient, purchaseRepository, paymentService, config.CryptoPayToken())
+		if config.CryptoPayWebhookUrl() != "" {
+			mux.Handle(config.CryptoPayWebhookUrl(), invoiceChecker.WebHookHandler())
+		}
+		mustAddJob(jobs, "cryptopay_check", everySeconds(config.CryptoPayCheckInterval()), invoiceChecker.CheckPending)
+	}
+
+	if config.IsTelegramStarsEnabled() {
+		starsChecker := payment.NewStarsChecker(purchaseRepository, paymentService)
+		mustAddJob(jobs, "stars_check", everySeconds(config.StarsCheckInterval()), starsChecker.CheckPending)
+	}
+
+	jobs.Start(ctx)
+
 	srv := &http.Server{Addr: fmt.Sprintf(":%d", config.GetHealthCheckPort()), Handler: mux}
 	go func() {
 		log.Printf("Server listening on %s", srv.Addr)
@@ -119,6 +209,23 @@ func main() {
 	shutdownCtx, shutCancel := context.WithTimeout(context.Background(), 5*time.Second)
 	defer shutCancel()
 	_ = srv.Shutdown(shutdownCtx)
+
+	log.Println("Waiting for scheduled jobs…")
+	jobs.Wait()
+}
+
+func mustAddJob(jobs *scheduler.Scheduler, name string, spec string, run scheduler.JobFunc) {
+	if err := jobs.Add(name, spec, run); err != nil {
+		panic(err)
+	}
+}
+
+// everySeconds переводит интервал опроса из конфига в расписание, 0 выключает задачу
+func everySeconds(seconds int) string {
+	if seconds <= 0 {
+		return ""
+	}
+	return fmt.Sprintf("@every %ds", seconds)
 }
 
 func fullHealthHandler(pool *pgxpool.Pool, rw *remnawave.Client) http.Handler {
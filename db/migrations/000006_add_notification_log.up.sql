@@ -0,0 +1,10 @@
+-- Журнал отправленных напоминаний: одна запись на этап для каждой подписки.
+-- expire_at фиксирует срок, к которому относилось напоминание, чтобы после продления
+-- этапы срабатывали заново.
+CREATE TABLE notification_log (
+    subscription_id BIGINT NOT NULL REFERENCES subscription (id) ON DELETE CASCADE,
+    stage           VARCHAR(16) NOT NULL,
+    expire_at       TIMESTAMP WITH TIME ZONE NOT NULL,
+    sent_at         TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP,
+    PRIMARY KEY (subscription_id, stage)
+);
@@ -0,0 +1,5 @@
+DROP INDEX IF EXISTS idx_subscription_remnawave_uuid;
+
+ALTER TABLE subscription DROP COLUMN IF EXISTS username;
+ALTER TABLE subscription DROP COLUMN IF EXISTS short_uuid;
+ALTER TABLE subscription DROP COLUMN IF EXISTS remnawave_uuid;
@@ -0,0 +1,11 @@
+-- Пользователь remnawave, которым обеспечена подписка
+ALTER TABLE subscription ADD COLUMN remnawave_uuid UUID;
+ALTER TABLE subscription ADD COLUMN short_uuid VARCHAR(64);
+ALTER TABLE subscription ADD COLUMN username VARCHAR(255);
+
+CREATE INDEX idx_subscription_remnawave_uuid ON subscription (remnawave_uuid);
+
+-- shortUuid — последний сегмент ссылки подписки, uuid и username заполнит синхронизация
+UPDATE subscription
+SET short_uuid = substring(subscription_link from '[^/]+$')
+WHERE subscription_link <> '';
@@ -0,0 +1,2 @@
+-- Мягкое удаление клиентов при синхронизации (SYNC_DELETE_MODE=soft)
+ALTER TABLE customer ADD COLUMN deleted_at TIMESTAMP WITH TIME ZONE;
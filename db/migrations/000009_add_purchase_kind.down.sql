@@ -0,0 +1,3 @@
+ALTER TABLE purchase DROP COLUMN IF EXISTS traffic_gb;
+ALTER TABLE purchase DROP COLUMN IF EXISTS subscription_id;
+ALTER TABLE purchase DROP COLUMN IF EXISTS kind;
@@ -0,0 +1,4 @@
+-- Что покупается: продление подписки или пакет трафика для конкретной подписки
+ALTER TABLE purchase ADD COLUMN kind VARCHAR(20) NOT NULL DEFAULT 'subscription';
+ALTER TABLE purchase ADD COLUMN subscription_id BIGINT REFERENCES subscription (id) ON DELETE SET NULL;
+ALTER TABLE purchase ADD COLUMN traffic_gb INTEGER NOT NULL DEFAULT 0;
@@ -0,0 +1,15 @@
+-- Использованные пробные периоды: одна запись на telegram-аккаунт. Таблица не ссылается
+-- на клиента и подписку, чтобы запись переживала их удаление и деактивацию.
+CREATE TABLE trial_usage (
+    telegram_id BIGINT PRIMARY KEY,
+    used_at     TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP
+);
+
+-- Клиенты, которые уже получили пробную подписку до появления таблицы
+INSERT INTO trial_usage (telegram_id, used_at)
+SELECT c.telegram_id, MIN(s.created_at)
+FROM subscription s
+         JOIN customer c ON c.id = s.customer_id
+WHERE s.description IN ('Бесплатная пробная подписка', 'Free trial subscription')
+GROUP BY c.telegram_id
+ON CONFLICT DO NOTHING;
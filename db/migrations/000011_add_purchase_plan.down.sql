@@ -0,0 +1,2 @@
+ALTER TABLE purchase DROP COLUMN IF EXISTS days;
+ALTER TABLE purchase DROP COLUMN IF EXISTS plan_id;
@@ -0,0 +1,4 @@
+-- Тариф каталога, по которому выставлен счёт, и срок в днях на момент выставления.
+-- Пусто у покупок до каталога и у Tribute: они продлевают на month месяцев
+ALTER TABLE purchase ADD COLUMN plan_id VARCHAR(32) NOT NULL DEFAULT '';
+ALTER TABLE purchase ADD COLUMN days INTEGER NOT NULL DEFAULT 0;
@@ -0,0 +1,18 @@
+-- Награды реферальной программы. Уникальный ключ не даёт начислить одну награду дважды:
+-- purchase_id равен 0 для наград за пробный период и первую покупку.
+CREATE TABLE referral_reward (
+    id          BIGSERIAL PRIMARY KEY,
+    referral_id BIGINT         NOT NULL REFERENCES referral (id) ON DELETE CASCADE,
+    referrer_id BIGINT         NOT NULL REFERENCES customer (telegram_id) ON DELETE CASCADE,
+    level       SMALLINT       NOT NULL,
+    event       VARCHAR(20)    NOT NULL,
+    purchase_id BIGINT         NOT NULL DEFAULT 0,
+    kind        VARCHAR(10)    NOT NULL,
+    amount      DECIMAL(20, 2) NOT NULL,
+    status      VARCHAR(10)    NOT NULL DEFAULT 'pending',
+    created_at  TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP,
+    granted_at  TIMESTAMP WITH TIME ZONE,
+    UNIQUE (referral_id, level, event, purchase_id, kind)
+);
+
+CREATE INDEX idx_referral_reward_referrer_id ON referral_reward (referrer_id, status);
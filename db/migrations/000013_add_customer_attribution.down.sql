@@ -0,0 +1,8 @@
+DROP INDEX IF EXISTS idx_customer_campaign_code;
+ALTER TABLE customer DROP COLUMN IF EXISTS attributed_at;
+ALTER TABLE customer DROP COLUMN IF EXISTS utm_campaign;
+ALTER TABLE customer DROP COLUMN IF EXISTS utm_medium;
+ALTER TABLE customer DROP COLUMN IF EXISTS utm_source;
+ALTER TABLE customer DROP COLUMN IF EXISTS promo_code;
+ALTER TABLE customer DROP COLUMN IF EXISTS campaign_code;
+ALTER TABLE customer DROP COLUMN IF EXISTS referrer_id;
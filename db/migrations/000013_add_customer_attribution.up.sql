@@ -0,0 +1,11 @@
+-- Откуда пришёл клиент: параметры первой ссылки /start. Каждое поле заполняется один раз,
+-- поэтому повторный переход по другой ссылке не перезаписывает источник.
+ALTER TABLE customer ADD COLUMN referrer_id BIGINT;
+ALTER TABLE customer ADD COLUMN campaign_code VARCHAR(32);
+ALTER TABLE customer ADD COLUMN promo_code VARCHAR(32);
+ALTER TABLE customer ADD COLUMN utm_source VARCHAR(64);
+ALTER TABLE customer ADD COLUMN utm_medium VARCHAR(64);
+ALTER TABLE customer ADD COLUMN utm_campaign VARCHAR(64);
+ALTER TABLE customer ADD COLUMN attributed_at TIMESTAMP WITH TIME ZONE;
+
+CREATE INDEX IF NOT EXISTS idx_customer_campaign_code ON customer (campaign_code) WHERE campaign_code IS NOT NULL;
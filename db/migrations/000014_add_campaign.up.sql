@@ -0,0 +1,7 @@
+-- Рекламные кампании: ссылка t.me/<bot>?start=c_<code> помечает новых клиентов в customer.campaign_code
+CREATE TABLE campaign (
+    code       VARCHAR(32) PRIMARY KEY,
+    name       VARCHAR(128)   NOT NULL,
+    cost       DECIMAL(20, 2) NOT NULL DEFAULT 0,
+    created_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP
+);
@@ -0,0 +1,2 @@
+DROP TABLE IF EXISTS promo_redemption;
+DROP TABLE IF EXISTS promo_code;
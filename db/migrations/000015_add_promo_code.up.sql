@@ -0,0 +1,29 @@
+-- Промокоды. value — дни, процент скидки, скидка в рублях или гигабайты в зависимости от kind;
+-- max_uses = 0 снимает общий лимит, plan_id ограничивает скидку тарифом каталога.
+CREATE TABLE promo_code (
+    code           VARCHAR(32) PRIMARY KEY,
+    kind           VARCHAR(16) NOT NULL CHECK (kind IN ('days', 'percent', 'amount', 'traffic')),
+    value          INTEGER     NOT NULL CHECK (value > 0),
+    max_uses       INTEGER     NOT NULL DEFAULT 0,
+    per_user_limit INTEGER     NOT NULL DEFAULT 1,
+    expires_at     TIMESTAMP WITH TIME ZONE,
+    plan_id        VARCHAR(32) NOT NULL DEFAULT '',
+    created_at     TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP
+);
+
+-- Погашения промокодов. Скидка сначала ждёт счёта в статусе pending, к ней привязывается
+-- покупка, после оплаты статус становится redeemed. Дни и трафик погашаются сразу.
+CREATE TABLE promo_redemption (
+    id              BIGSERIAL PRIMARY KEY,
+    code            VARCHAR(32) NOT NULL REFERENCES promo_code (code) ON DELETE CASCADE,
+    customer_id     BIGINT      NOT NULL REFERENCES customer (id) ON DELETE CASCADE,
+    subscription_id BIGINT,
+    purchase_id     BIGINT,
+    status          VARCHAR(16) NOT NULL DEFAULT 'pending',
+    created_at      TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP,
+    redeemed_at     TIMESTAMP WITH TIME ZONE
+);
+
+CREATE INDEX idx_promo_redemption_code ON promo_redemption (code);
+CREATE INDEX idx_promo_redemption_customer ON promo_redemption (customer_id, status);
+CREATE INDEX idx_promo_redemption_purchase ON promo_redemption (purchase_id) WHERE purchase_id IS NOT NULL;
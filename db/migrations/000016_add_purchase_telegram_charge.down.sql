@@ -0,0 +1,2 @@
+DROP INDEX IF EXISTS idx_purchase_telegram_charge;
+ALTER TABLE purchase DROP COLUMN IF EXISTS telegram_payment_charge_id;
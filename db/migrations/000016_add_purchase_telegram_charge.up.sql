@@ -0,0 +1,5 @@
+-- Идентификатор списания звёзд: по нему покупку, за которую Telegram уже получил оплату,
+-- можно довести до конца, если обработка сразу после платежа не удалась.
+ALTER TABLE purchase ADD COLUMN telegram_payment_charge_id VARCHAR(255);
+
+CREATE INDEX IF NOT EXISTS idx_purchase_telegram_charge ON purchase (status) WHERE telegram_payment_charge_id IS NOT NULL;
@@ -0,0 +1 @@
+ALTER TABLE subscription DROP COLUMN IF EXISTS extra_traffic_gb;
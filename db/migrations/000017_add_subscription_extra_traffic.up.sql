@@ -0,0 +1,3 @@
+-- Трафик купленных пакетов: добавляется к лимиту тарифа при каждом продлении подписки,
+-- чтобы продление не сбрасывало оплаченные гигабайты.
+ALTER TABLE subscription ADD COLUMN extra_traffic_gb INTEGER NOT NULL DEFAULT 0;
@@ -0,0 +1 @@
+DROP INDEX IF EXISTS idx_promo_redemption_pending;
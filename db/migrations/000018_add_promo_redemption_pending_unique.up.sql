@@ -0,0 +1,10 @@
+-- У клиента не больше одной неоплаченной скидки, даже если промокоды активируются параллельно.
+-- Из уже накопившихся дублей остаётся последняя активированная скидка.
+DELETE FROM promo_redemption r
+USING promo_redemption newer
+WHERE r.status = 'pending'
+  AND newer.status = 'pending'
+  AND newer.customer_id = r.customer_id
+  AND newer.id > r.id;
+
+CREATE UNIQUE INDEX IF NOT EXISTS idx_promo_redemption_pending ON promo_redemption (customer_id) WHERE status = 'pending';
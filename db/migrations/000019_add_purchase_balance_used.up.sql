@@ -0,0 +1,3 @@
+-- Часть реферального баланса, списанная в счёт покупки. Пока счёт не отменён, эта сумма
+-- не доступна для других счетов.
+ALTER TABLE purchase ADD COLUMN balance_used DECIMAL(20, 2) NOT NULL DEFAULT 0;
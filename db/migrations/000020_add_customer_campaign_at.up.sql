@@ -0,0 +1,5 @@
+-- Когда клиент перешёл по ссылке кампании: в отчёт кампании попадают только пробные периоды
+-- и покупки после этого момента. Для уже помеченных клиентов берётся время первой атрибуции.
+ALTER TABLE customer ADD COLUMN campaign_at TIMESTAMP WITH TIME ZONE;
+
+UPDATE customer SET campaign_at = COALESCE(attributed_at, created_at) WHERE campaign_code IS NOT NULL;
@@ -0,0 +1,3 @@
+-- Срок, до которого покупка продлевает подписку. Сохраняется до обращения к панели,
+-- чтобы повторная обработка после сбоя не добавила дни ещё раз.
+ALTER TABLE purchase ADD COLUMN target_expire_at TIMESTAMPTZ;
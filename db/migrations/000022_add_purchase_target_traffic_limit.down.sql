@@ -0,0 +1 @@
+ALTER TABLE purchase DROP COLUMN IF EXISTS target_traffic_limit;
@@ -0,0 +1,3 @@
+-- Лимит трафика в байтах, который выставляет пакет трафика. Сохраняется до обращения к панели,
+-- чтобы повторная обработка после сбоя не добавила пакет ещё раз.
+ALTER TABLE purchase ADD COLUMN target_traffic_limit BIGINT;
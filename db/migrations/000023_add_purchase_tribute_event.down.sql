@@ -0,0 +1,2 @@
+DROP INDEX IF EXISTS idx_purchase_tribute_event;
+ALTER TABLE purchase DROP COLUMN IF EXISTS tribute_event;
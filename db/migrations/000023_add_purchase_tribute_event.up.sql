@@ -0,0 +1,4 @@
+-- Ключ события Tribute, по которому создана покупка. Уникальный индекс не даёт повторной
+-- или параллельной доставке вебхука создать вторую покупку.
+ALTER TABLE purchase ADD COLUMN tribute_event TEXT;
+CREATE UNIQUE INDEX IF NOT EXISTS idx_purchase_tribute_event ON purchase (tribute_event) WHERE tribute_event IS NOT NULL;
@@ -0,0 +1,13 @@
+// Package callback — данные кнопок, которые бот отправляет не только из обработчиков,
+// но и из уведомлений
+package callback
+
+import "fmt"
+
+// Buy — кнопка покупки подписки
+const Buy = "buy"
+
+// RenewSubscription — кнопка продления подписки subscriptionID
+func RenewSubscription(subscriptionID int64) string {
+	return fmt.Sprintf("%s?subscriptionId=%d", Buy, subscriptionID)
+}
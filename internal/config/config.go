@@ -5,6 +5,7 @@ import (
 	"log"
 	"log/slog"
 	"os"
+	"sort"
 	"strconv"
 	"strings"
 
@@ -53,6 +54,35 @@ type config struct {
 	trialTrafficLimitResetStrategy                            string
 	trafficLimitResetStrategy                                 string
 	tgProxyLink                                               string
+	yookasaWebhookUrl                                         string
+	yookasaTrustForwardedFor                                  bool
+	yookasaCheckInterval                                      int
+	cryptoPayWebhookUrl                                       string
+	cryptoPayCheckInterval                                    int
+	starsCheckInterval                                        int
+	expirationNotificationsSchedule, syncSchedule             string
+	reminderStages                                            []int
+	expiredSubscriptionsSchedule                              string
+	expiredSubscriptionGraceDays                              int
+	expiredUserAction                                         string
+	syncDeleteThreshold                                       int
+	syncSoftDelete                                            bool
+	trafficUsageCacheTTL                                      int
+	trafficPackages                                           []TrafficPackage
+	trafficNotifyPercent                                      int
+	trafficNotificationsSchedule                              string
+	trialRequiredChannel                                      string
+	trialMinAccountAgeHours                                   int
+	plans                                                     []Plan
+	deviceLimit, trialDeviceLimit                             int
+	referralRules                                             []ReferralRule
+}
+
+// TrafficPackage — пакет дополнительного трафика, который можно докупить к подписке
+type TrafficPackage struct {
+	GB         int
+	Price      int
+	StarsPrice int
 }
 
 var conf config
@@ -123,6 +153,29 @@ func TrialTrafficLimit() int {
 func TrialDays() int {
 	return conf.trialDays
 }
+
+// DeviceLimit лимит HWID-устройств платных пользователей, 0 — лимит панели по умолчанию
+func DeviceLimit() int {
+	return conf.deviceLimit
+}
+
+// TrialDeviceLimit лимит HWID-устройств пробных пользователей, 0 — как у платных
+func TrialDeviceLimit() int {
+	if conf.trialDeviceLimit > 0 {
+		return conf.trialDeviceLimit
+	}
+	return conf.deviceLimit
+}
+
+// TrialRequiredChannel канал (@username или id), подписка на который нужна для пробного периода, пусто — не нужна
+func TrialRequiredChannel() string {
+	return conf.trialRequiredChannel
+}
+
+// TrialMinAccountAgeHours сколько часов должно пройти с первого /start до пробного периода
+func TrialMinAccountAgeHours() int {
+	return conf.trialMinAccountAgeHours
+}
 func FeedbackURL() string {
 	return conf.feedbackURL
 }
@@ -143,24 +196,22 @@ func TosURL() string {
 	return conf.tosURL
 }
 
-func YookasaEmail() string {
-	return conf.yookasaEmail
-}
-
-func Price1() int {
-	return conf.price1
+func YookasaWebhookUrl() string {
+	return conf.yookasaWebhookUrl
 }
 
-func Price3() int {
-	return conf.price3
+// YookasaTrustForwardedFor разрешает брать IP отправителя вебхука из X-Forwarded-For (бот за reverse proxy)
+func YookasaTrustForwardedFor() bool {
+	return conf.yookasaTrustForwardedFor
 }
 
-func Price6() int {
-	return conf.price6
+// YookasaCheckInterval интервал опроса ожидающих платежей в секундах, 0 — опрос выключен
+func YookasaCheckInterval() int {
+	return conf.yookasaCheckInterval
 }
 
-func Price12() int {
-	return conf.price12
+func YookasaEmail() string {
+	return conf.yookasaEmail
 }
 
 func DaysInMonth() int {
@@ -171,35 +222,6 @@ func ExternalSquadUUID() uuid.UUID {
 	return conf.externalSquadUUID
 }
 
-func Price(month int) int {
-	switch month {
-	case 1:
-		return conf.price1
-	case 3:
-		return conf.price3
-	case 6:
-		return conf.price6
-	case 12:
-		return conf.price12
-	default:
-		return conf.price1
-	}
-}
-
-func StarsPrice(month int) int {
-	switch month {
-	case 1:
-		return conf.starsPrice1
-	case 3:
-		return conf.starsPrice3
-	case 6:
-		return conf.starsPrice6
-	case 12:
-		return conf.starsPrice12
-	default:
-		return conf.starsPrice1
-	}
-}
 func TelegramToken() string {
 	return conf.telegramToken
 }
@@ -221,6 +243,92 @@ func CryptoPayUrl() string {
 func CryptoPayToken() string {
 	return conf.cryptoPayToken
 }
+
+// ExpirationNotificationsSchedule расписание (cron) рассылки уведомлений об истечении подписки
+func ExpirationNotificationsSchedule() string {
+	return conf.expirationNotificationsSchedule
+}
+
+// ReminderStages этапы напоминаний в днях до окончания подписки по убыванию,
+// отрицательные значения — дни после окончания
+func ReminderStages() []int {
+	return conf.reminderStages
+}
+
+// ExpiredSubscriptionsSchedule расписание (cron) деактивации истекших подписок
+func ExpiredSubscriptionsSchedule() string {
+	return conf.expiredSubscriptionsSchedule
+}
+
+// ExpiredSubscriptionGraceDays сколько дней после окончания подписка остаётся активной
+func ExpiredSubscriptionGraceDays() int {
+	return conf.expiredSubscriptionGraceDays
+}
+
+// ExpiredUserAction что сделать с пользователем remnawave истекшей подписки: disable или delete
+func ExpiredUserAction() string {
+	return conf.expiredUserAction
+}
+
+// SyncDeleteThreshold сколько удалений клиентов и деактиваций подписок синхронизация выполняет
+// без подтверждения админа
+func SyncDeleteThreshold() int {
+	return conf.syncDeleteThreshold
+}
+
+// SyncSoftDelete синхронизация помечает клиентов удалёнными вместо удаления из базы
+func SyncSoftDelete() bool {
+	return conf.syncSoftDelete
+}
+
+// TrafficUsageCacheTTL сколько секунд кешировать потребление трафика, полученное из панели
+func TrafficUsageCacheTTL() int {
+	return conf.trafficUsageCacheTTL
+}
+
+// TrafficPackages пакеты дополнительного трафика, пустой список выключает их продажу
+func TrafficPackages() []TrafficPackage {
+	return conf.trafficPackages
+}
+
+// FindTrafficPackage ищет пакет по объёму в гигабайтах
+func FindTrafficPackage(gb int) (TrafficPackage, bool) {
+	for _, p := range conf.trafficPackages {
+		if p.GB == gb {
+			return p, true
+		}
+	}
+	return TrafficPackage{}, false
+}
+
+// GigabytesToBytes переводит объём пакета трафика в байты для лимита remnawave
+func GigabytesToBytes(gb int) int {
+	return gb * bytesInGigabyte
+}
+
+// TrafficNotifyPercent при каком проценте израсходованного трафика предлагать докупить пакет, 0 — не предлагать
+func TrafficNotifyPercent() int {
+	return conf.trafficNotifyPercent
+}
+
+// TrafficNotificationsSchedule расписание (cron) проверки израсходованного трафика
+func TrafficNotificationsSchedule() string {
+	return conf.trafficNotificationsSchedule
+}
+
+// SyncSchedule расписание (cron) синхронизации с remnawave, пустое — только по команде /sync
+func SyncSchedule() string {
+	return conf.syncSchedule
+}
+
+func CryptoPayWebhookUrl() string {
+	return conf.cryptoPayWebhookUrl
+}
+
+// CryptoPayCheckInterval интервал опроса неоплаченных счетов в секундах, 0 — опрос выключен
+func CryptoPayCheckInterval() int {
+	return conf.cryptoPayCheckInterval
+}
 func BotURL() string {
 	return conf.botURL
 }
@@ -252,6 +360,11 @@ func IsTelegramStarsEnabled() bool {
 	return conf.isTelegramStarsEnabled
 }
 
+// StarsCheckInterval интервал повторной обработки оплаченных покупок за звёзды в секундах, 0 — выключено
+func StarsCheckInterval() int {
+	return conf.starsCheckInterval
+}
+
 func RequirePaidPurchaseForStars() bool {
 	return conf.requirePaidPurchaseForStars
 }
@@ -421,6 +534,64 @@ func envStringDefault(key string, def string) string {
 	return v
 }
 
+// parseReminderStages разбирает список вида "3d,1d,0d,-1d"
+func parseReminderStages(value string) ([]int, error) {
+	seen := make(map[int]bool)
+	var stages []int
+	for _, part := range strings.Split(value, ",") {
+		part = strings.TrimSuffix(strings.TrimSpace(part), "d")
+		if part == "" {
+			continue
+		}
+		days, err := strconv.Atoi(part)
+		if err != nil {
+			return nil, fmt.Errorf("invalid stage %q", part)
+		}
+		if !seen[days] {
+			seen[days] = true
+			stages = append(stages, days)
+		}
+	}
+	sort.Sort(sort.Reverse(sort.IntSlice(stages)))
+	return stages, nil
+}
+
+// parseTrafficPackages разбирает список вида "50:150,100:250:200" — гигабайты, цена в рублях
+// и необязательная цена в звёздах (по умолчанию равна цене в рублях)
+func parseTrafficPackages(value string) ([]TrafficPackage, error) {
+	var packages []TrafficPackage
+	seen := make(map[int]bool)
+	for _, part := range strings.Split(value, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+		fields := strings.Split(part, ":")
+		if len(fields) != 2 && len(fields) != 3 {
+			return nil, fmt.Errorf("invalid package %q, expected gb:price or gb:price:stars", part)
+		}
+		values := make([]int, len(fields))
+		for i, field := range fields {
+			v, err := strconv.Atoi(strings.TrimSpace(field))
+			if err != nil || v <= 0 {
+				return nil, fmt.Errorf("invalid package %q", part)
+			}
+			values[i] = v
+		}
+		if seen[values[0]] {
+			return nil, fmt.Errorf("duplicate package %d GB", values[0])
+		}
+		seen[values[0]] = true
+		p := TrafficPackage{GB: values[0], Price: values[1], StarsPrice: values[1]}
+		if len(values) == 3 {
+			p.StarsPrice = values[2]
+		}
+		packages = append(packages, p)
+	}
+	sort.Slice(packages, func(i, j int) bool { return packages[i].GB < packages[j].GB })
+	return packages, nil
+}
+
 func envBool(key string) bool {
 	return os.Getenv(key) == "true"
 }
@@ -457,6 +628,51 @@ func InitConfig() {
 
 	conf.daysInMonth = envIntDefault("DAYS_IN_MONTH", 30)
 
+	conf.expirationNotificationsSchedule = envStringDefault("EXPIRATION_NOTIFICATIONS_SCHEDULE", "0 16 * * *")
+	if conf.expirationNotificationsSchedule == "off" {
+		conf.expirationNotificationsSchedule = ""
+	}
+	conf.syncSchedule = envStringDefault("SYNC_SCHEDULE", "")
+	conf.syncDeleteThreshold = envIntDefault("SYNC_DELETE_THRESHOLD", 10)
+	conf.trafficUsageCacheTTL = envIntDefault("TRAFFIC_USAGE_CACHE_TTL", 60)
+	conf.trafficPackages, err = parseTrafficPackages(os.Getenv("TRAFFIC_PACKAGES"))
+	if err != nil {
+		panic(fmt.Sprintf("invalid TRAFFIC_PACKAGES: %v", err))
+	}
+	conf.trafficNotifyPercent = envIntDefault("TRAFFIC_NOTIFY_PERCENT", 80)
+	if conf.trafficNotifyPercent < 0 || conf.trafficNotifyPercent > 100 {
+		panic("TRAFFIC_NOTIFY_PERCENT must be between 0 and 100")
+	}
+	conf.trafficNotificationsSchedule = envStringDefault("TRAFFIC_NOTIFICATIONS_SCHEDULE", "@hourly")
+	if conf.trafficNotificationsSchedule == "off" || conf.trafficNotifyPercent == 0 || len(conf.trafficPackages) == 0 {
+		conf.trafficNotificationsSchedule = ""
+	}
+	switch syncDeleteMode := envStringDefault("SYNC_DELETE_MODE", "hard"); syncDeleteMode {
+	case "hard":
+	case "soft":
+		conf.syncSoftDelete = true
+	default:
+		panic(fmt.Sprintf("invalid SYNC_DELETE_MODE %q, expected hard or soft", syncDeleteMode))
+	}
+
+	conf.reminderStages, err = parseReminderStages(envStringDefault("REMINDER_STAGES", "3d,1d,0d,-1d"))
+	if err != nil {
+		panic(fmt.Sprintf("invalid REMINDER_STAGES: %v", err))
+	}
+
+	conf.expiredSubscriptionsSchedule = envStringDefault("EXPIRED_SUBSCRIPTIONS_SCHEDULE", "@hourly")
+	if conf.expiredSubscriptionsSchedule == "off" {
+		conf.expiredSubscriptionsSchedule = ""
+	}
+	conf.expiredSubscriptionGraceDays = envIntDefault("EXPIRED_SUBSCRIPTION_GRACE_DAYS", 3)
+	if conf.expiredSubscriptionGraceDays < 0 {
+		panic("EXPIRED_SUBSCRIPTION_GRACE_DAYS must be non-negative")
+	}
+	conf.expiredUserAction = envStringDefault("EXPIRED_USER_ACTION", "disable")
+	if conf.expiredUserAction != "disable" && conf.expiredUserAction != "delete" {
+		panic(fmt.Sprintf("invalid EXPIRED_USER_ACTION %q, expected disable or delete", conf.expiredUserAction))
+	}
+
 	externalSquadUUIDStr := os.Getenv("EXTERNAL_SQUAD_UUID")
 	if externalSquadUUIDStr != "" {
 		parsedUUID, err := uuid.Parse(externalSquadUUIDStr)
@@ -473,13 +689,28 @@ func InitConfig() {
 	conf.healthCheckPort = envIntDefault("HEALTH_CHECK_PORT", 8080)
 
 	conf.trialDays = mustEnvInt("TRIAL_DAYS")
+	conf.trialRequiredChannel = os.Getenv("TRIAL_REQUIRED_CHANNEL")
+	conf.trialMinAccountAgeHours = envIntDefault("TRIAL_MIN_ACCOUNT_AGE_HOURS", 0)
+	if conf.trialMinAccountAgeHours < 0 {
+		panic("TRIAL_MIN_ACCOUNT_AGE_HOURS must be non-negative")
+	}
+
+	conf.deviceLimit = envIntDefault("DEVICE_LIMIT", 0)
+	conf.trialDeviceLimit = envIntDefault("TRIAL_DEVICE_LIMIT", 0)
+	if conf.deviceLimit < 0 || conf.trialDeviceLimit < 0 {
+		panic("DEVICE_LIMIT and TRIAL_DEVICE_LIMIT must be non-negative")
+	}
 
 	conf.enableAutoPayment = envBool("ENABLE_AUTO_PAYMENT")
 
-	conf.price1 = mustEnvInt("PRICE_1")
-	conf.price3 = mustEnvInt("PRICE_3")
-	conf.price6 = mustEnvInt("PRICE_6")
-	conf.price12 = mustEnvInt("PRICE_12")
+	// с каталогом тарифов цены PRICE_N не нужны
+	plansFile := os.Getenv("PLANS_FILE")
+	if plansFile == "" {
+		conf.price1 = mustEnvInt("PRICE_1")
+		conf.price3 = mustEnvInt("PRICE_3")
+		conf.price6 = mustEnvInt("PRICE_6")
+		conf.price12 = mustEnvInt("PRICE_12")
+	}
 
 	conf.isTelegramStarsEnabled = envBool("TELEGRAM_STARS_ENABLED")
 	if conf.isTelegramStarsEnabled {
@@ -487,6 +718,7 @@ func InitConfig() {
 		conf.starsPrice3 = envIntDefault("STARS_PRICE_3", conf.price3)
 		conf.starsPrice6 = envIntDefault("STARS_PRICE_6", conf.price6)
 		conf.starsPrice12 = envIntDefault("STARS_PRICE_12", conf.price12)
+		conf.starsCheckInterval = envIntDefault("STARS_CHECK_INTERVAL", 60)
 
 	}
 
@@ -515,6 +747,8 @@ func InitConfig() {
 	if conf.isCryptoEnabled {
 		conf.cryptoPayURL = mustEnv("CRYPTO_PAY_URL")
 		conf.cryptoPayToken = mustEnv("CRYPTO_PAY_TOKEN")
+		conf.cryptoPayWebhookUrl = os.Getenv("CRYPTO_PAY_WEBHOOK_URL")
+		conf.cryptoPayCheckInterval = envIntDefault("CRYPTO_PAY_CHECK_INTERVAL", 10)
 	}
 
 	conf.isYookasaEnabled = envBool("YOOKASA_ENABLED")
@@ -523,10 +757,17 @@ func InitConfig() {
 		conf.yookasaShopId = mustEnv("YOOKASA_SHOP_ID")
 		conf.yookasaSecretKey = mustEnv("YOOKASA_SECRET_KEY")
 		conf.yookasaEmail = mustEnv("YOOKASA_EMAIL")
+		conf.yookasaWebhookUrl = os.Getenv("YOOKASA_WEBHOOK_URL")
+		conf.yookasaTrustForwardedFor = envBool("YOOKASA_TRUST_FORWARDED_FOR")
+		conf.yookasaCheckInterval = envIntDefault("YOOKASA_CHECK_INTERVAL", 30)
 	}
 
 	conf.trafficLimit = mustEnvInt("TRAFFIC_LIMIT")
 	conf.referralDays = mustEnvInt("REFERRAL_DAYS")
+	conf.referralRules, err = parseReferralRules(os.Getenv("REFERRAL_REWARDS"), conf.referralDays)
+	if err != nil {
+		panic(fmt.Sprintf("invalid REFERRAL_REWARDS: %v", err))
+	}
 
 	conf.serverStatusURL = os.Getenv("SERVER_STATUS_URL")
 	conf.supportURL = os.Getenv("SUPPORT_URL")
@@ -657,4 +898,14 @@ func InitConfig() {
 	}()
 
 	conf.tgProxyLink = os.Getenv("TG_PROXY_LINK")
+
+	if plansFile != "" {
+		conf.plans, err = loadPlans(plansFile, conf.daysInMonth)
+		if err != nil {
+			panic(fmt.Sprintf("invalid PLANS_FILE: %v", err))
+		}
+		slog.Info("Loaded plans", "count", len(conf.plans))
+	} else {
+		conf.plans = defaultPlans()
+	}
 }
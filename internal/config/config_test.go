@@ -221,4 +221,82 @@ func TestDetectPlatformFromUpdate(t *testing.T) {
 			}
 		})
 	}
-} 
\ No newline at end of file
+} 
+func TestParseReminderStages(t *testing.T) {
+	stages, err := parseReminderStages("1d, 3d,0d,-1d,1")
+	if err != nil {
+		t.Fatalf("parseReminderStages returned error: %v", err)
+	}
+	expected := []int{3, 1, 0, -1}
+	if len(stages) != len(expected) {
+		t.Fatalf("expected %v, got %v", expected, stages)
+	}
+	for i := range expected {
+		if stages[i] != expected[i] {
+			t.Fatalf("expected %v, got %v", expected, stages)
+		}
+	}
+
+	if _, err := parseReminderStages("3d,soon"); err == nil {
+		t.Fatal("expected error for invalid stage")
+	}
+}
+
+func TestParseTrafficPackages(t *testing.T) {
+	packages, err := parseTrafficPackages("100:250:200, 50:150")
+	if err != nil {
+		t.Fatalf("parseTrafficPackages returned error: %v", err)
+	}
+	expected := []TrafficPackage{{GB: 50, Price: 150, StarsPrice: 150}, {GB: 100, Price: 250, StarsPrice: 200}}
+	if len(packages) != len(expected) {
+		t.Fatalf("expected %v, got %v", expected, packages)
+	}
+	for i := range expected {
+		if packages[i] != expected[i] {
+			t.Fatalf("expected %v, got %v", expected, packages)
+		}
+	}
+
+	if packages, err := parseTrafficPackages(""); err != nil || len(packages) != 0 {
+		t.Fatalf("expected no packages, got %v, %v", packages, err)
+	}
+	for _, value := range []string{"50", "50:free", "50:0", "50:150,50:200"} {
+		if _, err := parseTrafficPackages(value); err == nil {
+			t.Errorf("expected error for %q", value)
+		}
+	}
+}
+
+func TestParseReferralRules(t *testing.T) {
+	rules, err := parseReferralRules("trial:3d, first_purchase:5GB,purchase:10%,purchase:50rub:2", 7)
+	if err != nil {
+		t.Fatalf("parseReferralRules returned error: %v", err)
+	}
+	expected := []ReferralRule{
+		{Event: ReferralEventTrial, Level: 1, Kind: ReferralRewardDays, Amount: 3},
+		{Event: ReferralEventFirstPurchase, Level: 1, Kind: ReferralRewardTraffic, Amount: 5},
+		{Event: ReferralEventPurchase, Level: 1, Kind: ReferralRewardBalance, Amount: 10, Percent: true},
+		{Event: ReferralEventPurchase, Level: 2, Kind: ReferralRewardBalance, Amount: 50},
+	}
+	if len(rules) != len(expected) {
+		t.Fatalf("expected %v, got %v", expected, rules)
+	}
+	for i := range expected {
+		if rules[i] != expected[i] {
+			t.Fatalf("expected %v, got %v", expected, rules)
+		}
+	}
+
+	rules, err = parseReferralRules("", 7)
+	if err != nil || len(rules) != 1 || rules[0] != (ReferralRule{Event: ReferralEventFirstPurchase, Level: 1, Kind: ReferralRewardDays, Amount: 7}) {
+		t.Fatalf("expected the REFERRAL_DAYS rule, got %v, %v", rules, err)
+	}
+	if rules, err := parseReferralRules("", 0); err != nil || len(rules) != 0 {
+		t.Fatalf("expected the program to be disabled, got %v, %v", rules, err)
+	}
+	for _, value := range []string{"trial", "signup:3d", "trial:3", "trial:0d", "trial:10%", "purchase:150%", "purchase:3d:3", "trial:3d,trial:5d"} {
+		if _, err := parseReferralRules(value, 0); err == nil {
+			t.Errorf("expected error for %q", value)
+		}
+	}
+}
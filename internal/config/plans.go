@@ -0,0 +1,173 @@
+package config
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"regexp"
+
+	"github.com/google/uuid"
+)
+
+// Валюты цен тарифов: рубли (карта, криптовалюта, Tribute) и Telegram Stars
+const (
+	CurrencyRUB   = "RUB"
+	CurrencyStars = "XTR"
+)
+
+// Plan — тариф из каталога. Пустые squads, внешний squad и стратегия сброса берутся из общих
+// настроек (SQUAD_UUIDS, EXTERNAL_SQUAD_UUID, TRAFFIC_LIMIT_RESET_STRATEGY).
+type Plan struct {
+	ID string `json:"id"`
+	// Title — название по кодам языков, без него тариф называется по длительности
+	Title map[string]string `json:"title"`
+	// Months или Days задают длительность, месяц равен DAYS_IN_MONTH дней
+	Months int            `json:"months"`
+	Days   int            `json:"days"`
+	Prices map[string]int `json:"prices"`
+	// TrafficLimitGB 0 — безлимитный трафик
+	TrafficLimitGB            int         `json:"traffic_limit_gb"`
+	TrafficLimitResetStrategy string      `json:"traffic_limit_reset_strategy"`
+	InternalSquads            []uuid.UUID `json:"internal_squads"`
+	ExternalSquad             uuid.UUID   `json:"external_squad"`
+	// DeviceLimit 0 — лимит из DEVICE_LIMIT
+	DeviceLimit int `json:"device_limit"`
+	// Hidden скрывает тариф из меню покупки
+	Hidden bool `json:"hidden"`
+}
+
+// Price цена тарифа в валюте, 0 — в этой валюте тариф не продаётся
+func (p Plan) Price(currency string) int {
+	return p.Prices[currency]
+}
+
+// TrafficLimitBytes лимит трафика тарифа для remnawave
+func (p Plan) TrafficLimitBytes() int {
+	return p.TrafficLimitGB * bytesInGigabyte
+}
+
+// Plans все тарифы каталога в порядке объявления
+func Plans() []Plan {
+	return conf.plans
+}
+
+// VisiblePlans тарифы, которые показываются в меню покупки
+func VisiblePlans() []Plan {
+	var plans []Plan
+	for _, p := range conf.plans {
+		if !p.Hidden {
+			plans = append(plans, p)
+		}
+	}
+	return plans
+}
+
+// FindPlan ищет тариф по id
+func FindPlan(id string) (Plan, bool) {
+	for _, p := range conf.plans {
+		if p.ID == id {
+			return p, true
+		}
+	}
+	return Plan{}, false
+}
+
+// MonthsPlan тариф для покупок без тарифа из каталога (созданных до него или через Tribute):
+// видимый тариф на столько же месяцев, иначе общие настройки
+func MonthsPlan(months int) Plan {
+	for _, p := range conf.plans {
+		if !p.Hidden && p.Months == months {
+			return p
+		}
+	}
+	return Plan{ID: fmt.Sprintf("%dm", months), Months: months, Days: months * conf.daysInMonth, TrafficLimitGB: conf.trafficLimit}
+}
+
+// defaultPlans — тарифы на 1/3/6/12 месяцев из PRICE_N и STARS_PRICE_N, когда PLANS_FILE не задан
+func defaultPlans() []Plan {
+	var plans []Plan
+	for _, p := range []struct{ months, price, stars int }{
+		{1, conf.price1, conf.starsPrice1},
+		{3, conf.price3, conf.starsPrice3},
+		{6, conf.price6, conf.starsPrice6},
+		{12, conf.price12, conf.starsPrice12},
+	} {
+		if p.price <= 0 {
+			continue
+		}
+		plans = append(plans, Plan{
+			ID:             fmt.Sprintf("%dm", p.months),
+			Months:         p.months,
+			Days:           p.months * conf.daysInMonth,
+			Prices:         map[string]int{CurrencyRUB: p.price, CurrencyStars: p.stars},
+			TrafficLimitGB: conf.trafficLimit,
+		})
+	}
+	return plans
+}
+
+func loadPlans(path string, daysInMonth int) ([]Plan, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return parsePlans(data, daysInMonth)
+}
+
+// planIDPattern — id попадает в callback data, поэтому он короткий и без разделителей запроса
+var planIDPattern = regexp.MustCompile(`^[a-z0-9_-]{1,32}$`)
+
+// parsePlans разбирает JSON-массив тарифов и проверяет его
+func parsePlans(data []byte, daysInMonth int) ([]Plan, error) {
+	var plans []Plan
+	if err := json.Unmarshal(data, &plans); err != nil {
+		return nil, err
+	}
+	if len(plans) == 0 {
+		return nil, fmt.Errorf("no plans defined")
+	}
+
+	seen := make(map[string]bool)
+	for i := range plans {
+		p := &plans[i]
+		if !planIDPattern.MatchString(p.ID) {
+			return nil, fmt.Errorf("invalid plan id %q, expected up to 32 lowercase letters, digits, _ or -", p.ID)
+		}
+		if seen[p.ID] {
+			return nil, fmt.Errorf("duplicate plan %q", p.ID)
+		}
+		seen[p.ID] = true
+
+		switch {
+		case p.Months > 0 && p.Days == 0:
+			p.Days = p.Months * daysInMonth
+		case p.Months == 0 && p.Days > 0:
+		default:
+			return nil, fmt.Errorf("plan %q must set either positive months or days", p.ID)
+		}
+
+		sellable := false
+		for currency, price := range p.Prices {
+			if currency != CurrencyRUB && currency != CurrencyStars {
+				return nil, fmt.Errorf("plan %q has unknown currency %q", p.ID, currency)
+			}
+			if price < 0 {
+				return nil, fmt.Errorf("plan %q has negative %s price", p.ID, currency)
+			}
+			sellable = sellable || price > 0
+		}
+		if !sellable {
+			return nil, fmt.Errorf("plan %q has no prices", p.ID)
+		}
+
+		switch p.TrafficLimitResetStrategy {
+		case "", "DAY", "WEEK", "MONTH", "NO_RESET":
+		default:
+			return nil, fmt.Errorf("plan %q has invalid traffic limit reset strategy %q", p.ID, p.TrafficLimitResetStrategy)
+		}
+		if p.TrafficLimitGB < 0 || p.DeviceLimit < 0 {
+			return nil, fmt.Errorf("plan %q has negative limits", p.ID)
+		}
+	}
+	return plans, nil
+}
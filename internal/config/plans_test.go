@@ -0,0 +1,68 @@
+package config
+
+import (
+	"testing"
+
+	"github.com/google/uuid"
+)
+
+func TestParsePlans(t *testing.T) {
+	squad := uuid.New()
+	data := []byte(`[
+		{"id": "month", "months": 1, "prices": {"RUB": 150, "XTR": 100}, "traffic_limit_gb": 100, "device_limit": 3, "internal_squads": ["` + squad.String() + `"]},
+		{"id": "week", "title": {"en": "Week"}, "days": 7, "prices": {"XTR": 30}, "traffic_limit_reset_strategy": "NO_RESET", "hidden": true}
+	]`)
+
+	plans, err := parsePlans(data, 30)
+	if err != nil {
+		t.Fatalf("parsePlans returned error: %v", err)
+	}
+	if len(plans) != 2 {
+		t.Fatalf("expected 2 plans, got %v", plans)
+	}
+	month, week := plans[0], plans[1]
+	if month.Days != 30 || month.Price(CurrencyRUB) != 150 || month.Price(CurrencyStars) != 100 || month.DeviceLimit != 3 || len(month.InternalSquads) != 1 || month.InternalSquads[0] != squad {
+		t.Errorf("unexpected month plan: %#v", month)
+	}
+	if month.TrafficLimitBytes() != 100*bytesInGigabyte {
+		t.Errorf("expected 100 GB limit, got %d", month.TrafficLimitBytes())
+	}
+	if week.Days != 7 || week.Months != 0 || week.Price(CurrencyRUB) != 0 || !week.Hidden || week.Title["en"] != "Week" {
+		t.Errorf("unexpected week plan: %#v", week)
+	}
+
+	for name, value := range map[string]string{
+		"empty":              `[]`,
+		"bad id":             `[{"id": "Month 1", "months": 1, "prices": {"RUB": 1}}]`,
+		"duplicate id":       `[{"id": "m", "months": 1, "prices": {"RUB": 1}}, {"id": "m", "days": 3, "prices": {"RUB": 1}}]`,
+		"no duration":        `[{"id": "m", "prices": {"RUB": 1}}]`,
+		"months and days":    `[{"id": "m", "months": 1, "days": 30, "prices": {"RUB": 1}}]`,
+		"no prices":          `[{"id": "m", "months": 1, "prices": {"RUB": 0}}]`,
+		"unknown currency":   `[{"id": "m", "months": 1, "prices": {"USD": 1}}]`,
+		"bad strategy":       `[{"id": "m", "months": 1, "prices": {"RUB": 1}, "traffic_limit_reset_strategy": "YEAR"}]`,
+		"negative limit":     `[{"id": "m", "months": 1, "prices": {"RUB": 1}, "device_limit": -1}]`,
+		"invalid squad uuid": `[{"id": "m", "months": 1, "prices": {"RUB": 1}, "internal_squads": ["nope"]}]`,
+	} {
+		if _, err := parsePlans([]byte(value), 30); err == nil {
+			t.Errorf("%s: expected error", name)
+		}
+	}
+}
+
+func TestMonthsPlan(t *testing.T) {
+	original := conf
+	defer func() { conf = original }()
+	conf.daysInMonth = 30
+	conf.trafficLimit = 50
+	conf.plans = []Plan{
+		{ID: "hidden", Months: 3, Days: 90, Hidden: true},
+		{ID: "quarter", Months: 3, Days: 90},
+	}
+
+	if p := MonthsPlan(3); p.ID != "quarter" {
+		t.Errorf("expected visible plan for 3 months, got %#v", p)
+	}
+	if p := MonthsPlan(6); p.Days != 180 || p.TrafficLimitGB != 50 {
+		t.Errorf("expected plan with global settings for 6 months, got %#v", p)
+	}
+}
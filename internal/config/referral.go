@@ -0,0 +1,123 @@
+package config
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// ReferralEvent — действие приглашённого, за которое начисляется награда
+type ReferralEvent string
+
+const (
+	ReferralEventTrial         ReferralEvent = "trial"
+	ReferralEventFirstPurchase ReferralEvent = "first_purchase"
+	ReferralEventPurchase      ReferralEvent = "purchase"
+)
+
+// ReferralRewardKind — что получает пригласивший
+type ReferralRewardKind string
+
+const (
+	ReferralRewardDays    ReferralRewardKind = "days"
+	ReferralRewardTraffic ReferralRewardKind = "traffic"
+	ReferralRewardBalance ReferralRewardKind = "balance"
+)
+
+// ReferralRule — награда за событие приглашённого. Level 1 — награда тому, кто пригласил,
+// level 2 — тому, кто пригласил его. Percent означает процент оплаченной суммы на баланс.
+type ReferralRule struct {
+	Event   ReferralEvent
+	Level   int
+	Kind    ReferralRewardKind
+	Amount  int
+	Percent bool
+}
+
+// ReferralRules правила реферальной программы, пустой список — программа выключена
+func ReferralRules() []ReferralRule {
+	return conf.referralRules
+}
+
+// ReferralEnabled включена ли реферальная программа
+func ReferralEnabled() bool {
+	return len(conf.referralRules) > 0
+}
+
+// ReferralMaxLevel глубина реферальной программы: 1 или 2
+func ReferralMaxLevel() int {
+	level := 0
+	for _, rule := range conf.referralRules {
+		level = max(level, rule.Level)
+	}
+	return level
+}
+
+// parseReferralRules разбирает список вида "trial:3d,first_purchase:7d,purchase:10%,purchase:5%:2".
+// Без REFERRAL_REWARDS пригласивший получает referralDays дней за первую покупку приглашённого.
+func parseReferralRules(value string, referralDays int) ([]ReferralRule, error) {
+	if strings.TrimSpace(value) == "" {
+		if referralDays <= 0 {
+			return nil, nil
+		}
+		return []ReferralRule{{Event: ReferralEventFirstPurchase, Level: 1, Kind: ReferralRewardDays, Amount: referralDays}}, nil
+	}
+
+	var rules []ReferralRule
+	seen := make(map[string]bool)
+	for _, part := range strings.Split(value, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+		fields := strings.Split(part, ":")
+		if len(fields) != 2 && len(fields) != 3 {
+			return nil, fmt.Errorf("invalid rule %q, expected event:reward or event:reward:level", part)
+		}
+
+		rule := ReferralRule{Event: ReferralEvent(fields[0]), Level: 1}
+		switch rule.Event {
+		case ReferralEventTrial, ReferralEventFirstPurchase, ReferralEventPurchase:
+		default:
+			return nil, fmt.Errorf("invalid rule %q, unknown event %q", part, fields[0])
+		}
+		if len(fields) == 3 {
+			level, err := strconv.Atoi(fields[2])
+			if err != nil || level < 1 || level > 2 {
+				return nil, fmt.Errorf("invalid rule %q, level must be 1 or 2", part)
+			}
+			rule.Level = level
+		}
+
+		reward := strings.ToLower(fields[1])
+		var amount string
+		switch {
+		case strings.HasSuffix(reward, "%"):
+			rule.Kind, rule.Percent, amount = ReferralRewardBalance, true, strings.TrimSuffix(reward, "%")
+		case strings.HasSuffix(reward, "gb"):
+			rule.Kind, amount = ReferralRewardTraffic, strings.TrimSuffix(reward, "gb")
+		case strings.HasSuffix(reward, "rub"):
+			rule.Kind, amount = ReferralRewardBalance, strings.TrimSuffix(reward, "rub")
+		case strings.HasSuffix(reward, "d"):
+			rule.Kind, amount = ReferralRewardDays, strings.TrimSuffix(reward, "d")
+		default:
+			return nil, fmt.Errorf("invalid rule %q, reward must end with d, gb, rub or %%", part)
+		}
+		var err error
+		rule.Amount, err = strconv.Atoi(amount)
+		if err != nil || rule.Amount <= 0 {
+			return nil, fmt.Errorf("invalid rule %q, reward must be a positive number", part)
+		}
+		if rule.Percent && (rule.Event == ReferralEventTrial || rule.Amount > 100) {
+			return nil, fmt.Errorf("invalid rule %q, percent rewards are for purchases and at most 100%%", part)
+		}
+
+		key := fmt.Sprintf("%s:%d:%s", rule.Event, rule.Level, rule.Kind)
+		if seen[key] {
+			return nil, fmt.Errorf("duplicate rule %q", part)
+		}
+		seen[key] = true
+		rules = append(rules, rule)
+	}
+	return rules, nil
+}
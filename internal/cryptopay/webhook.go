@@ -0,0 +1,193 @@
+package cryptopay
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"remnawave-tg-shop-bot/internal/database"
+	"remnawave-tg-shop-bot/utils"
+)
+
+const (
+	UpdateTypeInvoicePaid = "invoice_paid"
+	SignatureHeader       = "crypto-pay-api-signature"
+
+	invoiceStatusExpired = "expired"
+	// invoicesBatchSize — сколько счетов запрашивать одним вызовом getInvoices
+	invoicesBatchSize = 100
+)
+
+type Update struct {
+	UpdateID    int64           `json:"update_id"`
+	UpdateType  string          `json:"update_type"`
+	RequestDate string          `json:"request_date"`
+	Payload     InvoiceResponse `json:"payload"`
+}
+
+type purchaseRepository interface {
+	FindByCryptoInvoiceID(ctx context.Context, invoiceID int64) (*database.Purchase, error)
+	FindByInvoiceTypeAndStatus(ctx context.Context, invoiceType database.InvoiceType, status database.PurchaseStatus) (*[]database.Purchase, error)
+}
+
+type paymentProcessor interface {
+	ProcessPurchaseById(ctx context.Context, purchaseId int64) error
+	CancelPayment(ctx context.Context, purchaseId int64) error
+}
+
+type invoiceGetter interface {
+	GetInvoices(status, fiat, asset, invoiceIds string, offset, limit int) (*[]InvoiceResponse, error)
+}
+
+// InvoiceChecker подтверждает оплату счетов CryptoPay через вебхук и периодический опрос
+type InvoiceChecker struct {
+	api                invoiceGetter
+	purchaseRepository purchaseRepository
+	paymentProcessor   paymentProcessor
+	token              string
+}
+
+func NewInvoiceChecker(api invoiceGetter, purchaseRepository purchaseRepository, paymentProcessor paymentProcessor, token string) *InvoiceChecker {
+	return &InvoiceChecker{
+		api:                api,
+		purchaseRepository: purchaseRepository,
+		paymentProcessor:   paymentProcessor,
+		token:              token,
+	}
+}
+
+// WebHookHandler принимает обновления invoice_paid, подписанные токеном приложения
+func (c *InvoiceChecker) WebHookHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+
+		body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, 1<<20))
+		if err != nil {
+			slog.Error("error reading cryptopay update", "error", err)
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+
+		if !VerifySignature(c.token, body, r.Header.Get(SignatureHeader)) {
+			slog.Warn("cryptopay webhook with invalid signature")
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+
+		var update Update
+		if err := json.Unmarshal(body, &update); err != nil {
+			slog.Error("error decoding cryptopay update", "error", err)
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+
+		if update.UpdateType != UpdateTypeInvoicePaid || update.Payload.InvoiceID == nil {
+			w.WriteHeader(http.StatusOK)
+			return
+		}
+
+		ctx, cancel := context.WithTimeout(r.Context(), 60*time.Second)
+		defer cancel()
+
+		purchase, err := c.purchaseRepository.FindByCryptoInvoiceID(ctx, *update.Payload.InvoiceID)
+		if err != nil {
+			slog.Error("error finding purchase by crypto invoice id", "error", err)
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		if purchase == nil {
+			slog.Warn("purchase for crypto invoice not found", "invoiceId", *update.Payload.InvoiceID)
+			w.WriteHeader(http.StatusOK)
+			return
+		}
+
+		if err := c.apply(ctx, purchase, update.Payload); err != nil {
+			slog.Error("error confirming crypto invoice", "error", err, "purchase_id", utils.MaskHalfInt64(purchase.ID))
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+
+		w.WriteHeader(http.StatusOK)
+	})
+}
+
+// CheckPending запрашивает статусы всех ожидающих счетов пачками и закрывает оплаченные и истёкшие
+func (c *InvoiceChecker) CheckPending(ctx context.Context) error {
+	purchases, err := c.purchaseRepository.FindByInvoiceTypeAndStatus(ctx, database.InvoiceTypeCrypto, database.PurchaseStatusPending)
+	if err != nil {
+		return fmt.Errorf("failed to find pending crypto purchases: %w", err)
+	}
+
+	byInvoice := make(map[int64]*database.Purchase, len(*purchases))
+	ids := make([]string, 0, len(*purchases))
+	for i := range *purchases {
+		purchase := &(*purchases)[i]
+		if purchase.CryptoInvoiceID == nil {
+			continue
+		}
+		byInvoice[*purchase.CryptoInvoiceID] = purchase
+		ids = append(ids, strconv.FormatInt(*purchase.CryptoInvoiceID, 10))
+	}
+
+	for start := 0; start < len(ids); start += invoicesBatchSize {
+		end := min(start+invoicesBatchSize, len(ids))
+		invoices, err := c.api.GetInvoices("", "", "", strings.Join(ids[start:end], ","), 0, end-start)
+		if err != nil {
+			return fmt.Errorf("failed to get crypto invoices: %w", err)
+		}
+
+		for _, invoice := range *invoices {
+			if invoice.InvoiceID == nil {
+				continue
+			}
+			purchase, ok := byInvoice[*invoice.InvoiceID]
+			if !ok {
+				continue
+			}
+			if err := c.apply(ctx, purchase, invoice); err != nil {
+				slog.Error("error checking crypto invoice", "error", err, "purchase_id", utils.MaskHalfInt64(purchase.ID))
+			}
+		}
+	}
+	return nil
+}
+
+func (c *InvoiceChecker) apply(ctx context.Context, purchase *database.Purchase, invoice InvoiceResponse) error {
+	if purchase.Status == database.PurchaseStatusPaid || purchase.Status == database.PurchaseStatusCancel {
+		return nil
+	}
+
+	switch {
+	case invoice.IsPaid():
+		return c.paymentProcessor.ProcessPurchaseById(ctx, purchase.ID)
+	case invoice.Status == invoiceStatusExpired:
+		return c.paymentProcessor.CancelPayment(ctx, purchase.ID)
+	default:
+		return nil
+	}
+}
+
+// VerifySignature проверяет подпись обновления: HMAC-SHA256 тела с ключом SHA256(token)
+// https://help.crypt.bot/crypto-pay-api#verifying-webhook-updates
+func VerifySignature(token string, body []byte, signature string) bool {
+	expected, err := hex.DecodeString(signature)
+	if err != nil || len(expected) == 0 {
+		return false
+	}
+	secret := sha256.Sum256([]byte(token))
+	mac := hmac.New(sha256.New, secret[:])
+	mac.Write(body)
+	return hmac.Equal(mac.Sum(nil), expected)
+}
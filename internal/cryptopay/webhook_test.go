@@ -0,0 +1,177 @@
+package cryptopay
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+
+	"remnawave-tg-shop-bot/internal/database"
+)
+
+const testToken = "12345:AAtesttoken"
+
+type purchaseRepoMock struct {
+	purchases []database.Purchase
+}
+
+func (m *purchaseRepoMock) FindByCryptoInvoiceID(ctx context.Context, invoiceID int64) (*database.Purchase, error) {
+	for i := range m.purchases {
+		if m.purchases[i].CryptoInvoiceID != nil && *m.purchases[i].CryptoInvoiceID == invoiceID {
+			p := m.purchases[i]
+			return &p, nil
+		}
+	}
+	return nil, nil
+}
+
+func (m *purchaseRepoMock) FindByInvoiceTypeAndStatus(ctx context.Context, invoiceType database.InvoiceType, status database.PurchaseStatus) (*[]database.Purchase, error) {
+	var result []database.Purchase
+	for _, p := range m.purchases {
+		if p.InvoiceType == invoiceType && p.Status == status {
+			result = append(result, p)
+		}
+	}
+	return &result, nil
+}
+
+type processorMock struct {
+	processed []int64
+	cancelled []int64
+}
+
+func (m *processorMock) ProcessPurchaseById(ctx context.Context, purchaseId int64) error {
+	m.processed = append(m.processed, purchaseId)
+	return nil
+}
+
+func (m *processorMock) CancelPayment(ctx context.Context, purchaseId int64) error {
+	m.cancelled = append(m.cancelled, purchaseId)
+	return nil
+}
+
+// newCryptoPayStub поднимает заглушку getInvoices, отдающую статусы из statuses
+func newCryptoPayStub(t *testing.T, statuses map[int64]string, calls *[]string) *httptest.Server {
+	t.Helper()
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ids := r.URL.Query().Get("invoice_ids")
+		*calls = append(*calls, ids)
+
+		var items []InvoiceResponse
+		for _, raw := range strings.Split(ids, ",") {
+			id, err := strconv.ParseInt(raw, 10, 64)
+			if err != nil {
+				continue
+			}
+			if status, ok := statuses[id]; ok {
+				items = append(items, InvoiceResponse{InvoiceID: &id, Status: status})
+			}
+		}
+		_ = json.NewEncoder(w).Encode(ResponseListWrapper[InvoiceResponse]{Ok: true, Result: ResultListWrapper[InvoiceResponse]{Items: items}})
+	}))
+	t.Cleanup(server.Close)
+	return server
+}
+
+func sign(token string, body []byte) string {
+	secret := sha256.Sum256([]byte(token))
+	mac := hmac.New(sha256.New, secret[:])
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+func postUpdate(t *testing.T, handler http.Handler, update Update, signature func([]byte) string) int {
+	t.Helper()
+	body, err := json.Marshal(update)
+	if err != nil {
+		t.Fatalf("marshal update: %v", err)
+	}
+	req := httptest.NewRequest(http.MethodPost, "/cryptopay", bytes.NewReader(body))
+	req.Header.Set(SignatureHeader, signature(body))
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, req)
+	return rec.Code
+}
+
+func int64Ptr(v int64) *int64 {
+	return &v
+}
+
+func TestWebHookHandler_ProcessesSignedInvoicePaid(t *testing.T) {
+	repo := &purchaseRepoMock{purchases: []database.Purchase{
+		{ID: 5, Status: database.PurchaseStatusPending, InvoiceType: database.InvoiceTypeCrypto, CryptoInvoiceID: int64Ptr(42)},
+	}}
+	processor := &processorMock{}
+	checker := NewInvoiceChecker(nil, repo, processor, testToken)
+
+	code := postUpdate(t, checker.WebHookHandler(), Update{
+		UpdateType: UpdateTypeInvoicePaid,
+		Payload:    InvoiceResponse{InvoiceID: int64Ptr(42), Status: "paid"},
+	}, func(body []byte) string { return sign(testToken, body) })
+
+	if code != http.StatusOK {
+		t.Fatalf("expected 200, got %d", code)
+	}
+	if len(processor.processed) != 1 || processor.processed[0] != 5 {
+		t.Fatalf("expected purchase 5 to be processed, got %#v", processor.processed)
+	}
+}
+
+func TestWebHookHandler_RejectsInvalidSignature(t *testing.T) {
+	repo := &purchaseRepoMock{purchases: []database.Purchase{
+		{ID: 5, Status: database.PurchaseStatusPending, InvoiceType: database.InvoiceTypeCrypto, CryptoInvoiceID: int64Ptr(42)},
+	}}
+	processor := &processorMock{}
+	checker := NewInvoiceChecker(nil, repo, processor, testToken)
+
+	code := postUpdate(t, checker.WebHookHandler(), Update{
+		UpdateType: UpdateTypeInvoicePaid,
+		Payload:    InvoiceResponse{InvoiceID: int64Ptr(42), Status: "paid"},
+	}, func(body []byte) string { return sign("other-token", body) })
+
+	if code != http.StatusUnauthorized {
+		t.Fatalf("expected 401, got %d", code)
+	}
+	if len(processor.processed) != 0 {
+		t.Fatalf("forged update must not be processed, got %#v", processor.processed)
+	}
+}
+
+func TestCheckPending_BatchesInvoicesAndAppliesStatuses(t *testing.T) {
+	var calls []string
+	server := newCryptoPayStub(t, map[int64]string{
+		101: "paid",
+		102: "expired",
+		103: "active",
+	}, &calls)
+
+	repo := &purchaseRepoMock{purchases: []database.Purchase{
+		{ID: 1, Status: database.PurchaseStatusPending, InvoiceType: database.InvoiceTypeCrypto, CryptoInvoiceID: int64Ptr(101)},
+		{ID: 2, Status: database.PurchaseStatusPending, InvoiceType: database.InvoiceTypeCrypto, CryptoInvoiceID: int64Ptr(102)},
+		{ID: 3, Status: database.PurchaseStatusPending, InvoiceType: database.InvoiceTypeCrypto, CryptoInvoiceID: int64Ptr(103)},
+		{ID: 4, Status: database.PurchaseStatusPending, InvoiceType: database.InvoiceTypeYookasa},
+	}}
+	processor := &processorMock{}
+	checker := NewInvoiceChecker(NewCryptoPayClient(server.URL, testToken), repo, processor, testToken)
+
+	if err := checker.CheckPending(context.Background()); err != nil {
+		t.Fatalf("CheckPending returned error: %v", err)
+	}
+
+	if len(calls) != 1 || calls[0] != "101,102,103" {
+		t.Fatalf("expected a single batched getInvoices call, got %#v", calls)
+	}
+	if len(processor.processed) != 1 || processor.processed[0] != 1 {
+		t.Fatalf("expected purchase 1 to be processed, got %#v", processor.processed)
+	}
+	if len(processor.cancelled) != 1 || processor.cancelled[0] != 2 {
+		t.Fatalf("expected purchase 2 to be cancelled, got %#v", processor.cancelled)
+	}
+}
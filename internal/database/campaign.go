@@ -0,0 +1,137 @@
+package database
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	sq "github.com/Masterminds/squirrel"
+	"github.com/jackc/pgconn"
+	"github.com/jackc/pgx/v4"
+	"github.com/jackc/pgx/v4/pgxpool"
+)
+
+// ErrCampaignExists — кампания с таким кодом уже есть
+var ErrCampaignExists = errors.New("campaign already exists")
+
+// Campaign — рекламная кампания. Cost — сколько потрачено на рекламу, в рублях.
+type Campaign struct {
+	Code      string    `db:"code"`
+	Name      string    `db:"name"`
+	Cost      float64   `db:"cost"`
+	CreatedAt time.Time `db:"created_at"`
+}
+
+// CampaignStats — результаты кампании: регистрации, пробные периоды, оплатившие клиенты
+// и выручка по валютам
+type CampaignStats struct {
+	Campaign
+	Registrations int
+	Trials        int
+	Paid          int
+	Revenue       float64
+	RevenueStars  float64
+}
+
+type CampaignRepository struct {
+	pool *pgxpool.Pool
+}
+
+func NewCampaignRepository(pool *pgxpool.Pool) *CampaignRepository {
+	return &CampaignRepository{pool: pool}
+}
+
+func (r *CampaignRepository) Create(ctx context.Context, campaign *Campaign) error {
+	query := sq.Insert("campaign").
+		Columns("code", "name", "cost").
+		Values(campaign.Code, campaign.Name, campaign.Cost).
+		Suffix("RETURNING created_at").
+		PlaceholderFormat(sq.Dollar)
+
+	sql, args, err := query.ToSql()
+	if err != nil {
+		return fmt.Errorf("failed to build insert campaign query: %w", err)
+	}
+
+	if err := r.pool.QueryRow(ctx, sql, args...).Scan(&campaign.CreatedAt); err != nil {
+		var pgErr *pgconn.PgError
+		if errors.As(err, &pgErr) && pgErr.Code == "23505" {
+			return ErrCampaignExists
+		}
+		return fmt.Errorf("failed to insert campaign: %w", err)
+	}
+	return nil
+}
+
+func (r *CampaignRepository) FindByCode(ctx context.Context, code string) (*Campaign, error) {
+	query := sq.Select("code", "name", "cost", "created_at").
+		From("campaign").
+		Where(sq.Eq{"code": code}).
+		PlaceholderFormat(sq.Dollar)
+
+	sql, args, err := query.ToSql()
+	if err != nil {
+		return nil, fmt.Errorf("failed to build select campaign query: %w", err)
+	}
+
+	var c Campaign
+	if err := r.pool.QueryRow(ctx, sql, args...).Scan(&c.Code, &c.Name, &c.Cost, &c.CreatedAt); err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("failed to query campaign: %w", err)
+	}
+	return &c, nil
+}
+
+// campaignReportQuery считает клиентов кампании и их оплаченные покупки отдельно,
+// чтобы покупки не умножали число регистраций. Пробные периоды и покупки учитываются
+// только после перехода по ссылке кампании.
+const campaignReportQuery = `
+	WITH registrations AS (
+		SELECT cu.campaign_code, COUNT(*) AS registrations, COUNT(t.telegram_id) AS trials
+		FROM customer cu
+			LEFT JOIN trial_usage t ON t.telegram_id = cu.telegram_id AND t.used_at >= cu.campaign_at
+		WHERE cu.campaign_code IS NOT NULL
+		GROUP BY cu.campaign_code
+	), paid AS (
+		SELECT cu.campaign_code,
+			COUNT(DISTINCT p.customer_id) AS paid,
+			COALESCE(SUM(p.amount) FILTER (WHERE p.currency = $2), 0) AS revenue,
+			COALESCE(SUM(p.amount) FILTER (WHERE p.currency = $3), 0) AS revenue_stars
+		FROM purchase p
+			JOIN customer cu ON cu.id = p.customer_id
+		WHERE cu.campaign_code IS NOT NULL AND p.status = $1 AND p.created_at >= cu.campaign_at
+		GROUP BY cu.campaign_code
+	)
+	SELECT c.code, c.name, c.cost, c.created_at,
+		COALESCE(r.registrations, 0), COALESCE(r.trials, 0),
+		COALESCE(p.paid, 0), COALESCE(p.revenue, 0), COALESCE(p.revenue_stars, 0)
+	FROM campaign c
+		LEFT JOIN registrations r ON r.campaign_code = c.code
+		LEFT JOIN paid p ON p.campaign_code = c.code
+	ORDER BY c.created_at DESC
+`
+
+// Report возвращает статистику всех кампаний, новые первыми
+func (r *CampaignRepository) Report(ctx context.Context) ([]CampaignStats, error) {
+	rows, err := r.pool.Query(ctx, campaignReportQuery, PurchaseStatusPaid, "RUB", "XTR")
+	if err != nil {
+		return nil, fmt.Errorf("failed to query campaign report: %w", err)
+	}
+	defer rows.Close()
+
+	var report []CampaignStats
+	for rows.Next() {
+		var s CampaignStats
+		if err := rows.Scan(&s.Code, &s.Name, &s.Cost, &s.CreatedAt, &s.Registrations, &s.Trials, &s.Paid, &s.Revenue, &s.RevenueStars); err != nil {
+			return nil, fmt.Errorf("failed to scan campaign stats: %w", err)
+		}
+		report = append(report, s)
+	}
+	if rows.Err() != nil {
+		return nil, fmt.Errorf("error iterating campaign stats: %w", rows.Err())
+	}
+	return report, nil
+}
@@ -207,6 +207,39 @@ func (cr *CustomerRepository) UpdateFields(ctx context.Context, id int64, update
 	return nil
 }
 
+// CustomerAttribution — источник клиента из ссылки /start
+type CustomerAttribution struct {
+	ReferrerID  *int64
+	Campaign    string
+	Promo       string
+	UTMSource   string
+	UTMMedium   string
+	UTMCampaign string
+}
+
+// SetAttribution сохраняет источник клиента. Заполняются только пустые поля: источник
+// определяется первой ссылкой, по которой клиент пришёл.
+func (cr *CustomerRepository) SetAttribution(ctx context.Context, id int64, attribution CustomerAttribution) error {
+	query := `
+		UPDATE customer SET
+			referrer_id   = COALESCE(referrer_id, $2),
+			campaign_code = COALESCE(campaign_code, NULLIF($3, '')),
+			campaign_at   = CASE WHEN campaign_code IS NULL AND $3 <> '' THEN NOW() ELSE campaign_at END,
+			promo_code    = COALESCE(promo_code, NULLIF($4, '')),
+			utm_source    = COALESCE(utm_source, NULLIF($5, '')),
+			utm_medium    = COALESCE(utm_medium, NULLIF($6, '')),
+			utm_campaign  = COALESCE(utm_campaign, NULLIF($7, '')),
+			attributed_at = COALESCE(attributed_at, NOW())
+		WHERE id = $1
+	`
+	_, err := cr.pool.Exec(ctx, query, id, attribution.ReferrerID, attribution.Campaign, attribution.Promo,
+		attribution.UTMSource, attribution.UTMMedium, attribution.UTMCampaign)
+	if err != nil {
+		return fmt.Errorf("failed to set customer attribution: %w", err)
+	}
+	return nil
+}
+
 func (cr *CustomerRepository) FindByTelegramIds(ctx context.Context, telegramIDs []int64) ([]Customer, error) {
 	buildSelect := sq.Select("id", "telegram_id", "expire_at", "created_at", "subscription_link", "language").
 		From("customer").
@@ -247,6 +280,46 @@ func (cr *CustomerRepository) FindByTelegramIds(ctx context.Context, telegramIDs
 	return customers, nil
 }
 
+func (cr *CustomerRepository) FindByIds(ctx context.Context, ids []int64) ([]Customer, error) {
+	buildSelect := sq.Select("id", "telegram_id", "expire_at", "created_at", "subscription_link", "language").
+		From("customer").
+		Where(sq.Eq{"id": ids}).
+		PlaceholderFormat(sq.Dollar)
+
+	sqlStr, args, err := buildSelect.ToSql()
+	if err != nil {
+		return nil, fmt.Errorf("failed to build select query: %w", err)
+	}
+
+	rows, err := cr.pool.Query(ctx, sqlStr, args...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query customers: %w", err)
+	}
+	defer rows.Close()
+
+	var customers []Customer
+	for rows.Next() {
+		var customer Customer
+		err := rows.Scan(
+			&customer.ID,
+			&customer.TelegramID,
+			&customer.ExpireAt,
+			&customer.CreatedAt,
+			&customer.SubscriptionLink,
+			&customer.Language,
+		)
+		if err != nil {
+			return nil, fmt.Errorf("failed to scan customer row: %w", err)
+		}
+		customers = append(customers, customer)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("error iterating over customer rows: %w", err)
+	}
+
+	return customers, nil
+}
+
 func (cr *CustomerRepository) CreateBatch(ctx context.Context, customers []Customer) error {
 	if len(customers) == 0 {
 		return nil
@@ -285,7 +358,7 @@ func (cr *CustomerRepository) UpdateBatch(ctx context.Context, customers []Custo
 	if len(customers) == 0 {
 		return nil
 	}
-	query := "UPDATE customer SET expire_at = c.expire_at, subscription_link = c.subscription_link FROM (VALUES "
+	query := "UPDATE customer SET expire_at = c.expire_at, subscription_link = c.subscription_link, deleted_at = NULL FROM (VALUES "
 	var args []interface{}
 	for i, cust := range customers {
 		if i > 0 {
@@ -314,17 +387,59 @@ func (cr *CustomerRepository) UpdateBatch(ctx context.Context, customers []Custo
 	return nil
 }
 
-func (cr *CustomerRepository) DeleteByNotInTelegramIds(ctx context.Context, telegramIDs []int64) error {
-	var buildDelete sq.DeleteBuilder
-	if len(telegramIDs) == 0 {
-		buildDelete = sq.Delete("customer")
-	} else {
-		buildDelete = sq.Delete("customer").
-			PlaceholderFormat(sq.Dollar).
-			Where(sq.NotEq{"telegram_id": telegramIDs})
+// FindByNotInTelegramIds возвращает клиентов, которых нет среди telegramIDs; мягко удалённые не возвращаются
+func (cr *CustomerRepository) FindByNotInTelegramIds(ctx context.Context, telegramIDs []int64) ([]Customer, error) {
+	buildSelect := sq.Select("id", "telegram_id", "expire_at", "created_at", "subscription_link", "language").
+		From("customer").
+		Where(sq.Eq{"deleted_at": nil}).
+		PlaceholderFormat(sq.Dollar)
+	if len(telegramIDs) > 0 {
+		buildSelect = buildSelect.Where(sq.NotEq{"telegram_id": telegramIDs})
+	}
+
+	sqlStr, args, err := buildSelect.ToSql()
+	if err != nil {
+		return nil, fmt.Errorf("failed to build select query: %w", err)
+	}
+
+	rows, err := cr.pool.Query(ctx, sqlStr, args...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query customers: %w", err)
+	}
+	defer rows.Close()
+
+	var customers []Customer
+	for rows.Next() {
+		var customer Customer
+		err := rows.Scan(
+			&customer.ID,
+			&customer.TelegramID,
+			&customer.ExpireAt,
+			&customer.CreatedAt,
+			&customer.SubscriptionLink,
+			&customer.Language,
+		)
+		if err != nil {
+			return nil, fmt.Errorf("failed to scan customer row: %w", err)
+		}
+		customers = append(customers, customer)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("error iterating over customer rows: %w", err)
 	}
 
-	sqlStr, args, err := buildDelete.ToSql()
+	return customers, nil
+}
+
+// DeleteByIds удаляет клиентов вместе с их покупками, рефералами и подписками (ON DELETE CASCADE)
+func (cr *CustomerRepository) DeleteByIds(ctx context.Context, ids []int64) error {
+	if len(ids) == 0 {
+		return nil
+	}
+	sqlStr, args, err := sq.Delete("customer").
+		Where(sq.Eq{"id": ids}).
+		PlaceholderFormat(sq.Dollar).
+		ToSql()
 	if err != nil {
 		return fmt.Errorf("failed to build delete query: %w", err)
 	}
@@ -335,7 +450,50 @@ func (cr *CustomerRepository) DeleteByNotInTelegramIds(ctx context.Context, tele
 	}
 
 	return nil
+}
+
+// SoftDeleteByIds помечает клиентов удалёнными и деактивирует их подписки, покупки и рефералы
+// сохраняются. Пометка снимается, когда клиент снова появляется в панели (UpdateBatch).
+func (cr *CustomerRepository) SoftDeleteByIds(ctx context.Context, ids []int64) error {
+	if len(ids) == 0 {
+		return nil
+	}
+
+	tx, err := cr.pool.Begin(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback(ctx)
+
+	sqlStr, args, err := sq.Update("customer").
+		Set("deleted_at", sq.Expr("NOW()")).
+		Set("subscription_count", 0).
+		Where(sq.Eq{"id": ids}).
+		PlaceholderFormat(sq.Dollar).
+		ToSql()
+	if err != nil {
+		return fmt.Errorf("failed to build update query: %w", err)
+	}
+	if _, err := tx.Exec(ctx, sqlStr, args...); err != nil {
+		return fmt.Errorf("failed to soft delete customers: %w", err)
+	}
+
+	sqlStr, args, err = sq.Update("subscription").
+		Set("is_active", false).
+		Where(sq.Eq{"customer_id": ids}).
+		PlaceholderFormat(sq.Dollar).
+		ToSql()
+	if err != nil {
+		return fmt.Errorf("failed to build update query: %w", err)
+	}
+	if _, err := tx.Exec(ctx, sqlStr, args...); err != nil {
+		return fmt.Errorf("failed to deactivate subscriptions: %w", err)
+	}
 
+	if err := tx.Commit(ctx); err != nil {
+		return fmt.Errorf("failed to commit transaction: %w", err)
+	}
+	return nil
 }
 
 func (cr *CustomerRepository) FindAll(ctx context.Context) ([]Customer, error) {
@@ -0,0 +1,76 @@
+package database
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	sq "github.com/Masterminds/squirrel"
+	"github.com/jackc/pgx/v4/pgxpool"
+)
+
+type NotificationLogRepository struct {
+	pool *pgxpool.Pool
+}
+
+func NewNotificationLogRepository(pool *pgxpool.Pool) *NotificationLogRepository {
+	return &NotificationLogRepository{pool: pool}
+}
+
+// TryMark резервирует отправку этапа напоминания для подписки. Возвращает false, если этот этап
+// для текущего срока подписки уже отправлен. Запись о предыдущем сроке перезаписывается.
+func (r *NotificationLogRepository) TryMark(ctx context.Context, subscriptionID int64, stage string, expireAt time.Time) (bool, error) {
+	query := sq.Insert("notification_log").
+		Columns("subscription_id", "stage", "expire_at", "sent_at").
+		Values(subscriptionID, stage, expireAt, sq.Expr("NOW()")).
+		Suffix("ON CONFLICT (subscription_id, stage) DO UPDATE SET expire_at = EXCLUDED.expire_at, sent_at = EXCLUDED.sent_at WHERE notification_log.expire_at <> EXCLUDED.expire_at").
+		PlaceholderFormat(sq.Dollar)
+
+	sql, args, err := query.ToSql()
+	if err != nil {
+		return false, fmt.Errorf("failed to build notification log insert: %w", err)
+	}
+
+	tag, err := r.pool.Exec(ctx, sql, args...)
+	if err != nil {
+		return false, fmt.Errorf("failed to insert notification log: %w", err)
+	}
+	return tag.RowsAffected() == 1, nil
+}
+
+// Unmark снимает резерв, если напоминание не удалось отправить, чтобы повторить его при следующем запуске
+func (r *NotificationLogRepository) Unmark(ctx context.Context, subscriptionID int64, stage string) error {
+	query := sq.Delete("notification_log").
+		Where(sq.Eq{"subscription_id": subscriptionID, "stage": stage}).
+		PlaceholderFormat(sq.Dollar)
+
+	sql, args, err := query.ToSql()
+	if err != nil {
+		return fmt.Errorf("failed to build notification log delete: %w", err)
+	}
+
+	if _, err := r.pool.Exec(ctx, sql, args...); err != nil {
+		return fmt.Errorf("failed to delete notification log: %w", err)
+	}
+	return nil
+}
+
+// UnmarkMany снимает этап у нескольких подписок одним запросом
+func (r *NotificationLogRepository) UnmarkMany(ctx context.Context, subscriptionIDs []int64, stage string) error {
+	if len(subscriptionIDs) == 0 {
+		return nil
+	}
+	query := sq.Delete("notification_log").
+		Where(sq.Eq{"subscription_id": subscriptionIDs, "stage": stage}).
+		PlaceholderFormat(sq.Dollar)
+
+	sql, args, err := query.ToSql()
+	if err != nil {
+		return fmt.Errorf("failed to build notification log delete: %w", err)
+	}
+
+	if _, err := r.pool.Exec(ctx, sql, args...); err != nil {
+		return fmt.Errorf("failed to delete notification log: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,269 @@
+package database
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	sq "github.com/Masterminds/squirrel"
+	"github.com/jackc/pgconn"
+	"github.com/jackc/pgx/v4"
+	"github.com/jackc/pgx/v4/pgxpool"
+)
+
+type PromoKind string
+
+const (
+	PromoKindDays    PromoKind = "days"
+	PromoKindPercent PromoKind = "percent"
+	PromoKindAmount  PromoKind = "amount"
+	PromoKindTraffic PromoKind = "traffic"
+)
+
+// IsDiscount — промокод уменьшает сумму счёта, а не выдаётся сразу
+func (k PromoKind) IsDiscount() bool {
+	return k == PromoKindPercent || k == PromoKindAmount
+}
+
+type PromoRedemptionStatus string
+
+const (
+	// PromoRedemptionStatusPending — скидка активирована и ждёт оплаты счёта
+	PromoRedemptionStatusPending  PromoRedemptionStatus = "pending"
+	PromoRedemptionStatusRedeemed PromoRedemptionStatus = "redeemed"
+)
+
+var (
+	ErrPromoExists    = errors.New("promo code already exists")
+	ErrPromoExhausted = errors.New("promo code has no uses left")
+	ErrPromoUserLimit = errors.New("promo code limit per user reached")
+	ErrPromoNotFound  = errors.New("promo code not found")
+	// ErrPromoPending — у клиента уже есть неоплаченная скидка
+	ErrPromoPending = errors.New("customer already has a pending discount")
+)
+
+// PromoCode — промокод. Value — дни, процент, рубли или гигабайты в зависимости от Kind.
+// MaxUses = 0 — без общего лимита; PlanID ограничивает скидку тарифом каталога.
+type PromoCode struct {
+	Code         string     `db:"code"`
+	Kind         PromoKind  `db:"kind"`
+	Value        int        `db:"value"`
+	MaxUses      int        `db:"max_uses"`
+	PerUserLimit int        `db:"per_user_limit"`
+	ExpiresAt    *time.Time `db:"expires_at"`
+	PlanID       string     `db:"plan_id"`
+	CreatedAt    time.Time  `db:"created_at"`
+}
+
+// Expired истёк ли срок действия промокода
+func (p PromoCode) Expired(now time.Time) bool {
+	return p.ExpiresAt != nil && !now.Before(*p.ExpiresAt)
+}
+
+type PromoRedemption struct {
+	ID             int64                 `db:"id"`
+	Code           string                `db:"code"`
+	CustomerID     int64                 `db:"customer_id"`
+	SubscriptionID *int64                `db:"subscription_id"`
+	PurchaseID     *int64                `db:"purchase_id"`
+	Status         PromoRedemptionStatus `db:"status"`
+	CreatedAt      time.Time             `db:"created_at"`
+	RedeemedAt     *time.Time            `db:"redeemed_at"`
+}
+
+type PromoRepository struct {
+	pool *pgxpool.Pool
+}
+
+func NewPromoRepository(pool *pgxpool.Pool) *PromoRepository {
+	return &PromoRepository{pool: pool}
+}
+
+var promoCodeColumns = []string{"code", "kind", "value", "max_uses", "per_user_limit", "expires_at", "plan_id", "created_at"}
+
+func scanPromoCode(row pgx.Row) (*PromoCode, error) {
+	var p PromoCode
+	if err := row.Scan(&p.Code, &p.Kind, &p.Value, &p.MaxUses, &p.PerUserLimit, &p.ExpiresAt, &p.PlanID, &p.CreatedAt); err != nil {
+		return nil, err
+	}
+	return &p, nil
+}
+
+func (r *PromoRepository) Create(ctx context.Context, promo *PromoCode) error {
+	query := sq.Insert("promo_code").
+		Columns("code", "kind", "value", "max_uses", "per_user_limit", "expires_at", "plan_id").
+		Values(promo.Code, promo.Kind, promo.Value, promo.MaxUses, promo.PerUserLimit, promo.ExpiresAt, promo.PlanID).
+		Suffix("RETURNING created_at").
+		PlaceholderFormat(sq.Dollar)
+
+	sql, args, err := query.ToSql()
+	if err != nil {
+		return fmt.Errorf("failed to build insert promo code query: %w", err)
+	}
+
+	if err := r.pool.QueryRow(ctx, sql, args...).Scan(&promo.CreatedAt); err != nil {
+		var pgErr *pgconn.PgError
+		if errors.As(err, &pgErr) && pgErr.Code == "23505" {
+			return ErrPromoExists
+		}
+		return fmt.Errorf("failed to insert promo code: %w", err)
+	}
+	return nil
+}
+
+func (r *PromoRepository) FindByCode(ctx context.Context, code string) (*PromoCode, error) {
+	query := sq.Select(promoCodeColumns...).
+		From("promo_code").
+		Where(sq.Eq{"code": code}).
+		PlaceholderFormat(sq.Dollar)
+
+	sql, args, err := query.ToSql()
+	if err != nil {
+		return nil, fmt.Errorf("failed to build select promo code query: %w", err)
+	}
+
+	promo, err := scanPromoCode(r.pool.QueryRow(ctx, sql, args...))
+	if errors.Is(err, pgx.ErrNoRows) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to query promo code: %w", err)
+	}
+	return promo, nil
+}
+
+// redemptionCounted — погашение занимает использование промокода: оно погашено или скидка вошла
+// в неотменённый счёт. Скидка, ещё не вошедшая в счёт, использование не занимает.
+const redemptionCounted = `(r.status = 'redeemed' OR (r.status = 'pending' AND r.purchase_id IN (SELECT id FROM purchase WHERE status <> 'cancel')))`
+
+type rowQuerier interface {
+	QueryRow(ctx context.Context, sql string, args ...interface{}) pgx.Row
+}
+
+// checkLimits сравнивает число погашений промокода, всего и у клиента, с его лимитами
+func checkLimits(ctx context.Context, q rowQuerier, code string, customerID int64, maxUses, perUserLimit int) error {
+	var total, byCustomer int
+	err := q.QueryRow(ctx,
+		"SELECT COUNT(*), COUNT(*) FILTER (WHERE r.customer_id = $2) FROM promo_redemption r WHERE r.code = $1 AND "+redemptionCounted,
+		code, customerID,
+	).Scan(&total, &byCustomer)
+	if err != nil {
+		return fmt.Errorf("failed to count promo redemptions: %w", err)
+	}
+	if maxUses > 0 && total >= maxUses {
+		return ErrPromoExhausted
+	}
+	if perUserLimit > 0 && byCustomer >= perUserLimit {
+		return ErrPromoUserLimit
+	}
+	return nil
+}
+
+// CheckLimits проверяет, что у промокода остались использования, в том числе у клиента
+func (r *PromoRepository) CheckLimits(ctx context.Context, promo *PromoCode, customerID int64) error {
+	return checkLimits(ctx, r.pool, promo.Code, customerID, promo.MaxUses, promo.PerUserLimit)
+}
+
+// Redeem записывает погашение и применяет его в одной транзакции. Строка промокода
+// блокируется, поэтому параллельные погашения не превысят лимиты. Если apply вернул
+// ошибку, погашение не сохраняется. Вторая неоплаченная скидка клиента отклоняется
+// уникальным индексом с ErrPromoPending.
+func (r *PromoRepository) Redeem(ctx context.Context, redemption *PromoRedemption, apply func(ctx context.Context) error) error {
+	tx, err := r.pool.Begin(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer func() { _ = tx.Rollback(ctx) }()
+
+	var maxUses, perUserLimit int
+	err = tx.QueryRow(ctx, "SELECT max_uses, per_user_limit FROM promo_code WHERE code = $1 FOR UPDATE", redemption.Code).Scan(&maxUses, &perUserLimit)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return ErrPromoNotFound
+	}
+	if err != nil {
+		return fmt.Errorf("failed to lock promo code: %w", err)
+	}
+
+	if err := checkLimits(ctx, tx, redemption.Code, redemption.CustomerID, maxUses, perUserLimit); err != nil {
+		return err
+	}
+
+	query := sq.Insert("promo_redemption").
+		Columns("code", "customer_id", "subscription_id", "status", "redeemed_at").
+		Values(redemption.Code, redemption.CustomerID, redemption.SubscriptionID, redemption.Status, redemption.RedeemedAt).
+		Suffix("RETURNING id, created_at").
+		PlaceholderFormat(sq.Dollar)
+	sql, args, err := query.ToSql()
+	if err != nil {
+		return fmt.Errorf("failed to build insert promo redemption query: %w", err)
+	}
+	if err := tx.QueryRow(ctx, sql, args...).Scan(&redemption.ID, &redemption.CreatedAt); err != nil {
+		var pgErr *pgconn.PgError
+		if errors.As(err, &pgErr) && pgErr.Code == "23505" {
+			return ErrPromoPending
+		}
+		return fmt.Errorf("failed to insert promo redemption: %w", err)
+	}
+
+	if apply != nil {
+		if err := apply(ctx); err != nil {
+			return err
+		}
+	}
+	if err := tx.Commit(ctx); err != nil {
+		return fmt.Errorf("failed to commit transaction: %w", err)
+	}
+	return nil
+}
+
+// discountUnbound — скидка не вошла ни в один счёт или её счёт отменён
+const discountUnbound = `(r.purchase_id IS NULL OR r.purchase_id IN (SELECT id FROM purchase WHERE status = 'cancel'))`
+
+// FindAvailableDiscount возвращает неоплаченную скидку клиента, которую можно применить к новому
+// счёту: пока счёт со скидкой не отменён, другие счета выставляются без неё
+func (r *PromoRepository) FindAvailableDiscount(ctx context.Context, customerID int64) (*PromoRedemption, *PromoCode, error) {
+	row := r.pool.QueryRow(ctx, `
+		SELECT r.id, r.code, r.customer_id, r.subscription_id, r.purchase_id, r.status, r.created_at, r.redeemed_at,
+			p.code, p.kind, p.value, p.max_uses, p.per_user_limit, p.expires_at, p.plan_id, p.created_at
+		FROM promo_redemption r
+			JOIN promo_code p ON p.code = r.code
+		WHERE r.customer_id = $1 AND r.status = $2 AND p.kind IN ($3, $4) AND `+discountUnbound+`
+		ORDER BY r.created_at DESC
+		LIMIT 1`,
+		customerID, PromoRedemptionStatusPending, PromoKindPercent, PromoKindAmount,
+	)
+
+	var red PromoRedemption
+	var promo PromoCode
+	err := row.Scan(&red.ID, &red.Code, &red.CustomerID, &red.SubscriptionID, &red.PurchaseID, &red.Status, &red.CreatedAt, &red.RedeemedAt,
+		&promo.Code, &promo.Kind, &promo.Value, &promo.MaxUses, &promo.PerUserLimit, &promo.ExpiresAt, &promo.PlanID, &promo.CreatedAt)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return nil, nil, nil
+	}
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to query available promo discount: %w", err)
+	}
+	return &red, &promo, nil
+}
+
+// BindPurchase привязывает скидку к счёту, в который она вошла. Скидка, уже вошедшая в
+// неотменённый счёт, не перепривязывается; false — привязать не удалось.
+func (r *PromoRepository) BindPurchase(ctx context.Context, redemptionID, purchaseID int64) (bool, error) {
+	tag, err := r.pool.Exec(ctx, "UPDATE promo_redemption r SET purchase_id = $1 WHERE r.id = $2 AND r.status = $3 AND "+discountUnbound,
+		purchaseID, redemptionID, PromoRedemptionStatusPending)
+	if err != nil {
+		return false, fmt.Errorf("failed to bind promo redemption to purchase: %w", err)
+	}
+	return tag.RowsAffected() > 0, nil
+}
+
+// MarkRedeemedByPurchase погашает скидку, привязанную к оплаченной покупке
+func (r *PromoRepository) MarkRedeemedByPurchase(ctx context.Context, purchaseID int64) error {
+	_, err := r.pool.Exec(ctx, "UPDATE promo_redemption SET status = $1, redeemed_at = NOW() WHERE purchase_id = $2 AND status = $3",
+		PromoRedemptionStatusRedeemed, purchaseID, PromoRedemptionStatusPending)
+	if err != nil {
+		return fmt.Errorf("failed to mark promo redemption redeemed: %w", err)
+	}
+	return nil
+}
@@ -8,10 +8,14 @@ import (
 
 	sq "github.com/Masterminds/squirrel"
 	"github.com/google/uuid"
+	"github.com/jackc/pgconn"
 	"github.com/jackc/pgx/v4"
 	"github.com/jackc/pgx/v4/pgxpool"
 )
 
+// ErrTributeEventExists — покупка по этому событию Tribute уже создана
+var ErrTributeEventExists = errors.New("purchase for tribute event already exists")
+
 type InvoiceType string
 
 const (
@@ -30,6 +34,16 @@ const (
 	PurchaseStatusCancel  PurchaseStatus = "cancel"
 )
 
+// PurchaseKind — что покупается
+type PurchaseKind string
+
+const (
+	// PurchaseKindSubscription — продление подписки по тарифу PlanID (у старых покупок — на Month месяцев)
+	PurchaseKindSubscription PurchaseKind = "subscription"
+	// PurchaseKindTraffic — пакет TrafficGB гигабайт для подписки SubscriptionID
+	PurchaseKindTraffic PurchaseKind = "traffic"
+)
+
 type Purchase struct {
 	ID                int64          `db:"id"`
 	Amount            float64        `db:"amount"`
@@ -45,6 +59,35 @@ type Purchase struct {
 	CryptoInvoiceLink *string        `db:"crypto_invoice_url"`
 	YookasaURL        *string        `db:"yookasa_url"`
 	YookasaID         *uuid.UUID     `db:"yookasa_id"`
+	Kind              PurchaseKind   `db:"kind"`
+	SubscriptionID    *int64         `db:"subscription_id"`
+	TrafficGB         int            `db:"traffic_gb"`
+	PlanID            string         `db:"plan_id"`
+	Days              int            `db:"days"`
+	// TelegramChargeID — идентификатор списания звёзд, сохраняется сразу после оплаты
+	TelegramChargeID *string `db:"telegram_payment_charge_id"`
+	// BalanceUsed — сколько рублей реферального баланса вычтено из суммы счёта
+	BalanceUsed float64 `db:"balance_used"`
+	// TargetExpireAt — срок, до которого покупка продлевает подписку; сохраняется до обращения к панели
+	TargetExpireAt *time.Time `db:"target_expire_at"`
+	// TargetTrafficLimit — лимит трафика в байтах, который выставляет пакет; сохраняется до обращения к панели
+	TargetTrafficLimit *int64 `db:"target_traffic_limit"`
+	// TributeEvent — ключ события Tribute, по которому создана покупка
+	TributeEvent *string `db:"tribute_event"`
+}
+
+var purchaseColumns = []string{"id", "amount", "customer_id", "created_at", "month", "paid_at", "currency", "expire_at", "status", "invoice_type", "crypto_invoice_id", "crypto_invoice_url", "yookasa_url", "yookasa_id", "kind", "subscription_id", "traffic_gb", "plan_id", "days", "telegram_payment_charge_id", "balance_used", "target_expire_at", "target_traffic_limit", "tribute_event"}
+
+func scanPurchase(row pgx.Row) (*Purchase, error) {
+	p := &Purchase{}
+	err := row.Scan(
+		&p.ID, &p.Amount, &p.CustomerID, &p.CreatedAt, &p.Month,
+		&p.PaidAt, &p.Currency, &p.ExpireAt, &p.Status, &p.InvoiceType,
+		&p.CryptoInvoiceID, &p.CryptoInvoiceLink, &p.YookasaURL, &p.YookasaID,
+		&p.Kind, &p.SubscriptionID, &p.TrafficGB, &p.PlanID, &p.Days,
+		&p.TelegramChargeID, &p.BalanceUsed, &p.TargetExpireAt, &p.TargetTrafficLimit, &p.TributeEvent,
+	)
+	return p, err
 }
 
 type PurchaseRepository struct {
@@ -59,8 +102,8 @@ func NewPurchaseRepository(pool *pgxpool.Pool) *PurchaseRepository {
 
 func (cr *PurchaseRepository) Create(ctx context.Context, purchase *Purchase) (int64, error) {
 	buildInsert := sq.Insert("purchase").
-		Columns("amount", "customer_id", "month", "currency", "expire_at", "status", "invoice_type", "crypto_invoice_id", "crypto_invoice_url", "yookasa_url", "yookasa_id").
-		Values(purchase.Amount, purchase.CustomerID, purchase.Month, purchase.Currency, purchase.ExpireAt, purchase.Status, purchase.InvoiceType, purchase.CryptoInvoiceID, purchase.CryptoInvoiceLink, purchase.YookasaURL, purchase.YookasaID).
+		Columns("amount", "customer_id", "month", "currency", "expire_at", "status", "invoice_type", "crypto_invoice_id", "crypto_invoice_url", "yookasa_url", "yookasa_id", "kind", "subscription_id", "traffic_gb", "plan_id", "days", "balance_used", "tribute_event").
+		Values(purchase.Amount, purchase.CustomerID, purchase.Month, purchase.Currency, purchase.ExpireAt, purchase.Status, purchase.InvoiceType, purchase.CryptoInvoiceID, purchase.CryptoInvoiceLink, purchase.YookasaURL, purchase.YookasaID, purchase.Kind, purchase.SubscriptionID, purchase.TrafficGB, purchase.PlanID, purchase.Days, purchase.BalanceUsed, purchase.TributeEvent).
 		Suffix("RETURNING id").
 		PlaceholderFormat(sq.Dollar)
 
@@ -72,6 +115,10 @@ func (cr *PurchaseRepository) Create(ctx context.Context, purchase *Purchase) (i
 	var id int64
 	err = cr.pool.QueryRow(ctx, sql, args...).Scan(&id)
 	if err != nil {
+		var pgErr *pgconn.PgError
+		if errors.As(err, &pgErr) && pgErr.Code == "23505" && pgErr.ConstraintName == "idx_purchase_tribute_event" {
+			return 0, ErrTributeEventExists
+		}
 		return 0, err
 	}
 
@@ -79,7 +126,7 @@ func (cr *PurchaseRepository) Create(ctx context.Context, purchase *Purchase) (i
 }
 
 func (cr *PurchaseRepository) FindByInvoiceTypeAndStatus(ctx context.Context, invoiceType InvoiceType, status PurchaseStatus) (*[]Purchase, error) {
-	buildSelect := sq.Select("*").
+	buildSelect := sq.Select(purchaseColumns...).
 		From("purchase").
 		Where(sq.And{
 			sq.Eq{"invoice_type": invoiceType},
@@ -100,27 +147,50 @@ func (cr *PurchaseRepository) FindByInvoiceTypeAndStatus(ctx context.Context, in
 
 	purchases := []Purchase{}
 	for rows.Next() {
-		purchase := Purchase{}
-		err = rows.Scan(
-			&purchase.ID,
-			&purchase.Amount,
-			&purchase.CustomerID,
-			&purchase.CreatedAt,
-			&purchase.Month,
-			&purchase.PaidAt,
-			&purchase.Currency,
-			&purchase.ExpireAt,
-			&purchase.Status,
-			&purchase.InvoiceType,
-			&purchase.CryptoInvoiceID,
-			&purchase.CryptoInvoiceLink,
-			&purchase.YookasaURL,
-			&purchase.YookasaID,
-		)
+		purchase, err := scanPurchase(rows)
 		if err != nil {
 			return nil, fmt.Errorf("failed to scan purchase: %w", err)
 		}
-		purchases = append(purchases, purchase)
+		purchases = append(purchases, *purchase)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, fmt.Errorf("error iterating rows: %w", err)
+	}
+
+	return &purchases, nil
+}
+
+// FindChargedTelegramPurchases возвращает покупки за звёзды, которые Telegram уже списал,
+// но которые ещё не обработаны
+func (cr *PurchaseRepository) FindChargedTelegramPurchases(ctx context.Context) (*[]Purchase, error) {
+	buildSelect := sq.Select(purchaseColumns...).
+		From("purchase").
+		Where(sq.And{
+			sq.Eq{"invoice_type": InvoiceTypeTelegram},
+			sq.Eq{"status": []PurchaseStatus{PurchaseStatusNew, PurchaseStatusPending}},
+			sq.NotEq{"telegram_payment_charge_id": nil},
+		}).
+		PlaceholderFormat(sq.Dollar)
+
+	sql, args, err := buildSelect.ToSql()
+	if err != nil {
+		return nil, err
+	}
+
+	rows, err := cr.pool.Query(ctx, sql, args...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query purchases: %w", err)
+	}
+	defer rows.Close()
+
+	purchases := []Purchase{}
+	for rows.Next() {
+		purchase, err := scanPurchase(rows)
+		if err != nil {
+			return nil, fmt.Errorf("failed to scan purchase: %w", err)
+		}
+		purchases = append(purchases, *purchase)
 	}
 
 	if err = rows.Err(); err != nil {
@@ -131,7 +201,7 @@ func (cr *PurchaseRepository) FindByInvoiceTypeAndStatus(ctx context.Context, in
 }
 
 func (cr *PurchaseRepository) FindById(ctx context.Context, id int64) (*Purchase, error) {
-	buildSelect := sq.Select("*").
+	buildSelect := sq.Select(purchaseColumns...).
 		From("purchase").
 		Where(sq.Eq{"id": id}).
 		PlaceholderFormat(sq.Dollar)
@@ -140,24 +210,7 @@ func (cr *PurchaseRepository) FindById(ctx context.Context, id int64) (*Purchase
 	if err != nil {
 		return nil, err
 	}
-	purchase := &Purchase{}
-
-	err = cr.pool.QueryRow(ctx, sql, args...).Scan(
-		&purchase.ID,
-		&purchase.Amount,
-		&purchase.CustomerID,
-		&purchase.CreatedAt,
-		&purchase.Month,
-		&purchase.PaidAt,
-		&purchase.Currency,
-		&purchase.ExpireAt,
-		&purchase.Status,
-		&purchase.InvoiceType,
-		&purchase.CryptoInvoiceID,
-		&purchase.CryptoInvoiceLink,
-		&purchase.YookasaURL,
-		&purchase.YookasaID,
-	)
+	purchase, err := scanPurchase(cr.pool.QueryRow(ctx, sql, args...))
 
 	if err != nil {
 		if errors.Is(err, pgx.ErrNoRows) {
@@ -213,7 +266,7 @@ func (pr *PurchaseRepository) MarkAsPaid(ctx context.Context, purchaseID int64)
 
 func buildLatestActiveTributesQuery(customerIDs []int64) sq.SelectBuilder {
 	return sq.
-		Select("*").
+		Select(purchaseColumns...).
 		From("purchase").
 		Where(sq.And{
 			sq.Eq{"invoice_type": InvoiceTypeTribute},
@@ -247,15 +300,11 @@ func (pr *PurchaseRepository) FindLatestActiveTributesByCustomerIDs(
 
 	var purchases []Purchase
 	for rows.Next() {
-		var p Purchase
-		if err := rows.Scan(
-			&p.ID, &p.Amount, &p.CustomerID, &p.CreatedAt, &p.Month,
-			&p.PaidAt, &p.Currency, &p.ExpireAt, &p.Status, &p.InvoiceType,
-			&p.CryptoInvoiceID, &p.CryptoInvoiceLink, &p.YookasaURL, &p.YookasaID,
-		); err != nil {
+		p, err := scanPurchase(rows)
+		if err != nil {
 			return nil, fmt.Errorf("scan purchase: %w", err)
 		}
-		purchases = append(purchases, p)
+		purchases = append(purchases, *p)
 	}
 
 	if err = rows.Err(); err != nil {
@@ -271,7 +320,7 @@ func (pr *PurchaseRepository) FindByCustomerIDAndInvoiceTypeLast(
 	invoiceType InvoiceType,
 ) (*Purchase, error) {
 
-	query := sq.Select("*").
+	query := sq.Select(purchaseColumns...).
 		From("purchase").
 		Where(sq.And{
 			sq.Eq{"customer_id": customerID},
@@ -286,12 +335,7 @@ func (pr *PurchaseRepository) FindByCustomerIDAndInvoiceTypeLast(
 		return nil, fmt.Errorf("build query: %w", err)
 	}
 
-	p := &Purchase{}
-	err = pr.pool.QueryRow(ctx, sql, args...).Scan(
-		&p.ID, &p.Amount, &p.CustomerID, &p.CreatedAt, &p.Month,
-		&p.PaidAt, &p.Currency, &p.ExpireAt, &p.Status, &p.InvoiceType,
-		&p.CryptoInvoiceID, &p.CryptoInvoiceLink, &p.YookasaURL, &p.YookasaID,
-	)
+	p, err := scanPurchase(pr.pool.QueryRow(ctx, sql, args...))
 	if err != nil {
 		if errors.Is(err, pgx.ErrNoRows) {
 			return nil, nil
@@ -302,9 +346,8 @@ func (pr *PurchaseRepository) FindByCustomerIDAndInvoiceTypeLast(
 	return p, nil
 }
 
-
 func (pr *PurchaseRepository) FindSuccessfulPaidPurchaseByCustomer(ctx context.Context, customerID int64) (*Purchase, error) {
-	query := sq.Select("*").
+	query := sq.Select(purchaseColumns...).
 		From("purchase").
 		Where(sq.And{
 			sq.Eq{"customer_id": customerID},
@@ -323,12 +366,109 @@ func (pr *PurchaseRepository) FindSuccessfulPaidPurchaseByCustomer(ctx context.C
 		return nil, fmt.Errorf("build query: %w", err)
 	}
 
-	p := &Purchase{}
-	err = pr.pool.QueryRow(ctx, sql, args...).Scan(
-		&p.ID, &p.Amount, &p.CustomerID, &p.CreatedAt, &p.Month,
-		&p.PaidAt, &p.Currency, &p.ExpireAt, &p.Status, &p.InvoiceType,
-		&p.CryptoInvoiceID, &p.CryptoInvoiceLink, &p.YookasaURL, &p.YookasaID,
-	)
+	p, err := scanPurchase(pr.pool.QueryRow(ctx, sql, args...))
+	if err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("query purchase: %w", err)
+	}
+
+	return p, nil
+}
+
+// HasPaidPurchase есть ли у клиента хотя бы одна оплаченная покупка
+func (pr *PurchaseRepository) HasPaidPurchase(ctx context.Context, customerID int64) (bool, error) {
+	var exists bool
+	err := pr.pool.QueryRow(ctx,
+		"SELECT EXISTS (SELECT 1 FROM purchase WHERE customer_id = $1 AND status = $2)",
+		customerID, PurchaseStatusPaid,
+	).Scan(&exists)
+	if err != nil {
+		return false, fmt.Errorf("failed to check paid purchases: %w", err)
+	}
+	return exists, nil
+}
+
+// LockForProcessing берёт транзакционную advisory-блокировку на покупку, чтобы
+// параллельные вебхуки и поллеры обрабатывали её строго по очереди.
+// Возвращаемая функция снимает блокировку.
+func (pr *PurchaseRepository) LockForProcessing(ctx context.Context, purchaseID int64) (func(), error) {
+	tx, err := pr.pool.Begin(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to begin transaction: %w", err)
+	}
+
+	if _, err := tx.Exec(ctx, "SELECT pg_advisory_xact_lock($1)", purchaseID); err != nil {
+		_ = tx.Rollback(ctx)
+		return nil, fmt.Errorf("failed to lock purchase %d: %w", purchaseID, err)
+	}
+
+	return func() {
+		_ = tx.Rollback(context.Background())
+	}, nil
+}
+
+func (pr *PurchaseRepository) FindByYookasaID(ctx context.Context, yookasaID uuid.UUID) (*Purchase, error) {
+	query := sq.Select(purchaseColumns...).
+		From("purchase").
+		Where(sq.Eq{"yookasa_id": yookasaID}).
+		Limit(1).
+		PlaceholderFormat(sq.Dollar)
+
+	sql, args, err := query.ToSql()
+	if err != nil {
+		return nil, fmt.Errorf("build query: %w", err)
+	}
+
+	p, err := scanPurchase(pr.pool.QueryRow(ctx, sql, args...))
+	if err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("query purchase: %w", err)
+	}
+
+	return p, nil
+}
+
+// FindByTributeEvent возвращает покупку, созданную по событию Tribute, или nil
+func (pr *PurchaseRepository) FindByTributeEvent(ctx context.Context, event string) (*Purchase, error) {
+	query := sq.Select(purchaseColumns...).
+		From("purchase").
+		Where(sq.Eq{"tribute_event": event}).
+		Limit(1).
+		PlaceholderFormat(sq.Dollar)
+
+	sql, args, err := query.ToSql()
+	if err != nil {
+		return nil, fmt.Errorf("build query: %w", err)
+	}
+
+	p, err := scanPurchase(pr.pool.QueryRow(ctx, sql, args...))
+	if err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("query purchase: %w", err)
+	}
+
+	return p, nil
+}
+
+func (pr *PurchaseRepository) FindByCryptoInvoiceID(ctx context.Context, invoiceID int64) (*Purchase, error) {
+	query := sq.Select(purchaseColumns...).
+		From("purchase").
+		Where(sq.Eq{"crypto_invoice_id": invoiceID}).
+		Limit(1).
+		PlaceholderFormat(sq.Dollar)
+
+	sql, args, err := query.ToSql()
+	if err != nil {
+		return nil, fmt.Errorf("build query: %w", err)
+	}
+
+	p, err := scanPurchase(pr.pool.QueryRow(ctx, sql, args...))
 	if err != nil {
 		if errors.Is(err, pgx.ErrNoRows) {
 			return nil, nil
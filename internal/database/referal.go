@@ -16,8 +16,13 @@ type Referral struct {
 	RefereeID    int64     `db:"referee_id"`
 	UsedAt       time.Time `db:"used_at"`
 	BonusGranted bool      `db:"bonus_granted"`
+	// Converted — у приглашённого есть оплаченная покупка, заполняется FindByReferrer
+	Converted bool `db:"-"`
 }
 
+// refereeConverted — условие "у приглашённого есть оплаченная покупка"
+const refereeConverted = "EXISTS (SELECT 1 FROM purchase p JOIN customer c ON c.id = p.customer_id WHERE c.telegram_id = referral.referee_id AND p.status = 'paid')"
+
 type ReferralRepository struct {
 	pool *pgxpool.Pool
 }
@@ -46,11 +51,14 @@ func (r *ReferralRepository) Create(ctx context.Context, referrerID, refereeID i
 	return &ref, nil
 }
 
-func (r *ReferralRepository) FindByReferrer(ctx context.Context, referrerID int64) ([]Referral, error) {
-	query := sq.Select("id", "referrer_id", "referee_id", "used_at", "bonus_granted").
+// FindByReferrer возвращает страницу приглашённых, новые первыми, с отметкой об оплате
+func (r *ReferralRepository) FindByReferrer(ctx context.Context, referrerID int64, limit, offset int) ([]Referral, error) {
+	query := sq.Select("id", "referrer_id", "referee_id", "used_at", "bonus_granted", refereeConverted).
 		From("referral").
 		Where(sq.Eq{"referrer_id": referrerID}).
-		OrderBy("used_at DESC").
+		OrderBy("used_at DESC", "id DESC").
+		Limit(uint64(limit)).
+		Offset(uint64(offset)).
 		PlaceholderFormat(sq.Dollar)
 
 	sql, args, err := query.ToSql()
@@ -67,7 +75,7 @@ func (r *ReferralRepository) FindByReferrer(ctx context.Context, referrerID int6
 	var list []Referral
 	for rows.Next() {
 		var ref Referral
-		if err := rows.Scan(&ref.ID, &ref.ReferrerID, &ref.RefereeID, &ref.UsedAt, &ref.BonusGranted); err != nil {
+		if err := rows.Scan(&ref.ID, &ref.ReferrerID, &ref.RefereeID, &ref.UsedAt, &ref.BonusGranted, &ref.Converted); err != nil {
 			return nil, fmt.Errorf("failed to scan referral row: %w", err)
 		}
 		list = append(list, ref)
@@ -78,6 +86,45 @@ func (r *ReferralRepository) FindByReferrer(ctx context.Context, referrerID int6
 	return list, nil
 }
 
+// CountConverted считает приглашённых, у которых есть оплаченная покупка
+func (r *ReferralRepository) CountConverted(ctx context.Context, referrerID int64) (int, error) {
+	query := sq.Select("COUNT(*)").
+		From("referral").
+		Where(sq.And{sq.Eq{"referrer_id": referrerID}, sq.Expr(refereeConverted)}).
+		PlaceholderFormat(sq.Dollar)
+
+	sql, args, err := query.ToSql()
+	if err != nil {
+		return 0, fmt.Errorf("failed to build count converted referrals query: %w", err)
+	}
+
+	var count int
+	if err := r.pool.QueryRow(ctx, sql, args...).Scan(&count); err != nil {
+		return 0, fmt.Errorf("failed to scan count of converted referrals: %w", err)
+	}
+	return count, nil
+}
+
+// CountSecondLevel считает пользователей, которых пригласили приглашённые referrerID
+func (r *ReferralRepository) CountSecondLevel(ctx context.Context, referrerID int64) (int, error) {
+	query := sq.Select("COUNT(*)").
+		From("referral r2").
+		Join("referral r1 ON r1.referee_id = r2.referrer_id").
+		Where(sq.And{sq.Eq{"r1.referrer_id": referrerID}, sq.NotEq{"r2.referee_id": referrerID}}).
+		PlaceholderFormat(sq.Dollar)
+
+	sql, args, err := query.ToSql()
+	if err != nil {
+		return 0, fmt.Errorf("failed to build count second level referrals query: %w", err)
+	}
+
+	var count int
+	if err := r.pool.QueryRow(ctx, sql, args...).Scan(&count); err != nil {
+		return 0, fmt.Errorf("failed to scan count of second level referrals: %w", err)
+	}
+	return count, nil
+}
+
 func (r *ReferralRepository) CountByReferrer(ctx context.Context, referrerID int64) (int, error) {
 	query := sq.Select("COUNT(*)").
 		From("referral").
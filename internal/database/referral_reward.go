@@ -0,0 +1,228 @@
+package database
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	sq "github.com/Masterminds/squirrel"
+	"github.com/jackc/pgx/v4"
+	"github.com/jackc/pgx/v4/pgxpool"
+)
+
+type ReferralRewardStatus string
+
+const (
+	// ReferralRewardStatusPending — награду не удалось применить, она применится позже
+	ReferralRewardStatusPending ReferralRewardStatus = "pending"
+	ReferralRewardStatusGranted ReferralRewardStatus = "granted"
+)
+
+// ReferralReward — начисленная награда реферальной программы. Amount — дни, гигабайты или рубли
+// в зависимости от Kind.
+type ReferralReward struct {
+	ID         int64                `db:"id"`
+	ReferralID int64                `db:"referral_id"`
+	ReferrerID int64                `db:"referrer_id"`
+	Level      int                  `db:"level"`
+	Event      string               `db:"event"`
+	PurchaseID int64                `db:"purchase_id"`
+	Kind       string               `db:"kind"`
+	Amount     float64              `db:"amount"`
+	Status     ReferralRewardStatus `db:"status"`
+	CreatedAt  time.Time            `db:"created_at"`
+	GrantedAt  *time.Time           `db:"granted_at"`
+}
+
+// ReferralRewardTotal — сумма наград одного вида и статуса
+type ReferralRewardTotal struct {
+	Kind   string
+	Status ReferralRewardStatus
+	Amount float64
+}
+
+var referralRewardColumns = []string{
+	"id", "referral_id", "referrer_id", "level", "event", "purchase_id", "kind", "amount", "status", "created_at", "granted_at",
+}
+
+func scanReferralReward(row pgx.Row) (ReferralReward, error) {
+	var r ReferralReward
+	err := row.Scan(&r.ID, &r.ReferralID, &r.ReferrerID, &r.Level, &r.Event, &r.PurchaseID, &r.Kind, &r.Amount, &r.Status, &r.CreatedAt, &r.GrantedAt)
+	return r, err
+}
+
+type ReferralRewardRepository struct {
+	pool *pgxpool.Pool
+}
+
+func NewReferralRewardRepository(pool *pgxpool.Pool) *ReferralRewardRepository {
+	return &ReferralRewardRepository{pool: pool}
+}
+
+// Grant записывает награду и применяет её в одной транзакции. Пока транзакция открыта,
+// такая же награда из параллельной обработки ждёт на уникальном ключе, поэтому применяется
+// ровно один раз. Если apply вернул ошибку, награда сохраняется в статусе pending.
+// Возвращает false, если такая награда уже была записана.
+func (r *ReferralRewardRepository) Grant(ctx context.Context, reward *ReferralReward, apply func(ctx context.Context) error) (bool, error) {
+	query := sq.Insert("referral_reward").
+		Columns("referral_id", "referrer_id", "level", "event", "purchase_id", "kind", "amount", "status").
+		Values(reward.ReferralID, reward.ReferrerID, reward.Level, reward.Event, reward.PurchaseID, reward.Kind, reward.Amount, ReferralRewardStatusPending).
+		Suffix("ON CONFLICT (referral_id, level, event, purchase_id, kind) DO NOTHING RETURNING id, created_at").
+		PlaceholderFormat(sq.Dollar)
+
+	sql, args, err := query.ToSql()
+	if err != nil {
+		return false, fmt.Errorf("failed to build insert referral reward query: %w", err)
+	}
+
+	tx, err := r.pool.Begin(ctx)
+	if err != nil {
+		return false, fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer func() { _ = tx.Rollback(ctx) }()
+
+	err = tx.QueryRow(ctx, sql, args...).Scan(&reward.ID, &reward.CreatedAt)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return false, nil
+	}
+	if err != nil {
+		return false, fmt.Errorf("failed to insert referral reward: %w", err)
+	}
+
+	applyErr := apply(ctx)
+	reward.Status = ReferralRewardStatusPending
+	if applyErr == nil {
+		if err := markRewardGranted(ctx, tx, reward); err != nil {
+			return false, err
+		}
+	}
+	if err := tx.Commit(ctx); err != nil {
+		return false, fmt.Errorf("failed to commit transaction: %w", err)
+	}
+	return true, applyErr
+}
+
+// GrantPending повторно применяет отложенную награду. Строка блокируется на время apply,
+// поэтому параллельные повторы не применят её дважды. Возвращает false, если награда уже
+// применена.
+func (r *ReferralRewardRepository) GrantPending(ctx context.Context, reward *ReferralReward, apply func(ctx context.Context) error) (bool, error) {
+	tx, err := r.pool.Begin(ctx)
+	if err != nil {
+		return false, fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer func() { _ = tx.Rollback(ctx) }()
+
+	var id int64
+	err = tx.QueryRow(ctx, "SELECT id FROM referral_reward WHERE id = $1 AND status = $2 FOR UPDATE", reward.ID, ReferralRewardStatusPending).Scan(&id)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return false, nil
+	}
+	if err != nil {
+		return false, fmt.Errorf("failed to lock referral reward: %w", err)
+	}
+
+	if err := apply(ctx); err != nil {
+		return false, err
+	}
+	if err := markRewardGranted(ctx, tx, reward); err != nil {
+		return false, err
+	}
+	if err := tx.Commit(ctx); err != nil {
+		return false, fmt.Errorf("failed to commit transaction: %w", err)
+	}
+	return true, nil
+}
+
+func markRewardGranted(ctx context.Context, tx pgx.Tx, reward *ReferralReward) error {
+	now := time.Now()
+	if _, err := tx.Exec(ctx, "UPDATE referral_reward SET status = $1, granted_at = $2 WHERE id = $3", ReferralRewardStatusGranted, now, reward.ID); err != nil {
+		return fmt.Errorf("failed to mark referral reward granted: %w", err)
+	}
+	reward.Status = ReferralRewardStatusGranted
+	reward.GrantedAt = &now
+	return nil
+}
+
+// FindPending возвращает отложенные награды пригласившего, старые первыми
+func (r *ReferralRewardRepository) FindPending(ctx context.Context, referrerID int64) ([]ReferralReward, error) {
+	query := sq.Select(referralRewardColumns...).
+		From("referral_reward").
+		Where(sq.Eq{"referrer_id": referrerID, "status": ReferralRewardStatusPending}).
+		OrderBy("created_at").
+		PlaceholderFormat(sq.Dollar)
+
+	sql, args, err := query.ToSql()
+	if err != nil {
+		return nil, fmt.Errorf("failed to build select pending referral rewards query: %w", err)
+	}
+
+	rows, err := r.pool.Query(ctx, sql, args...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query pending referral rewards: %w", err)
+	}
+	defer rows.Close()
+
+	var rewards []ReferralReward
+	for rows.Next() {
+		reward, err := scanReferralReward(rows)
+		if err != nil {
+			return nil, fmt.Errorf("failed to scan referral reward row: %w", err)
+		}
+		rewards = append(rewards, reward)
+	}
+	if rows.Err() != nil {
+		return nil, fmt.Errorf("error iterating referral reward rows: %w", rows.Err())
+	}
+	return rewards, nil
+}
+
+// Totals суммирует награды пригласившего по видам и статусам
+func (r *ReferralRewardRepository) Totals(ctx context.Context, referrerID int64) ([]ReferralRewardTotal, error) {
+	query := sq.Select("kind", "status", "SUM(amount)").
+		From("referral_reward").
+		Where(sq.Eq{"referrer_id": referrerID}).
+		GroupBy("kind", "status").
+		OrderBy("kind", "status").
+		PlaceholderFormat(sq.Dollar)
+
+	sql, args, err := query.ToSql()
+	if err != nil {
+		return nil, fmt.Errorf("failed to build referral reward totals query: %w", err)
+	}
+
+	rows, err := r.pool.Query(ctx, sql, args...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query referral reward totals: %w", err)
+	}
+	defer rows.Close()
+
+	var totals []ReferralRewardTotal
+	for rows.Next() {
+		var total ReferralRewardTotal
+		if err := rows.Scan(&total.Kind, &total.Status, &total.Amount); err != nil {
+			return nil, fmt.Errorf("failed to scan referral reward total: %w", err)
+		}
+		totals = append(totals, total)
+	}
+	if rows.Err() != nil {
+		return nil, fmt.Errorf("error iterating referral reward totals: %w", rows.Err())
+	}
+	return totals, nil
+}
+
+// Balance — реферальный баланс клиента: выданные денежные награды за вычетом сумм, списанных
+// в счета, которые не отменены
+func (r *ReferralRewardRepository) Balance(ctx context.Context, referrerID, customerID int64) (float64, error) {
+	var balance float64
+	err := r.pool.QueryRow(ctx, `
+		SELECT
+			COALESCE((SELECT SUM(amount) FROM referral_reward WHERE referrer_id = $1 AND kind = $2 AND status = $3), 0) -
+			COALESCE((SELECT SUM(balance_used) FROM purchase WHERE customer_id = $4 AND status <> $5), 0)`,
+		referrerID, "balance", ReferralRewardStatusGranted, customerID, PurchaseStatusCancel,
+	).Scan(&balance)
+	if err != nil {
+		return 0, fmt.Errorf("failed to query referral balance: %w", err)
+	}
+	return max(balance, 0), nil
+}
@@ -5,20 +5,49 @@ import (
 	"errors"
 	"fmt"
 	sq "github.com/Masterminds/squirrel"
+	"github.com/google/uuid"
 	"github.com/jackc/pgx/v4"
 	"github.com/jackc/pgx/v4/pgxpool"
 	"time"
 )
 
 type Subscription struct {
-	ID               int64      `db:"id"`
-	CustomerID       int64      `db:"customer_id"`
-	SubscriptionLink string     `db:"subscription_link"`
-	ExpireAt         time.Time  `db:"expire_at"`
-	CreatedAt        time.Time  `db:"created_at"`
-	IsActive         bool       `db:"is_active"`
-	Name             string     `db:"name"`
-	Description      string     `db:"description"`
+	ID               int64     `db:"id"`
+	CustomerID       int64     `db:"customer_id"`
+	SubscriptionLink string    `db:"subscription_link"`
+	ExpireAt         time.Time `db:"expire_at"`
+	CreatedAt        time.Time `db:"created_at"`
+	IsActive         bool      `db:"is_active"`
+	Name             string    `db:"name"`
+	Description      string    `db:"description"`
+	// пользователь remnawave, которым обеспечена подписка; у подписок, созданных
+	// до появления этих колонок, RemnawaveUUID и Username пусты до синхронизации
+	RemnawaveUUID *uuid.UUID `db:"remnawave_uuid"`
+	ShortUUID     *string    `db:"short_uuid"`
+	Username      *string    `db:"username"`
+	// ExtraTrafficGB — гигабайты купленных пакетов, сохраняемые при продлении
+	ExtraTrafficGB int `db:"extra_traffic_gb"`
+}
+
+var subscriptionColumns = []string{"id", "customer_id", "subscription_link", "expire_at", "created_at", "is_active", "name", "description", "remnawave_uuid", "short_uuid", "username", "extra_traffic_gb"}
+
+func scanSubscription(row pgx.Row) (Subscription, error) {
+	var sub Subscription
+	err := row.Scan(
+		&sub.ID,
+		&sub.CustomerID,
+		&sub.SubscriptionLink,
+		&sub.ExpireAt,
+		&sub.CreatedAt,
+		&sub.IsActive,
+		&sub.Name,
+		&sub.Description,
+		&sub.RemnawaveUUID,
+		&sub.ShortUUID,
+		&sub.Username,
+		&sub.ExtraTrafficGB,
+	)
+	return sub, err
 }
 
 type SubscriptionRepository struct {
@@ -32,8 +61,8 @@ func NewSubscriptionRepository(pool *pgxpool.Pool) *SubscriptionRepository {
 // CreateSubscription создает новую подписку для клиента
 func (sr *SubscriptionRepository) CreateSubscription(ctx context.Context, subscription *Subscription) (*Subscription, error) {
 	buildInsert := sq.Insert("subscription").
-		Columns("customer_id", "subscription_link", "expire_at", "is_active", "name", "description").
-		Values(subscription.CustomerID, subscription.SubscriptionLink, subscription.ExpireAt, subscription.IsActive, subscription.Name, subscription.Description).
+		Columns("customer_id", "subscription_link", "expire_at", "is_active", "name", "description", "remnawave_uuid", "short_uuid", "username").
+		Values(subscription.CustomerID, subscription.SubscriptionLink, subscription.ExpireAt, subscription.IsActive, subscription.Name, subscription.Description, subscription.RemnawaveUUID, subscription.ShortUUID, subscription.Username).
 		Suffix("RETURNING id, created_at").
 		PlaceholderFormat(sq.Dollar)
 
@@ -63,7 +92,7 @@ func (sr *SubscriptionRepository) CreateSubscription(ctx context.Context, subscr
 
 // GetActiveSubscriptions возвращает все активные подписки клиента
 func (sr *SubscriptionRepository) GetActiveSubscriptions(ctx context.Context, customerID int64) ([]Subscription, error) {
-	buildSelect := sq.Select("id", "customer_id", "subscription_link", "expire_at", "created_at", "is_active", "name", "description").
+	buildSelect := sq.Select(subscriptionColumns...).
 		From("subscription").
 		Where(sq.And{
 			sq.Eq{"customer_id": customerID},
@@ -85,17 +114,7 @@ func (sr *SubscriptionRepository) GetActiveSubscriptions(ctx context.Context, cu
 
 	var subscriptions []Subscription
 	for rows.Next() {
-		var sub Subscription
-		err := rows.Scan(
-			&sub.ID,
-			&sub.CustomerID,
-			&sub.SubscriptionLink,
-			&sub.ExpireAt,
-			&sub.CreatedAt,
-			&sub.IsActive,
-			&sub.Name,
-			&sub.Description,
-		)
+		sub, err := scanSubscription(rows)
 		if err != nil {
 			return nil, fmt.Errorf("failed to scan subscription row: %w", err)
 		}
@@ -111,7 +130,7 @@ func (sr *SubscriptionRepository) GetActiveSubscriptions(ctx context.Context, cu
 
 // GetAllSubscriptions возвращает все подписки клиента (включая неактивные)
 func (sr *SubscriptionRepository) GetAllSubscriptions(ctx context.Context, customerID int64) ([]Subscription, error) {
-	buildSelect := sq.Select("id", "customer_id", "subscription_link", "expire_at", "created_at", "is_active", "name", "description").
+	buildSelect := sq.Select(subscriptionColumns...).
 		From("subscription").
 		Where(sq.Eq{"customer_id": customerID}).
 		OrderBy("created_at DESC").
@@ -130,17 +149,7 @@ func (sr *SubscriptionRepository) GetAllSubscriptions(ctx context.Context, custo
 
 	var subscriptions []Subscription
 	for rows.Next() {
-		var sub Subscription
-		err := rows.Scan(
-			&sub.ID,
-			&sub.CustomerID,
-			&sub.SubscriptionLink,
-			&sub.ExpireAt,
-			&sub.CreatedAt,
-			&sub.IsActive,
-			&sub.Name,
-			&sub.Description,
-		)
+		sub, err := scanSubscription(rows)
 		if err != nil {
 			return nil, fmt.Errorf("failed to scan subscription row: %w", err)
 		}
@@ -156,7 +165,7 @@ func (sr *SubscriptionRepository) GetAllSubscriptions(ctx context.Context, custo
 
 // GetSubscriptionByID возвращает подписку по ID
 func (sr *SubscriptionRepository) GetSubscriptionByID(ctx context.Context, id int64) (*Subscription, error) {
-	buildSelect := sq.Select("id", "customer_id", "subscription_link", "expire_at", "created_at", "is_active", "name", "description").
+	buildSelect := sq.Select(subscriptionColumns...).
 		From("subscription").
 		Where(sq.Eq{"id": id}).
 		PlaceholderFormat(sq.Dollar)
@@ -166,17 +175,7 @@ func (sr *SubscriptionRepository) GetSubscriptionByID(ctx context.Context, id in
 		return nil, fmt.Errorf("failed to build select query: %w", err)
 	}
 
-	var sub Subscription
-	err = sr.pool.QueryRow(ctx, sqlStr, args...).Scan(
-		&sub.ID,
-		&sub.CustomerID,
-		&sub.SubscriptionLink,
-		&sub.ExpireAt,
-		&sub.CreatedAt,
-		&sub.IsActive,
-		&sub.Name,
-		&sub.Description,
-	)
+	sub, err := scanSubscription(sr.pool.QueryRow(ctx, sqlStr, args...))
 	if err != nil {
 		if errors.Is(err, pgx.ErrNoRows) {
 			return nil, nil
@@ -243,14 +242,128 @@ func (sr *SubscriptionRepository) DeactivateSubscription(ctx context.Context, id
 	return sr.updateCustomerSubscriptionCount(ctx, sub.CustomerID)
 }
 
-// FindExpiredSubscriptions находит просроченные подписки
-func (sr *SubscriptionRepository) FindExpiredSubscriptions(ctx context.Context) ([]Subscription, error) {
-	buildSelect := sq.Select("id", "customer_id", "subscription_link", "expire_at", "created_at", "is_active", "name", "description").
+// ActivateSubscription снова делает подписку активной
+func (sr *SubscriptionRepository) ActivateSubscription(ctx context.Context, id int64) error {
+	sub, err := sr.GetSubscriptionByID(ctx, id)
+	if err != nil {
+		return err
+	}
+	if sub == nil {
+		return fmt.Errorf("subscription with id %d not found", id)
+	}
+
+	err = sr.UpdateSubscription(ctx, id, map[string]interface{}{"is_active": true})
+	if err != nil {
+		return err
+	}
+
+	return sr.updateCustomerSubscriptionCount(ctx, sub.CustomerID)
+}
+
+// RecountExtraTraffic пересчитывает купленный сверх тарифа трафик подписки по её оплаченным пакетам
+// и пакету покупки purchaseID, которая ещё не отмечена оплаченной. Повторный вызов даёт тот же результат.
+func (sr *SubscriptionRepository) RecountExtraTraffic(ctx context.Context, id int64, purchaseID int64) error {
+	purchased := sq.Select("COALESCE(SUM(traffic_gb), 0)").
+		From("purchase").
+		Where(sq.Eq{"subscription_id": id, "kind": PurchaseKindTraffic}).
+		Where(sq.Or{sq.Eq{"status": PurchaseStatusPaid}, sq.Eq{"id": purchaseID}})
+	sqlStr, args, err := sq.Update("subscription").
+		PlaceholderFormat(sq.Dollar).
+		Set("extra_traffic_gb", sq.Expr("(?)", purchased)).
+		Where(sq.Eq{"id": id}).
+		ToSql()
+	if err != nil {
+		return fmt.Errorf("failed to build update query: %w", err)
+	}
+
+	if _, err := sr.pool.Exec(ctx, sqlStr, args...); err != nil {
+		return fmt.Errorf("failed to recount extra traffic: %w", err)
+	}
+	return nil
+}
+
+// FindAll возвращает все подписки всех клиентов (включая неактивные)
+func (sr *SubscriptionRepository) FindAll(ctx context.Context) ([]Subscription, error) {
+	buildSelect := sq.Select(subscriptionColumns...).
+		From("subscription").
+		OrderBy("id").
+		PlaceholderFormat(sq.Dollar)
+
+	sqlStr, args, err := buildSelect.ToSql()
+	if err != nil {
+		return nil, fmt.Errorf("failed to build select query: %w", err)
+	}
+
+	rows, err := sr.pool.Query(ctx, sqlStr, args...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query subscriptions: %w", err)
+	}
+	defer rows.Close()
+
+	var subscriptions []Subscription
+	for rows.Next() {
+		sub, err := scanSubscription(rows)
+		if err != nil {
+			return nil, fmt.Errorf("failed to scan subscription row: %w", err)
+		}
+		subscriptions = append(subscriptions, sub)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("error iterating over subscription rows: %w", err)
+	}
+
+	return subscriptions, nil
+}
+
+// FindByExpirationRange находит активные подписки, истекающие в интервале [startDate, endDate]
+func (sr *SubscriptionRepository) FindByExpirationRange(ctx context.Context, startDate, endDate time.Time) ([]Subscription, error) {
+	buildSelect := sq.Select(subscriptionColumns...).
+		From("subscription").
+		Where(sq.And{
+			sq.Eq{"is_active": true},
+			sq.GtOrEq{"expire_at": startDate},
+			sq.LtOrEq{"expire_at": endDate},
+		}).
+		OrderBy("expire_at").
+		PlaceholderFormat(sq.Dollar)
+
+	sqlStr, args, err := buildSelect.ToSql()
+	if err != nil {
+		return nil, fmt.Errorf("failed to build select query: %w", err)
+	}
+
+	rows, err := sr.pool.Query(ctx, sqlStr, args...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query expiring subscriptions: %w", err)
+	}
+	defer rows.Close()
+
+	var subscriptions []Subscription
+	for rows.Next() {
+		sub, err := scanSubscription(rows)
+		if err != nil {
+			return nil, fmt.Errorf("failed to scan subscription row: %w", err)
+		}
+		subscriptions = append(subscriptions, sub)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("error iterating over subscription rows: %w", err)
+	}
+
+	return subscriptions, nil
+}
+
+// FindExpiredSubscriptions находит активные подписки, истекшие раньше expiredBefore
+func (sr *SubscriptionRepository) FindExpiredSubscriptions(ctx context.Context, expiredBefore time.Time) ([]Subscription, error) {
+	buildSelect := sq.Select(subscriptionColumns...).
 		From("subscription").
 		Where(sq.And{
 			sq.Eq{"is_active": true},
-			sq.Lt{"expire_at": time.Now()},
+			sq.Lt{"expire_at": expiredBefore},
 		}).
+		OrderBy("expire_at").
 		PlaceholderFormat(sq.Dollar)
 
 	sqlStr, args, err := buildSelect.ToSql()
@@ -266,23 +379,17 @@ func (sr *SubscriptionRepository) FindExpiredSubscriptions(ctx context.Context)
 
 	var subscriptions []Subscription
 	for rows.Next() {
-		var sub Subscription
-		err := rows.Scan(
-			&sub.ID,
-			&sub.CustomerID,
-			&sub.SubscriptionLink,
-			&sub.ExpireAt,
-			&sub.CreatedAt,
-			&sub.IsActive,
-			&sub.Name,
-			&sub.Description,
-		)
+		sub, err := scanSubscription(rows)
 		if err != nil {
 			return nil, fmt.Errorf("failed to scan subscription row: %w", err)
 		}
 		subscriptions = append(subscriptions, sub)
 	}
 
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("error iterating over subscription rows: %w", err)
+	}
+
 	return subscriptions, nil
 }
 
@@ -325,4 +432,4 @@ func (sr *SubscriptionRepository) updateCustomerSubscriptionCount(ctx context.Co
 	}
 
 	return nil
-}
\ No newline at end of file
+}
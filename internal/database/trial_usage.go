@@ -0,0 +1,81 @@
+package database
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	sq "github.com/Masterminds/squirrel"
+	"github.com/jackc/pgx/v4"
+	"github.com/jackc/pgx/v4/pgxpool"
+)
+
+type TrialUsageRepository struct {
+	pool *pgxpool.Pool
+}
+
+func NewTrialUsageRepository(pool *pgxpool.Pool) *TrialUsageRepository {
+	return &TrialUsageRepository{pool: pool}
+}
+
+// TryUse отмечает пробный период telegram-аккаунта использованным. Возвращает false, если он
+// уже был использован, поэтому два одновременных нажатия не выдадут две пробные подписки.
+func (r *TrialUsageRepository) TryUse(ctx context.Context, telegramID int64) (bool, error) {
+	query := sq.Insert("trial_usage").
+		Columns("telegram_id", "used_at").
+		Values(telegramID, sq.Expr("NOW()")).
+		Suffix("ON CONFLICT (telegram_id) DO NOTHING").
+		PlaceholderFormat(sq.Dollar)
+
+	sql, args, err := query.ToSql()
+	if err != nil {
+		return false, fmt.Errorf("failed to build trial usage insert: %w", err)
+	}
+
+	tag, err := r.pool.Exec(ctx, sql, args...)
+	if err != nil {
+		return false, fmt.Errorf("failed to insert trial usage: %w", err)
+	}
+	return tag.RowsAffected() == 1, nil
+}
+
+// IsUsed сообщает, использовал ли telegram-аккаунт пробный период
+func (r *TrialUsageRepository) IsUsed(ctx context.Context, telegramID int64) (bool, error) {
+	query := sq.Select("1").
+		From("trial_usage").
+		Where(sq.Eq{"telegram_id": telegramID}).
+		PlaceholderFormat(sq.Dollar)
+
+	sql, args, err := query.ToSql()
+	if err != nil {
+		return false, fmt.Errorf("failed to build trial usage select: %w", err)
+	}
+
+	var one int
+	err = r.pool.QueryRow(ctx, sql, args...).Scan(&one)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return false, nil
+	}
+	if err != nil {
+		return false, fmt.Errorf("failed to query trial usage: %w", err)
+	}
+	return true, nil
+}
+
+// Reset снова разрешает аккаунту пробный период. Возвращает false, если записи не было.
+func (r *TrialUsageRepository) Reset(ctx context.Context, telegramID int64) (bool, error) {
+	query := sq.Delete("trial_usage").
+		Where(sq.Eq{"telegram_id": telegramID}).
+		PlaceholderFormat(sq.Dollar)
+
+	sql, args, err := query.ToSql()
+	if err != nil {
+		return false, fmt.Errorf("failed to build trial usage delete: %w", err)
+	}
+
+	tag, err := r.pool.Exec(ctx, sql, args...)
+	if err != nil {
+		return false, fmt.Errorf("failed to delete trial usage: %w", err)
+	}
+	return tag.RowsAffected() > 0, nil
+}
@@ -0,0 +1,203 @@
+// Package deeplink разбирает параметр команды /start из ссылок вида t.me/<bot>?start=<payload>.
+//
+// Поддерживаются токены ref_<telegram id>, promo_<код>, c_<код> (или campaign_<код>)
+// и utm_<source>[_<medium>[_<campaign>]], объединённые через "-": ref_123-promo_SALE.
+// Если токены не подходят, payload читается как base64url без паддинга от строки запроса
+// r=123&p=SALE&c=spring&us=<source>&um=<medium>&uc=<campaign>: ключи короткие, потому что
+// после кодирования ссылка должна уложиться в 64 символа.
+package deeplink
+
+import (
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// MaxLength — Telegram передаёт в /start не больше 64 символов
+const MaxLength = 64
+
+var ErrInvalidPayload = errors.New("invalid start payload")
+
+var (
+	codePattern = regexp.MustCompile(`^[A-Za-z0-9_]{1,32}$`)
+	utmPattern  = regexp.MustCompile(`^[A-Za-z0-9_.]{1,64}$`)
+)
+
+// Payload — атрибуция из ссылки: кто пригласил, промокод, рекламная кампания и UTM-метки
+type Payload struct {
+	ReferrerID  int64
+	Promo       string
+	Campaign    string
+	UTMSource   string
+	UTMMedium   string
+	UTMCampaign string
+}
+
+// ValidCode подходит ли строка как код промокода или кампании: до 32 латинских букв, цифр и _
+func ValidCode(code string) bool {
+	return codePattern.MatchString(code)
+}
+
+func (p Payload) IsEmpty() bool {
+	return p == Payload{}
+}
+
+// FromCommand возвращает payload из текста "/start <payload>", пустую строку без параметра
+func FromCommand(text string) string {
+	fields := strings.Fields(text)
+	if len(fields) < 2 {
+		return ""
+	}
+	return fields[1]
+}
+
+// Parse разбирает payload. Пустой payload — не ошибка, ссылка просто без атрибуции.
+func Parse(payload string) (Payload, error) {
+	if payload == "" {
+		return Payload{}, nil
+	}
+	if len(payload) > MaxLength {
+		return Payload{}, fmt.Errorf("%w: longer than %d characters", ErrInvalidPayload, MaxLength)
+	}
+	if p, err := parseTokens(payload); err == nil {
+		return p, nil
+	}
+	if p, err := parsePacked(payload); err == nil {
+		return p, nil
+	}
+	return Payload{}, fmt.Errorf("%w: %q", ErrInvalidPayload, payload)
+}
+
+// Pack упаковывает payload в base64url, например для ссылки с промокодом и кампанией сразу
+func Pack(p Payload) string {
+	values := url.Values{}
+	if p.ReferrerID != 0 {
+		values.Set("r", strconv.FormatInt(p.ReferrerID, 10))
+	}
+	setIf(values, "p", p.Promo)
+	setIf(values, "c", p.Campaign)
+	setIf(values, "us", p.UTMSource)
+	setIf(values, "um", p.UTMMedium)
+	setIf(values, "uc", p.UTMCampaign)
+	return base64.RawURLEncoding.EncodeToString([]byte(values.Encode()))
+}
+
+func setIf(values url.Values, key, value string) {
+	if value != "" {
+		values.Set(key, value)
+	}
+}
+
+func parseTokens(payload string) (Payload, error) {
+	var p Payload
+	for _, token := range strings.Split(payload, "-") {
+		prefix, value, ok := strings.Cut(token, "_")
+		if !ok || value == "" {
+			return Payload{}, fmt.Errorf("token %q has no value", token)
+		}
+		var err error
+		switch prefix {
+		case "ref":
+			err = p.setReferrer(value)
+		case "promo":
+			err = setCode(&p.Promo, value)
+		case "c", "campaign":
+			err = setCode(&p.Campaign, value)
+		case "utm":
+			parts := strings.SplitN(value, "_", 3)
+			err = setUTM(&p.UTMSource, parts[0])
+			if err == nil && len(parts) > 1 {
+				err = setUTM(&p.UTMMedium, parts[1])
+			}
+			if err == nil && len(parts) > 2 {
+				err = setUTM(&p.UTMCampaign, parts[2])
+			}
+		default:
+			err = fmt.Errorf("unknown token %q", token)
+		}
+		if err != nil {
+			return Payload{}, err
+		}
+	}
+	return p, nil
+}
+
+func parsePacked(payload string) (Payload, error) {
+	decoded, err := base64.RawURLEncoding.DecodeString(payload)
+	if err != nil {
+		return Payload{}, err
+	}
+	values, err := url.ParseQuery(string(decoded))
+	if err != nil {
+		return Payload{}, err
+	}
+
+	var p Payload
+	for key, vals := range values {
+		if len(vals) != 1 {
+			return Payload{}, fmt.Errorf("key %q must be set once", key)
+		}
+		value := vals[0]
+		switch key {
+		case "r":
+			err = p.setReferrer(value)
+		case "p":
+			err = setCode(&p.Promo, value)
+		case "c":
+			err = setCode(&p.Campaign, value)
+		case "us":
+			err = setUTM(&p.UTMSource, value)
+		case "um":
+			err = setUTM(&p.UTMMedium, value)
+		case "uc":
+			err = setUTM(&p.UTMCampaign, value)
+		default:
+			err = fmt.Errorf("unknown key %q", key)
+		}
+		if err != nil {
+			return Payload{}, err
+		}
+	}
+	if p.IsEmpty() {
+		return Payload{}, errors.New("packed payload is empty")
+	}
+	return p, nil
+}
+
+func (p *Payload) setReferrer(value string) error {
+	if p.ReferrerID != 0 {
+		return errors.New("referrer is set twice")
+	}
+	id, err := strconv.ParseInt(value, 10, 64)
+	if err != nil || id <= 0 {
+		return fmt.Errorf("invalid referrer id %q", value)
+	}
+	p.ReferrerID = id
+	return nil
+}
+
+func setCode(field *string, value string) error {
+	if *field != "" {
+		return fmt.Errorf("code %q is set twice", value)
+	}
+	if !ValidCode(value) {
+		return fmt.Errorf("invalid code %q", value)
+	}
+	*field = value
+	return nil
+}
+
+func setUTM(field *string, value string) error {
+	if *field != "" {
+		return fmt.Errorf("utm %q is set twice", value)
+	}
+	if !utmPattern.MatchString(value) {
+		return fmt.Errorf("invalid utm value %q", value)
+	}
+	*field = value
+	return nil
+}
@@ -0,0 +1,54 @@
+package deeplink
+
+import (
+	"errors"
+	"strings"
+	"testing"
+)
+
+func TestParse(t *testing.T) {
+	tests := []struct {
+		payload string
+		want    Payload
+		wantErr bool
+	}{
+		{payload: "", want: Payload{}},
+		{payload: "ref_123456", want: Payload{ReferrerID: 123456}},
+		{payload: "promo_SALE10", want: Payload{Promo: "SALE10"}},
+		{payload: "c_spring", want: Payload{Campaign: "spring"}},
+		{payload: "campaign_spring_2025", want: Payload{Campaign: "spring_2025"}},
+		{payload: "utm_vk", want: Payload{UTMSource: "vk"}},
+		{payload: "utm_vk_cpc_black_friday", want: Payload{UTMSource: "vk", UTMMedium: "cpc", UTMCampaign: "black_friday"}},
+		{payload: "ref_42-promo_SALE-c_spring", want: Payload{ReferrerID: 42, Promo: "SALE", Campaign: "spring"}},
+		{payload: Pack(Payload{ReferrerID: 42, Promo: "SALE", UTMSource: "tg.ads", UTMCampaign: "x"}), want: Payload{ReferrerID: 42, Promo: "SALE", UTMSource: "tg.ads", UTMCampaign: "x"}},
+		{payload: "ref_", wantErr: true},
+		{payload: "ref_abc", wantErr: true},
+		{payload: "ref_-5", wantErr: true},
+		{payload: "ref_1-ref_2", wantErr: true},
+		{payload: "promo_bad!", wantErr: true},
+		{payload: "hello", wantErr: true},
+		{payload: "ref_" + strings.Repeat("1", MaxLength), wantErr: true},
+	}
+
+	for _, tt := range tests {
+		got, err := Parse(tt.payload)
+		if tt.wantErr {
+			if !errors.Is(err, ErrInvalidPayload) {
+				t.Errorf("Parse(%q) error = %v, want ErrInvalidPayload", tt.payload, err)
+			}
+			continue
+		}
+		if err != nil || got != tt.want {
+			t.Errorf("Parse(%q) = %+v, %v, want %+v", tt.payload, got, err, tt.want)
+		}
+	}
+}
+
+func TestFromCommand(t *testing.T) {
+	if got := FromCommand("/start"); got != "" {
+		t.Errorf("expected no payload, got %q", got)
+	}
+	if got := FromCommand("/start  ref_1 extra"); got != "ref_1" {
+		t.Errorf("expected ref_1, got %q", got)
+	}
+}
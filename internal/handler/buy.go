@@ -0,0 +1,288 @@
+package handler
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"strconv"
+
+	"github.com/go-telegram/bot"
+	"github.com/go-telegram/bot/models"
+
+	"remnawave-tg-shop-bot/internal/config"
+	"remnawave-tg-shop-bot/internal/database"
+	"remnawave-tg-shop-bot/utils"
+)
+
+// planTitle — название тарифа на языке клиента, без заданного названия — по длительности
+func (h Handler) planTitle(langCode string, plan config.Plan) string {
+	if title := plan.Title[langCode]; title != "" {
+		return title
+	}
+	if title := plan.Title[config.DefaultLanguage()]; title != "" {
+		return title
+	}
+	switch plan.Months {
+	case 0:
+		return fmt.Sprintf("%d %s", plan.Days, h.translation.GetText(langCode, "days_word"))
+	case 1, 3, 6, 12:
+		return h.translation.GetText(langCode, fmt.Sprintf("month_%d", plan.Months))
+	default:
+		return fmt.Sprintf("%d %s", plan.Months, h.translation.GetText(langCode, "months_word"))
+	}
+}
+
+// planPriceText — цена тарифа для кнопки: в рублях, а если он продаётся только за звёзды — в звёздах
+func planPriceText(plan config.Plan) string {
+	if price := plan.Price(config.CurrencyRUB); price > 0 {
+		return fmt.Sprintf("%d₽", price)
+	}
+	return fmt.Sprintf("%d⭐", plan.Price(config.CurrencyStars))
+}
+
+// callbackPlan находит тариф из callback data
+func callbackPlan(callbackQuery map[string]string) (config.Plan, bool) {
+	return config.FindPlan(callbackQuery["plan"])
+}
+
+// renewalParam — хвост callback data, привязывающий покупку к продлеваемой подписке
+func renewalParam(subscriptionID int64) string {
+	if subscriptionID == 0 {
+		return ""
+	}
+	return fmt.Sprintf("&subscriptionId=%d", subscriptionID)
+}
+
+// parseRenewalSubscriptionID возвращает id продлеваемой подписки или 0 для покупки без привязки
+func parseRenewalSubscriptionID(callbackQuery map[string]string) int64 {
+	id, err := strconv.ParseInt(callbackQuery["subscriptionId"], 10, 64)
+	if err != nil {
+		return 0
+	}
+	return id
+}
+
+// addSubscriptionCallback — куда ведёт кнопка добавления подписки: клиентам без подписок,
+// которые ещё не брали пробный период, предлагается он, остальным — выбор тарифа, если оплата включена
+func (h Handler) addSubscriptionCallback(ctx context.Context, telegramID int64, subscriptionsCount int) string {
+	if (subscriptionsCount == 0 && h.isTrialAvailable(ctx, telegramID)) || !isPaymentAvailable() {
+		return CallbackTrial
+	}
+	return CallbackBuy
+}
+
+// isPaymentAvailable сообщает, включён ли хотя бы один способ оплаты
+func isPaymentAvailable() bool {
+	return config.IsCryptoPayEnabled() || config.IsYookasaEnabled() || config.IsTelegramStarsEnabled() || config.GetTributePaymentUrl() != ""
+}
+
+// isInvoiceTypeEnabled сообщает, можно ли выставить счёт этим способом оплаты из бота
+func isInvoiceTypeEnabled(invoiceType database.InvoiceType) bool {
+	switch invoiceType {
+	case database.InvoiceTypeCrypto:
+		return config.IsCryptoPayEnabled()
+	case database.InvoiceTypeYookasa:
+		return config.IsYookasaEnabled()
+	case database.InvoiceTypeTelegram:
+		return config.IsTelegramStarsEnabled()
+	default:
+		return false
+	}
+}
+
+// isStarsAllowed проверяет, доступна ли клиенту оплата звёздами. При REQUIRE_PAID_PURCHASE_FOR_STARS
+// нужна хотя бы одна успешная оплата криптовалютой или картой.
+func (h Handler) isStarsAllowed(ctx context.Context, customerID int64) bool {
+	if !config.IsTelegramStarsEnabled() {
+		return false
+	}
+	if !config.RequirePaidPurchaseForStars() {
+		return true
+	}
+	paid, err := h.purchaseRepository.FindSuccessfulPaidPurchaseByCustomer(ctx, customerID)
+	if err != nil {
+		slog.Error("Error finding paid purchase", "error", err)
+		return false
+	}
+	return paid != nil
+}
+
+// BuyCallbackHandler показывает выбор тарифа. С subscriptionId тариф продлевает эту подписку.
+func (h Handler) BuyCallbackHandler(ctx context.Context, b *bot.Bot, update *models.Update) {
+	callback := update.CallbackQuery.Message.Message
+	langCode := update.CallbackQuery.From.LanguageCode
+	subscriptionID := parseRenewalSubscriptionID(parseCallbackData(update.CallbackQuery.Data))
+
+	var priceButtons []models.InlineKeyboardButton
+	for _, plan := range config.VisiblePlans() {
+		priceButtons = append(priceButtons, models.InlineKeyboardButton{
+			Text:         fmt.Sprintf("%s - %s", h.planTitle(langCode, plan), planPriceText(plan)),
+			CallbackData: fmt.Sprintf("%s?plan=%s%s", CallbackSell, plan.ID, renewalParam(subscriptionID)),
+		})
+	}
+
+	var keyboard [][]models.InlineKeyboardButton
+	for i := 0; i < len(priceButtons); i += 2 {
+		keyboard = append(keyboard, priceButtons[i:min(i+2, len(priceButtons))])
+	}
+	backData := CallbackStart
+	if subscriptionID != 0 {
+		backData = fmt.Sprintf("%s?id=%d", CallbackOpenSubscription, subscriptionID)
+	}
+	keyboard = append(keyboard, []models.InlineKeyboardButton{
+		{Text: h.translation.GetText(langCode, "back_button"), CallbackData: backData},
+	})
+
+	_, err := b.EditMessageText(ctx, &bot.EditMessageTextParams{
+		ChatID:    callback.Chat.ID,
+		MessageID: callback.ID,
+		ParseMode: models.ParseModeHTML,
+		Text:      h.translation.GetText(langCode, "pricing_info"),
+		ReplyMarkup: models.InlineKeyboardMarkup{
+			InlineKeyboard: keyboard,
+		},
+	})
+	if err != nil {
+		slog.Error("Error sending buy message", "error", err)
+	}
+}
+
+// SellCallbackHandler показывает способы оплаты для выбранного тарифа
+func (h Handler) SellCallbackHandler(ctx context.Context, b *bot.Bot, update *models.Update) {
+	callback := update.CallbackQuery.Message.Message
+	langCode := update.CallbackQuery.From.LanguageCode
+	callbackQuery := parseCallbackData(update.CallbackQuery.Data)
+
+	plan, ok := callbackPlan(callbackQuery)
+	if !ok {
+		slog.Error("Unknown plan", "data", update.CallbackQuery.Data)
+		return
+	}
+	subscriptionID := parseRenewalSubscriptionID(callbackQuery)
+	renewal := renewalParam(subscriptionID)
+	rubPrice := plan.Price(config.CurrencyRUB)
+
+	var keyboard [][]models.InlineKeyboardButton
+
+	if config.IsCryptoPayEnabled() && rubPrice > 0 {
+		keyboard = append(keyboard, []models.InlineKeyboardButton{
+			{Text: h.translation.GetText(langCode, "crypto_button"), CallbackData: fmt.Sprintf("%s?plan=%s&invoiceType=%s%s", CallbackPayment, plan.ID, database.InvoiceTypeCrypto, renewal)},
+		})
+	}
+
+	if config.IsYookasaEnabled() && rubPrice > 0 {
+		keyboard = append(keyboard, []models.InlineKeyboardButton{
+			{Text: h.translation.GetText(langCode, "card_button"), CallbackData: fmt.Sprintf("%s?plan=%s&invoiceType=%s%s", CallbackPayment, plan.ID, database.InvoiceTypeYookasa, renewal)},
+		})
+	}
+
+	if plan.Price(config.CurrencyStars) > 0 {
+		customer, err := h.customerRepository.FindByTelegramId(ctx, update.CallbackQuery.From.ID)
+		if err != nil {
+			slog.Error("Error finding customer", "error", err)
+		} else if customer != nil && h.isStarsAllowed(ctx, customer.ID) {
+			keyboard = append(keyboard, []models.InlineKeyboardButton{
+				{Text: h.translation.GetText(langCode, "stars_button"), CallbackData: fmt.Sprintf("%s?plan=%s&invoiceType=%s%s", CallbackPayment, plan.ID, database.InvoiceTypeTelegram, renewal)},
+			})
+		}
+	}
+
+	// подписка Tribute не знает, какую подписку продлевать, поэтому при продлении не предлагается
+	if config.GetTributePaymentUrl() != "" && subscriptionID == 0 && rubPrice > 0 {
+		keyboard = append(keyboard, []models.InlineKeyboardButton{
+			{Text: h.translation.GetText(langCode, "tribute_button"), URL: config.GetTributePaymentUrl()},
+		})
+	}
+
+	backData := CallbackBuy
+	if subscriptionID != 0 {
+		backData = fmt.Sprintf("%s?subscriptionId=%d", CallbackBuy, subscriptionID)
+	}
+	keyboard = append(keyboard, []models.InlineKeyboardButton{
+		{Text: h.translation.GetText(langCode, "back_button"), CallbackData: backData},
+	})
+
+	_, err := b.EditMessageReplyMarkup(ctx, &bot.EditMessageReplyMarkupParams{
+		ChatID:    callback.Chat.ID,
+		MessageID: callback.ID,
+		ReplyMarkup: models.InlineKeyboardMarkup{
+			InlineKeyboard: keyboard,
+		},
+	})
+	if err != nil {
+		slog.Error("Error sending sell message", "error", err)
+	}
+}
+
+// PaymentCallbackHandler создаёт покупку и выдаёт ссылку на оплату
+func (h Handler) PaymentCallbackHandler(ctx context.Context, b *bot.Bot, update *models.Update) {
+	callback := update.CallbackQuery.Message.Message
+	langCode := update.CallbackQuery.From.LanguageCode
+	callbackQuery := parseCallbackData(update.CallbackQuery.Data)
+
+	plan, ok := callbackPlan(callbackQuery)
+	if !ok {
+		slog.Error("Unknown plan", "data", update.CallbackQuery.Data)
+		return
+	}
+
+	invoiceType := database.InvoiceType(callbackQuery["invoiceType"])
+	if !isInvoiceTypeEnabled(invoiceType) {
+		slog.Error("Unsupported invoice type", "invoiceType", invoiceType)
+		return
+	}
+
+	customer, err := h.customerRepository.FindByTelegramId(ctx, update.CallbackQuery.From.ID)
+	if err != nil {
+		slog.Error("Error finding customer", "error", err)
+		return
+	}
+	if customer == nil {
+		slog.Error("customer not exist", "chatID", callback.Chat.ID)
+		return
+	}
+
+	price := plan.Price(config.CurrencyRUB)
+	if invoiceType == database.InvoiceTypeTelegram {
+		if !h.isStarsAllowed(ctx, customer.ID) {
+			slog.Warn("stars payment is not allowed for customer", "customerId", utils.MaskHalfInt64(customer.ID))
+			return
+		}
+		price = plan.Price(config.CurrencyStars)
+	}
+	if price <= 0 {
+		slog.Error("Price is not configured", "plan", plan.ID, "invoiceType", invoiceType)
+		return
+	}
+
+	ctxWithUsername := context.WithValue(ctx, "username", update.CallbackQuery.From.Username)
+	subscriptionID := parseRenewalSubscriptionID(callbackQuery)
+	if subscriptionID != 0 {
+		subscription, findErr := h.subscriptionRepository.GetSubscriptionByID(ctx, subscriptionID)
+		if findErr != nil || subscription == nil || subscription.CustomerID != customer.ID {
+			slog.Error("Subscription to renew not found", "subscriptionID", subscriptionID, "error", findErr)
+			return
+		}
+	}
+	paymentURL, purchaseId, err := h.paymentService.CreatePlanPurchase(ctxWithUsername, float64(price), plan, subscriptionID, customer, invoiceType)
+	if err != nil {
+		slog.Error("Error creating payment", "error", err)
+		return
+	}
+
+	message, err := b.EditMessageReplyMarkup(ctx, &bot.EditMessageReplyMarkupParams{
+		ChatID:    callback.Chat.ID,
+		MessageID: callback.ID,
+		ReplyMarkup: models.InlineKeyboardMarkup{
+			InlineKeyboard: [][]models.InlineKeyboardButton{
+				{{Text: h.translation.GetText(langCode, "pay_button"), URL: paymentURL}},
+				{{Text: h.translation.GetText(langCode, "back_button"), CallbackData: fmt.Sprintf("%s?plan=%s%s", CallbackSell, plan.ID, renewalParam(subscriptionID))}},
+			},
+		},
+	})
+	if err != nil {
+		slog.Error("Error updating sell message", "error", err)
+		return
+	}
+	h.cache.Set(purchaseId, message.ID)
+}
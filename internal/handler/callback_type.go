@@ -1,25 +1,44 @@
 package handler
 
+import "remnawave-tg-shop-bot/internal/callback"
+
 const (
-	CallbackBuy      = "buy"
+	CallbackBuy      = callback.Buy
 	CallbackSell     = "sell"
 	CallbackStart    = "start"
 	CallbackConnect  = "connect"
 	CallbackPayment  = "payment"
 	CallbackTrial    = "trial"
 	CallbackReferral = "referral"
-	
+
+	// Promo code callbacks
+	CallbackPromo      = "promo"
+	CallbackPromoApply = "promo_apply"
+
 	// Multiple subscriptions callbacks
 	CallbackMySubscriptions        = "my_subscriptions"
 	CallbackOpenSubscription       = "open_subscription"
 	CallbackDeactivateSubscription = "deactivate_subscription"
 	CallbackRenameSubscription     = "rename_subscription"
 	CallbackRenameConfirm         = "rename_confirm"
-	
+
+	// Traffic packages callbacks
+	CallbackTrafficPackages = "traffic_packages"
+	CallbackTrafficSell     = "traffic_sell"
+	CallbackTrafficPayment  = "traffic_payment"
+
+	// HWID devices callbacks
+	CallbackDevices      = "devices"
+	CallbackDeviceUnbind = "device_unbind"
+
 	// Broadcast callbacks
 	CallbackBroadcastMenu     = "broadcast_menu"
 	CallbackBroadcastToAll    = "broadcast_to_all"
 	CallbackBroadcastToAdmins = "broadcast_to_admins"
 	CallbackBroadcastConfirm  = "broadcast_confirm"
 	CallbackBroadcastCancel   = "broadcast_cancel"
+
+	// Sync callbacks
+	CallbackSyncConfirm = "sync_confirm"
+	CallbackSyncCancel  = "sync_cancel"
 )
\ No newline at end of file
@@ -0,0 +1,117 @@
+package handler
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"math"
+	"strconv"
+	"strings"
+
+	"github.com/go-telegram/bot"
+	"github.com/go-telegram/bot/models"
+
+	"remnawave-tg-shop-bot/internal/config"
+	"remnawave-tg-shop-bot/internal/database"
+	"remnawave-tg-shop-bot/internal/deeplink"
+)
+
+// campaignMessageLimit — отчёт делится на сообщения, чтобы не упереться в лимит Telegram в 4096 символов
+const campaignMessageLimit = 3500
+
+// campaignLink — ссылка, по которой клиенты попадают в кампанию
+func campaignLink(code string) string {
+	return fmt.Sprintf("%s?start=c_%s", config.BotURL(), code)
+}
+
+// CampaignAddCommandHandler создаёт рекламную кампанию: /campaign_add <code> <cost> <name>
+func (h Handler) CampaignAddCommandHandler(ctx context.Context, b *bot.Bot, update *models.Update) {
+	args := strings.Fields(update.Message.Text)
+	var text string
+	if len(args) < 4 {
+		text = "Usage: /campaign_add <code> <cost> <name>"
+	} else if code := args[1]; !deeplink.ValidCode(code) {
+		text = fmt.Sprintf("Invalid code %q: up to 32 latin letters, digits and _", code)
+	} else if cost, err := strconv.ParseFloat(args[2], 64); err != nil || cost < 0 {
+		text = fmt.Sprintf("Invalid cost %q", args[2])
+	} else {
+		campaign := &database.Campaign{Code: code, Name: strings.Join(args[3:], " "), Cost: cost}
+		err := h.campaignRepository.Create(ctx, campaign)
+		switch {
+		case errors.Is(err, database.ErrCampaignExists):
+			text = fmt.Sprintf("Campaign %q already exists", code)
+		case err != nil:
+			slog.Error("Error creating campaign", "error", err)
+			text = fmt.Sprintf("Failed to create campaign: %v", err)
+		default:
+			text = fmt.Sprintf("Campaign %q created\n%s", campaign.Name, campaignLink(code))
+		}
+	}
+
+	if _, err := b.SendMessage(ctx, &bot.SendMessageParams{ChatID: update.Message.Chat.ID, Text: text}); err != nil {
+		slog.Error("Error sending campaign message", "error", err)
+	}
+}
+
+// CampaignsCommandHandler присылает отчёт по кампаниям: /campaigns
+func (h Handler) CampaignsCommandHandler(ctx context.Context, b *bot.Bot, update *models.Update) {
+	report, err := h.campaignRepository.Report(ctx)
+	var messages []string
+	switch {
+	case err != nil:
+		slog.Error("Error building campaign report", "error", err)
+		messages = []string{fmt.Sprintf("Failed to build campaign report: %v", err)}
+	case len(report) == 0:
+		messages = []string{"No campaigns yet. Create one with /campaign_add <code> <cost> <name>"}
+	default:
+		messages = campaignReportMessages(report)
+	}
+
+	for _, text := range messages {
+		if _, err := b.SendMessage(ctx, &bot.SendMessageParams{ChatID: update.Message.Chat.ID, Text: text}); err != nil {
+			slog.Error("Error sending campaign report", "error", err)
+			return
+		}
+	}
+}
+
+func campaignReportMessages(report []database.CampaignStats) []string {
+	var messages []string
+	var sb strings.Builder
+	for _, s := range report {
+		block := campaignStatsText(s)
+		if sb.Len() > 0 && sb.Len()+len(block) > campaignMessageLimit {
+			messages = append(messages, sb.String())
+			sb.Reset()
+		}
+		if sb.Len() > 0 {
+			sb.WriteString("\n\n")
+		}
+		sb.WriteString(block)
+	}
+	return append(messages, sb.String())
+}
+
+func campaignStatsText(s database.CampaignStats) string {
+	var sb strings.Builder
+	fmt.Fprintf(&sb, "📣 %s (%s)\n%s\n", s.Name, s.Code, campaignLink(s.Code))
+	fmt.Fprintf(&sb, "Cost: %s ₽\n", formatMoney(s.Cost))
+	fmt.Fprintf(&sb, "Registrations: %d · Trials: %d · Paid: %d", s.Registrations, s.Trials, s.Paid)
+	if s.Registrations > 0 {
+		fmt.Fprintf(&sb, " (%.1f%%)", float64(s.Paid)*100/float64(s.Registrations))
+	}
+	fmt.Fprintf(&sb, "\nRevenue: %s ₽", formatMoney(s.Revenue))
+	if s.RevenueStars > 0 {
+		fmt.Fprintf(&sb, " · %s ⭐", formatMoney(s.RevenueStars))
+	}
+	if s.Paid > 0 && s.Cost > 0 {
+		fmt.Fprintf(&sb, "\nCost per paid customer: %s ₽", formatMoney(s.Cost/float64(s.Paid)))
+	}
+	return sb.String()
+}
+
+// formatMoney округляет до копеек и убирает лишние нули
+func formatMoney(amount float64) string {
+	return strconv.FormatFloat(math.Round(amount*100)/100, 'f', -1, 64)
+}
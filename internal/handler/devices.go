@@ -0,0 +1,183 @@
+package handler
+
+import (
+	"context"
+	"crypto/sha1"
+	"encoding/hex"
+	"fmt"
+	"html"
+	"log/slog"
+	"strconv"
+	"strings"
+	"time"
+
+	remapi "github.com/Jolymmiles/remnawave-api-go/v2/api"
+	"github.com/go-telegram/bot"
+	"github.com/go-telegram/bot/models"
+	"remnawave-tg-shop-bot/internal/database"
+)
+
+// devicesTimeout — сколько ждать панель при работе с устройствами
+const devicesTimeout = 5 * time.Second
+
+// deviceKey — короткий ключ устройства для callback data, HWID может не поместиться в 64 байта
+func deviceKey(hwid string) string {
+	sum := sha1.Sum([]byte(hwid))
+	return hex.EncodeToString(sum[:])[:10]
+}
+
+// deviceLabel — модель и система устройства, как их сообщил клиент
+func (h Handler) deviceLabel(langCode string, device remapi.Device) string {
+	var parts []string
+	for _, value := range []remapi.NilString{device.DeviceModel, device.Platform, device.OsVersion} {
+		if v, ok := value.Get(); ok && strings.TrimSpace(v) != "" {
+			parts = append(parts, strings.TrimSpace(v))
+		}
+	}
+	if len(parts) == 0 {
+		return h.translation.GetText(langCode, "device_unknown")
+	}
+	return strings.Join(parts, " · ")
+}
+
+// canManageDevices сообщает, показывать ли устройства подписки: у неё есть пользователь в панели
+func (h Handler) canManageDevices(sub *database.Subscription) bool {
+	return h.remnawaveClient != nil && sub.RemnawaveUUID != nil && sub.IsActive
+}
+
+// devicesSubscription находит подписку из callback, если она принадлежит клиенту
+func (h Handler) devicesSubscription(ctx context.Context, update *models.Update) *database.Subscription {
+	subID, err := strconv.ParseInt(parseCallbackData(update.CallbackQuery.Data)["id"], 10, 64)
+	if err != nil {
+		slog.Error("Error parsing subscription id", "data", update.CallbackQuery.Data)
+		return nil
+	}
+	customer, err := h.customerRepository.FindByTelegramId(ctx, update.CallbackQuery.From.ID)
+	if err != nil || customer == nil {
+		slog.Error("Customer not found", "error", err)
+		return nil
+	}
+	sub, err := h.subscriptionRepository.GetSubscriptionByID(ctx, subID)
+	if err != nil || sub == nil || sub.CustomerID != customer.ID {
+		slog.Error("Subscription not found", "subscriptionID", subID, "error", err)
+		return nil
+	}
+	if !h.canManageDevices(sub) {
+		return nil
+	}
+	return sub
+}
+
+// DevicesCallbackHandler показывает устройства, привязанные к подписке
+func (h Handler) DevicesCallbackHandler(ctx context.Context, b *bot.Bot, update *models.Update) {
+	sub := h.devicesSubscription(ctx, update)
+	if sub == nil {
+		return
+	}
+	h.renderDevices(ctx, b, update, sub)
+}
+
+// DeviceUnbindCallbackHandler отвязывает устройство от подписки и обновляет список
+func (h Handler) DeviceUnbindCallbackHandler(ctx context.Context, b *bot.Bot, update *models.Update) {
+	langCode := update.CallbackQuery.From.LanguageCode
+	sub := h.devicesSubscription(ctx, update)
+	if sub == nil {
+		return
+	}
+	key := parseCallbackData(update.CallbackQuery.Data)["device"]
+
+	panelCtx, cancel := context.WithTimeout(ctx, devicesTimeout)
+	defer cancel()
+	devices, err := h.remnawaveClient.GetUserDevices(panelCtx, *sub.RemnawaveUUID)
+	if err != nil {
+		slog.Error("Error getting user devices", "subscription_id", sub.ID, "error", err)
+		h.answerDevices(ctx, b, update, h.translation.GetText(langCode, "devices_failed"))
+		return
+	}
+	for _, device := range devices {
+		if deviceKey(device.Hwid) != key {
+			continue
+		}
+		if err := h.remnawaveClient.DeleteUserDevice(panelCtx, *sub.RemnawaveUUID, device.Hwid); err != nil {
+			slog.Error("Error deleting user device", "subscription_id", sub.ID, "error", err)
+			h.answerDevices(ctx, b, update, h.translation.GetText(langCode, "devices_failed"))
+			return
+		}
+		h.answerDevices(ctx, b, update, h.translation.GetText(langCode, "device_unbound"))
+		break
+	}
+	// устройство могли отвязать раньше, тогда просто показываем актуальный список
+	h.renderDevices(ctx, b, update, sub)
+}
+
+func (h Handler) answerDevices(ctx context.Context, b *bot.Bot, update *models.Update, text string) {
+	_, err := b.AnswerCallbackQuery(ctx, &bot.AnswerCallbackQueryParams{
+		CallbackQueryID: update.CallbackQuery.ID,
+		Text:            text,
+	})
+	if err != nil {
+		slog.Error("Error answering devices callback", "error", err)
+	}
+}
+
+func (h Handler) renderDevices(ctx context.Context, b *bot.Bot, update *models.Update, sub *database.Subscription) {
+	callback := update.CallbackQuery.Message.Message
+	langCode := update.CallbackQuery.From.LanguageCode
+	back := []models.InlineKeyboardButton{
+		{Text: h.translation.GetText(langCode, "back_button"), CallbackData: fmt.Sprintf("%s?id=%d", CallbackOpenSubscription, sub.ID)},
+	}
+
+	panelCtx, cancel := context.WithTimeout(ctx, devicesTimeout)
+	defer cancel()
+	devices, err := h.remnawaveClient.GetUserDevices(panelCtx, *sub.RemnawaveUUID)
+	if err != nil {
+		slog.Error("Error getting user devices", "subscription_id", sub.ID, "error", err)
+		_, err = b.EditMessageText(ctx, &bot.EditMessageTextParams{
+			ChatID:      callback.Chat.ID,
+			MessageID:   callback.ID,
+			Text:        h.translation.GetText(langCode, "devices_failed"),
+			ReplyMarkup: models.InlineKeyboardMarkup{InlineKeyboard: [][]models.InlineKeyboardButton{back}},
+		})
+		if err != nil {
+			slog.Error("Error sending devices message", "error", err)
+		}
+		return
+	}
+
+	count := strconv.Itoa(len(devices))
+	if user, err := h.remnawaveClient.GetUserByUUID(panelCtx, *sub.RemnawaveUUID); err != nil {
+		slog.Error("Error getting user device limit", "subscription_id", sub.ID, "error", err)
+	} else if user != nil {
+		if limit, ok := user.HwidDeviceLimit.Get(); ok && limit > 0 {
+			count = fmt.Sprintf("%d / %d", len(devices), limit)
+		}
+	}
+
+	text := fmt.Sprintf(h.translation.GetText(langCode, "devices_info"), html.EscapeString(sub.Name), count) + "\n\n"
+	if len(devices) == 0 {
+		text += h.translation.GetText(langCode, "devices_empty")
+	}
+	var keyboard [][]models.InlineKeyboardButton
+	for i, device := range devices {
+		label := h.deviceLabel(langCode, device)
+		text += fmt.Sprintf("%d. %s — %s\n", i+1, html.EscapeString(label), device.CreatedAt.Format("02.01.2006"))
+		keyboard = append(keyboard, []models.InlineKeyboardButton{{
+			Text:         fmt.Sprintf(h.translation.GetText(langCode, "device_unbind_button"), i+1, label),
+			CallbackData: fmt.Sprintf("%s?id=%d&device=%s", CallbackDeviceUnbind, sub.ID, deviceKey(device.Hwid)),
+		}})
+	}
+	keyboard = append(keyboard, back)
+
+	_, err = b.EditMessageText(ctx, &bot.EditMessageTextParams{
+		ChatID:    callback.Chat.ID,
+		MessageID: callback.ID,
+		ParseMode: models.ParseModeHTML,
+		Text:      text,
+		ReplyMarkup: models.InlineKeyboardMarkup{
+			InlineKeyboard: keyboard,
+		},
+	})
+	if err != nil {
+		slog.Error("Error sending devices message", "error", err)
+	}
+}
@@ -1,9 +1,17 @@
 package handler
 
 import (
+	gosync "sync"
+	"sync/atomic"
+
 	"remnawave-tg-shop-bot/internal/cache"
 	"remnawave-tg-shop-bot/internal/cryptopay"
 	"remnawave-tg-shop-bot/internal/database"
+	"remnawave-tg-shop-bot/internal/payment"
+	"remnawave-tg-shop-bot/internal/promo"
+	"remnawave-tg-shop-bot/internal/referral"
+	"remnawave-tg-shop-bot/internal/remnawave"
+	"remnawave-tg-shop-bot/internal/scheduler"
 	"remnawave-tg-shop-bot/internal/sync"
 	"remnawave-tg-shop-bot/internal/translation"
 	"remnawave-tg-shop-bot/internal/yookasa"
@@ -16,14 +24,28 @@ type Handler struct {
 	cryptoPayClient        *cryptopay.Client
 	yookasaClient          *yookasa.Client
 	translation            *translation.Manager
+	paymentService         *payment.PaymentService
 	syncService            *sync.SyncService
 	referralRepository     *database.ReferralRepository
+	trialUsageRepository   *database.TrialUsageRepository
 	cache                  *cache.Cache
+	usage                  *remnawave.UsageCache
+	remnawaveClient        *remnawave.Client
+	referralRewards        *database.ReferralRewardRepository
+	referralService        *referral.Service
+	campaignRepository     *database.CampaignRepository
+	promoRepository        *database.PromoRepository
+	promoService           *promo.Service
+	jobs                   *scheduler.Scheduler
+	// reportedSyncDeletes — отпечаток удалений из последнего отчёта, отправленного по расписанию
+	reportedSyncDeletes *atomic.Value
+	// pendingPromos — чаты, от которых ждём промокод текстом
+	pendingPromos *gosync.Map
 }
 
 func NewHandler(
 	syncService *sync.SyncService,
-	_ interface{},
+	paymentService *payment.PaymentService,
 	translation *translation.Manager,
 	customerRepository *database.CustomerRepository,
 	purchaseRepository *database.PurchaseRepository,
@@ -31,9 +53,19 @@ func NewHandler(
 	cryptoPayClient *cryptopay.Client,
 	yookasaClient *yookasa.Client,
 	referralRepository *database.ReferralRepository,
-	cache *cache.Cache) *Handler {
+	trialUsageRepository *database.TrialUsageRepository,
+	cache *cache.Cache,
+	usage *remnawave.UsageCache,
+	remnawaveClient *remnawave.Client,
+	referralRewards *database.ReferralRewardRepository,
+	referralService *referral.Service,
+	campaignRepository *database.CampaignRepository,
+	promoRepository *database.PromoRepository,
+	promoService *promo.Service,
+	jobs *scheduler.Scheduler) *Handler {
 	return &Handler{
 		syncService:            syncService,
+		paymentService:         paymentService,
 		customerRepository:     customerRepository,
 		purchaseRepository:     purchaseRepository,
 		subscriptionRepository: subscriptionRepository,
@@ -41,6 +73,17 @@ func NewHandler(
 		yookasaClient:          yookasaClient,
 		translation:            translation,
 		referralRepository:     referralRepository,
+		trialUsageRepository:   trialUsageRepository,
 		cache:                  cache,
+		usage:                  usage,
+		remnawaveClient:        remnawaveClient,
+		referralRewards:        referralRewards,
+		referralService:        referralService,
+		campaignRepository:     campaignRepository,
+		promoRepository:        promoRepository,
+		promoService:           promoService,
+		jobs:                   jobs,
+		reportedSyncDeletes:    &atomic.Value{},
+		pendingPromos:          &gosync.Map{},
 	}
 }
@@ -0,0 +1,44 @@
+package handler
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"strings"
+	"time"
+
+	"github.com/go-telegram/bot"
+	"github.com/go-telegram/bot/models"
+)
+
+// JobsCommandHandler показывает состояние фоновых задач: последний запуск, его длительность,
+// ошибку и время следующего запуска
+func (h Handler) JobsCommandHandler(ctx context.Context, b *bot.Bot, update *models.Update) {
+	var sb strings.Builder
+	statuses := h.jobs.Status()
+	if len(statuses) == 0 {
+		sb.WriteString("No scheduled jobs")
+	}
+	for _, status := range statuses {
+		sb.WriteString(fmt.Sprintf("%s (%s)\n", status.Name, status.Spec))
+		switch {
+		case status.Running:
+			sb.WriteString("running now\n")
+		case status.LastRun.IsZero():
+			sb.WriteString("not run yet\n")
+		default:
+			sb.WriteString(fmt.Sprintf("last run: %s, %s\n", status.LastRun.Format("02.01.2006 15:04:05"), status.LastDuration.Round(time.Millisecond)))
+		}
+		if status.LastError != nil {
+			sb.WriteString(fmt.Sprintf("error: %v\n", status.LastError))
+		}
+		if !status.NextRun.IsZero() {
+			sb.WriteString(fmt.Sprintf("next run: %s\n", status.NextRun.Format("02.01.2006 15:04:05")))
+		}
+		sb.WriteString("\n")
+	}
+
+	if _, err := b.SendMessage(ctx, &bot.SendMessageParams{ChatID: update.Message.Chat.ID, Text: sb.String()}); err != nil {
+		slog.Error("Error sending jobs message", "error", err)
+	}
+}
@@ -13,6 +13,9 @@ import (
 	"remnawave-tg-shop-bot/utils"
 )
 
+// CreateCustomerIfNotExistMiddleware создаёт клиента при первом обращении. Источник клиента
+// здесь не сохраняется: Telegram передаёт параметр ссылки только с командой /start, а её
+// обрабатывает StartCommandHandler без этого middleware.
 func (h Handler) CreateCustomerIfNotExistMiddleware(next bot.HandlerFunc) bot.HandlerFunc {
 	return func(ctx context.Context, b *bot.Bot, update *models.Update) {
 		var telegramId int64
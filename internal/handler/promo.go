@@ -0,0 +1,245 @@
+package handler
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"html"
+	"log/slog"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-telegram/bot"
+	"github.com/go-telegram/bot/models"
+
+	"remnawave-tg-shop-bot/internal/config"
+	"remnawave-tg-shop-bot/internal/database"
+	"remnawave-tg-shop-bot/internal/promo"
+)
+
+// PromoCallbackHandler просит прислать промокод сообщением
+func (h Handler) PromoCallbackHandler(ctx context.Context, b *bot.Bot, update *models.Update) {
+	callback := update.CallbackQuery.Message.Message
+	langCode := update.CallbackQuery.From.LanguageCode
+	h.pendingPromos.Store(callback.Chat.ID, true)
+	_, err := b.EditMessageText(ctx, &bot.EditMessageTextParams{
+		ChatID:    callback.Chat.ID,
+		MessageID: callback.ID,
+		ParseMode: models.ParseModeHTML,
+		Text:      h.translation.GetText(langCode, "promo_enter"),
+		ReplyMarkup: models.InlineKeyboardMarkup{InlineKeyboard: [][]models.InlineKeyboardButton{
+			{{Text: h.translation.GetText(langCode, "back_button"), CallbackData: CallbackStart}},
+		}},
+	})
+	if err != nil {
+		slog.Error("Error sending promo prompt", "error", err)
+	}
+}
+
+// PromoCommandHandler погашает промокод: /promo <code>. Без кода просит прислать его сообщением.
+func (h Handler) PromoCommandHandler(ctx context.Context, b *bot.Bot, update *models.Update) {
+	chatID := update.Message.Chat.ID
+	langCode := update.Message.From.LanguageCode
+	args := strings.Fields(update.Message.Text)
+	if len(args) < 2 {
+		h.pendingPromos.Store(chatID, true)
+		h.sendPromoMessage(ctx, b, chatID, 0, langCode, h.translation.GetText(langCode, "promo_enter"), nil)
+		return
+	}
+	h.redeemPromo(ctx, b, chatID, update.Message.From.ID, langCode, args[1])
+}
+
+// handlePromoText принимает промокод, если его ждали от этого чата
+func (h Handler) handlePromoText(ctx context.Context, b *bot.Bot, update *models.Update) bool {
+	chatID := update.Message.Chat.ID
+	if _, ok := h.pendingPromos.LoadAndDelete(chatID); !ok {
+		return false
+	}
+	h.redeemPromo(ctx, b, chatID, update.Message.From.ID, update.Message.From.LanguageCode, update.Message.Text)
+	return true
+}
+
+// redeemPromo проверяет код и погашает его: скидка ждёт ближайшего счёта, дни и трафик
+// добавляются к подписке, а если подписок несколько — предлагается выбрать
+func (h Handler) redeemPromo(ctx context.Context, b *bot.Bot, chatID int64, telegramID int64, langCode string, code string) {
+	customer, err := h.customerRepository.FindByTelegramId(ctx, telegramID)
+	if err != nil || customer == nil {
+		slog.Error("Customer not found", "error", err)
+		return
+	}
+	promoCode, err := h.promoService.Check(ctx, customer, code)
+	if err != nil {
+		h.sendPromoMessage(ctx, b, chatID, 0, langCode, h.promoErrorText(langCode, err), nil)
+		return
+	}
+
+	if promoCode.Kind.IsDiscount() {
+		if err := h.promoService.ActivateDiscount(ctx, customer, promoCode); err != nil {
+			h.sendPromoMessage(ctx, b, chatID, 0, langCode, h.promoErrorText(langCode, err), nil)
+			return
+		}
+		var keyboard [][]models.InlineKeyboardButton
+		if isPaymentAvailable() {
+			keyboard = append(keyboard, []models.InlineKeyboardButton{{Text: h.translation.GetText(langCode, "buy_button"), CallbackData: CallbackBuy}})
+		}
+		text := fmt.Sprintf(h.translation.GetText(langCode, "promo_discount_activated"), promoDiscountText(promoCode))
+		if plan, ok := config.FindPlan(promoCode.PlanID); ok {
+			text += "\n" + fmt.Sprintf(h.translation.GetText(langCode, "promo_plan_only"), html.EscapeString(h.planTitle(langCode, plan)))
+		}
+		h.sendPromoMessage(ctx, b, chatID, 0, langCode, text, keyboard)
+		return
+	}
+
+	subs, err := h.promoSubscriptions(ctx, customer.ID)
+	if err != nil {
+		slog.Error("Error finding subscriptions", "error", err)
+		h.sendPromoMessage(ctx, b, chatID, 0, langCode, h.translation.GetText(langCode, "promo_failed"), nil)
+		return
+	}
+	switch len(subs) {
+	case 0:
+		var keyboard [][]models.InlineKeyboardButton
+		if isPaymentAvailable() {
+			keyboard = append(keyboard, []models.InlineKeyboardButton{{Text: h.translation.GetText(langCode, "buy_button"), CallbackData: CallbackBuy}})
+		}
+		h.sendPromoMessage(ctx, b, chatID, 0, langCode, h.translation.GetText(langCode, "promo_no_subscription"), keyboard)
+	case 1:
+		h.applyPromo(ctx, b, chatID, 0, langCode, customer, promoCode, &subs[0])
+	default:
+		var keyboard [][]models.InlineKeyboardButton
+		for _, sub := range subs {
+			keyboard = append(keyboard, []models.InlineKeyboardButton{
+				{Text: "📦 " + sub.Name, CallbackData: fmt.Sprintf("%s?code=%s&id=%d", CallbackPromoApply, promoCode.Code, sub.ID)},
+			})
+		}
+		h.sendPromoMessage(ctx, b, chatID, 0, langCode, h.translation.GetText(langCode, "promo_choose_subscription"), keyboard)
+	}
+}
+
+// PromoApplyCallbackHandler погашает промокод на подписку, выбранную из списка
+func (h Handler) PromoApplyCallbackHandler(ctx context.Context, b *bot.Bot, update *models.Update) {
+	callback := update.CallbackQuery.Message.Message
+	langCode := update.CallbackQuery.From.LanguageCode
+	q := parseCallbackData(update.CallbackQuery.Data)
+	subID, err := strconv.ParseInt(q["id"], 10, 64)
+	if err != nil {
+		slog.Error("Error parsing subscription id", "data", update.CallbackQuery.Data)
+		return
+	}
+	customer, err := h.customerRepository.FindByTelegramId(ctx, update.CallbackQuery.From.ID)
+	if err != nil || customer == nil {
+		slog.Error("Customer not found", "error", err)
+		return
+	}
+	promoCode, err := h.promoService.Check(ctx, customer, q["code"])
+	if err != nil {
+		h.sendPromoMessage(ctx, b, callback.Chat.ID, callback.ID, langCode, h.promoErrorText(langCode, err), nil)
+		return
+	}
+	sub, err := h.subscriptionRepository.GetSubscriptionByID(ctx, subID)
+	if err != nil || sub == nil || sub.CustomerID != customer.ID {
+		slog.Error("Subscription not found", "subscriptionID", subID, "error", err)
+		return
+	}
+	h.applyPromo(ctx, b, callback.Chat.ID, callback.ID, langCode, customer, promoCode, sub)
+}
+
+func (h Handler) applyPromo(ctx context.Context, b *bot.Bot, chatID int64, messageID int, langCode string, customer *database.Customer, promoCode *database.PromoCode, sub *database.Subscription) {
+	if err := h.promoService.ApplyToSubscription(ctx, customer, promoCode, sub); err != nil {
+		slog.Error("Error applying promo code", "code", promoCode.Code, "subscriptionID", sub.ID, "error", err)
+		h.sendPromoMessage(ctx, b, chatID, messageID, langCode, h.promoErrorText(langCode, err), nil)
+		return
+	}
+	key := "promo_days_applied"
+	if promoCode.Kind == database.PromoKindTraffic {
+		key = "promo_traffic_applied"
+	}
+	text := fmt.Sprintf(h.translation.GetText(langCode, key), promoCode.Value, html.EscapeString(sub.Name))
+	keyboard := [][]models.InlineKeyboardButton{
+		{{Text: h.translation.GetText(langCode, "my_subscriptions_button"), CallbackData: fmt.Sprintf("%s?id=%d", CallbackOpenSubscription, sub.ID)}},
+	}
+	h.sendPromoMessage(ctx, b, chatID, messageID, langCode, text, keyboard)
+}
+
+// promoSubscriptions — действующие подписки клиента с пользователем в панели
+func (h Handler) promoSubscriptions(ctx context.Context, customerID int64) ([]database.Subscription, error) {
+	active, err := h.subscriptionRepository.GetActiveSubscriptions(ctx, customerID)
+	if err != nil {
+		return nil, err
+	}
+	var subs []database.Subscription
+	for _, sub := range active {
+		if sub.RemnawaveUUID != nil && sub.ExpireAt.After(time.Now()) {
+			subs = append(subs, sub)
+		}
+	}
+	return subs, nil
+}
+
+func promoDiscountText(promoCode *database.PromoCode) string {
+	if promoCode.Kind == database.PromoKindPercent {
+		return fmt.Sprintf("−%d%%", promoCode.Value)
+	}
+	return fmt.Sprintf("−%d ₽", promoCode.Value)
+}
+
+func (h Handler) promoErrorText(langCode string, err error) string {
+	switch {
+	case errors.Is(err, promo.ErrNotFound):
+		return h.translation.GetText(langCode, "promo_not_found")
+	case errors.Is(err, promo.ErrExpired):
+		return h.translation.GetText(langCode, "promo_expired")
+	case errors.Is(err, database.ErrPromoExhausted):
+		return h.translation.GetText(langCode, "promo_exhausted")
+	case errors.Is(err, database.ErrPromoUserLimit):
+		return h.translation.GetText(langCode, "promo_already_used")
+	case errors.Is(err, promo.ErrDiscountActive):
+		return h.translation.GetText(langCode, "promo_discount_active")
+	case errors.Is(err, promo.ErrNoSubscription):
+		return h.translation.GetText(langCode, "promo_no_subscription")
+	case errors.Is(err, promo.ErrSubscriptionInvalid):
+		return h.translation.GetText(langCode, "promo_subscription_invalid")
+	default:
+		return h.translation.GetText(langCode, "promo_failed")
+	}
+}
+
+// sendPromoMessage редактирует сообщение с кнопками или, если его нет, отправляет новое
+func (h Handler) sendPromoMessage(ctx context.Context, b *bot.Bot, chatID int64, messageID int, langCode string, text string, keyboard [][]models.InlineKeyboardButton) {
+	keyboard = append(keyboard, []models.InlineKeyboardButton{{Text: h.translation.GetText(langCode, "back_button"), CallbackData: CallbackStart}})
+	markup := models.InlineKeyboardMarkup{InlineKeyboard: keyboard}
+	var err error
+	if messageID != 0 {
+		_, err = b.EditMessageText(ctx, &bot.EditMessageTextParams{ChatID: chatID, MessageID: messageID, ParseMode: models.ParseModeHTML, Text: text, ReplyMarkup: markup})
+	} else {
+		_, err = b.SendMessage(ctx, &bot.SendMessageParams{ChatID: chatID, ParseMode: models.ParseModeHTML, Text: text, ReplyMarkup: markup})
+	}
+	if err != nil {
+		slog.Error("Error sending promo message", "error", err)
+	}
+}
+
+// PromoAddCommandHandler создаёт промокод: /promo_add <code> days=7|percent=10|amount=100|traffic=5
+// [uses=N] [per_user=N] [expires=YYYY-MM-DD] [plan=<id>]
+func (h Handler) PromoAddCommandHandler(ctx context.Context, b *bot.Bot, update *models.Update) {
+	args := strings.Fields(update.Message.Text)
+	var text string
+	promoCode, err := promo.ParseSpec(args[1:])
+	if err != nil {
+		text = fmt.Sprintf("%v\nUsage: /promo_add <code> days=7|percent=10|amount=100|traffic=5 [uses=N] [per_user=N] [expires=YYYY-MM-DD] [plan=<id>]", err)
+	} else if _, ok := config.FindPlan(promoCode.PlanID); promoCode.PlanID != "" && !ok {
+		text = fmt.Sprintf("Unknown plan %q", promoCode.PlanID)
+	} else if err := h.promoRepository.Create(ctx, promoCode); errors.Is(err, database.ErrPromoExists) {
+		text = fmt.Sprintf("Promo code %s already exists", promoCode.Code)
+	} else if err != nil {
+		slog.Error("Error creating promo code", "error", err)
+		text = fmt.Sprintf("Failed to create promo code: %v", err)
+	} else {
+		text = fmt.Sprintf("Promo code %s created: %s %d\n/promo %s\n%s?start=promo_%s", promoCode.Code, promoCode.Kind, promoCode.Value, promoCode.Code, config.BotURL(), promoCode.Code)
+	}
+
+	if _, err := b.SendMessage(ctx, &bot.SendMessageParams{ChatID: update.Message.Chat.ID, Text: text}); err != nil {
+		slog.Error("Error sending promo message", "error", err)
+	}
+}
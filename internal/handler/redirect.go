@@ -38,7 +38,7 @@ func (h Handler) afterSubscriptionCreated(ctx context.Context, b *bot.Bot, chatI
 		keyboard = append(keyboard, row)
 	}
 	msg += "└────────────────────────────────────┘\n\n"
-	keyboard = append(keyboard, []models.InlineKeyboardButton{{ Text: h.translation.GetText(lang, "add_subscription_button"), CallbackData: CallbackTrial }})
+	keyboard = append(keyboard, []models.InlineKeyboardButton{{ Text: h.translation.GetText(lang, "add_subscription_button"), CallbackData: h.addSubscriptionCallback(ctx, customer.TelegramID, len(subs)) }})
 	keyboard = append(keyboard, []models.InlineKeyboardButton{{ Text: h.translation.GetText(lang, "back_button"), CallbackData: CallbackStart }})
 
 	_, _ = b.EditMessageText(ctx, &bot.EditMessageTextParams{ ChatID: chatID, MessageID: messageID, ParseMode: models.ParseModeHTML, Text: msg, ReplyMarkup: models.InlineKeyboardMarkup{ InlineKeyboard: keyboard } })
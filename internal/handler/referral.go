@@ -3,16 +3,34 @@ package handler
 import (
 	"context"
 	"fmt"
+	"strconv"
+	"strings"
 
 	"github.com/go-telegram/bot"
 	"github.com/go-telegram/bot/models"
 	"log/slog"
+
+	"remnawave-tg-shop-bot/internal/config"
+	"remnawave-tg-shop-bot/internal/database"
+	"remnawave-tg-shop-bot/internal/referral"
+	"remnawave-tg-shop-bot/utils"
 )
 
+// referralPageSize — сколько приглашённых показывать на одной странице
+const referralPageSize = 10
+
+// ReferralCallbackHandler показывает статистику реферальной программы и постраничный список
+// приглашённых: referral?page=N
 func (h Handler) ReferralCallbackHandler(ctx context.Context, b *bot.Bot, update *models.Update) {
-	customer, _ := h.customerRepository.FindByTelegramId(ctx, update.CallbackQuery.From.ID)
+	customer, err := h.customerRepository.FindByTelegramId(ctx, update.CallbackQuery.From.ID)
+	if err != nil || customer == nil {
+		slog.Error("customer not found", "error", err)
+		return
+	}
 	langCode := update.CallbackQuery.From.LanguageCode
 	refCode := customer.TelegramID
+	page, _ := strconv.Atoi(parseCallbackData(update.CallbackQuery.Data)["page"])
+	page = max(page, 0)
 
 	refLink := fmt.Sprintf("https://telegram.me/share/url?url=https://t.me/%s?start=ref_%d", update.CallbackQuery.Message.Message.From.Username, refCode)
 	count, err := h.referralRepository.CountByReferrer(ctx, customer.TelegramID)
@@ -20,23 +38,118 @@ func (h Handler) ReferralCallbackHandler(ctx context.Context, b *bot.Bot, update
 		slog.Error("error counting referrals", "error", err)
 		return
 	}
-	text := fmt.Sprintf(h.translation.GetText(langCode, "referral_text"), count)
+	text, err := h.referralStatsText(ctx, customer, langCode, count)
+	if err != nil {
+		slog.Error("error building referral stats", "error", err)
+		return
+	}
+	referees, err := h.referralRepository.FindByReferrer(ctx, customer.TelegramID, referralPageSize, page*referralPageSize)
+	if err != nil {
+		slog.Error("error finding referrals", "error", err)
+		return
+	}
+	text += referralListText(h.translation.GetText(langCode, "referral_list_title"), referees)
+
+	var keyboard [][]models.InlineKeyboardButton
+	var nav []models.InlineKeyboardButton
+	if page > 0 {
+		nav = append(nav, models.InlineKeyboardButton{Text: h.translation.GetText(langCode, "prev_page_button"), CallbackData: fmt.Sprintf("%s?page=%d", CallbackReferral, page-1)})
+	}
+	if (page+1)*referralPageSize < count {
+		nav = append(nav, models.InlineKeyboardButton{Text: h.translation.GetText(langCode, "next_page_button"), CallbackData: fmt.Sprintf("%s?page=%d", CallbackReferral, page+1)})
+	}
+	if len(nav) > 0 {
+		keyboard = append(keyboard, nav)
+	}
+	keyboard = append(keyboard,
+		[]models.InlineKeyboardButton{{Text: h.translation.GetText(langCode, "share_referral_button"), URL: refLink}},
+		[]models.InlineKeyboardButton{{Text: h.translation.GetText(langCode, "back_button"), CallbackData: CallbackStart}},
+	)
+
 	callbackMessage := update.CallbackQuery.Message.Message
 	_, err = b.EditMessageText(ctx, &bot.EditMessageTextParams{
-		ChatID:    callbackMessage.Chat.ID,
-		MessageID: callbackMessage.ID,
-		Text:      text,
-		ParseMode: models.ParseModeHTML,
-		ReplyMarkup: models.InlineKeyboardMarkup{InlineKeyboard: [][]models.InlineKeyboardButton{
-			{
-				{Text: h.translation.GetText(langCode, "share_referral_button"), URL: refLink},
-			},
-			{
-				{Text: h.translation.GetText(langCode, "back_button"), CallbackData: CallbackStart},
-			},
-		}},
+		ChatID:      callbackMessage.Chat.ID,
+		MessageID:   callbackMessage.ID,
+		Text:        text,
+		ParseMode:   models.ParseModeHTML,
+		ReplyMarkup: models.InlineKeyboardMarkup{InlineKeyboard: keyboard},
 	})
 	if err != nil {
 		slog.Error("Error sending referral message", "error", err)
 	}
 }
+
+// referralStatsText — приглашённые, оплатившие, награды и правила программы
+func (h Handler) referralStatsText(ctx context.Context, customer *database.Customer, langCode string, count int) (string, error) {
+	referrerID := customer.TelegramID
+	converted, err := h.referralRepository.CountConverted(ctx, referrerID)
+	if err != nil {
+		return "", err
+	}
+	totals, err := h.referralRewards.Totals(ctx, referrerID)
+	if err != nil {
+		return "", err
+	}
+
+	var sb strings.Builder
+	sb.WriteString(fmt.Sprintf(h.translation.GetText(langCode, "referral_text"), count))
+	sb.WriteString("\n" + fmt.Sprintf(h.translation.GetText(langCode, "referral_converted"), converted))
+	if config.ReferralMaxLevel() >= 2 {
+		second, err := h.referralRepository.CountSecondLevel(ctx, referrerID)
+		if err != nil {
+			return "", err
+		}
+		sb.WriteString("\n" + fmt.Sprintf(h.translation.GetText(langCode, "referral_second_level"), second))
+	}
+
+	earned := h.rewardTotalsText(langCode, totals, database.ReferralRewardStatusGranted)
+	sb.WriteString("\n\n" + fmt.Sprintf(h.translation.GetText(langCode, "referral_rewards_earned"), earned))
+	if pending := h.rewardTotalsText(langCode, totals, database.ReferralRewardStatusPending); pending != "—" {
+		sb.WriteString("\n" + fmt.Sprintf(h.translation.GetText(langCode, "referral_rewards_pending"), pending))
+	}
+	balance, err := h.referralRewards.Balance(ctx, referrerID, customer.ID)
+	if err != nil {
+		return "", err
+	}
+	if balance > 0 {
+		sb.WriteString("\n" + fmt.Sprintf(h.translation.GetText(langCode, "referral_balance"), referral.FormatAmount(balance)))
+	}
+
+	if rules := config.ReferralRules(); len(rules) > 0 {
+		sb.WriteString("\n\n" + h.translation.GetText(langCode, "referral_rules_title"))
+		for _, rule := range rules {
+			sb.WriteString("\n• " + referral.FormatRule(h.translation, langCode, rule))
+		}
+	}
+	return sb.String(), nil
+}
+
+func (h Handler) rewardTotalsText(langCode string, totals []database.ReferralRewardTotal, status database.ReferralRewardStatus) string {
+	var parts []string
+	for _, total := range totals {
+		if total.Status == status && total.Amount > 0 {
+			parts = append(parts, referral.FormatReward(h.translation, langCode, total.Kind, total.Amount))
+		}
+	}
+	if len(parts) == 0 {
+		return "—"
+	}
+	return strings.Join(parts, ", ")
+}
+
+// referralListText — страница приглашённых с замаскированными id: ✅ оплатил, ⏳ ещё нет
+func referralListText(title string, referees []database.Referral) string {
+	if len(referees) == 0 {
+		return ""
+	}
+	var sb strings.Builder
+	sb.WriteString("\n\n" + title)
+	for _, ref := range referees {
+		mark := "⏳"
+		if ref.Converted {
+			mark = "✅"
+		}
+		sb.WriteString(fmt.Sprintf("\n%s %s — %s", mark, utils.MaskHalfInt64(ref.RefereeID), ref.UsedAt.Format("02.01.2006")))
+	}
+	return sb.String()
+}
@@ -0,0 +1,89 @@
+package handler
+
+import (
+	"context"
+	"log/slog"
+
+	"github.com/go-telegram/bot"
+	"github.com/go-telegram/bot/models"
+
+	"remnawave-tg-shop-bot/internal/database"
+	"remnawave-tg-shop-bot/internal/payment"
+	"remnawave-tg-shop-bot/utils"
+)
+
+// PreCheckoutQueryHandler подтверждает оплату звёздами, только если счёт соответствует
+// ожидающей покупке этого клиента
+func (h Handler) PreCheckoutQueryHandler(ctx context.Context, b *bot.Bot, update *models.Update) {
+	query := update.PreCheckoutQuery
+	langCode := query.From.LanguageCode
+
+	purchase := h.findStarsPurchase(ctx, query.From.ID, query.InvoicePayload, query.Currency, query.TotalAmount)
+	ok := purchase != nil && purchase.Status == database.PurchaseStatusPending
+
+	params := &bot.AnswerPreCheckoutQueryParams{PreCheckoutQueryID: query.ID, OK: ok}
+	if !ok {
+		params.ErrorMessage = h.translation.GetText(langCode, "invoice_expired")
+	}
+	if _, err := b.AnswerPreCheckoutQuery(ctx, params); err != nil {
+		slog.Error("Error answering pre checkout query", "error", err)
+	}
+}
+
+// SuccessfulPaymentHandler завершает покупку после списания звёзд
+func (h Handler) SuccessfulPaymentHandler(ctx context.Context, b *bot.Bot, update *models.Update) {
+	successfulPayment := update.Message.SuccessfulPayment
+
+	purchase := h.findStarsPurchase(ctx, update.Message.From.ID, successfulPayment.InvoicePayload, successfulPayment.Currency, successfulPayment.TotalAmount)
+	if purchase == nil {
+		slog.Error("Stars payment does not match any purchase", "payload", successfulPayment.InvoicePayload, "chargeId", successfulPayment.TelegramPaymentChargeID)
+		return
+	}
+	purchaseId := purchase.ID
+
+	// звёзды уже списаны: сохраняем списание, чтобы покупку дообработала фоновая задача,
+	// если обработка ниже не удастся
+	err := h.purchaseRepository.UpdateFields(ctx, purchaseId, map[string]interface{}{
+		"telegram_payment_charge_id": successfulPayment.TelegramPaymentChargeID,
+	})
+	if err != nil {
+		slog.Error("Error saving stars charge", "error", err, "purchase_id", utils.MaskHalfInt64(purchaseId), "chargeId", successfulPayment.TelegramPaymentChargeID)
+	}
+
+	ctxWithUsername := context.WithValue(ctx, "username", update.Message.From.Username)
+	if err := h.paymentService.ProcessPurchaseById(ctxWithUsername, purchaseId); err != nil {
+		slog.Error("Error processing stars purchase", "error", err, "purchase_id", utils.MaskHalfInt64(purchaseId), "chargeId", successfulPayment.TelegramPaymentChargeID)
+	}
+}
+
+// findStarsPurchase возвращает покупку из payload счёта, если она принадлежит этому клиенту
+// и сумма в звёздах совпадает, иначе nil
+func (h Handler) findStarsPurchase(ctx context.Context, telegramID int64, invoicePayload string, currency string, totalAmount int) *database.Purchase {
+	purchaseId, err := payment.ParseStarsInvoicePayload(invoicePayload)
+	if err != nil {
+		slog.Error("Error parsing stars invoice payload", "error", err)
+		return nil
+	}
+
+	purchase, err := h.purchaseRepository.FindById(ctx, purchaseId)
+	if err != nil {
+		slog.Error("Error finding purchase", "error", err)
+		return nil
+	}
+	if purchase == nil || purchase.InvoiceType != database.InvoiceTypeTelegram {
+		return nil
+	}
+	if currency != payment.StarsCurrency || totalAmount != int(purchase.Amount) {
+		return nil
+	}
+
+	customer, err := h.customerRepository.FindByTelegramId(ctx, telegramID)
+	if err != nil {
+		slog.Error("Error finding customer", "error", err)
+		return nil
+	}
+	if customer == nil || customer.ID != purchase.CustomerID {
+		return nil
+	}
+	return purchase
+}
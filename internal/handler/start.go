@@ -2,8 +2,6 @@ package handler
 
 import (
 	"context"
-	"strconv"
-	"strings"
 	"time"
 
 	"github.com/go-telegram/bot"
@@ -12,6 +10,7 @@ import (
 
 	"remnawave-tg-shop-bot/internal/config"
 	"remnawave-tg-shop-bot/internal/database"
+	"remnawave-tg-shop-bot/internal/deeplink"
 	"remnawave-tg-shop-bot/utils"
 )
 
@@ -19,6 +18,11 @@ func (h Handler) StartCommandHandler(ctx context.Context, b *bot.Bot, update *mo
 	ctxWithTime, cancel := context.WithTimeout(ctx, 5*time.Second)
 	defer cancel()
 	langCode := update.Message.From.LanguageCode
+	h.pendingPromos.Delete(update.Message.Chat.ID)
+	payload, err := deeplink.Parse(deeplink.FromCommand(update.Message.Text))
+	if err != nil {
+		slog.Warn("ignoring start payload", "error", err)
+	}
 	existingCustomer, err := h.customerRepository.FindByTelegramId(ctx, update.Message.Chat.ID)
 	if err != nil {
 		slog.Error("error finding customer by telegram id", "error", err)
@@ -34,27 +38,6 @@ func (h Handler) StartCommandHandler(ctx context.Context, b *bot.Bot, update *mo
 			slog.Error("error creating customer", "error", err)
 			return
 		}
-
-		if strings.Contains(update.Message.Text, "ref_") {
-			arg := strings.Split(update.Message.Text, " ")[1]
-			if strings.HasPrefix(arg, "ref_") {
-				code := strings.TrimPrefix(arg, "ref_")
-				referrerId, err := strconv.ParseInt(code, 10, 64)
-				if err != nil {
-					slog.Error("error parsing referrer id", "error", err)
-					return
-				}
-				_, err = h.customerRepository.FindByTelegramId(ctx, referrerId)
-				if err == nil {
-					_, err := h.referralRepository.Create(ctx, referrerId, existingCustomer.TelegramID)
-					if err != nil {
-						slog.Error("error creating referral", "error", err)
-						return
-					}
-					slog.Info("referral created", "referrerId", utils.MaskHalfInt64(referrerId), "refereeId", utils.MaskHalfInt64(existingCustomer.TelegramID))
-				}
-			}
-		}
 	} else {
 		updates := map[string]interface{}{
 			"language": langCode,
@@ -63,9 +46,11 @@ func (h Handler) StartCommandHandler(ctx context.Context, b *bot.Bot, update *mo
 		err = h.customerRepository.UpdateFields(ctx, existingCustomer.ID, updates)
 		if err != nil {
 			slog.Error("Error updating customer", "error", err)
-			return
 		}
 	}
+	if !payload.IsEmpty() {
+		h.applyAttribution(ctxWithTime, existingCustomer, payload)
+	}
 
 	inlineKeyboard := h.buildStartKeyboard(existingCustomer, langCode)
 
@@ -103,6 +88,52 @@ func (h Handler) StartCommandHandler(ctx context.Context, b *bot.Bot, update *mo
 	if err != nil {
 		slog.Error("Error sending /start message", "error", err)
 	}
+
+	// промокод из ссылки погашается так же, как введённый через /promo
+	if payload.Promo != "" {
+		h.redeemPromo(ctx, b, update.Message.Chat.ID, update.Message.From.ID, langCode, payload.Promo)
+	}
+}
+
+// applyAttribution сохраняет источник клиента из ссылки /start и создаёт реферала. Уже сохранённые
+// кампания и метки не перезаписываются. Ошибки только логируются: приветствие отправляется в любом случае.
+func (h Handler) applyAttribution(ctx context.Context, customer *database.Customer, payload deeplink.Payload) {
+	attribution := database.CustomerAttribution{
+		Campaign:    h.knownCampaign(ctx, payload.Campaign),
+		Promo:       payload.Promo,
+		UTMSource:   payload.UTMSource,
+		UTMMedium:   payload.UTMMedium,
+		UTMCampaign: payload.UTMCampaign,
+	}
+	if payload.ReferrerID != 0 {
+		_, err := h.referralService.Attach(ctx, customer, payload.ReferrerID)
+		if err != nil {
+			slog.Info("referral not created", "referrerId", utils.MaskHalfInt64(payload.ReferrerID), "refereeId", utils.MaskHalfInt64(customer.TelegramID), "reason", err)
+		} else {
+			slog.Info("referral created", "referrerId", utils.MaskHalfInt64(payload.ReferrerID), "refereeId", utils.MaskHalfInt64(customer.TelegramID))
+			attribution.ReferrerID = &payload.ReferrerID
+		}
+	}
+	if err := h.customerRepository.SetAttribution(ctx, customer.ID, attribution); err != nil {
+		slog.Error("error saving customer attribution", "error", err)
+	}
+}
+
+// knownCampaign возвращает код кампании, если она создана через /campaign_add
+func (h Handler) knownCampaign(ctx context.Context, code string) string {
+	if code == "" {
+		return ""
+	}
+	campaign, err := h.campaignRepository.FindByCode(ctx, code)
+	if err != nil {
+		slog.Error("error finding campaign", "error", err)
+		return ""
+	}
+	if campaign == nil {
+		slog.Warn("unknown campaign in start link", "code", code)
+		return ""
+	}
+	return campaign.Code
 }
 
 func (h Handler) StartCallbackHandler(ctx context.Context, b *bot.Bot, update *models.Update) {
@@ -111,6 +142,8 @@ func (h Handler) StartCallbackHandler(ctx context.Context, b *bot.Bot, update *m
 
 	callback := update.CallbackQuery
 	langCode := callback.From.LanguageCode
+	// возврат в меню отменяет ожидание промокода
+	h.pendingPromos.Delete(callback.Message.Message.Chat.ID)
 
 	existingCustomer, err := h.customerRepository.FindByTelegramId(ctxWithTime, callback.From.ID)
 	if err != nil {
@@ -178,21 +211,32 @@ func (h Handler) buildStartKeyboard(existingCustomer *database.Customer, langCod
 	if activeSubscriptionsCount > 0 {
 		// Для пользователей с активными подписками - кнопка добавления
 		inlineKeyboard = append(inlineKeyboard, []models.InlineKeyboardButton{
-			{Text: h.translation.GetText(langCode, "add_subscription_button"), CallbackData: CallbackTrial},
+			{Text: h.translation.GetText(langCode, "add_subscription_button"), CallbackData: h.addSubscriptionCallback(context.Background(), existingCustomer.TelegramID, activeSubscriptionsCount)},
 		})
-	} else {
+	} else if h.isTrialAvailable(context.Background(), existingCustomer.TelegramID) || !isPaymentAvailable() {
 		// Для новых пользователей - кнопка получения бесплатной подписки
 		inlineKeyboard = append(inlineKeyboard, []models.InlineKeyboardButton{
 			{Text: h.translation.GetText(langCode, "trial_button"), CallbackData: CallbackTrial},
 		})
 	}
 
-	if config.GetReferralDays() > 0 {
+	// у клиентов с подписками к выбору тарифа уже ведёт кнопка добавления
+	if isPaymentAvailable() && activeSubscriptionsCount == 0 {
+		inlineKeyboard = append(inlineKeyboard, []models.InlineKeyboardButton{
+			{Text: h.translation.GetText(langCode, "buy_button"), CallbackData: CallbackBuy},
+		})
+	}
+
+	if config.ReferralEnabled() {
 		inlineKeyboard = append(inlineKeyboard, []models.InlineKeyboardButton{
 			{Text: h.translation.GetText(langCode, "referral_button"), CallbackData: CallbackReferral},
 		})
 	}
 
+	inlineKeyboard = append(inlineKeyboard, []models.InlineKeyboardButton{
+		{Text: h.translation.GetText(langCode, "promo_button"), CallbackData: CallbackPromo},
+	})
+
 	if config.ServerStatusURL() != "" {
 		inlineKeyboard = append(inlineKeyboard, []models.InlineKeyboardButton{
 			{Text: h.translation.GetText(langCode, "server_status_button"), URL: config.ServerStatusURL()},
@@ -46,7 +46,7 @@ func (h Handler) MySubscriptionsCallbackHandler(ctx context.Context, b *bot.Bot,
 			{ Text: label, CallbackData: fmt.Sprintf("%s?id=%d", CallbackOpenSubscription, sub.ID) },
 		})
 	}
-	keyboard = append(keyboard, []models.InlineKeyboardButton{{ Text: h.translation.GetText(langCode, "add_subscription_button"), CallbackData: CallbackTrial }})
+	keyboard = append(keyboard, []models.InlineKeyboardButton{{ Text: h.translation.GetText(langCode, "add_subscription_button"), CallbackData: h.addSubscriptionCallback(ctx, customer.TelegramID, len(activeSubscriptions)) }})
 	keyboard = append(keyboard, []models.InlineKeyboardButton{{ Text: h.translation.GetText(langCode, "back_button"), CallbackData: CallbackStart }})
 
 	_, err = b.EditMessageText(ctx, &bot.EditMessageTextParams{ ChatID: chatID, MessageID: callback.ID, ParseMode: models.ParseModeHTML, ReplyMarkup: models.InlineKeyboardMarkup{ InlineKeyboard: keyboard }, Text: messageText })
@@ -68,10 +68,23 @@ func (h Handler) OpenSubscriptionCallbackHandler(ctx context.Context, b *bot.Bot
 	status := "✅ Активна"
 	if subscription.ExpireAt.Before(time.Now()) { status = "❌ Истекла" } else if subscription.ExpireAt.Before(time.Now().Add(24*time.Hour)) { status = "⚠️ Истекает" }
 	messageText := fmt.Sprintf("<b>%s</b>\n📅 %s\n%s", subscription.Name, subscription.ExpireAt.Format("02.01.2006 15:04"), status)
+	usage := h.subscriptionUsage(ctx, subscription)
+	if usage != nil {
+		messageText += "\n\n" + h.usageText(langCode, *usage)
+	}
 
 	var keyboard [][]models.InlineKeyboardButton
 	keyboard = append(keyboard, []models.InlineKeyboardButton{{ Text: fmt.Sprintf("📱 %s", subscription.Name), URL: subscription.SubscriptionLink }})
 	keyboard = append(keyboard, []models.InlineKeyboardButton{{ Text: "✏️ Переименовать", CallbackData: fmt.Sprintf("%s?id=%d", CallbackRenameSubscription, subscription.ID) }})
+	if isPaymentAvailable() {
+		keyboard = append(keyboard, []models.InlineKeyboardButton{{ Text: h.translation.GetText(langCode, "renew_subscription_button"), CallbackData: fmt.Sprintf("%s?subscriptionId=%d", CallbackBuy, subscription.ID) }})
+	}
+	if canBuyTraffic(subscription, usage) {
+		keyboard = append(keyboard, []models.InlineKeyboardButton{{ Text: h.translation.GetText(langCode, "traffic_buy_button"), CallbackData: fmt.Sprintf("%s?id=%d", CallbackTrafficPackages, subscription.ID) }})
+	}
+	if h.canManageDevices(subscription) {
+		keyboard = append(keyboard, []models.InlineKeyboardButton{{ Text: h.translation.GetText(langCode, "devices_button"), CallbackData: fmt.Sprintf("%s?id=%d", CallbackDevices, subscription.ID) }})
+	}
 	if subscription.ExpireAt.After(time.Now()) {
 		keyboard = append(keyboard, []models.InlineKeyboardButton{{ Text: fmt.Sprintf("🗑 %s", h.translation.GetText(langCode, "deactivate_button")), CallbackData: fmt.Sprintf("%s?id=%d", CallbackDeactivateSubscription, subscription.ID) }})
 	}
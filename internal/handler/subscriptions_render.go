@@ -19,6 +19,7 @@ func (h Handler) renderMySubscriptionsForChat(ctx context.Context, b *bot.Bot, c
 
 	msg := "📋 <b>Ваши подписки:</b>\n\n"
 	msg += "┌────────────────────────────────────┐\n"
+	usages := h.subscriptionsUsage(ctx, subs)
 	var keyboard [][]models.InlineKeyboardButton
 	for i, sub := range subs {
 		status := "✅"; statusText := "Активна"
@@ -27,6 +28,7 @@ func (h Handler) renderMySubscriptionsForChat(ctx context.Context, b *bot.Bot, c
 		msg += fmt.Sprintf("│ %s <b>%s</b>\n", status, sub.Name)
 		msg += fmt.Sprintf("│ 📅 %s\n", sub.ExpireAt.Format("02.01.2006 15:04"))
 		msg += fmt.Sprintf("│ 🟢 %s\n", statusText)
+		if usage, ok := usages[sub.ID]; ok { msg += "│ " + h.trafficLine(langCode, usage) + "\n" }
 		if i < len(subs)-1 { msg += "├────────────────────────────────────┤\n" }
 		row := []models.InlineKeyboardButton{{ Text: fmt.Sprintf("🔗 %s", sub.Name), URL: sub.SubscriptionLink }}
 		if sub.ExpireAt.After(time.Now()) {
@@ -36,7 +38,7 @@ func (h Handler) renderMySubscriptionsForChat(ctx context.Context, b *bot.Bot, c
 		keyboard = append(keyboard, row)
 	}
 	msg += "└────────────────────────────────────┘\n\n"
-	keyboard = append(keyboard, []models.InlineKeyboardButton{{ Text: h.translation.GetText(langCode, "add_subscription_button"), CallbackData: CallbackTrial }})
+	keyboard = append(keyboard, []models.InlineKeyboardButton{{ Text: h.translation.GetText(langCode, "add_subscription_button"), CallbackData: h.addSubscriptionCallback(ctx, customer.TelegramID, len(subs)) }})
 	keyboard = append(keyboard, []models.InlineKeyboardButton{{ Text: h.translation.GetText(langCode, "back_button"), CallbackData: CallbackStart }})
 
 	if messageID > 0 {
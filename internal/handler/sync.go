@@ -2,19 +2,184 @@ package handler
 
 import (
 	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"slices"
+	"strconv"
+	"strings"
 
 	"github.com/go-telegram/bot"
 	"github.com/go-telegram/bot/models"
 	"log/slog"
+	"remnawave-tg-shop-bot/internal/config"
+	"remnawave-tg-shop-bot/internal/sync"
 )
 
 func (h Handler) SyncUsersCommandHandler(ctx context.Context, b *bot.Bot, update *models.Update) {
-	h.syncService.Sync()
-	_, err := b.SendMessage(ctx, &bot.SendMessageParams{
-		ChatID: update.Message.Chat.ID,
-		Text:   "Users synced",
+	report, err := h.syncService.Sync(ctx, sync.Options{})
+	h.sendSyncReport(ctx, b, update.Message.Chat.ID, report, err)
+}
+
+// SyncDryRunCommandHandler показывает, что изменит синхронизация, ничего не записывая
+func (h Handler) SyncDryRunCommandHandler(ctx context.Context, b *bot.Bot, update *models.Update) {
+	report, err := h.syncService.Sync(ctx, sync.Options{DryRun: true})
+	h.sendSyncReport(ctx, b, update.Message.Chat.ID, report, err)
+}
+
+// SyncConfirmCallbackHandler повторяет синхронизацию с разрешением удалить столько записей,
+// сколько админ видел в отчёте. Если с тех пор удалений стало больше, нужно новое подтверждение.
+func (h Handler) SyncConfirmCallbackHandler(ctx context.Context, b *bot.Bot, update *models.Update) {
+	callback := update.CallbackQuery
+	deletes, err := strconv.Atoi(parseCallbackData(callback.Data)["deletes"])
+	if err != nil {
+		slog.Error("Error parsing sync confirmation", "data", callback.Data, "error", err)
+		return
+	}
+
+	_, err = b.AnswerCallbackQuery(ctx, &bot.AnswerCallbackQueryParams{CallbackQueryID: callback.ID})
+	if err != nil {
+		slog.Error("Error answering callback query", "error", err)
+	}
+	h.removeSyncButtons(ctx, b, callback)
+
+	report, err := h.syncService.Sync(ctx, sync.Options{ConfirmedDeletes: deletes})
+	h.sendSyncReport(ctx, b, callback.Message.Message.Chat.ID, report, err)
+}
+
+func (h Handler) SyncCancelCallbackHandler(ctx context.Context, b *bot.Bot, update *models.Update) {
+	callback := update.CallbackQuery
+	_, err := b.AnswerCallbackQuery(ctx, &bot.AnswerCallbackQueryParams{
+		CallbackQueryID: callback.ID,
+		Text:            "Deletions cancelled",
 	})
 	if err != nil {
+		slog.Error("Error answering callback query", "error", err)
+	}
+	h.removeSyncButtons(ctx, b, callback)
+}
+
+// ScheduledSync запускает синхронизацию по расписанию. Если удаления ждут подтверждения,
+// админ получает отчёт с кнопкой подтверждения — один раз на каждый новый набор удалений.
+func (h Handler) ScheduledSync(ctx context.Context, b *bot.Bot) error {
+	report, err := h.syncService.Sync(ctx, sync.Options{})
+	if err != nil {
+		return err
+	}
+	if !report.DeletesPending {
+		h.reportedSyncDeletes.Store("")
+		return nil
+	}
+	digest := syncDeletesDigest(report)
+	if h.reportedSyncDeletes.Swap(digest) == digest {
+		slog.Info("sync deletions still pending, admin already notified", "deletes", report.Deletes())
+		return nil
+	}
+	h.sendSyncReport(ctx, b, config.GetAdminTelegramId(), report, nil)
+	return nil
+}
+
+// syncDeletesDigest — отпечаток набора удалений, ожидающих подтверждения
+func syncDeletesDigest(report sync.Report) string {
+	customers := slices.Sorted(slices.Values(report.CustomersDeleted))
+	subscriptions := slices.Sorted(slices.Values(report.SubscriptionsDeactivated))
+	sum := sha256.Sum256([]byte(fmt.Sprint(customers, subscriptions)))
+	return hex.EncodeToString(sum[:])
+}
+
+func (h Handler) sendSyncReport(ctx context.Context, b *bot.Bot, chatID int64, report sync.Report, syncErr error) {
+	if syncErr != nil {
+		slog.Error("Error while syncing users", "error", syncErr)
+	}
+
+	params := &bot.SendMessageParams{
+		ChatID: chatID,
+		Text:   syncReportText(report, syncErr),
+	}
+	if report.DeletesPending && !report.DryRun && syncErr == nil {
+		params.ReplyMarkup = models.InlineKeyboardMarkup{
+			InlineKeyboard: [][]models.InlineKeyboardButton{
+				{
+					{Text: fmt.Sprintf("✅ Confirm %d deletions", report.Deletes()), CallbackData: fmt.Sprintf("%s?deletes=%d", CallbackSyncConfirm, report.Deletes())},
+					{Text: "❌ Cancel", CallbackData: CallbackSyncCancel},
+				},
+			},
+		}
+	}
+	if _, err := b.SendMessage(ctx, params); err != nil {
 		slog.Error("Error sending sync message", "error", err)
 	}
+
+	// списки telegram id и подписок могут быть длинными, поэтому отправляются файлом
+	if details := syncReportDetails(report); details != "" && (report.DryRun || report.DeletesPending) {
+		_, err := b.SendDocument(ctx, &bot.SendDocumentParams{
+			ChatID:   chatID,
+			Document: &models.InputFileUpload{Filename: "sync_diff.txt", Data: strings.NewReader(details)},
+		})
+		if err != nil {
+			slog.Error("Error sending sync diff", "error", err)
+		}
+	}
+}
+
+func (h Handler) removeSyncButtons(ctx context.Context, b *bot.Bot, callback *models.CallbackQuery) {
+	if callback.Message.Message == nil {
+		return
+	}
+	_, err := b.EditMessageReplyMarkup(ctx, &bot.EditMessageReplyMarkupParams{
+		ChatID:    callback.Message.Message.Chat.ID,
+		MessageID: callback.Message.Message.ID,
+	})
+	if err != nil {
+		slog.Error("Error removing sync buttons", "error", err)
+	}
+}
+
+func syncReportText(report sync.Report, syncErr error) string {
+	var sb strings.Builder
+	switch {
+	case syncErr != nil:
+		sb.WriteString(fmt.Sprintf("Sync failed: %v\n", syncErr))
+	case report.DryRun:
+		sb.WriteString("Sync dry run, nothing was changed\n")
+	default:
+		sb.WriteString("Users synced\n")
+	}
+
+	deleteMode := "deleted"
+	if report.SoftDelete {
+		deleteMode = "soft deleted"
+	}
+	sb.WriteString(fmt.Sprintf("\nCustomers created: %d\nCustomers updated: %d\nCustomers %s: %d\n",
+		len(report.CustomersCreated), report.CustomersUpdated, deleteMode, len(report.CustomersDeleted)))
+	sb.WriteString(fmt.Sprintf("\nSubscriptions created: %d\nSubscriptions updated: %d\nSubscriptions deactivated: %d\n",
+		report.Subscriptions.Created, report.Subscriptions.Updated, report.Subscriptions.Deactivated))
+
+	if report.DeletesPending {
+		sb.WriteString(fmt.Sprintf("\n⚠️ %d deletions exceed SYNC_DELETE_THRESHOLD (%d)", report.Deletes(), config.SyncDeleteThreshold()))
+		if !report.DryRun {
+			sb.WriteString(" and were skipped. Check the list and confirm them")
+		}
+		sb.WriteString("\n")
+	}
+	return sb.String()
+}
+
+func syncReportDetails(report sync.Report) string {
+	var sb strings.Builder
+	writeIDs := func(title string, ids []int64) {
+		if len(ids) == 0 {
+			return
+		}
+		sb.WriteString(fmt.Sprintf("%s (%d):\n", title, len(ids)))
+		for _, id := range ids {
+			sb.WriteString(strconv.FormatInt(id, 10))
+			sb.WriteString("\n")
+		}
+		sb.WriteString("\n")
+	}
+	writeIDs("Customers to delete, telegram id", report.CustomersDeleted)
+	writeIDs("Subscriptions to deactivate, id", report.SubscriptionsDeactivated)
+	writeIDs("Customers to create, telegram id", report.CustomersCreated)
+	return sb.String()
 }
@@ -17,7 +17,7 @@ func (h Handler) TextMessageHandler(ctx context.Context, b *bot.Bot, update *mod
 
 	// Если нет ожидания — выходим
 	subID, ok := pendingRenames[chatID]
-	if !ok { return }
+	if !ok { h.handlePromoText(ctx, b, update); return }
 
 	// Валидация
 	if len(newName) < 1 || len(newName) > 50 { 
@@ -0,0 +1,279 @@
+package handler
+
+import (
+	"context"
+	"fmt"
+	"html"
+	"log/slog"
+	"strconv"
+	"time"
+
+	"github.com/go-telegram/bot"
+	"github.com/go-telegram/bot/models"
+	"github.com/google/uuid"
+	"remnawave-tg-shop-bot/internal/config"
+	"remnawave-tg-shop-bot/internal/database"
+	"remnawave-tg-shop-bot/internal/remnawave"
+	"remnawave-tg-shop-bot/utils"
+)
+
+// usageTimeout — сколько ждать панель при показе трафика, чтобы карточка не зависала
+const usageTimeout = 3 * time.Second
+
+// subscriptionUsage возвращает трафик подписки или nil, если его не удалось получить
+func (h Handler) subscriptionUsage(ctx context.Context, sub *database.Subscription) *remnawave.Usage {
+	if h.usage == nil || sub.RemnawaveUUID == nil {
+		return nil
+	}
+	ctx, cancel := context.WithTimeout(ctx, usageTimeout)
+	defer cancel()
+
+	usage, err := h.usage.Get(ctx, *sub.RemnawaveUUID)
+	if err != nil {
+		slog.Error("Error getting subscription usage", "subscription_id", sub.ID, "error", err)
+		return nil
+	}
+	return usage
+}
+
+// subscriptionsUsage возвращает трафик нескольких подписок по их id
+func (h Handler) subscriptionsUsage(ctx context.Context, subs []database.Subscription) map[int64]remnawave.Usage {
+	result := make(map[int64]remnawave.Usage, len(subs))
+	if h.usage == nil {
+		return result
+	}
+	ctx, cancel := context.WithTimeout(ctx, usageTimeout)
+	defer cancel()
+
+	uuids := make([]uuid.UUID, 0, len(subs))
+	for _, sub := range subs {
+		if sub.RemnawaveUUID != nil {
+			uuids = append(uuids, *sub.RemnawaveUUID)
+		}
+	}
+	usages := h.usage.GetMany(ctx, uuids)
+	for _, sub := range subs {
+		if sub.RemnawaveUUID == nil {
+			continue
+		}
+		if usage, ok := usages[*sub.RemnawaveUUID]; ok {
+			result[sub.ID] = usage
+		}
+	}
+	return result
+}
+
+// trafficLine — "📊 Трафик: 1.25 GB / 50.00 GB"
+func (h Handler) trafficLine(langCode string, usage remnawave.Usage) string {
+	limit := h.translation.GetText(langCode, "traffic_unlimited")
+	if usage.LimitBytes > 0 {
+		limit = utils.FormatBytes(usage.LimitBytes)
+	}
+	return fmt.Sprintf(h.translation.GetText(langCode, "traffic_usage"), utils.FormatBytes(usage.UsedBytes), limit)
+}
+
+// usageText — трафик с полосой заполненности и статус подключения для карточки подписки
+func (h Handler) usageText(langCode string, usage remnawave.Usage) string {
+	text := h.trafficLine(langCode, usage) + "\n"
+	if usage.LimitBytes > 0 {
+		percent := min(usage.UsedBytes*100/usage.LimitBytes, 100)
+		text += fmt.Sprintf("%s %d%%\n", utils.ProgressBar(usage.UsedBytes, usage.LimitBytes, 10), percent)
+	}
+
+	switch {
+	case usage.Online:
+		text += h.translation.GetText(langCode, "user_online")
+	case usage.LastOnlineAt != nil:
+		text += fmt.Sprintf(h.translation.GetText(langCode, "user_last_online"), usage.LastOnlineAt.Format("02.01.2006 15:04"))
+	default:
+		text += h.translation.GetText(langCode, "user_never_connected")
+	}
+	return text
+}
+
+// canBuyTraffic сообщает, предлагать ли докупить трафик к подписке: пакеты настроены, есть способ
+// оплаты из бота, подписка действует и у её пользователя ограниченный трафик
+func canBuyTraffic(sub *database.Subscription, usage *remnawave.Usage) bool {
+	if len(config.TrafficPackages()) == 0 || sub.RemnawaveUUID == nil || !sub.IsActive || !sub.ExpireAt.After(time.Now()) {
+		return false
+	}
+	if !config.IsCryptoPayEnabled() && !config.IsYookasaEnabled() && !config.IsTelegramStarsEnabled() {
+		return false
+	}
+	return usage == nil || usage.LimitBytes > 0
+}
+
+// trafficSubscription находит клиента и подписку из callback, если подписка принадлежит клиенту
+// и к ней можно докупить трафик
+func (h Handler) trafficSubscription(ctx context.Context, update *models.Update) (*database.Customer, *database.Subscription) {
+	subID, err := strconv.ParseInt(parseCallbackData(update.CallbackQuery.Data)["id"], 10, 64)
+	if err != nil {
+		slog.Error("Error parsing subscription id", "data", update.CallbackQuery.Data)
+		return nil, nil
+	}
+	customer, err := h.customerRepository.FindByTelegramId(ctx, update.CallbackQuery.From.ID)
+	if err != nil || customer == nil {
+		slog.Error("Customer not found", "error", err)
+		return nil, nil
+	}
+	sub, err := h.subscriptionRepository.GetSubscriptionByID(ctx, subID)
+	if err != nil || sub == nil || sub.CustomerID != customer.ID {
+		slog.Error("Subscription not found", "subscriptionID", subID, "error", err)
+		return nil, nil
+	}
+	if !canBuyTraffic(sub, nil) {
+		return nil, nil
+	}
+	return customer, sub
+}
+
+// TrafficPackagesCallbackHandler показывает пакеты трафика для подписки
+func (h Handler) TrafficPackagesCallbackHandler(ctx context.Context, b *bot.Bot, update *models.Update) {
+	callback := update.CallbackQuery.Message.Message
+	langCode := update.CallbackQuery.From.LanguageCode
+	_, sub := h.trafficSubscription(ctx, update)
+	if sub == nil {
+		return
+	}
+
+	var packageButtons []models.InlineKeyboardButton
+	for _, p := range config.TrafficPackages() {
+		packageButtons = append(packageButtons, models.InlineKeyboardButton{
+			Text:         fmt.Sprintf("%s - %d₽", fmt.Sprintf(h.translation.GetText(langCode, "traffic_package"), p.GB), p.Price),
+			CallbackData: fmt.Sprintf("%s?id=%d&gb=%d", CallbackTrafficSell, sub.ID, p.GB),
+		})
+	}
+
+	var keyboard [][]models.InlineKeyboardButton
+	for i := 0; i < len(packageButtons); i += 2 {
+		keyboard = append(keyboard, packageButtons[i:min(i+2, len(packageButtons))])
+	}
+	keyboard = append(keyboard, []models.InlineKeyboardButton{
+		{Text: h.translation.GetText(langCode, "back_button"), CallbackData: fmt.Sprintf("%s?id=%d", CallbackOpenSubscription, sub.ID)},
+	})
+
+	_, err := b.EditMessageText(ctx, &bot.EditMessageTextParams{
+		ChatID:    callback.Chat.ID,
+		MessageID: callback.ID,
+		ParseMode: models.ParseModeHTML,
+		Text:      fmt.Sprintf(h.translation.GetText(langCode, "traffic_packages_info"), html.EscapeString(sub.Name)),
+		ReplyMarkup: models.InlineKeyboardMarkup{
+			InlineKeyboard: keyboard,
+		},
+	})
+	if err != nil {
+		slog.Error("Error sending traffic packages message", "error", err)
+	}
+}
+
+// TrafficSellCallbackHandler показывает способы оплаты выбранного пакета трафика
+func (h Handler) TrafficSellCallbackHandler(ctx context.Context, b *bot.Bot, update *models.Update) {
+	callback := update.CallbackQuery.Message.Message
+	langCode := update.CallbackQuery.From.LanguageCode
+	customer, sub := h.trafficSubscription(ctx, update)
+	if sub == nil {
+		return
+	}
+	gb, err := strconv.Atoi(parseCallbackData(update.CallbackQuery.Data)["gb"])
+	if err != nil {
+		slog.Error("Error parsing traffic package", "data", update.CallbackQuery.Data)
+		return
+	}
+	p, ok := config.FindTrafficPackage(gb)
+	if !ok {
+		slog.Error("Unknown traffic package", "gb", gb)
+		return
+	}
+
+	paymentData := func(invoiceType database.InvoiceType) string {
+		return fmt.Sprintf("%s?id=%d&gb=%d&invoiceType=%s", CallbackTrafficPayment, sub.ID, p.GB, invoiceType)
+	}
+	var keyboard [][]models.InlineKeyboardButton
+	if config.IsCryptoPayEnabled() {
+		keyboard = append(keyboard, []models.InlineKeyboardButton{
+			{Text: h.translation.GetText(langCode, "crypto_button"), CallbackData: paymentData(database.InvoiceTypeCrypto)},
+		})
+	}
+	if config.IsYookasaEnabled() {
+		keyboard = append(keyboard, []models.InlineKeyboardButton{
+			{Text: h.translation.GetText(langCode, "card_button"), CallbackData: paymentData(database.InvoiceTypeYookasa)},
+		})
+	}
+	if h.isStarsAllowed(ctx, customer.ID) {
+		keyboard = append(keyboard, []models.InlineKeyboardButton{
+			{Text: h.translation.GetText(langCode, "stars_button"), CallbackData: paymentData(database.InvoiceTypeTelegram)},
+		})
+	}
+	keyboard = append(keyboard, []models.InlineKeyboardButton{
+		{Text: h.translation.GetText(langCode, "back_button"), CallbackData: fmt.Sprintf("%s?id=%d", CallbackTrafficPackages, sub.ID)},
+	})
+
+	_, err = b.EditMessageReplyMarkup(ctx, &bot.EditMessageReplyMarkupParams{
+		ChatID:    callback.Chat.ID,
+		MessageID: callback.ID,
+		ReplyMarkup: models.InlineKeyboardMarkup{
+			InlineKeyboard: keyboard,
+		},
+	})
+	if err != nil {
+		slog.Error("Error sending traffic sell message", "error", err)
+	}
+}
+
+// TrafficPaymentCallbackHandler создаёт покупку пакета трафика и выдаёт ссылку на оплату
+func (h Handler) TrafficPaymentCallbackHandler(ctx context.Context, b *bot.Bot, update *models.Update) {
+	callback := update.CallbackQuery.Message.Message
+	langCode := update.CallbackQuery.From.LanguageCode
+	callbackQuery := parseCallbackData(update.CallbackQuery.Data)
+	customer, sub := h.trafficSubscription(ctx, update)
+	if sub == nil {
+		return
+	}
+	gb, err := strconv.Atoi(callbackQuery["gb"])
+	if err != nil {
+		slog.Error("Error parsing traffic package", "data", update.CallbackQuery.Data)
+		return
+	}
+	p, ok := config.FindTrafficPackage(gb)
+	if !ok {
+		slog.Error("Unknown traffic package", "gb", gb)
+		return
+	}
+
+	invoiceType := database.InvoiceType(callbackQuery["invoiceType"])
+	if !isInvoiceTypeEnabled(invoiceType) {
+		slog.Error("Unsupported invoice type", "invoiceType", invoiceType)
+		return
+	}
+	price := p.Price
+	if invoiceType == database.InvoiceTypeTelegram {
+		if !h.isStarsAllowed(ctx, customer.ID) {
+			slog.Warn("stars payment is not allowed for customer", "customerId", utils.MaskHalfInt64(customer.ID))
+			return
+		}
+		price = p.StarsPrice
+	}
+
+	ctxWithUsername := context.WithValue(ctx, "username", update.CallbackQuery.From.Username)
+	paymentURL, purchaseId, err := h.paymentService.CreateTrafficPurchase(ctxWithUsername, float64(price), p.GB, sub.ID, customer, invoiceType)
+	if err != nil {
+		slog.Error("Error creating traffic payment", "error", err)
+		return
+	}
+
+	message, err := b.EditMessageReplyMarkup(ctx, &bot.EditMessageReplyMarkupParams{
+		ChatID:    callback.Chat.ID,
+		MessageID: callback.ID,
+		ReplyMarkup: models.InlineKeyboardMarkup{
+			InlineKeyboard: [][]models.InlineKeyboardButton{
+				{{Text: h.translation.GetText(langCode, "pay_button"), URL: paymentURL}},
+				{{Text: h.translation.GetText(langCode, "back_button"), CallbackData: fmt.Sprintf("%s?id=%d&gb=%d", CallbackTrafficSell, sub.ID, p.GB)}},
+			},
+		},
+	})
+	if err != nil {
+		slog.Error("Error updating traffic sell message", "error", err)
+		return
+	}
+	h.cache.Set(purchaseId, message.ID)
+}
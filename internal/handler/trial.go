@@ -2,7 +2,11 @@ package handler
 
 import (
 	"context"
+	"errors"
+	"fmt"
 	"log/slog"
+	"strconv"
+	"strings"
 
 	"github.com/go-telegram/bot"
 	"github.com/go-telegram/bot/models"
@@ -10,17 +14,59 @@ import (
 	"remnawave-tg-shop-bot/internal/subscriptions"
 )
 
+// channelMembers проверяет подписку на канал TRIAL_REQUIRED_CHANNEL через Bot API.
+// Бот должен быть администратором канала, иначе Telegram не отдаёт список участников.
+type channelMembers struct {
+	b *bot.Bot
+}
+
+func (c channelMembers) IsChannelMember(ctx context.Context, telegramID int64) (bool, error) {
+	member, err := c.b.GetChatMember(ctx, &bot.GetChatMemberParams{ChatID: config.TrialRequiredChannel(), UserID: telegramID})
+	if err != nil {
+		return false, fmt.Errorf("failed to get channel member: %w", err)
+	}
+	switch member.Type {
+	case models.ChatMemberTypeOwner, models.ChatMemberTypeAdministrator, models.ChatMemberTypeMember:
+		return true, nil
+	case models.ChatMemberTypeRestricted:
+		return member.Restricted != nil && member.Restricted.IsMember, nil
+	default:
+		return false, nil
+	}
+}
+
+// isTrialAvailable сообщает, можно ли предложить клиенту пробный период
+func (h Handler) isTrialAvailable(ctx context.Context, telegramID int64) bool {
+	if config.TrialDays() == 0 {
+		return false
+	}
+	used, err := h.trialUsageRepository.IsUsed(ctx, telegramID)
+	if err != nil {
+		slog.Error("Error checking trial usage", "error", err)
+		return false
+	}
+	return !used
+}
+
+// trialChannelURL — ссылка на канал для кнопки подписки
+func trialChannelURL() string {
+	if channel := config.TrialRequiredChannel(); strings.HasPrefix(channel, "@") {
+		return "https://t.me/" + strings.TrimPrefix(channel, "@")
+	}
+	return config.ChannelURL()
+}
+
 func (h Handler) TrialCallbackHandler(ctx context.Context, b *bot.Bot, update *models.Update) {
 	if config.TrialDays() == 0 {
 		return
 	}
-	// Всегда создаём бесплатную подписку через free service
-	svc := &subscriptions.Service{SubsRepo: h.subscriptionRepository, Customers: h.customerRepository, RW: h.syncService.GetClient(), Translate: h.translation}
+	svc := &subscriptions.Service{SubsRepo: h.subscriptionRepository, Customers: h.customerRepository, Trials: h.trialUsageRepository, RW: h.syncService.GetClient(), Translate: h.translation, Members: channelMembers{b: b}, Referrals: h.referralService}
 	callback := update.CallbackQuery.Message.Message
 	_, err := svc.ActivateFree(context.WithValue(ctx, "username", update.CallbackQuery.From.Username), update.CallbackQuery.From.ID)
 	langCode := update.CallbackQuery.From.LanguageCode
 	if err != nil {
-		slog.Error("Error activating free subscription", "err", err)
+		h.sendTrialRejection(ctx, b, callback, langCode, err)
+		return
 	}
 	// сразу рендерим красивую таблицу
 	h.afterSubscriptionCreated(ctx, b, callback.Chat.ID, callback.ID)
@@ -28,3 +74,60 @@ func (h Handler) TrialCallbackHandler(ctx context.Context, b *bot.Bot, update *m
 	_, _ = b.EditMessageText(ctx, &bot.EditMessageTextParams{ChatID: callback.Chat.ID, MessageID: callback.ID, Text: h.translation.GetText(langCode, "trial_activated"), ParseMode: models.ParseModeHTML, ReplyMarkup: models.InlineKeyboardMarkup{InlineKeyboard: h.createConnectKeyboard(langCode)}})
 }
 
+// sendTrialRejection объясняет, почему пробный период не выдан
+func (h Handler) sendTrialRejection(ctx context.Context, b *bot.Bot, callback *models.Message, langCode string, err error) {
+	var text string
+	var keyboard [][]models.InlineKeyboardButton
+	switch {
+	case errors.Is(err, subscriptions.ErrTrialUsed):
+		text = h.translation.GetText(langCode, "trial_already_used")
+		if isPaymentAvailable() {
+			keyboard = append(keyboard, []models.InlineKeyboardButton{{Text: h.translation.GetText(langCode, "buy_button"), CallbackData: CallbackBuy}})
+		}
+	case errors.Is(err, subscriptions.ErrTrialChannelRequired):
+		text = h.translation.GetText(langCode, "trial_channel_required")
+		if url := trialChannelURL(); url != "" {
+			keyboard = append(keyboard, []models.InlineKeyboardButton{{Text: h.translation.GetText(langCode, "channel_button"), URL: url}})
+		}
+		keyboard = append(keyboard, []models.InlineKeyboardButton{{Text: h.translation.GetText(langCode, "trial_check_button"), CallbackData: CallbackTrial}})
+	case errors.Is(err, subscriptions.ErrTrialAccountTooNew):
+		text = fmt.Sprintf(h.translation.GetText(langCode, "trial_account_too_new"), config.TrialMinAccountAgeHours())
+	default:
+		slog.Error("Error activating free subscription", "err", err)
+		text = h.translation.GetText(langCode, "trial_failed")
+	}
+	keyboard = append(keyboard, []models.InlineKeyboardButton{{Text: h.translation.GetText(langCode, "back_button"), CallbackData: CallbackStart}})
+
+	_, err = b.EditMessageText(ctx, &bot.EditMessageTextParams{
+		ChatID:      callback.Chat.ID,
+		MessageID:   callback.ID,
+		ParseMode:   models.ParseModeHTML,
+		Text:        text,
+		ReplyMarkup: models.InlineKeyboardMarkup{InlineKeyboard: keyboard},
+	})
+	if err != nil {
+		slog.Error("Error sending trial rejection", "error", err)
+	}
+}
+
+// ResetTrialCommandHandler снова разрешает пользователю пробный период: /reset_trial <telegram_id>
+func (h Handler) ResetTrialCommandHandler(ctx context.Context, b *bot.Bot, update *models.Update) {
+	args := strings.Fields(update.Message.Text)
+	var text string
+	if len(args) != 2 {
+		text = "Usage: /reset_trial <telegram_id>"
+	} else if telegramID, err := strconv.ParseInt(args[1], 10, 64); err != nil {
+		text = fmt.Sprintf("Invalid telegram id %q", args[1])
+	} else if reset, err := h.trialUsageRepository.Reset(ctx, telegramID); err != nil {
+		slog.Error("Error resetting trial", "error", err)
+		text = fmt.Sprintf("Failed to reset trial: %v", err)
+	} else if reset {
+		text = fmt.Sprintf("Trial eligibility reset for %d", telegramID)
+	} else {
+		text = fmt.Sprintf("%d has not used the trial", telegramID)
+	}
+
+	if _, err := b.SendMessage(ctx, &bot.SendMessageParams{ChatID: update.Message.Chat.ID, Text: text}); err != nil {
+		slog.Error("Error sending reset trial message", "error", err)
+	}
+}
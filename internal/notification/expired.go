@@ -0,0 +1,168 @@
+package notification
+
+import (
+	"context"
+	"fmt"
+	"html"
+	"log/slog"
+	"time"
+
+	remapi "github.com/Jolymmiles/remnawave-api-go/v2/api"
+	"github.com/go-telegram/bot"
+	"github.com/go-telegram/bot/models"
+	"github.com/google/uuid"
+	"remnawave-tg-shop-bot/internal/callback"
+	"remnawave-tg-shop-bot/internal/config"
+	"remnawave-tg-shop-bot/internal/database"
+	"remnawave-tg-shop-bot/internal/translation"
+)
+
+const userActionDelete = "delete"
+
+type expiredSubscriptionRepository interface {
+	FindExpiredSubscriptions(ctx context.Context, expiredBefore time.Time) ([]database.Subscription, error)
+	UpdateSubscription(ctx context.Context, id int64, updates map[string]interface{}) error
+	DeactivateSubscription(ctx context.Context, id int64) error
+}
+
+type remnawaveUserManager interface {
+	FindSubscriptionUser(ctx context.Context, userUuid *uuid.UUID, link string) (*remapi.User, error)
+	DisableUser(ctx context.Context, userUuid uuid.UUID) error
+	DeleteUser(ctx context.Context, userUuid uuid.UUID) error
+}
+
+// ExpiredSubscriptionService деактивирует подписки, истекшие больше льготного периода назад,
+// отключает или удаляет их пользователей в remnawave и сообщает об этом клиенту
+type ExpiredSubscriptionService struct {
+	customerRepository     customerRepository
+	subscriptionRepository expiredSubscriptionRepository
+	remnawave              remnawaveUserManager
+	telegramBot            *bot.Bot
+	tm                     *translation.Manager
+	graceDays              int
+	userAction             string
+	notify                 func(context.Context, database.Customer, database.Subscription) error
+}
+
+func NewExpiredSubscriptionService(customerRepository customerRepository,
+	subscriptionRepository expiredSubscriptionRepository,
+	remnawave remnawaveUserManager,
+	telegramBot *bot.Bot,
+	tm *translation.Manager) *ExpiredSubscriptionService {
+	svc := &ExpiredSubscriptionService{customerRepository: customerRepository, subscriptionRepository: subscriptionRepository, remnawave: remnawave, telegramBot: telegramBot, tm: tm, graceDays: config.ExpiredSubscriptionGraceDays(), userAction: config.ExpiredUserAction()}
+	svc.notify = svc.sendNotification
+	return svc
+}
+
+// DeactivateExpired обрабатывает подписки, истекшие раньше now - EXPIRED_SUBSCRIPTION_GRACE_DAYS.
+// Если панель недоступна, подписка остаётся активной до следующего запуска. Если пользователь
+// был продлён в панели в обход бота, подписка не деактивируется, а получает новую дату окончания.
+func (s *ExpiredSubscriptionService) DeactivateExpired(ctx context.Context) error {
+	cutoff := time.Now().AddDate(0, 0, -s.graceDays)
+	subscriptions, err := s.subscriptionRepository.FindExpiredSubscriptions(ctx, cutoff)
+	if err != nil {
+		return fmt.Errorf("failed to find expired subscriptions: %w", err)
+	}
+	if len(subscriptions) == 0 {
+		return nil
+	}
+
+	customersIds := make([]int64, 0, len(subscriptions))
+	seen := make(map[int64]bool, len(subscriptions))
+	for _, sub := range subscriptions {
+		if !seen[sub.CustomerID] {
+			seen[sub.CustomerID] = true
+			customersIds = append(customersIds, sub.CustomerID)
+		}
+	}
+
+	customers, err := s.customerRepository.FindByIds(ctx, customersIds)
+	if err != nil {
+		return fmt.Errorf("failed to query customers of expired subscriptions: %w", err)
+	}
+	customersById := make(map[int64]database.Customer, len(customers))
+	for _, customer := range customers {
+		customersById[customer.ID] = customer
+	}
+
+	deactivated := 0
+	for _, subscription := range subscriptions {
+		user, err := s.remnawave.FindSubscriptionUser(ctx, subscription.RemnawaveUUID, subscription.SubscriptionLink)
+		if err != nil {
+			slog.Error("Failed to find remnawave user of expired subscription", "subscription_id", subscription.ID, "error", err)
+			continue
+		}
+
+		if user != nil && user.ExpireAt.After(cutoff) {
+			if err := s.subscriptionRepository.UpdateSubscription(ctx, subscription.ID, map[string]interface{}{"expire_at": user.ExpireAt}); err != nil {
+				slog.Error("Failed to update subscription expiration", "subscription_id", subscription.ID, "error", err)
+			}
+			continue
+		}
+
+		if user != nil {
+			if err := s.releaseUser(ctx, user); err != nil {
+				slog.Error("Failed to release remnawave user of expired subscription", "subscription_id", subscription.ID, "action", s.userAction, "error", err)
+				continue
+			}
+		}
+
+		if err := s.subscriptionRepository.DeactivateSubscription(ctx, subscription.ID); err != nil {
+			slog.Error("Failed to deactivate expired subscription", "subscription_id", subscription.ID, "error", err)
+			continue
+		}
+		deactivated++
+
+		customer, ok := customersById[subscription.CustomerID]
+		if !ok {
+			slog.Warn("Customer of expired subscription not found", "subscription_id", subscription.ID)
+			continue
+		}
+
+		send := s.notify
+		if send == nil {
+			send = s.sendNotification
+		}
+		if err := send(ctx, customer, subscription); err != nil {
+			slog.Error("Failed to send expired subscription notification", "customer_id", customer.ID, "subscription_id", subscription.ID, "error", err)
+		}
+	}
+
+	slog.Info(fmt.Sprintf("Deactivated %d of %d expired subscriptions", deactivated, len(subscriptions)))
+	return nil
+}
+
+// releaseUser отключает или удаляет пользователя в зависимости от EXPIRED_USER_ACTION
+func (s *ExpiredSubscriptionService) releaseUser(ctx context.Context, user *remapi.User) error {
+	if s.userAction == userActionDelete {
+		return s.remnawave.DeleteUser(ctx, user.UUID)
+	}
+	if status, ok := user.Status.Get(); ok && status == remapi.UserStatusDISABLED {
+		return nil
+	}
+	return s.remnawave.DisableUser(ctx, user.UUID)
+}
+
+func (s *ExpiredSubscriptionService) sendNotification(ctx context.Context, customer database.Customer, subscription database.Subscription) error {
+	_, err := s.telegramBot.SendMessage(ctx, &bot.SendMessageParams{
+		ChatID: customer.TelegramID,
+		Text: fmt.Sprintf(
+			s.tm.GetText(customer.Language, "subscription_expired_deactivated"),
+			html.EscapeString(subscription.Name),
+			subscription.ExpireAt.Format("02.01.2006"),
+		),
+		ParseMode: models.ParseModeHTML,
+		ReplyMarkup: models.InlineKeyboardMarkup{
+			InlineKeyboard: [][]models.InlineKeyboardButton{
+				{
+					{
+						Text:         s.tm.GetText(customer.Language, "buy_button"),
+						CallbackData: callback.Buy,
+					},
+				},
+			},
+		},
+	})
+
+	return err
+}
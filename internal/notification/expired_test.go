@@ -0,0 +1,170 @@
+package notification
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	remapi "github.com/Jolymmiles/remnawave-api-go/v2/api"
+	"github.com/google/uuid"
+	"remnawave-tg-shop-bot/internal/database"
+)
+
+type expiredRepoMock struct {
+	subscriptions []database.Subscription
+	expiredBefore time.Time
+	deactivated   []int64
+	updated       map[int64]map[string]interface{}
+}
+
+func (m *expiredRepoMock) FindExpiredSubscriptions(ctx context.Context, expiredBefore time.Time) ([]database.Subscription, error) {
+	m.expiredBefore = expiredBefore
+	return m.subscriptions, nil
+}
+
+func (m *expiredRepoMock) UpdateSubscription(ctx context.Context, id int64, updates map[string]interface{}) error {
+	if m.updated == nil {
+		m.updated = make(map[int64]map[string]interface{})
+	}
+	m.updated[id] = updates
+	return nil
+}
+
+func (m *expiredRepoMock) DeactivateSubscription(ctx context.Context, id int64) error {
+	m.deactivated = append(m.deactivated, id)
+	return nil
+}
+
+type remnawaveMock struct {
+	users    map[string]*remapi.User
+	findErr  error
+	disabled []uuid.UUID
+	deleted  []uuid.UUID
+}
+
+func (m *remnawaveMock) FindSubscriptionUser(ctx context.Context, userUuid *uuid.UUID, link string) (*remapi.User, error) {
+	if m.findErr != nil {
+		return nil, m.findErr
+	}
+	if userUuid != nil {
+		for _, user := range m.users {
+			if user.UUID == *userUuid {
+				return user, nil
+			}
+		}
+		return nil, nil
+	}
+	return m.users[link], nil
+}
+
+func (m *remnawaveMock) DisableUser(ctx context.Context, userUuid uuid.UUID) error {
+	m.disabled = append(m.disabled, userUuid)
+	return nil
+}
+
+func (m *remnawaveMock) DeleteUser(ctx context.Context, userUuid uuid.UUID) error {
+	m.deleted = append(m.deleted, userUuid)
+	return nil
+}
+
+func newExpiredService(repo *expiredRepoMock, rw *remnawaveMock, action string, notified *[]int64) *ExpiredSubscriptionService {
+	return &ExpiredSubscriptionService{
+		customerRepository:     &customerRepoMock{customers: []database.Customer{{ID: 1, TelegramID: 100}}},
+		subscriptionRepository: repo,
+		remnawave:              rw,
+		graceDays:              3,
+		userAction:             action,
+		notify: func(ctx context.Context, customer database.Customer, subscription database.Subscription) error {
+			*notified = append(*notified, subscription.ID)
+			return nil
+		},
+	}
+}
+
+func TestDeactivateExpired_DisablesUserAndNotifies(t *testing.T) {
+	now := time.Now()
+	userUuid := uuid.New()
+	repo := &expiredRepoMock{subscriptions: []database.Subscription{
+		{ID: 10, CustomerID: 1, SubscriptionLink: "https://sub/abc", ExpireAt: now.AddDate(0, 0, -5)},
+		{ID: 11, CustomerID: 1, SubscriptionLink: "https://sub/gone", ExpireAt: now.AddDate(0, 0, -5)},
+	}}
+	rw := &remnawaveMock{users: map[string]*remapi.User{
+		"https://sub/abc": {UUID: userUuid, ExpireAt: now.AddDate(0, 0, -5)},
+	}}
+	var notified []int64
+
+	if err := newExpiredService(repo, rw, "disable", &notified).DeactivateExpired(context.Background()); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if cutoff := now.AddDate(0, 0, -3); repo.expiredBefore.Sub(cutoff).Abs() > time.Minute {
+		t.Errorf("expected cutoff around %v, got %v", cutoff, repo.expiredBefore)
+	}
+	if len(rw.disabled) != 1 || rw.disabled[0] != userUuid || len(rw.deleted) != 0 {
+		t.Errorf("expected only user %v disabled, got disabled=%v deleted=%v", userUuid, rw.disabled, rw.deleted)
+	}
+	if len(repo.deactivated) != 2 {
+		t.Errorf("expected both subscriptions deactivated, got %v", repo.deactivated)
+	}
+	if len(notified) != 2 {
+		t.Errorf("expected 2 notifications, got %v", notified)
+	}
+}
+
+func TestDeactivateExpired_DeleteAction(t *testing.T) {
+	userUuid := uuid.New()
+	repo := &expiredRepoMock{subscriptions: []database.Subscription{
+		{ID: 10, CustomerID: 1, SubscriptionLink: "https://sub/abc", ExpireAt: time.Now().AddDate(0, 0, -5)},
+	}}
+	rw := &remnawaveMock{users: map[string]*remapi.User{
+		"https://sub/abc": {UUID: userUuid, ExpireAt: time.Now().AddDate(0, 0, -5), Status: remapi.NewOptUserStatus(remapi.UserStatusDISABLED)},
+	}}
+	var notified []int64
+
+	if err := newExpiredService(repo, rw, "delete", &notified).DeactivateExpired(context.Background()); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if len(rw.deleted) != 1 || rw.deleted[0] != userUuid || len(rw.disabled) != 0 {
+		t.Errorf("expected user %v deleted, got disabled=%v deleted=%v", userUuid, rw.disabled, rw.deleted)
+	}
+}
+
+func TestDeactivateExpired_UserExtendedInPanel(t *testing.T) {
+	extended := time.Now().AddDate(0, 1, 0)
+	repo := &expiredRepoMock{subscriptions: []database.Subscription{
+		{ID: 10, CustomerID: 1, SubscriptionLink: "https://sub/abc", ExpireAt: time.Now().AddDate(0, 0, -5)},
+	}}
+	rw := &remnawaveMock{users: map[string]*remapi.User{
+		"https://sub/abc": {UUID: uuid.New(), ExpireAt: extended},
+	}}
+	var notified []int64
+
+	if err := newExpiredService(repo, rw, "disable", &notified).DeactivateExpired(context.Background()); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if len(repo.deactivated) != 0 || len(rw.disabled) != 0 || len(notified) != 0 {
+		t.Fatalf("extended subscription must stay active, got deactivated=%v disabled=%v notified=%v", repo.deactivated, rw.disabled, notified)
+	}
+	if got := repo.updated[10]["expire_at"]; got != extended {
+		t.Errorf("expected expire_at updated to %v, got %v", extended, got)
+	}
+}
+
+func TestDeactivateExpired_PanelUnavailable(t *testing.T) {
+	repo := &expiredRepoMock{subscriptions: []database.Subscription{
+		{ID: 10, CustomerID: 1, SubscriptionLink: "https://sub/abc", ExpireAt: time.Now().AddDate(0, 0, -5)},
+	}}
+	rw := &remnawaveMock{findErr: errors.New("connection refused")}
+	var notified []int64
+
+	if err := newExpiredService(repo, rw, "disable", &notified).DeactivateExpired(context.Background()); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if len(repo.deactivated) != 0 || len(notified) != 0 {
+		t.Errorf("subscription must stay active until the panel answers, got deactivated=%v notified=%v", repo.deactivated, notified)
+	}
+}
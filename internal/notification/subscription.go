@@ -5,14 +5,27 @@ import (
 	"fmt"
 	"github.com/go-telegram/bot"
 	"github.com/go-telegram/bot/models"
+	"html"
 	"log/slog"
+	"remnawave-tg-shop-bot/internal/callback"
+	"remnawave-tg-shop-bot/internal/config"
 	"remnawave-tg-shop-bot/internal/database"
+	"remnawave-tg-shop-bot/internal/remnawave"
 	"remnawave-tg-shop-bot/internal/translation"
 	"time"
 )
 
 type customerRepository interface {
-	FindByExpirationRange(ctx context.Context, startDate, endDate time.Time) (*[]database.Customer, error)
+	FindByIds(ctx context.Context, ids []int64) ([]database.Customer, error)
+}
+
+type subscriptionRepository interface {
+	FindByExpirationRange(ctx context.Context, startDate, endDate time.Time) ([]database.Subscription, error)
+}
+
+type notificationLogRepository interface {
+	TryMark(ctx context.Context, subscriptionID int64, stage string, expireAt time.Time) (bool, error)
+	Unmark(ctx context.Context, subscriptionID int64, stage string) error
 }
 
 type tributeRepository interface {
@@ -20,45 +33,72 @@ type tributeRepository interface {
 }
 
 type paymentProcessor interface {
-	CreatePurchase(ctx context.Context, amount float64, months int, customer *database.Customer, invoiceType database.InvoiceType) (string, int64, error)
+	CreatePlanPurchase(ctx context.Context, amount float64, plan config.Plan, subscriptionID int64, customer *database.Customer, invoiceType database.InvoiceType) (string, int64, error)
 	ProcessPurchaseById(ctx context.Context, purchaseId int64) error
 }
 
+// tributeRenewalStage — запись notification_log об автопродлении Tribute: одно продление на срок подписки
+const tributeRenewalStage = "tribute_renewal"
+
 type SubscriptionService struct {
-	customerRepository customerRepository
-	purchaseRepository tributeRepository
-	paymentService     paymentProcessor
-	telegramBot        *bot.Bot
-	tm                 *translation.Manager
-	notify             func(context.Context, database.Customer) error
+	customerRepository     customerRepository
+	subscriptionRepository subscriptionRepository
+	notificationLog        notificationLogRepository
+	purchaseRepository     tributeRepository
+	paymentService         paymentProcessor
+	telegramBot            *bot.Bot
+	tm                     *translation.Manager
+	stages                 []int
+	notify                 func(context.Context, database.Customer, database.Subscription, int) error
 }
 
 func NewSubscriptionService(customerRepository customerRepository,
+	subscriptionRepository subscriptionRepository,
+	notificationLog notificationLogRepository,
 	purchaseRepository tributeRepository,
 	paymentService paymentProcessor,
 	telegramBot *bot.Bot,
 	tm *translation.Manager) *SubscriptionService {
-	svc := &SubscriptionService{customerRepository: customerRepository, purchaseRepository: purchaseRepository, paymentService: paymentService, telegramBot: telegramBot, tm: tm}
+	svc := &SubscriptionService{customerRepository: customerRepository, subscriptionRepository: subscriptionRepository, notificationLog: notificationLog, purchaseRepository: purchaseRepository, paymentService: paymentService, telegramBot: telegramBot, tm: tm, stages: config.ReminderStages()}
 	svc.notify = svc.sendNotification
 	return svc
 }
-func (s *SubscriptionService) ProcessSubscriptionExpiration() error {
-	ctx := context.Background()
-	customers, err := s.getCustomersWithExpiringSubscriptions()
+
+// ProcessSubscriptionExpiration напоминает об окончании каждой подписки отдельно: клиент
+// с тремя истекающими подписками получит три сообщения. Каждый этап напоминания (REMINDER_STAGES)
+// отправляется один раз, это фиксирует notification_log. Подписку, которую продлевает активная
+// подписка Tribute, вместо напоминаний продлеваем за день до окончания; об остальных подписках
+// клиента напоминаем как обычно.
+func (s *SubscriptionService) ProcessSubscriptionExpiration(ctx context.Context) error {
+	subscriptions, err := s.getExpiringSubscriptions(ctx)
 	if err != nil {
-		slog.Error("Failed to get customers with expiring subscriptions", "error", err)
+		slog.Error("Failed to get expiring subscriptions", "error", err)
 		return err
 	}
 
-	slog.Info(fmt.Sprintf("Found %d customers with expiring subscriptions", len(*customers)))
-	if len(*customers) == 0 {
+	slog.Info(fmt.Sprintf("Found %d expiring subscriptions", len(subscriptions)))
+	if len(subscriptions) == 0 {
 		return nil
 	}
 	now := time.Now()
 
-	customersIds := make([]int64, len(*customers))
-	for i, customer := range *customers {
-		customersIds[i] = customer.ID
+	customersIds := make([]int64, 0, len(subscriptions))
+	seen := make(map[int64]bool, len(subscriptions))
+	for _, sub := range subscriptions {
+		if !seen[sub.CustomerID] {
+			seen[sub.CustomerID] = true
+			customersIds = append(customersIds, sub.CustomerID)
+		}
+	}
+
+	customers, err := s.customerRepository.FindByIds(ctx, customersIds)
+	if err != nil {
+		slog.Error("Failed to query customers of expiring subscriptions", "error", err)
+		return err
+	}
+	customersById := make(map[int64]database.Customer, len(customers))
+	for _, customer := range customers {
+		customersById[customer.ID] = customer
 	}
 
 	latestActiveTributes, err := s.purchaseRepository.FindLatestActiveTributesByCustomerIDs(ctx, customersIds)
@@ -74,29 +114,33 @@ func (s *SubscriptionService) ProcessSubscriptionExpiration() error {
 	}
 
 	tributesProcessed := make(map[int64]bool, len(*latestActiveTributes))
+	notificationsSent := 0
 
-	for _, customer := range *customers {
-		daysUntilExpiration := s.getDaysUntilExpiration(now, *customer.ExpireAt)
+	for _, subscription := range subscriptions {
+		customer, ok := customersById[subscription.CustomerID]
+		if !ok {
+			slog.Warn("Customer of expiring subscription not found", "subscription_id", subscription.ID)
+			continue
+		}
+		daysUntilExpiration := s.getDaysUntilExpiration(now, subscription.ExpireAt)
 
-		if p, ok := customerIdTributes[customer.ID]; ok {
-			if daysUntilExpiration != 1 {
-				continue
-			}
-			_, purchaseId, err := s.paymentService.CreatePurchase(ctx, p.Amount, p.Month, &customer, database.InvoiceTypeTribute)
-			if err != nil {
-				slog.Error("Failed to create tribute purchase", "error", err)
-				continue
+		if p, ok := customerIdTributes[customer.ID]; ok && renewedByTribute(p, customer, subscription) {
+			if daysUntilExpiration == 1 && !tributesProcessed[customer.ID] && s.renewTribute(ctx, customer, subscription, p) {
+				tributesProcessed[customer.ID] = true
 			}
+			continue
+		}
 
-			err = s.paymentService.ProcessPurchaseById(ctx, purchaseId)
-			if err != nil {
-				slog.Error("Failed to process tribute purchase", "error", err)
-				continue
-			}
-			slog.Info("Tribute purchase processed successfully", "purchase_id", purchaseId)
-			tributesProcessed[customer.ID] = true
+		stage, ok := s.currentStage(daysUntilExpiration)
+		if !ok {
+			continue
+		}
+		marked, err := s.notificationLog.TryMark(ctx, subscription.ID, stageName(stage), subscription.ExpireAt)
+		if err != nil {
+			slog.Error("Failed to mark notification", "subscription_id", subscription.ID, "stage", stageName(stage), "error", err)
+			continue
 		}
-		if _, ok := tributesProcessed[customer.ID]; ok {
+		if !marked {
 			continue
 		}
 
@@ -105,35 +149,107 @@ func (s *SubscriptionService) ProcessSubscriptionExpiration() error {
 			send = s.sendNotification
 		}
 
-		err := send(ctx, customer)
+		err = send(ctx, customer, subscription, stage)
 		if err != nil {
 			slog.Error("Failed to send notification",
 				"customer_id", customer.ID,
-				"days_until_expiration", daysUntilExpiration,
+				"subscription_id", subscription.ID,
+				"stage", stageName(stage),
 				"error", err)
+			if err := s.notificationLog.Unmark(ctx, subscription.ID, stageName(stage)); err != nil {
+				slog.Error("Failed to unmark notification", "subscription_id", subscription.ID, "error", err)
+			}
 			continue
 		}
+		notificationsSent++
 
 		slog.Info("Notification sent successfully",
 			"customer_id", customer.ID,
-			"days_until_expiration", daysUntilExpiration)
+			"subscription_id", subscription.ID,
+			"stage", stageName(stage))
 	}
 
 	slog.Info(fmt.Sprintf("Processed tributes customers %d with expiring subscriptions", len(tributesProcessed)))
-	slog.Info(fmt.Sprintf("Sent notifications to %d customers with expiring subscriptions", len(*customers)-len(tributesProcessed)))
+	slog.Info(fmt.Sprintf("Sent notifications for %d expiring subscriptions", notificationsSent))
 	return nil
 }
 
-func (s *SubscriptionService) getCustomersWithExpiringSubscriptions() (*[]database.Customer, error) {
-	now := time.Now()
-	endDate := now.AddDate(0, 0, 3)
+// renewedByTribute сообщает, продлевает ли подписку Tribute: это подписка, к которой привязана
+// его последняя покупка, а у покупки из вебхука без привязки — собственная подписка клиента
+func renewedByTribute(tribute *database.Purchase, customer database.Customer, subscription database.Subscription) bool {
+	if tribute.SubscriptionID != nil {
+		return *tribute.SubscriptionID == subscription.ID
+	}
+	return subscription.Username != nil && *subscription.Username == remnawave.CustomerUsername(customer.ID, customer.TelegramID)
+}
 
-	dbCustomers, err := s.customerRepository.FindByExpirationRange(context.Background(), now, endDate)
+// renewTribute продлевает подписку по последней покупке Tribute. Продление за текущий срок
+// фиксируется в notification_log, поэтому повторные запуски в тот же день его не повторяют.
+func (s *SubscriptionService) renewTribute(ctx context.Context, customer database.Customer, subscription database.Subscription, tribute *database.Purchase) bool {
+	marked, err := s.notificationLog.TryMark(ctx, subscription.ID, tributeRenewalStage, subscription.ExpireAt)
 	if err != nil {
-		return nil, err
+		slog.Error("Failed to mark tribute renewal", "subscription_id", subscription.ID, "error", err)
+		return false
+	}
+	if !marked {
+		return false
 	}
 
-	return dbCustomers, nil
+	plan, ok := config.FindPlan(tribute.PlanID)
+	if !ok {
+		plan = config.MonthsPlan(tribute.Month)
+	}
+	_, purchaseId, err := s.paymentService.CreatePlanPurchase(ctx, tribute.Amount, plan, subscription.ID, &customer, database.InvoiceTypeTribute)
+	if err == nil {
+		err = s.paymentService.ProcessPurchaseById(ctx, purchaseId)
+	}
+	if err != nil {
+		slog.Error("Failed to renew tribute subscription", "subscription_id", subscription.ID, "error", err)
+		if err := s.notificationLog.Unmark(ctx, subscription.ID, tributeRenewalStage); err != nil {
+			slog.Error("Failed to unmark tribute renewal", "subscription_id", subscription.ID, "error", err)
+		}
+		return false
+	}
+	slog.Info("Tribute purchase processed successfully", "purchase_id", purchaseId, "subscription_id", subscription.ID)
+	return true
+}
+
+// getExpiringSubscriptions выбирает подписки, попадающие в окно этапов: от самого позднего
+// этапа после окончания до самого раннего перед ним. Окно всегда включает завтрашний день,
+// чтобы автопродление Tribute работало и без напоминаний.
+func (s *SubscriptionService) getExpiringSubscriptions(ctx context.Context) ([]database.Subscription, error) {
+	now := time.Now()
+	today := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, now.Location())
+
+	daysBefore, daysAfter := 1, 0
+	for _, stage := range s.stages {
+		daysBefore = max(daysBefore, stage)
+		daysAfter = max(daysAfter, -stage)
+	}
+
+	return s.subscriptionRepository.FindByExpirationRange(ctx, today.AddDate(0, 0, -daysAfter), today.AddDate(0, 0, daysBefore+1))
+}
+
+// currentStage возвращает ближайший наступивший этап: наименьший из тех, что не меньше
+// оставшихся дней. Пропущенные ранние этапы (например, бот был выключен) не досылаются.
+func (s *SubscriptionService) currentStage(daysUntilExpiration int) (int, bool) {
+	found := false
+	var current int
+	for _, stage := range s.stages {
+		if stage >= daysUntilExpiration && (!found || stage < current) {
+			current = stage
+			found = true
+		}
+	}
+	return current, found
+}
+
+// stageName — ключ этапа в notification_log: "3d" до окончания, "after_1d" после
+func stageName(stage int) string {
+	if stage < 0 {
+		return fmt.Sprintf("after_%dd", -stage)
+	}
+	return fmt.Sprintf("%dd", stage)
 }
 
 func (s *SubscriptionService) getDaysUntilExpiration(now time.Time, expireAt time.Time) int {
@@ -144,11 +260,19 @@ func (s *SubscriptionService) getDaysUntilExpiration(now time.Time, expireAt tim
 	return int(duration.Hours() / 24)
 }
 
-func (s *SubscriptionService) sendNotification(ctx context.Context, customer database.Customer) error {
-	expireDate := customer.ExpireAt.Format("02.01.2006")
+func (s *SubscriptionService) sendNotification(ctx context.Context, customer database.Customer, subscription database.Subscription, stage int) error {
+	expireDate := subscription.ExpireAt.Format("02.01.2006")
+
+	// у этапа может не быть своего текста, тогда используется общий
+	key := "reminder_" + stageName(stage)
+	template := s.tm.GetText(customer.Language, key)
+	if template == key {
+		template = s.tm.GetText(customer.Language, "subscription_expiring")
+	}
 
 	messageText := fmt.Sprintf(
-		s.tm.GetText(customer.Language, "subscription_expiring"),
+		template,
+		html.EscapeString(subscription.Name),
 		expireDate,
 	)
 
@@ -161,7 +285,7 @@ func (s *SubscriptionService) sendNotification(ctx context.Context, customer dat
 				{
 					{
 						Text:         s.tm.GetText(customer.Language, "renew_subscription_button"),
-						CallbackData: "buy",
+						CallbackData: callback.RenewSubscription(subscription.ID),
 					},
 				},
 			},
@@ -2,21 +2,57 @@ package notification
 
 import (
 	"context"
+	"errors"
+	"fmt"
 	"testing"
 	"time"
 
+	"remnawave-tg-shop-bot/internal/config"
 	"remnawave-tg-shop-bot/internal/database"
 )
 
 type customerRepoMock struct {
-	customers *[]database.Customer
+	customers []database.Customer
 	err       error
 }
 
-func (m *customerRepoMock) FindByExpirationRange(ctx context.Context, startDate, endDate time.Time) (*[]database.Customer, error) {
+func (m *customerRepoMock) FindByIds(ctx context.Context, ids []int64) ([]database.Customer, error) {
 	return m.customers, m.err
 }
 
+type subscriptionRepoMock struct {
+	subscriptions []database.Subscription
+	err           error
+}
+
+func (m *subscriptionRepoMock) FindByExpirationRange(ctx context.Context, startDate, endDate time.Time) ([]database.Subscription, error) {
+	return m.subscriptions, m.err
+}
+
+type notificationLogMock struct {
+	marked   map[string]time.Time
+	unmarked []string
+}
+
+func (m *notificationLogMock) TryMark(ctx context.Context, subscriptionID int64, stage string, expireAt time.Time) (bool, error) {
+	if m.marked == nil {
+		m.marked = make(map[string]time.Time)
+	}
+	key := fmt.Sprintf("%d:%s", subscriptionID, stage)
+	if prev, ok := m.marked[key]; ok && prev.Equal(expireAt) {
+		return false, nil
+	}
+	m.marked[key] = expireAt
+	return true, nil
+}
+
+func (m *notificationLogMock) Unmark(ctx context.Context, subscriptionID int64, stage string) error {
+	key := fmt.Sprintf("%d:%s", subscriptionID, stage)
+	delete(m.marked, key)
+	m.unmarked = append(m.unmarked, key)
+	return nil
+}
+
 type purchaseRepoMock struct {
 	tributes    *[]database.Purchase
 	err         error
@@ -34,16 +70,18 @@ type paymentServiceMock struct {
 	amounts            []float64
 	months             []int
 	customers          []int64
+	subscriptionIDs    []int64
 	processIDs         []int64
 	createErr          error
 	processErr         error
 	purchaseIDToReturn int64
 }
 
-func (m *paymentServiceMock) CreatePurchase(ctx context.Context, amount float64, months int, customer *database.Customer, invoiceType database.InvoiceType) (string, int64, error) {
+func (m *paymentServiceMock) CreatePlanPurchase(ctx context.Context, amount float64, plan config.Plan, subscriptionID int64, customer *database.Customer, invoiceType database.InvoiceType) (string, int64, error) {
 	m.createCalls++
 	m.amounts = append(m.amounts, amount)
-	m.months = append(m.months, months)
+	m.months = append(m.months, plan.Months)
+	m.subscriptionIDs = append(m.subscriptionIDs, subscriptionID)
 	if customer != nil {
 		m.customers = append(m.customers, customer.ID)
 	}
@@ -61,23 +99,31 @@ func (m *paymentServiceMock) ProcessPurchaseById(ctx context.Context, purchaseId
 
 func TestSubscriptionService_ProcessSubscriptionExpiration_ProcessesTribute(t *testing.T) {
 	expireAt := time.Now().Add(24 * time.Hour)
-	customers := []database.Customer{{ID: 1, ExpireAt: &expireAt}}
+	ownUsername := "1_100"
+	customers := []database.Customer{{ID: 1, TelegramID: 100}}
+	subscriptions := []database.Subscription{{ID: 10, CustomerID: 1, ExpireAt: expireAt, Username: &ownUsername}, {ID: 11, CustomerID: 1, ExpireAt: expireAt}}
 	tributes := []database.Purchase{{CustomerID: 1, Amount: 10.5, Month: 2}}
 
-	cRepo := &customerRepoMock{customers: &customers}
+	cRepo := &customerRepoMock{customers: customers}
+	sRepo := &subscriptionRepoMock{subscriptions: subscriptions}
 	pRepo := &purchaseRepoMock{tributes: &tributes}
 	payMock := &paymentServiceMock{purchaseIDToReturn: 77}
 
-	svc := NewSubscriptionService(cRepo, pRepo, payMock, nil, nil)
-	svc.notify = func(ctx context.Context, customer database.Customer) error {
-		t.Fatalf("sendNotification should not be called in successful tribute processing scenario")
+	svc := NewSubscriptionService(cRepo, sRepo, &notificationLogMock{}, pRepo, payMock, nil, nil)
+	svc.stages = []int{1}
+	var notified []int64
+	svc.notify = func(ctx context.Context, customer database.Customer, subscription database.Subscription, stage int) error {
+		notified = append(notified, subscription.ID)
 		return nil
 	}
 
-	if err := svc.ProcessSubscriptionExpiration(); err != nil {
+	if err := svc.ProcessSubscriptionExpiration(context.Background()); err != nil {
 		t.Fatalf("ProcessSubscriptionExpiration returned error: %v", err)
 	}
 
+	if len(notified) != 1 || notified[0] != 11 {
+		t.Fatalf("expected a reminder only for the subscription not renewed by tribute, got %v", notified)
+	}
 	if payMock.createCalls != 1 {
 		t.Fatalf("expected create purchase to be called once, got %d", payMock.createCalls)
 	}
@@ -90,6 +136,9 @@ func TestSubscriptionService_ProcessSubscriptionExpiration_ProcessesTribute(t *t
 	if len(payMock.months) != 1 || payMock.months[0] != tributes[0].Month {
 		t.Fatalf("unexpected months used for purchase: %#v", payMock.months)
 	}
+	if len(payMock.subscriptionIDs) != 1 || payMock.subscriptionIDs[0] != subscriptions[0].ID {
+		t.Fatalf("expected renewal of subscription %d, got %#v", subscriptions[0].ID, payMock.subscriptionIDs)
+	}
 	if len(payMock.processIDs) != 1 || payMock.processIDs[0] != payMock.purchaseIDToReturn {
 		t.Fatalf("expected process to be called with purchase id %d, got %#v", payMock.purchaseIDToReturn, payMock.processIDs)
 	}
@@ -98,22 +147,76 @@ func TestSubscriptionService_ProcessSubscriptionExpiration_ProcessesTribute(t *t
 	}
 }
 
+func TestSubscriptionService_ProcessSubscriptionExpiration_RenewsTributeOncePerTerm(t *testing.T) {
+	expireAt := time.Now().Add(24 * time.Hour)
+	boundID := int64(21)
+	customers := []database.Customer{{ID: 2}}
+	subscriptions := []database.Subscription{{ID: 20, CustomerID: 2, ExpireAt: expireAt}, {ID: boundID, CustomerID: 2, ExpireAt: expireAt}}
+	tributes := []database.Purchase{{CustomerID: 2, Amount: 300, Month: 1, SubscriptionID: &boundID}}
+
+	payMock := &paymentServiceMock{}
+	svc := NewSubscriptionService(&customerRepoMock{customers: customers}, &subscriptionRepoMock{subscriptions: subscriptions}, &notificationLogMock{}, &purchaseRepoMock{tributes: &tributes}, payMock, nil, nil)
+
+	for i := 0; i < 3; i++ {
+		if err := svc.ProcessSubscriptionExpiration(context.Background()); err != nil {
+			t.Fatalf("ProcessSubscriptionExpiration returned error: %v", err)
+		}
+	}
+
+	if payMock.createCalls != 1 {
+		t.Fatalf("expected one renewal for repeated runs, got %d", payMock.createCalls)
+	}
+	if payMock.subscriptionIDs[0] != boundID {
+		t.Fatalf("expected renewal of the subscription bound to tribute, got %d", payMock.subscriptionIDs[0])
+	}
+}
+
+func TestSubscriptionService_ProcessSubscriptionExpiration_RetriesFailedTributeRenewal(t *testing.T) {
+	expireAt := time.Now().Add(24 * time.Hour)
+	ownUsername := "4_400"
+	customers := []database.Customer{{ID: 4, TelegramID: 400}}
+	subscriptions := []database.Subscription{{ID: 40, CustomerID: 4, ExpireAt: expireAt, Username: &ownUsername}}
+	tributes := []database.Purchase{{CustomerID: 4, Amount: 300, Month: 1}}
+
+	logMock := &notificationLogMock{}
+	payMock := &paymentServiceMock{processErr: errors.New("panel unavailable")}
+	svc := NewSubscriptionService(&customerRepoMock{customers: customers}, &subscriptionRepoMock{subscriptions: subscriptions}, logMock, &purchaseRepoMock{tributes: &tributes}, payMock, nil, nil)
+
+	if err := svc.ProcessSubscriptionExpiration(context.Background()); err != nil {
+		t.Fatalf("ProcessSubscriptionExpiration returned error: %v", err)
+	}
+	if len(logMock.unmarked) != 1 || logMock.unmarked[0] != "40:"+tributeRenewalStage {
+		t.Fatalf("expected failed renewal to be unmarked, got %#v", logMock.unmarked)
+	}
+
+	payMock.processErr = nil
+	if err := svc.ProcessSubscriptionExpiration(context.Background()); err != nil {
+		t.Fatalf("ProcessSubscriptionExpiration returned error: %v", err)
+	}
+	if payMock.processCalls != 2 {
+		t.Fatalf("expected renewal to be retried on the next run, got %d attempts", payMock.processCalls)
+	}
+}
+
 func TestSubscriptionService_ProcessSubscriptionExpiration_SkipsAutoRenewWhenNotOneDay(t *testing.T) {
 	expireAt := time.Now().Add(48 * time.Hour)
-	customers := []database.Customer{{ID: 5, ExpireAt: &expireAt}}
+	ownUsername := "5_500"
+	customers := []database.Customer{{ID: 5, TelegramID: 500}}
+	subscriptions := []database.Subscription{{ID: 50, CustomerID: 5, ExpireAt: expireAt, Username: &ownUsername}}
 	tributes := []database.Purchase{{CustomerID: 5, Amount: 20, Month: 1}}
 
-	cRepo := &customerRepoMock{customers: &customers}
+	cRepo := &customerRepoMock{customers: customers}
+	sRepo := &subscriptionRepoMock{subscriptions: subscriptions}
 	pRepo := &purchaseRepoMock{tributes: &tributes}
 	payMock := &paymentServiceMock{purchaseIDToReturn: 101}
 
-	svc := NewSubscriptionService(cRepo, pRepo, payMock, nil, nil)
-	svc.notify = func(ctx context.Context, customer database.Customer) error {
+	svc := NewSubscriptionService(cRepo, sRepo, &notificationLogMock{}, pRepo, payMock, nil, nil)
+	svc.notify = func(ctx context.Context, customer database.Customer, subscription database.Subscription, stage int) error {
 		t.Fatalf("sendNotification should not be called when auto-renew is skipped due to days remaining")
 		return nil
 	}
 
-	if err := svc.ProcessSubscriptionExpiration(); err != nil {
+	if err := svc.ProcessSubscriptionExpiration(context.Background()); err != nil {
 		t.Fatalf("ProcessSubscriptionExpiration returned error: %v", err)
 	}
 
@@ -130,21 +233,24 @@ func TestSubscriptionService_ProcessSubscriptionExpiration_SkipsAutoRenewWhenNot
 
 func TestSubscriptionService_ProcessSubscriptionExpiration_SkipsAutoRenewWhenLastTributeCancelled(t *testing.T) {
 	expireAt := time.Now().Add(24 * time.Hour)
-	customers := []database.Customer{{ID: 9, ExpireAt: &expireAt}}
+	customers := []database.Customer{{ID: 9}}
+	subscriptions := []database.Subscription{{ID: 90, CustomerID: 9, ExpireAt: expireAt}}
 	tributes := []database.Purchase{}
 
-	cRepo := &customerRepoMock{customers: &customers}
+	cRepo := &customerRepoMock{customers: customers}
+	sRepo := &subscriptionRepoMock{subscriptions: subscriptions}
 	pRepo := &purchaseRepoMock{tributes: &tributes}
 	payMock := &paymentServiceMock{}
 	notifyCalls := 0
 
-	svc := NewSubscriptionService(cRepo, pRepo, payMock, nil, nil)
-	svc.notify = func(ctx context.Context, customer database.Customer) error {
+	svc := NewSubscriptionService(cRepo, sRepo, &notificationLogMock{}, pRepo, payMock, nil, nil)
+	svc.stages = []int{3, 1, 0, -1}
+	svc.notify = func(ctx context.Context, customer database.Customer, subscription database.Subscription, stage int) error {
 		notifyCalls++
 		return nil
 	}
 
-	if err := svc.ProcessSubscriptionExpiration(); err != nil {
+	if err := svc.ProcessSubscriptionExpiration(context.Background()); err != nil {
 		t.Fatalf("ProcessSubscriptionExpiration returned error: %v", err)
 	}
 
@@ -161,3 +267,99 @@ func TestSubscriptionService_ProcessSubscriptionExpiration_SkipsAutoRenewWhenLas
 		t.Fatalf("expected purchase repository to query by customer id %d, got %#v", customers[0].ID, pRepo.receivedIDs)
 	}
 }
+
+func TestSubscriptionService_ProcessSubscriptionExpiration_NotifiesEachSubscription(t *testing.T) {
+	now := time.Now()
+	customers := []database.Customer{{ID: 3, TelegramID: 300}}
+	subscriptions := []database.Subscription{
+		{ID: 31, CustomerID: 3, Name: "Phone", ExpireAt: now.Add(24 * time.Hour)},
+		{ID: 32, CustomerID: 3, Name: "Laptop", ExpireAt: now.Add(48 * time.Hour)},
+		{ID: 33, CustomerID: 3, Name: "TV", ExpireAt: now.Add(60 * time.Hour)},
+	}
+	tributes := []database.Purchase{}
+
+	svc := NewSubscriptionService(&customerRepoMock{customers: customers}, &subscriptionRepoMock{subscriptions: subscriptions}, &notificationLogMock{}, &purchaseRepoMock{tributes: &tributes}, &paymentServiceMock{}, nil, nil)
+	svc.stages = []int{3, 1, 0, -1}
+
+	var notified []int64
+	svc.notify = func(ctx context.Context, customer database.Customer, subscription database.Subscription, stage int) error {
+		if customer.ID != subscription.CustomerID {
+			t.Fatalf("subscription %d sent to customer %d", subscription.ID, customer.ID)
+		}
+		notified = append(notified, subscription.ID)
+		return nil
+	}
+
+	if err := svc.ProcessSubscriptionExpiration(context.Background()); err != nil {
+		t.Fatalf("ProcessSubscriptionExpiration returned error: %v", err)
+	}
+
+	if len(notified) != 3 || notified[0] != 31 || notified[1] != 32 || notified[2] != 33 {
+		t.Fatalf("expected a reminder per subscription, got %#v", notified)
+	}
+}
+
+func TestSubscriptionService_ProcessSubscriptionExpiration_SendsEachStageOnce(t *testing.T) {
+	now := time.Now()
+	customers := []database.Customer{{ID: 4}}
+	tributes := []database.Purchase{}
+	sRepo := &subscriptionRepoMock{subscriptions: []database.Subscription{
+		{ID: 41, CustomerID: 4, ExpireAt: now.AddDate(0, 0, 1)},
+		{ID: 42, CustomerID: 4, ExpireAt: now.AddDate(0, 0, -1)},
+		{ID: 43, CustomerID: 4, ExpireAt: now.AddDate(0, 0, 2)},
+	}}
+	logMock := &notificationLogMock{}
+
+	svc := NewSubscriptionService(&customerRepoMock{customers: customers}, sRepo, logMock, &purchaseRepoMock{tributes: &tributes}, &paymentServiceMock{}, nil, nil)
+	svc.stages = []int{3, 1, 0, -1}
+
+	sent := make(map[int64]int)
+	svc.notify = func(ctx context.Context, customer database.Customer, subscription database.Subscription, stage int) error {
+		sent[subscription.ID] = stage
+		return nil
+	}
+
+	for i := 0; i < 3; i++ {
+		if err := svc.ProcessSubscriptionExpiration(context.Background()); err != nil {
+			t.Fatalf("ProcessSubscriptionExpiration returned error: %v", err)
+		}
+	}
+
+	if len(logMock.marked) != 3 {
+		t.Fatalf("expected one ledger entry per subscription, got %#v", logMock.marked)
+	}
+	if sent[41] != 1 || sent[42] != -1 || sent[43] != 3 {
+		t.Fatalf("unexpected stages: %#v", sent)
+	}
+
+	// после продления тот же этап срабатывает снова
+	sRepo.subscriptions = []database.Subscription{{ID: 41, CustomerID: 4, ExpireAt: now.AddDate(0, 0, 1).Add(time.Hour)}}
+	delete(sent, 41)
+	if err := svc.ProcessSubscriptionExpiration(context.Background()); err != nil {
+		t.Fatalf("ProcessSubscriptionExpiration returned error: %v", err)
+	}
+	if _, ok := sent[41]; !ok {
+		t.Fatal("expected reminder for the renewed period")
+	}
+}
+
+func TestSubscriptionService_ProcessSubscriptionExpiration_UnmarksFailedSend(t *testing.T) {
+	customers := []database.Customer{{ID: 6}}
+	tributes := []database.Purchase{}
+	logMock := &notificationLogMock{}
+
+	svc := NewSubscriptionService(&customerRepoMock{customers: customers}, &subscriptionRepoMock{subscriptions: []database.Subscription{
+		{ID: 61, CustomerID: 6, ExpireAt: time.Now()},
+	}}, logMock, &purchaseRepoMock{tributes: &tributes}, &paymentServiceMock{}, nil, nil)
+	svc.stages = []int{0}
+	svc.notify = func(ctx context.Context, customer database.Customer, subscription database.Subscription, stage int) error {
+		return errors.New("blocked by user")
+	}
+
+	if err := svc.ProcessSubscriptionExpiration(context.Background()); err != nil {
+		t.Fatalf("ProcessSubscriptionExpiration returned error: %v", err)
+	}
+	if len(logMock.unmarked) != 1 || len(logMock.marked) != 0 {
+		t.Fatalf("expected failed reminder to be unmarked, got marked=%#v unmarked=%#v", logMock.marked, logMock.unmarked)
+	}
+}
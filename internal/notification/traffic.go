@@ -0,0 +1,186 @@
+package notification
+
+import (
+	"context"
+	"fmt"
+	"html"
+	"log/slog"
+	"time"
+
+	remapi "github.com/Jolymmiles/remnawave-api-go/v2/api"
+	"github.com/go-telegram/bot"
+	"github.com/go-telegram/bot/models"
+	"github.com/google/uuid"
+	"remnawave-tg-shop-bot/internal/config"
+	"remnawave-tg-shop-bot/internal/database"
+	"remnawave-tg-shop-bot/internal/remnawave"
+	"remnawave-tg-shop-bot/internal/translation"
+	"remnawave-tg-shop-bot/utils"
+)
+
+type trafficSubscriptionRepository interface {
+	FindAll(ctx context.Context) ([]database.Subscription, error)
+}
+
+type trafficNotificationLog interface {
+	notificationLogRepository
+	UnmarkMany(ctx context.Context, subscriptionIDs []int64, stage string) error
+}
+
+type remnawaveUsersGetter interface {
+	GetUsers(ctx context.Context) (*[]remapi.User, error)
+}
+
+// TrafficNotificationService предлагает докупить пакет трафика подпискам, израсходовавшим
+// TRAFFIC_NOTIFY_PERCENT процентов лимита
+type TrafficNotificationService struct {
+	customerRepository     customerRepository
+	subscriptionRepository trafficSubscriptionRepository
+	notificationLog        trafficNotificationLog
+	remnawave              remnawaveUsersGetter
+	telegramBot            *bot.Bot
+	tm                     *translation.Manager
+	percent                int
+	notify                 func(context.Context, database.Customer, database.Subscription, remnawave.Usage) error
+}
+
+func NewTrafficNotificationService(customerRepository customerRepository,
+	subscriptionRepository trafficSubscriptionRepository,
+	notificationLog trafficNotificationLog,
+	remnawave remnawaveUsersGetter,
+	telegramBot *bot.Bot,
+	tm *translation.Manager) *TrafficNotificationService {
+	svc := &TrafficNotificationService{customerRepository: customerRepository, subscriptionRepository: subscriptionRepository, notificationLog: notificationLog, remnawave: remnawave, telegramBot: telegramBot, tm: tm, percent: config.TrafficNotifyPercent()}
+	svc.notify = svc.sendNotification
+	return svc
+}
+
+// NotifyTrafficUsage отправляет предложение один раз, пока расход выше порога. Когда расход
+// опускается ниже (докуплен пакет или лимит сбросился в новом периоде), отметка снимается
+// и при следующем превышении предложение придёт снова.
+func (s *TrafficNotificationService) NotifyTrafficUsage(ctx context.Context) error {
+	subscriptions, err := s.subscriptionRepository.FindAll(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to find subscriptions: %w", err)
+	}
+	users, err := s.remnawave.GetUsers(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to get remnawave users: %w", err)
+	}
+	usersByUuid := make(map[uuid.UUID]*remapi.User, len(*users))
+	for i := range *users {
+		usersByUuid[(*users)[i].UUID] = &(*users)[i]
+	}
+
+	now := time.Now()
+	stage := trafficStageName(s.percent)
+	var below []int64
+	var exceeded []database.Subscription
+	usages := make(map[int64]remnawave.Usage)
+	for _, sub := range subscriptions {
+		if !sub.IsActive || sub.RemnawaveUUID == nil || !sub.ExpireAt.After(now) {
+			continue
+		}
+		user, ok := usersByUuid[*sub.RemnawaveUUID]
+		if !ok {
+			continue
+		}
+		usage := remnawave.UsageFromUser(user, now)
+		if usage.LimitBytes == 0 {
+			continue
+		}
+		if usage.UsedBytes*100 < usage.LimitBytes*int64(s.percent) {
+			below = append(below, sub.ID)
+			continue
+		}
+		exceeded = append(exceeded, sub)
+		usages[sub.ID] = usage
+	}
+
+	if err := s.notificationLog.UnmarkMany(ctx, below, stage); err != nil {
+		slog.Error("Failed to unmark traffic notifications", "error", err)
+	}
+	if len(exceeded) == 0 {
+		return nil
+	}
+
+	customersIds := make([]int64, 0, len(exceeded))
+	seen := make(map[int64]bool, len(exceeded))
+	for _, sub := range exceeded {
+		if !seen[sub.CustomerID] {
+			seen[sub.CustomerID] = true
+			customersIds = append(customersIds, sub.CustomerID)
+		}
+	}
+	customers, err := s.customerRepository.FindByIds(ctx, customersIds)
+	if err != nil {
+		return fmt.Errorf("failed to query customers: %w", err)
+	}
+	customersById := make(map[int64]database.Customer, len(customers))
+	for _, customer := range customers {
+		customersById[customer.ID] = customer
+	}
+
+	notificationsSent := 0
+	for _, sub := range exceeded {
+		customer, ok := customersById[sub.CustomerID]
+		if !ok {
+			continue
+		}
+		marked, err := s.notificationLog.TryMark(ctx, sub.ID, stage, sub.ExpireAt)
+		if err != nil {
+			slog.Error("Failed to mark traffic notification", "subscription_id", sub.ID, "error", err)
+			continue
+		}
+		if !marked {
+			continue
+		}
+
+		send := s.notify
+		if send == nil {
+			send = s.sendNotification
+		}
+		if err := send(ctx, customer, sub, usages[sub.ID]); err != nil {
+			slog.Error("Failed to send traffic notification", "customer_id", customer.ID, "subscription_id", sub.ID, "error", err)
+			if err := s.notificationLog.Unmark(ctx, sub.ID, stage); err != nil {
+				slog.Error("Failed to unmark traffic notification", "subscription_id", sub.ID, "error", err)
+			}
+			continue
+		}
+		notificationsSent++
+	}
+
+	slog.Info(fmt.Sprintf("Sent traffic notifications for %d subscriptions", notificationsSent))
+	return nil
+}
+
+// trafficStageName — ключ в notification_log, свой для каждого порога
+func trafficStageName(percent int) string {
+	return fmt.Sprintf("traffic_%d", percent)
+}
+
+func (s *TrafficNotificationService) sendNotification(ctx context.Context, customer database.Customer, subscription database.Subscription, usage remnawave.Usage) error {
+	_, err := s.telegramBot.SendMessage(ctx, &bot.SendMessageParams{
+		ChatID: customer.TelegramID,
+		Text: fmt.Sprintf(
+			s.tm.GetText(customer.Language, "traffic_running_out"),
+			html.EscapeString(subscription.Name),
+			min(usage.UsedBytes*100/usage.LimitBytes, 100),
+			utils.FormatBytes(usage.UsedBytes),
+			utils.FormatBytes(usage.LimitBytes),
+		),
+		ParseMode: models.ParseModeHTML,
+		ReplyMarkup: models.InlineKeyboardMarkup{
+			InlineKeyboard: [][]models.InlineKeyboardButton{
+				{
+					{
+						Text:         s.tm.GetText(customer.Language, "traffic_buy_button"),
+						CallbackData: fmt.Sprintf("traffic_packages?id=%d", subscription.ID),
+					},
+				},
+			},
+		},
+	})
+
+	return err
+}
@@ -0,0 +1,104 @@
+package notification
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	remapi "github.com/Jolymmiles/remnawave-api-go/v2/api"
+	"github.com/google/uuid"
+	"remnawave-tg-shop-bot/internal/database"
+	"remnawave-tg-shop-bot/internal/remnawave"
+)
+
+type trafficRepoMock struct {
+	subscriptions []database.Subscription
+}
+
+func (m *trafficRepoMock) FindAll(ctx context.Context) ([]database.Subscription, error) {
+	return m.subscriptions, nil
+}
+
+func (m *notificationLogMock) UnmarkMany(ctx context.Context, subscriptionIDs []int64, stage string) error {
+	for _, id := range subscriptionIDs {
+		if err := m.Unmark(ctx, id, stage); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+type usersGetterMock struct {
+	users []remapi.User
+}
+
+func (m *usersGetterMock) GetUsers(ctx context.Context) (*[]remapi.User, error) {
+	return &m.users, nil
+}
+
+const gigabyte = 1 << 30
+
+func trafficUser(userUuid uuid.UUID, usedGB, limitGB int) remapi.User {
+	return remapi.User{
+		UUID:              userUuid,
+		TrafficLimitBytes: remapi.NewOptInt(limitGB * gigabyte),
+		UserTraffic:       remapi.UserTrafficItem{UsedTrafficBytes: float64(usedGB * gigabyte)},
+	}
+}
+
+func TestNotifyTrafficUsage(t *testing.T) {
+	expireAt := time.Now().AddDate(0, 1, 0)
+	full, half, unlimited, expired := uuid.New(), uuid.New(), uuid.New(), uuid.New()
+	repo := &trafficRepoMock{subscriptions: []database.Subscription{
+		{ID: 1, CustomerID: 1, IsActive: true, ExpireAt: expireAt, RemnawaveUUID: &full},
+		{ID: 2, CustomerID: 1, IsActive: true, ExpireAt: expireAt, RemnawaveUUID: &half},
+		{ID: 3, CustomerID: 1, IsActive: true, ExpireAt: expireAt, RemnawaveUUID: &unlimited},
+		{ID: 4, CustomerID: 1, IsActive: true, ExpireAt: time.Now().Add(-time.Hour), RemnawaveUUID: &expired},
+	}}
+	rw := &usersGetterMock{users: []remapi.User{
+		trafficUser(full, 45, 50),
+		trafficUser(half, 25, 50),
+		trafficUser(unlimited, 500, 0),
+		trafficUser(expired, 50, 50),
+	}}
+	log := &notificationLogMock{}
+
+	var notified []int64
+	svc := &TrafficNotificationService{
+		customerRepository:     &customerRepoMock{customers: []database.Customer{{ID: 1, TelegramID: 100}}},
+		subscriptionRepository: repo,
+		notificationLog:        log,
+		remnawave:              rw,
+		percent:                80,
+		notify: func(ctx context.Context, customer database.Customer, subscription database.Subscription, usage remnawave.Usage) error {
+			notified = append(notified, subscription.ID)
+			return nil
+		},
+	}
+
+	for i := 0; i < 2; i++ {
+		if err := svc.NotifyTrafficUsage(context.Background()); err != nil {
+			t.Fatalf("NotifyTrafficUsage returned error: %v", err)
+		}
+	}
+	if len(notified) != 1 || notified[0] != 1 {
+		t.Fatalf("expected a single notification for subscription 1, got %v", notified)
+	}
+
+	// после покупки пакета расход опускается ниже порога, и следующее превышение снова уведомляется
+	rw.users[0] = trafficUser(full, 45, 100)
+	if err := svc.NotifyTrafficUsage(context.Background()); err != nil {
+		t.Fatalf("NotifyTrafficUsage returned error: %v", err)
+	}
+	if _, ok := log.marked[fmt.Sprintf("1:%s", trafficStageName(80))]; ok {
+		t.Fatal("expected the mark to be removed when usage drops below the threshold")
+	}
+	rw.users[0] = trafficUser(full, 90, 100)
+	if err := svc.NotifyTrafficUsage(context.Background()); err != nil {
+		t.Fatalf("NotifyTrafficUsage returned error: %v", err)
+	}
+	if len(notified) != 2 {
+		t.Fatalf("expected a second notification after crossing the threshold again, got %v", notified)
+	}
+}
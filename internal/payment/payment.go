@@ -0,0 +1,820 @@
+package payment
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"html"
+	"log/slog"
+	"strconv"
+	"strings"
+	"time"
+
+	remapi "github.com/Jolymmiles/remnawave-api-go/v2/api"
+	"github.com/go-telegram/bot"
+	"github.com/go-telegram/bot/models"
+	"github.com/google/uuid"
+
+	"remnawave-tg-shop-bot/internal/cache"
+	"remnawave-tg-shop-bot/internal/config"
+	"remnawave-tg-shop-bot/internal/cryptopay"
+	"remnawave-tg-shop-bot/internal/database"
+	"remnawave-tg-shop-bot/internal/remnawave"
+	"remnawave-tg-shop-bot/internal/translation"
+	"remnawave-tg-shop-bot/internal/yookasa"
+	"remnawave-tg-shop-bot/utils"
+)
+
+// StarsCurrency — код валюты Telegram Stars
+const StarsCurrency = "XTR"
+
+type purchaseRepository interface {
+	Create(ctx context.Context, purchase *database.Purchase) (int64, error)
+	FindById(ctx context.Context, id int64) (*database.Purchase, error)
+	UpdateFields(ctx context.Context, id int64, updates map[string]interface{}) error
+	MarkAsPaid(ctx context.Context, purchaseID int64) error
+	LockForProcessing(ctx context.Context, purchaseID int64) (func(), error)
+}
+
+type customerRepository interface {
+	FindById(ctx context.Context, id int64) (*database.Customer, error)
+	UpdateFields(ctx context.Context, id int64, updates map[string]interface{}) error
+}
+
+type subscriptionRepository interface {
+	GetActiveSubscriptions(ctx context.Context, customerID int64) ([]database.Subscription, error)
+	GetAllSubscriptions(ctx context.Context, customerID int64) ([]database.Subscription, error)
+	CreateSubscription(ctx context.Context, subscription *database.Subscription) (*database.Subscription, error)
+	UpdateSubscription(ctx context.Context, id int64, updates map[string]interface{}) error
+	GetSubscriptionByID(ctx context.Context, id int64) (*database.Subscription, error)
+	ActivateSubscription(ctx context.Context, id int64) error
+	RecountExtraTraffic(ctx context.Context, id int64, purchaseID int64) error
+}
+
+type remnawaveClient interface {
+	CreateCustomerUser(ctx context.Context, customerId int64, telegramId int64, plan config.Plan, expireAt time.Time) (*remapi.User, error)
+	FindCustomerUser(ctx context.Context, customerId int64, telegramId int64) (*remapi.User, error)
+	FindSubscriptionUser(ctx context.Context, userUuid *uuid.UUID, link string) (*remapi.User, error)
+	GetUserByUUID(ctx context.Context, userUuid uuid.UUID) (*remapi.User, error)
+	ExtendUserTo(ctx context.Context, user *remapi.User, plan config.Plan, expireAt time.Time) (*remapi.User, error)
+	CreatePlanUserForSubscription(ctx context.Context, customerId int64, telegramId int64, plan config.Plan, seq int, expireAt time.Time) (*remapi.User, error)
+	SetTrafficLimit(ctx context.Context, userUuid uuid.UUID, limit int) (*remapi.User, error)
+}
+
+// usageCache — кеш потребления трафика, который сбрасывается после покупки пакета
+type usageCache interface {
+	Invalidate(userUuid uuid.UUID)
+}
+
+// referralRewards вычитает реферальный баланс из счёта и начисляет награды после оплаты
+type referralRewards interface {
+	ApplyBalance(ctx context.Context, customer *database.Customer, purchase *database.Purchase)
+	OnPurchase(ctx context.Context, customer *database.Customer, purchase *database.Purchase)
+}
+
+// promoDiscounts применяет скидку промокода к счёту и погашает её после оплаты
+type promoDiscounts interface {
+	ApplyDiscount(ctx context.Context, customer *database.Customer, purchase *database.Purchase) int64
+	BindDiscount(ctx context.Context, redemptionID, purchaseID int64)
+	OnPurchasePaid(ctx context.Context, purchase *database.Purchase)
+}
+
+type PaymentService struct {
+	purchaseRepository     purchaseRepository
+	remnawaveClient        remnawaveClient
+	customerRepository     customerRepository
+	subscriptionRepository subscriptionRepository
+	referralRewards        referralRewards
+	promos                 promoDiscounts
+	telegramBot            *bot.Bot
+	translation            *translation.Manager
+	cryptoPayClient        *cryptopay.Client
+	yookasaClient          *yookasa.Client
+	cache                  *cache.Cache
+	usage                  usageCache
+}
+
+func NewPaymentService(
+	translation *translation.Manager,
+	purchaseRepository purchaseRepository,
+	remnawaveClient remnawaveClient,
+	customerRepository customerRepository,
+	subscriptionRepository subscriptionRepository,
+	referralRewards referralRewards,
+	promos promoDiscounts,
+	telegramBot *bot.Bot,
+	cryptoPayClient *cryptopay.Client,
+	yookasaClient *yookasa.Client,
+	cache *cache.Cache,
+	usage usageCache,
+) *PaymentService {
+	return &PaymentService{
+		purchaseRepository:     purchaseRepository,
+		remnawaveClient:        remnawaveClient,
+		customerRepository:     customerRepository,
+		subscriptionRepository: subscriptionRepository,
+		referralRewards:        referralRewards,
+		promos:                 promos,
+		telegramBot:            telegramBot,
+		translation:            translation,
+		cryptoPayClient:        cryptoPayClient,
+		yookasaClient:          yookasaClient,
+		cache:                  cache,
+		usage:                  usage,
+	}
+}
+
+// CreatePurchase сохраняет покупку на число месяцев и выставляет счёт в выбранной платёжной системе.
+// Возвращает ссылку на оплату и id покупки.
+func (s PaymentService) CreatePurchase(ctx context.Context, amount float64, months int, customer *database.Customer, invoiceType database.InvoiceType) (string, int64, error) {
+	return s.createPurchase(ctx, &database.Purchase{
+		Kind:   database.PurchaseKindSubscription,
+		Amount: amount,
+		Month:  months,
+	}, customer, invoiceType)
+}
+
+// CreateTributePurchase сохраняет покупку по событию подписки Tribute с суммой и валютой из вебхука.
+// Покупка по уже принятому событию не создаётся, возвращается database.ErrTributeEventExists.
+func (s PaymentService) CreateTributePurchase(ctx context.Context, amount float64, currency string, months int, customer *database.Customer, event string) (int64, error) {
+	if currency == "" {
+		currency = "RUB"
+	}
+	_, purchaseId, err := s.createTributePurchase(ctx, &database.Purchase{
+		Kind:         database.PurchaseKindSubscription,
+		Amount:       amount,
+		Month:        months,
+		CustomerID:   customer.ID,
+		InvoiceType:  database.InvoiceTypeTribute,
+		Currency:     strings.ToUpper(currency),
+		TributeEvent: &event,
+	})
+	return purchaseId, err
+}
+
+// CreatePlanPurchase выставляет счёт за тариф каталога. С subscriptionID покупка продлевает
+// эту подписку, с 0 — подписку клиента без привязки.
+func (s PaymentService) CreatePlanPurchase(ctx context.Context, amount float64, plan config.Plan, subscriptionID int64, customer *database.Customer, invoiceType database.InvoiceType) (string, int64, error) {
+	purchase := &database.Purchase{
+		Kind:   database.PurchaseKindSubscription,
+		Amount: amount,
+		Month:  plan.Months,
+		PlanID: plan.ID,
+		Days:   plan.Days,
+	}
+	if subscriptionID != 0 {
+		purchase.SubscriptionID = &subscriptionID
+	}
+	return s.createPurchase(ctx, purchase, customer, invoiceType)
+}
+
+// CreateTrafficPurchase выставляет счёт за пакет трафика для подписки
+func (s PaymentService) CreateTrafficPurchase(ctx context.Context, amount float64, trafficGB int, subscriptionID int64, customer *database.Customer, invoiceType database.InvoiceType) (string, int64, error) {
+	return s.createPurchase(ctx, &database.Purchase{
+		Kind:           database.PurchaseKindTraffic,
+		Amount:         amount,
+		SubscriptionID: &subscriptionID,
+		TrafficGB:      trafficGB,
+	}, customer, invoiceType)
+}
+
+// createPurchase выставляет счёт в выбранной платёжной системе. Активная скидка промокода
+// и реферальный баланс уменьшают сумму счёта; у Tribute цена задаётся на его стороне, поэтому
+// они не применяются.
+func (s PaymentService) createPurchase(ctx context.Context, purchase *database.Purchase, customer *database.Customer, invoiceType database.InvoiceType) (string, int64, error) {
+	purchase.CustomerID = customer.ID
+	purchase.InvoiceType = invoiceType
+	purchase.Currency = "RUB"
+	if invoiceType == database.InvoiceTypeTelegram {
+		purchase.Currency = StarsCurrency
+	}
+	var redemptionID int64
+	if s.promos != nil && invoiceType != database.InvoiceTypeTribute {
+		redemptionID = s.promos.ApplyDiscount(ctx, customer, purchase)
+	}
+	if s.referralRewards != nil && invoiceType != database.InvoiceTypeTribute {
+		s.referralRewards.ApplyBalance(ctx, customer, purchase)
+	}
+
+	var url string
+	var purchaseId int64
+	var err error
+	switch invoiceType {
+	case database.InvoiceTypeCrypto:
+		url, purchaseId, err = s.createCryptoInvoice(ctx, purchase)
+	case database.InvoiceTypeYookasa:
+		url, purchaseId, err = s.createYookasaInvoice(ctx, purchase)
+	case database.InvoiceTypeTribute:
+		url, purchaseId, err = s.createTributePurchase(ctx, purchase)
+	case database.InvoiceTypeTelegram:
+		url, purchaseId, err = s.createTelegramInvoice(ctx, purchase, customer)
+	default:
+		return "", 0, fmt.Errorf("unknown invoice type: %s", invoiceType)
+	}
+	if err == nil && redemptionID != 0 {
+		s.promos.BindDiscount(ctx, redemptionID, purchaseId)
+	}
+	return url, purchaseId, err
+}
+
+func (s PaymentService) createCryptoInvoice(ctx context.Context, purchase *database.Purchase) (string, int64, error) {
+	if s.cryptoPayClient == nil {
+		return "", 0, errors.New("crypto pay is not configured")
+	}
+
+	purchase.Status = database.PurchaseStatusNew
+	purchase.Currency = "RUB"
+	purchaseId, err := s.purchaseRepository.Create(ctx, purchase)
+	if err != nil {
+		return "", 0, fmt.Errorf("failed to create purchase: %w", err)
+	}
+
+	description := fmt.Sprintf("Subscription on %d month", purchase.Month)
+	if purchase.Month == 0 {
+		description = fmt.Sprintf("Subscription on %d days", purchase.Days)
+	}
+	if purchase.Kind == database.PurchaseKindTraffic {
+		description = fmt.Sprintf("Additional traffic %d GB", purchase.TrafficGB)
+	}
+	invoice, err := s.cryptoPayClient.CreateInvoice(&cryptopay.InvoiceRequest{
+		CurrencyType:   "fiat",
+		Fiat:           "RUB",
+		Amount:         fmt.Sprintf("%d", int(purchase.Amount)),
+		AcceptedAssets: "USDT",
+		Payload:        fmt.Sprintf("purchaseId=%d&username=%v", purchaseId, ctx.Value("username")),
+		Description:    description,
+		PaidBtnName:    "callback",
+		PaidBtnUrl:     config.BotURL(),
+	})
+	if err != nil {
+		return "", 0, fmt.Errorf("failed to create crypto invoice: %w", err)
+	}
+
+	updates := map[string]interface{}{
+		"crypto_invoice_url": invoice.BotInvoiceUrl,
+		"crypto_invoice_id":  invoice.InvoiceID,
+		"status":             database.PurchaseStatusPending,
+	}
+	if err := s.purchaseRepository.UpdateFields(ctx, purchaseId, updates); err != nil {
+		return "", 0, fmt.Errorf("failed to update purchase: %w", err)
+	}
+
+	return invoice.BotInvoiceUrl, purchaseId, nil
+}
+
+func (s PaymentService) createYookasaInvoice(ctx context.Context, purchase *database.Purchase) (string, int64, error) {
+	if s.yookasaClient == nil {
+		return "", 0, errors.New("yookasa is not configured")
+	}
+
+	purchase.Status = database.PurchaseStatusNew
+	purchase.Currency = "RUB"
+	purchaseId, err := s.purchaseRepository.Create(ctx, purchase)
+	if err != nil {
+		return "", 0, fmt.Errorf("failed to create purchase: %w", err)
+	}
+
+	description := yookasa.SubscriptionDescription(purchase.Month)
+	if purchase.Month == 0 {
+		description = yookasa.SubscriptionDaysDescription(purchase.Days)
+	}
+	if purchase.Kind == database.PurchaseKindTraffic {
+		description = yookasa.TrafficDescription(purchase.TrafficGB)
+	}
+	invoice, err := s.yookasaClient.CreateInvoice(ctx, int(purchase.Amount), description, purchase.CustomerID, purchaseId)
+	if err != nil {
+		return "", 0, fmt.Errorf("failed to create yookasa invoice: %w", err)
+	}
+
+	updates := map[string]interface{}{
+		"yookasa_url": invoice.Confirmation.ConfirmationURL,
+		"yookasa_id":  invoice.ID,
+		"status":      database.PurchaseStatusPending,
+	}
+	if err := s.purchaseRepository.UpdateFields(ctx, purchaseId, updates); err != nil {
+		return "", 0, fmt.Errorf("failed to update purchase: %w", err)
+	}
+
+	return invoice.Confirmation.ConfirmationURL, purchaseId, nil
+}
+
+// createTelegramInvoice выставляет счёт в Telegram Stars. В payload счёта кладётся id покупки,
+// по нему её находят pre_checkout_query и successful_payment.
+func (s PaymentService) createTelegramInvoice(ctx context.Context, purchase *database.Purchase, customer *database.Customer) (string, int64, error) {
+	if s.telegramBot == nil {
+		return "", 0, errors.New("telegram bot is not configured")
+	}
+
+	purchase.Status = database.PurchaseStatusNew
+	purchase.Currency = StarsCurrency
+	purchaseId, err := s.purchaseRepository.Create(ctx, purchase)
+	if err != nil {
+		return "", 0, fmt.Errorf("failed to create purchase: %w", err)
+	}
+
+	description := fmt.Sprintf("%s (%d %s)", s.translation.GetText(customer.Language, "invoice_description"), purchase.Month, s.translation.GetText(customer.Language, "months_word"))
+	if purchase.Month == 0 {
+		description = fmt.Sprintf("%s (%d %s)", s.translation.GetText(customer.Language, "invoice_description"), purchase.Days, s.translation.GetText(customer.Language, "days_word"))
+	}
+	if purchase.Kind == database.PurchaseKindTraffic {
+		description = fmt.Sprintf(s.translation.GetText(customer.Language, "invoice_traffic_description"), purchase.TrafficGB)
+	}
+	invoiceURL, err := s.telegramBot.CreateInvoiceLink(ctx, &bot.CreateInvoiceLinkParams{
+		Title:       s.translation.GetText(customer.Language, "invoice_title"),
+		Description: description,
+		Payload:     StarsInvoicePayload(purchaseId),
+		Currency:    StarsCurrency,
+		Prices: []models.LabeledPrice{
+			{Label: s.translation.GetText(customer.Language, "invoice_label"), Amount: int(purchase.Amount)},
+		},
+	})
+	if err != nil {
+		return "", 0, fmt.Errorf("failed to create stars invoice: %w", err)
+	}
+
+	if err := s.purchaseRepository.UpdateFields(ctx, purchaseId, map[string]interface{}{
+		"status": database.PurchaseStatusPending,
+	}); err != nil {
+		return "", 0, fmt.Errorf("failed to update purchase: %w", err)
+	}
+
+	return invoiceURL, purchaseId, nil
+}
+
+func (s PaymentService) createTributePurchase(ctx context.Context, purchase *database.Purchase) (string, int64, error) {
+	if purchase.Kind != database.PurchaseKindSubscription {
+		return "", 0, fmt.Errorf("tribute does not support %s purchases", purchase.Kind)
+	}
+
+	purchase.Status = database.PurchaseStatusPending
+	purchaseId, err := s.purchaseRepository.Create(ctx, purchase)
+	if err != nil {
+		return "", 0, fmt.Errorf("failed to create purchase: %w", err)
+	}
+
+	return config.GetTributePaymentUrl(), purchaseId, nil
+}
+
+// ProcessPurchaseById продлевает (или создаёт) пользователя в remnawave по оплаченной покупке
+// и отражает результат в таблице подписок. Покупка, привязанная к подписке, продлевает именно её.
+// Повторный вызов для уже оплаченной покупки ничего не делает, поэтому дубли вебхуков
+// не продлевают подписку дважды. После оплаты погашается скидка промокода и начисляются реферальные награды.
+func (s PaymentService) ProcessPurchaseById(ctx context.Context, purchaseId int64) error {
+	unlock, err := s.purchaseRepository.LockForProcessing(ctx, purchaseId)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	purchase, err := s.purchaseRepository.FindById(ctx, purchaseId)
+	if err != nil {
+		return err
+	}
+	if purchase == nil {
+		return fmt.Errorf("purchase with id %d not found", purchaseId)
+	}
+	if purchase.Status == database.PurchaseStatusPaid {
+		slog.Info("purchase already processed", "purchase_id", utils.MaskHalfInt64(purchase.ID))
+		return nil
+	}
+
+	customer, err := s.customerRepository.FindById(ctx, purchase.CustomerID)
+	if err != nil {
+		return err
+	}
+	if customer == nil {
+		return fmt.Errorf("customer %s not found", utils.MaskHalfInt64(purchase.CustomerID))
+	}
+
+	switch {
+	case purchase.Kind == database.PurchaseKindTraffic:
+		err = s.processTrafficPurchase(ctx, purchase, customer)
+	case purchase.SubscriptionID != nil:
+		err = s.processRenewalPurchase(ctx, purchase, customer)
+	default:
+		err = s.processSubscriptionPurchase(ctx, purchase, customer)
+	}
+	if err != nil {
+		return err
+	}
+
+	if s.promos != nil {
+		s.promos.OnPurchasePaid(ctx, purchase)
+	}
+	if s.referralRewards != nil {
+		s.referralRewards.OnPurchase(ctx, customer, purchase)
+	}
+	return nil
+}
+
+// processSubscriptionPurchase продлевает собственного пользователя клиента или создаёт его
+func (s PaymentService) processSubscriptionPurchase(ctx context.Context, purchase *database.Purchase, customer *database.Customer) error {
+	user, err := s.extendCustomerUser(ctx, purchase, customer, purchasePlan(purchase))
+	if err != nil {
+		return err
+	}
+
+	if err := s.purchaseRepository.MarkAsPaid(ctx, purchase.ID); err != nil {
+		return err
+	}
+
+	customerUpdates := map[string]interface{}{
+		"subscription_link": user.SubscriptionUrl,
+		"expire_at":         user.ExpireAt,
+	}
+	if err := s.customerRepository.UpdateFields(ctx, customer.ID, customerUpdates); err != nil {
+		return err
+	}
+
+	if err := s.upsertSubscription(ctx, customer, user); err != nil {
+		return err
+	}
+
+	s.notifyPaid(ctx, customer, purchase.ID, s.translation.GetText(customer.Language, "subscription_activated"))
+	slog.Info("purchase processed", "purchase_id", utils.MaskHalfInt64(purchase.ID), "type", purchase.InvoiceType, "customer_id", utils.MaskHalfInt64(customer.ID))
+	return nil
+}
+
+// extendCustomerUser продлевает собственного пользователя клиента ({customerId}_{telegramId}) по uuid
+// из его подписки. По telegram id пользователь ищется, только если у клиента есть подписки,
+// сохранённые до хранения uuid, или пользователя могла создать прерванная обработка этой же покупки.
+// Если пользователя нет, он создаётся.
+func (s PaymentService) extendCustomerUser(ctx context.Context, purchase *database.Purchase, customer *database.Customer, plan config.Plan) (*remapi.User, error) {
+	subs, err := s.subscriptionRepository.GetAllSubscriptions(ctx, customer.ID)
+	if err != nil {
+		return nil, err
+	}
+
+	username := remnawave.CustomerUsername(customer.ID, customer.TelegramID)
+	legacy := false
+	for _, sub := range subs {
+		if sub.RemnawaveUUID == nil {
+			legacy = true
+			continue
+		}
+		if sub.Username == nil || *sub.Username != username {
+			continue
+		}
+		user, err := s.extendUser(ctx, purchase, *sub.RemnawaveUUID, withExtraTraffic(plan, sub.ExtraTrafficGB))
+		// пользователя могли удалить из панели (EXPIRED_USER_ACTION=delete), тогда он создаётся заново
+		if !errors.Is(err, remnawave.ErrUserNotFound) {
+			return user, err
+		}
+	}
+
+	if legacy || purchase.TargetExpireAt != nil {
+		user, err := s.remnawaveClient.FindCustomerUser(ctx, customer.ID, customer.TelegramID)
+		if err != nil {
+			return nil, err
+		}
+		if user != nil {
+			return s.applyPlan(ctx, purchase, user, plan)
+		}
+	}
+
+	expireAt, err := s.targetExpire(ctx, purchase, time.Time{}, plan.Days)
+	if err != nil {
+		return nil, err
+	}
+	return s.remnawaveClient.CreateCustomerUser(ctx, customer.ID, customer.TelegramID, plan, expireAt)
+}
+
+// extendUser продлевает пользователя remnawave по тарифу покупки
+func (s PaymentService) extendUser(ctx context.Context, purchase *database.Purchase, userUuid uuid.UUID, plan config.Plan) (*remapi.User, error) {
+	user, err := s.remnawaveClient.GetUserByUUID(ctx, userUuid)
+	if err != nil {
+		return nil, err
+	}
+	if user == nil {
+		return nil, fmt.Errorf("%w: %s", remnawave.ErrUserNotFound, userUuid)
+	}
+	return s.applyPlan(ctx, purchase, user, plan)
+}
+
+// applyPlan применяет тариф покупки к пользователю и ставит ему срок из targetExpire
+func (s PaymentService) applyPlan(ctx context.Context, purchase *database.Purchase, user *remapi.User, plan config.Plan) (*remapi.User, error) {
+	expireAt, err := s.targetExpire(ctx, purchase, user.ExpireAt, plan.Days)
+	if err != nil {
+		return nil, err
+	}
+	return s.remnawaveClient.ExtendUserTo(ctx, user, plan, expireAt)
+}
+
+// targetExpire возвращает срок, до которого покупка продлевает подписку. Он считается от текущего
+// срока и сохраняется в покупке до обращения к панели: если после продления не удалось отметить
+// покупку оплаченной, повторная обработка ставит тот же срок, а не добавляет дни ещё раз.
+func (s PaymentService) targetExpire(ctx context.Context, purchase *database.Purchase, current time.Time, days int) (time.Time, error) {
+	if purchase.TargetExpireAt != nil {
+		return *purchase.TargetExpireAt, nil
+	}
+	target := remnawave.NewExpire(days, current).Truncate(time.Second)
+	if err := s.purchaseRepository.UpdateFields(ctx, purchase.ID, map[string]interface{}{"target_expire_at": target}); err != nil {
+		return time.Time{}, err
+	}
+	purchase.TargetExpireAt = &target
+	return target, nil
+}
+
+// purchasePlan возвращает тариф, по которому продлевается подписка. Срок берётся из покупки,
+// чтобы изменения каталога после выставления счёта не меняли оплаченное. Покупки без тарифа
+// продлевают на Month месяцев.
+func purchasePlan(purchase *database.Purchase) config.Plan {
+	plan, ok := config.FindPlan(purchase.PlanID)
+	if !ok {
+		plan = config.MonthsPlan(purchase.Month)
+	}
+	plan.Days = purchase.Month * config.DaysInMonth()
+	if purchase.Days > 0 {
+		plan.Days = purchase.Days
+	}
+	return plan
+}
+
+// renewalPlan — тариф продления подписки: купленные пакеты трафика добавляются к лимиту,
+// иначе продление сбросило бы его до лимита тарифа
+func renewalPlan(purchase *database.Purchase, sub *database.Subscription) config.Plan {
+	return withExtraTraffic(purchasePlan(purchase), sub.ExtraTrafficGB)
+}
+
+// withExtraTraffic добавляет гигабайты к лимиту тарифа; безлимитный тариф не меняется
+func withExtraTraffic(plan config.Plan, gb int) config.Plan {
+	if plan.TrafficLimitGB > 0 {
+		plan.TrafficLimitGB += gb
+	}
+	return plan
+}
+
+// purchaseSubscription возвращает подписку, к которой привязана покупка, проверяя владельца
+func (s PaymentService) purchaseSubscription(ctx context.Context, purchase *database.Purchase, customer *database.Customer) (*database.Subscription, error) {
+	sub, err := s.subscriptionRepository.GetSubscriptionByID(ctx, *purchase.SubscriptionID)
+	if err != nil {
+		return nil, err
+	}
+	if sub == nil || sub.CustomerID != customer.ID {
+		return nil, fmt.Errorf("subscription %d of purchase %d not found", *purchase.SubscriptionID, purchase.ID)
+	}
+	return sub, nil
+}
+
+// processRenewalPurchase продлевает пользователя remnawave выбранной подписки: дни добавляются
+// к текущему сроку, а если он уже прошёл — к текущему моменту. У подписок, созданных до хранения
+// uuid, пользователь ищется по shortUuid из ссылки.
+func (s PaymentService) processRenewalPurchase(ctx context.Context, purchase *database.Purchase, customer *database.Customer) error {
+	sub, err := s.purchaseSubscription(ctx, purchase, customer)
+	if err != nil {
+		return err
+	}
+
+	plan := renewalPlan(purchase, sub)
+	userUuid := sub.RemnawaveUUID
+	if userUuid == nil {
+		found, err := s.remnawaveClient.FindSubscriptionUser(ctx, nil, sub.SubscriptionLink)
+		if err != nil {
+			return err
+		}
+		if found != nil {
+			userUuid = &found.UUID
+		}
+	}
+
+	var user *remapi.User
+	if userUuid != nil {
+		user, err = s.extendUser(ctx, purchase, *userUuid, plan)
+	}
+	// пользователя истёкшей подписки могли удалить из панели (EXPIRED_USER_ACTION=delete),
+	// тогда подписка получает нового пользователя
+	if userUuid == nil || errors.Is(err, remnawave.ErrUserNotFound) {
+		user, err = s.recreateSubscriptionUser(ctx, purchase, customer, plan)
+	}
+	if err != nil {
+		return err
+	}
+
+	if err := s.purchaseRepository.MarkAsPaid(ctx, purchase.ID); err != nil {
+		return err
+	}
+
+	if err := s.subscriptionRepository.UpdateSubscription(ctx, sub.ID, map[string]interface{}{
+		"expire_at":         user.ExpireAt,
+		"subscription_link": user.SubscriptionUrl,
+		"remnawave_uuid":    user.UUID,
+		"short_uuid":        user.ShortUuid,
+		"username":          user.Username,
+	}); err != nil {
+		return err
+	}
+	if !sub.IsActive {
+		if err := s.subscriptionRepository.ActivateSubscription(ctx, sub.ID); err != nil {
+			return err
+		}
+	}
+	if s.usage != nil {
+		s.usage.Invalidate(user.UUID)
+	}
+
+	s.notifyPaid(ctx, customer, purchase.ID, fmt.Sprintf(s.translation.GetText(customer.Language, "subscription_renewed"), html.EscapeString(sub.Name), user.ExpireAt.Format("02.01.2006")))
+	slog.Info("renewal purchase processed", "purchase_id", utils.MaskHalfInt64(purchase.ID), "type", purchase.InvoiceType, "subscription_id", sub.ID)
+	return nil
+}
+
+func (s PaymentService) recreateSubscriptionUser(ctx context.Context, purchase *database.Purchase, customer *database.Customer, plan config.Plan) (*remapi.User, error) {
+	active, err := s.subscriptionRepository.GetActiveSubscriptions(ctx, customer.ID)
+	if err != nil {
+		return nil, err
+	}
+	expireAt, err := s.targetExpire(ctx, purchase, time.Time{}, plan.Days)
+	if err != nil {
+		return nil, err
+	}
+	slog.Info("subscription user not found in panel, creating a new one", "purchase_id", utils.MaskHalfInt64(purchase.ID))
+	return s.remnawaveClient.CreatePlanUserForSubscription(ctx, customer.ID, customer.TelegramID, plan, len(active)+1, expireAt)
+}
+
+// processTrafficPurchase поднимает лимит трафика пользователя remnawave, которым обеспечена подписка
+func (s PaymentService) processTrafficPurchase(ctx context.Context, purchase *database.Purchase, customer *database.Customer) error {
+	if purchase.SubscriptionID == nil {
+		return fmt.Errorf("traffic purchase %d has no subscription", purchase.ID)
+	}
+	sub, err := s.purchaseSubscription(ctx, purchase, customer)
+	if err != nil {
+		return err
+	}
+	if sub.RemnawaveUUID == nil {
+		return fmt.Errorf("subscription %d has no remnawave user", sub.ID)
+	}
+
+	user, err := s.remnawaveClient.GetUserByUUID(ctx, *sub.RemnawaveUUID)
+	if err != nil {
+		return err
+	}
+	if user == nil {
+		return fmt.Errorf("%w: %s", remnawave.ErrUserNotFound, *sub.RemnawaveUUID)
+	}
+	limit, err := s.targetTrafficLimit(ctx, purchase, user)
+	if err != nil {
+		return err
+	}
+	if _, err := s.remnawaveClient.SetTrafficLimit(ctx, user.UUID, limit); err != nil {
+		return err
+	}
+	if err := s.subscriptionRepository.RecountExtraTraffic(ctx, sub.ID, purchase.ID); err != nil {
+		return err
+	}
+	if s.usage != nil {
+		s.usage.Invalidate(*sub.RemnawaveUUID)
+	}
+
+	if err := s.purchaseRepository.MarkAsPaid(ctx, purchase.ID); err != nil {
+		return err
+	}
+
+	s.notifyPaid(ctx, customer, purchase.ID, fmt.Sprintf(s.translation.GetText(customer.Language, "traffic_added"), html.EscapeString(sub.Name), purchase.TrafficGB))
+	slog.Info("traffic purchase processed", "purchase_id", utils.MaskHalfInt64(purchase.ID), "type", purchase.InvoiceType, "subscription_id", sub.ID, "gb", purchase.TrafficGB)
+	return nil
+}
+
+// targetTrafficLimit возвращает лимит трафика, который выставляет пакет: текущий лимит пользователя
+// плюс пакет. Лимит сохраняется в покупке до обращения к панели, поэтому повторная обработка после
+// сбоя выставляет тот же лимит, а не добавляет пакет ещё раз.
+func (s PaymentService) targetTrafficLimit(ctx context.Context, purchase *database.Purchase, user *remapi.User) (int, error) {
+	if purchase.TargetTrafficLimit != nil {
+		return int(*purchase.TargetTrafficLimit), nil
+	}
+	current := user.TrafficLimitBytes.Or(0)
+	if current == 0 {
+		return 0, fmt.Errorf("user %s has unlimited traffic", user.UUID)
+	}
+	target := int64(current + config.GigabytesToBytes(purchase.TrafficGB))
+	if err := s.purchaseRepository.UpdateFields(ctx, purchase.ID, map[string]interface{}{"target_traffic_limit": target}); err != nil {
+		return 0, err
+	}
+	purchase.TargetTrafficLimit = &target
+	return int(target), nil
+}
+
+// upsertSubscription обновляет подписку, соответствующую пользователю remnawave, или создаёт новую.
+// Неактивная подписка того же пользователя снова активируется, а не дублируется.
+func (s PaymentService) upsertSubscription(ctx context.Context, customer *database.Customer, user *remapi.User) error {
+	subs, err := s.subscriptionRepository.GetAllSubscriptions(ctx, customer.ID)
+	if err != nil {
+		return err
+	}
+	active := 0
+	for _, sub := range subs {
+		if sub.IsActive {
+			active++
+		}
+	}
+	for _, sub := range subs {
+		if !matchesUser(sub, user) {
+			continue
+		}
+		if err := s.subscriptionRepository.UpdateSubscription(ctx, sub.ID, map[string]interface{}{
+			"expire_at":         user.ExpireAt,
+			"subscription_link": user.SubscriptionUrl,
+			"remnawave_uuid":    user.UUID,
+			"short_uuid":        user.ShortUuid,
+			"username":          user.Username,
+		}); err != nil {
+			return err
+		}
+		if sub.IsActive {
+			return nil
+		}
+		return s.subscriptionRepository.ActivateSubscription(ctx, sub.ID)
+	}
+
+	_, err = s.subscriptionRepository.CreateSubscription(ctx, &database.Subscription{
+		CustomerID:       customer.ID,
+		SubscriptionLink: user.SubscriptionUrl,
+		ExpireAt:         user.ExpireAt,
+		IsActive:         true,
+		Name:             fmt.Sprintf("%s #%d", s.translation.GetText(customer.Language, "subscription_name"), active+1),
+		RemnawaveUUID:    &user.UUID,
+		ShortUUID:        &user.ShortUuid,
+		Username:         &user.Username,
+	})
+	return err
+}
+
+// matchesUser сравнивает подписку с пользователем по uuid, а у старых подписок без uuid —
+// по ссылке; если домен подписок в панели поменялся, ссылка всё равно заканчивается на shortUuid.
+func matchesUser(sub database.Subscription, user *remapi.User) bool {
+	if sub.RemnawaveUUID != nil {
+		return *sub.RemnawaveUUID == user.UUID
+	}
+	if sub.SubscriptionLink == user.SubscriptionUrl {
+		return true
+	}
+	return user.ShortUuid != "" && strings.HasSuffix(sub.SubscriptionLink, "/"+user.ShortUuid)
+}
+
+func (s PaymentService) notifyPaid(ctx context.Context, customer *database.Customer, purchaseId int64, text string) {
+	if s.telegramBot == nil {
+		return
+	}
+
+	if s.cache != nil {
+		if messageId, ok := s.cache.Get(purchaseId); ok {
+			_, err := s.telegramBot.DeleteMessage(ctx, &bot.DeleteMessageParams{
+				ChatID:    customer.TelegramID,
+				MessageID: messageId,
+			})
+			if err != nil {
+				slog.Error("Error deleting invoice message", "error", err)
+			}
+		}
+	}
+
+	_, err := s.telegramBot.SendMessage(ctx, &bot.SendMessageParams{
+		ChatID:    customer.TelegramID,
+		Text:      text,
+		ParseMode: models.ParseModeHTML,
+		ReplyMarkup: models.InlineKeyboardMarkup{
+			InlineKeyboard: [][]models.InlineKeyboardButton{
+				{{Text: s.translation.GetText(customer.Language, "my_subscriptions_button"), CallbackData: "my_subscriptions"}},
+			},
+		},
+	})
+	if err != nil {
+		slog.Error("Error sending subscription activated message", "error", err)
+	}
+}
+
+// CancelPayment помечает покупку отменённой
+func (s PaymentService) CancelPayment(ctx context.Context, purchaseId int64) error {
+	unlock, err := s.purchaseRepository.LockForProcessing(ctx, purchaseId)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	purchase, err := s.purchaseRepository.FindById(ctx, purchaseId)
+	if err != nil {
+		return err
+	}
+	if purchase == nil {
+		return fmt.Errorf("purchase with id %d not found", purchaseId)
+	}
+	if purchase.Status == database.PurchaseStatusPaid {
+		return nil
+	}
+
+	return s.purchaseRepository.UpdateFields(ctx, purchaseId, map[string]interface{}{
+		"status": database.PurchaseStatusCancel,
+	})
+}
+
+// StarsInvoicePayload кодирует id покупки в payload счёта Telegram Stars
+func StarsInvoicePayload(purchaseId int64) string {
+	return fmt.Sprintf("purchaseId=%d", purchaseId)
+}
+
+// ParseStarsInvoicePayload достаёт id покупки из payload счёта Telegram Stars
+func ParseStarsInvoicePayload(payload string) (int64, error) {
+	raw, ok := strings.CutPrefix(payload, "purchaseId=")
+	if !ok {
+		return 0, fmt.Errorf("unexpected invoice payload: %q", payload)
+	}
+	return strconv.ParseInt(raw, 10, 64)
+}
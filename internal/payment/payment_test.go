@@ -0,0 +1,712 @@
+package payment
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"testing"
+	"time"
+
+	remapi "github.com/Jolymmiles/remnawave-api-go/v2/api"
+	"github.com/google/uuid"
+
+	"remnawave-tg-shop-bot/internal/config"
+	"remnawave-tg-shop-bot/internal/database"
+	"remnawave-tg-shop-bot/internal/translation"
+)
+
+type purchaseRepoMock struct {
+	purchases  map[int64]*database.Purchase
+	locks      int
+	unlocks    int
+	markedPaid []int64
+	fieldsByID map[int64]map[string]interface{}
+	failPaid   int
+}
+
+func (m *purchaseRepoMock) Create(ctx context.Context, purchase *database.Purchase) (int64, error) {
+	id := int64(len(m.purchases) + 1)
+	p := *purchase
+	p.ID = id
+	m.purchases[id] = &p
+	return id, nil
+}
+
+func (m *purchaseRepoMock) FindById(ctx context.Context, id int64) (*database.Purchase, error) {
+	p, ok := m.purchases[id]
+	if !ok {
+		return nil, nil
+	}
+	cp := *p
+	return &cp, nil
+}
+
+func (m *purchaseRepoMock) UpdateFields(ctx context.Context, id int64, updates map[string]interface{}) error {
+	if m.fieldsByID == nil {
+		m.fieldsByID = make(map[int64]map[string]interface{})
+	}
+	m.fieldsByID[id] = updates
+	if status, ok := updates["status"].(database.PurchaseStatus); ok {
+		m.purchases[id].Status = status
+	}
+	if target, ok := updates["target_expire_at"].(time.Time); ok {
+		m.purchases[id].TargetExpireAt = &target
+	}
+	if limit, ok := updates["target_traffic_limit"].(int64); ok {
+		m.purchases[id].TargetTrafficLimit = &limit
+	}
+	return nil
+}
+
+func (m *purchaseRepoMock) MarkAsPaid(ctx context.Context, purchaseID int64) error {
+	if m.failPaid > 0 {
+		m.failPaid--
+		return fmt.Errorf("database unavailable")
+	}
+	m.markedPaid = append(m.markedPaid, purchaseID)
+	m.purchases[purchaseID].Status = database.PurchaseStatusPaid
+	return nil
+}
+
+func (m *purchaseRepoMock) LockForProcessing(ctx context.Context, purchaseID int64) (func(), error) {
+	m.locks++
+	return func() { m.unlocks++ }, nil
+}
+
+type customerRepoMock struct {
+	customer *database.Customer
+	updates  []map[string]interface{}
+}
+
+func (m *customerRepoMock) FindById(ctx context.Context, id int64) (*database.Customer, error) {
+	return m.customer, nil
+}
+
+func (m *customerRepoMock) UpdateFields(ctx context.Context, id int64, updates map[string]interface{}) error {
+	m.updates = append(m.updates, updates)
+	return nil
+}
+
+type subscriptionRepoMock struct {
+	active    []database.Subscription
+	inactive  []database.Subscription
+	byID      map[int64]*database.Subscription
+	created   []*database.Subscription
+	updated   map[int64]map[string]interface{}
+	activated []int64
+	purchases *purchaseRepoMock
+}
+
+func (m *subscriptionRepoMock) GetActiveSubscriptions(ctx context.Context, customerID int64) ([]database.Subscription, error) {
+	return m.active, nil
+}
+
+func (m *subscriptionRepoMock) GetAllSubscriptions(ctx context.Context, customerID int64) ([]database.Subscription, error) {
+	return append(append([]database.Subscription{}, m.active...), m.inactive...), nil
+}
+
+func (m *subscriptionRepoMock) CreateSubscription(ctx context.Context, subscription *database.Subscription) (*database.Subscription, error) {
+	m.created = append(m.created, subscription)
+	return subscription, nil
+}
+
+func (m *subscriptionRepoMock) UpdateSubscription(ctx context.Context, id int64, updates map[string]interface{}) error {
+	if m.updated == nil {
+		m.updated = make(map[int64]map[string]interface{})
+	}
+	m.updated[id] = updates
+	return nil
+}
+
+func (m *subscriptionRepoMock) GetSubscriptionByID(ctx context.Context, id int64) (*database.Subscription, error) {
+	return m.byID[id], nil
+}
+
+func (m *subscriptionRepoMock) ActivateSubscription(ctx context.Context, id int64) error {
+	m.activated = append(m.activated, id)
+	return nil
+}
+
+// RecountExtraTraffic считает пакеты так же, как запрос: оплаченные и пакет текущей покупки
+func (m *subscriptionRepoMock) RecountExtraTraffic(ctx context.Context, id int64, purchaseID int64) error {
+	gb := 0
+	for _, purchase := range m.purchases.purchases {
+		if purchase.Kind == database.PurchaseKindTraffic && purchase.SubscriptionID != nil && *purchase.SubscriptionID == id &&
+			(purchase.Status == database.PurchaseStatusPaid || purchase.ID == purchaseID) {
+			gb += purchase.TrafficGB
+		}
+	}
+	if sub := m.byID[id]; sub != nil {
+		sub.ExtraTrafficGB = gb
+	}
+	return nil
+}
+
+type remnawaveMock struct {
+	calls        []int
+	user         *remapi.User
+	customerUser *remapi.User
+	linkUser     *remapi.User
+	expireAt     map[uuid.UUID]time.Time
+	extended     map[uuid.UUID]int
+	limitGB      map[uuid.UUID]int
+	limits       map[uuid.UUID]int
+	deleted      map[uuid.UUID]bool
+	recreated    []int
+}
+
+// days — на сколько дней вперёд от сегодняшнего дня выставлен срок
+func days(expireAt time.Time) int {
+	return int(math.Round(time.Until(expireAt).Hours() / 24))
+}
+
+func (m *remnawaveMock) CreateCustomerUser(ctx context.Context, customerId int64, telegramId int64, plan config.Plan, expireAt time.Time) (*remapi.User, error) {
+	m.calls = append(m.calls, days(expireAt))
+	return m.user, nil
+}
+
+func (m *remnawaveMock) FindCustomerUser(ctx context.Context, customerId int64, telegramId int64) (*remapi.User, error) {
+	return m.customerUser, nil
+}
+
+func (m *remnawaveMock) FindSubscriptionUser(ctx context.Context, userUuid *uuid.UUID, link string) (*remapi.User, error) {
+	return m.linkUser, nil
+}
+
+func (m *remnawaveMock) GetUserByUUID(ctx context.Context, userUuid uuid.UUID) (*remapi.User, error) {
+	if m.deleted[userUuid] {
+		return nil, nil
+	}
+	return &remapi.User{UUID: userUuid, ExpireAt: m.expireAt[userUuid], TrafficLimitBytes: remapi.NewOptInt(m.limits[userUuid])}, nil
+}
+
+func (m *remnawaveMock) ExtendUserTo(ctx context.Context, user *remapi.User, plan config.Plan, expireAt time.Time) (*remapi.User, error) {
+	if m.expireAt == nil {
+		m.expireAt = make(map[uuid.UUID]time.Time)
+	}
+	m.expireAt[user.UUID] = expireAt
+	if m.extended == nil {
+		m.extended = make(map[uuid.UUID]int)
+	}
+	m.extended[user.UUID] = days(expireAt)
+	if m.limitGB == nil {
+		m.limitGB = make(map[uuid.UUID]int)
+	}
+	m.limitGB[user.UUID] = plan.TrafficLimitGB
+	return m.user, nil
+}
+
+func (m *remnawaveMock) CreatePlanUserForSubscription(ctx context.Context, customerId int64, telegramId int64, plan config.Plan, seq int, expireAt time.Time) (*remapi.User, error) {
+	m.recreated = append(m.recreated, days(expireAt))
+	return m.user, nil
+}
+
+func (m *remnawaveMock) SetTrafficLimit(ctx context.Context, userUuid uuid.UUID, limit int) (*remapi.User, error) {
+	if m.limits == nil {
+		m.limits = make(map[uuid.UUID]int)
+	}
+	m.limits[userUuid] = limit
+	return m.user, nil
+}
+
+// referralRewardsMock запоминает покупки, за которые начислялись реферальные награды
+type referralRewardsMock struct {
+	purchases []int64
+}
+
+func (m *referralRewardsMock) ApplyBalance(ctx context.Context, customer *database.Customer, purchase *database.Purchase) {
+}
+
+func (m *referralRewardsMock) OnPurchase(ctx context.Context, customer *database.Customer, purchase *database.Purchase) {
+	m.purchases = append(m.purchases, purchase.ID)
+}
+
+// promoDiscountsMock запоминает покупки, по которым погашалась скидка
+type promoDiscountsMock struct {
+	paid []int64
+}
+
+func (m *promoDiscountsMock) ApplyDiscount(ctx context.Context, customer *database.Customer, purchase *database.Purchase) int64 {
+	return 0
+}
+
+func (m *promoDiscountsMock) BindDiscount(ctx context.Context, redemptionID, purchaseID int64) {}
+
+func (m *promoDiscountsMock) OnPurchasePaid(ctx context.Context, purchase *database.Purchase) {
+	m.paid = append(m.paid, purchase.ID)
+}
+
+type usageCacheMock struct {
+	invalidated []uuid.UUID
+}
+
+func (m *usageCacheMock) Invalidate(userUuid uuid.UUID) {
+	m.invalidated = append(m.invalidated, userUuid)
+}
+
+func newTestService(p *purchaseRepoMock, c *customerRepoMock, s *subscriptionRepoMock, rw *remnawaveMock) *PaymentService {
+	return NewPaymentService(translation.GetInstance(), p, rw, c, s, nil, nil, nil, nil, nil, nil, nil)
+}
+
+func TestProcessPurchaseById_ExtendsMatchingSubscriptionOnce(t *testing.T) {
+	expireAt := time.Now().AddDate(0, 1, 0)
+	p := &purchaseRepoMock{purchases: map[int64]*database.Purchase{
+		7: {ID: 7, CustomerID: 1, Month: 3, Status: database.PurchaseStatusPending},
+	}}
+	c := &customerRepoMock{customer: &database.Customer{ID: 1, TelegramID: 100}}
+	s := &subscriptionRepoMock{active: []database.Subscription{
+		{ID: 10, CustomerID: 1, SubscriptionLink: "https://old.example/sub/abc"},
+		{ID: 11, CustomerID: 1, SubscriptionLink: "https://old.example/sub/xyz"},
+	}}
+	rw := &remnawaveMock{user: &remapi.User{ShortUuid: "xyz", SubscriptionUrl: "https://new.example/sub/xyz", ExpireAt: expireAt}}
+
+	svc := newTestService(p, c, s, rw)
+
+	for i := 0; i < 2; i++ {
+		if err := svc.ProcessPurchaseById(context.Background(), 7); err != nil {
+			t.Fatalf("ProcessPurchaseById returned error: %v", err)
+		}
+	}
+
+	if len(rw.calls) != 1 {
+		t.Fatalf("expected remnawave to be called once, got %d", len(rw.calls))
+	}
+	if len(p.markedPaid) != 1 || p.markedPaid[0] != 7 {
+		t.Fatalf("expected purchase 7 to be marked paid once, got %#v", p.markedPaid)
+	}
+	if p.locks != 2 || p.unlocks != 2 {
+		t.Fatalf("expected every call to lock and unlock, got %d/%d", p.locks, p.unlocks)
+	}
+	if len(s.created) != 0 {
+		t.Fatalf("expected no new subscription, got %d", len(s.created))
+	}
+	updates, ok := s.updated[11]
+	if !ok {
+		t.Fatalf("expected subscription 11 to be updated, got %#v", s.updated)
+	}
+	if updates["subscription_link"] != rw.user.SubscriptionUrl || updates["expire_at"] != expireAt {
+		t.Fatalf("unexpected subscription updates: %#v", updates)
+	}
+}
+
+func TestProcessPurchaseById_CreatesSubscriptionWhenNoMatch(t *testing.T) {
+	p := &purchaseRepoMock{purchases: map[int64]*database.Purchase{
+		1: {ID: 1, CustomerID: 1, Month: 1, Status: database.PurchaseStatusPending},
+	}}
+	c := &customerRepoMock{customer: &database.Customer{ID: 1, TelegramID: 100}}
+	s := &subscriptionRepoMock{}
+	rw := &remnawaveMock{user: &remapi.User{ShortUuid: "new", SubscriptionUrl: "https://example/sub/new", ExpireAt: time.Now()}}
+
+	svc := newTestService(p, c, s, rw)
+	if err := svc.ProcessPurchaseById(context.Background(), 1); err != nil {
+		t.Fatalf("ProcessPurchaseById returned error: %v", err)
+	}
+
+	if len(s.created) != 1 || s.created[0].SubscriptionLink != rw.user.SubscriptionUrl {
+		t.Fatalf("expected a subscription to be created, got %#v", s.created)
+	}
+	if s.created[0].ShortUUID == nil || *s.created[0].ShortUUID != "new" || s.created[0].RemnawaveUUID == nil {
+		t.Fatalf("expected remnawave user to be stored on the subscription, got %#v", s.created[0])
+	}
+}
+
+func TestProcessPurchaseById_MatchesSubscriptionByUUID(t *testing.T) {
+	userUuid := uuid.New()
+	otherUuid := uuid.New()
+	p := &purchaseRepoMock{purchases: map[int64]*database.Purchase{
+		1: {ID: 1, CustomerID: 1, Month: 1, Status: database.PurchaseStatusPending},
+	}}
+	c := &customerRepoMock{customer: &database.Customer{ID: 1, TelegramID: 100}}
+	s := &subscriptionRepoMock{active: []database.Subscription{
+		{ID: 10, CustomerID: 1, SubscriptionLink: "https://example/sub/xyz", RemnawaveUUID: &otherUuid},
+		{ID: 11, CustomerID: 1, SubscriptionLink: "https://example/sub/renamed", RemnawaveUUID: &userUuid},
+	}}
+	rw := &remnawaveMock{user: &remapi.User{UUID: userUuid, ShortUuid: "xyz", Username: "1_100", SubscriptionUrl: "https://example/sub/xyz", ExpireAt: time.Now()}}
+
+	svc := newTestService(p, c, s, rw)
+	if err := svc.ProcessPurchaseById(context.Background(), 1); err != nil {
+		t.Fatalf("ProcessPurchaseById returned error: %v", err)
+	}
+
+	if _, ok := s.updated[10]; ok {
+		t.Fatal("subscription of another user must not be updated")
+	}
+	if updates := s.updated[11]; updates["remnawave_uuid"] != userUuid || updates["username"] != "1_100" {
+		t.Fatalf("expected subscription 11 to be updated by uuid, got %#v", s.updated)
+	}
+}
+
+func TestProcessPurchaseById_ExtendsCustomerUserByUUID(t *testing.T) {
+	ownUuid, subscriptionUuid := uuid.New(), uuid.New()
+	ownUsername, subscriptionUsername := "1_100", "1_100_2_a1b2c3"
+	p := &purchaseRepoMock{purchases: map[int64]*database.Purchase{
+		1: {ID: 1, CustomerID: 1, Month: 1, Status: database.PurchaseStatusPending},
+	}}
+	c := &customerRepoMock{customer: &database.Customer{ID: 1, TelegramID: 100}}
+	s := &subscriptionRepoMock{
+		active:   []database.Subscription{{ID: 10, CustomerID: 1, IsActive: true, RemnawaveUUID: &subscriptionUuid, Username: &subscriptionUsername}},
+		inactive: []database.Subscription{{ID: 11, CustomerID: 1, RemnawaveUUID: &ownUuid, Username: &ownUsername}},
+	}
+	rw := &remnawaveMock{
+		user:         &remapi.User{UUID: ownUuid, Username: ownUsername, ExpireAt: time.Now().AddDate(0, 1, 0)},
+		customerUser: &remapi.User{UUID: uuid.New(), Username: ownUsername},
+	}
+
+	svc := newTestService(p, c, s, rw)
+	if err := svc.ProcessPurchaseById(context.Background(), 1); err != nil {
+		t.Fatalf("ProcessPurchaseById returned error: %v", err)
+	}
+
+	if _, ok := rw.extended[ownUuid]; !ok || len(rw.extended) != 1 || len(rw.calls) != 0 {
+		t.Fatalf("expected only the customer's own user to be extended, got extended %v, created %v", rw.extended, rw.calls)
+	}
+	if len(s.created) != 0 || len(s.activated) != 1 || s.activated[0] != 11 {
+		t.Fatalf("expected the own subscription to be reactivated, got created %d, activated %v", len(s.created), s.activated)
+	}
+}
+
+func TestProcessPurchaseById_FindsLegacyCustomerUser(t *testing.T) {
+	legacyUuid := uuid.New()
+	p := &purchaseRepoMock{purchases: map[int64]*database.Purchase{
+		1: {ID: 1, CustomerID: 1, Month: 1, Status: database.PurchaseStatusPending},
+	}}
+	c := &customerRepoMock{customer: &database.Customer{ID: 1, TelegramID: 100}}
+	s := &subscriptionRepoMock{active: []database.Subscription{
+		{ID: 10, CustomerID: 1, IsActive: true, SubscriptionLink: "https://example/sub/abc"},
+	}}
+	rw := &remnawaveMock{
+		user:         &remapi.User{UUID: legacyUuid, ShortUuid: "abc", SubscriptionUrl: "https://example/sub/abc", ExpireAt: time.Now()},
+		customerUser: &remapi.User{UUID: legacyUuid, Username: "1_100"},
+	}
+
+	svc := newTestService(p, c, s, rw)
+	if err := svc.ProcessPurchaseById(context.Background(), 1); err != nil {
+		t.Fatalf("ProcessPurchaseById returned error: %v", err)
+	}
+
+	if _, ok := rw.extended[legacyUuid]; !ok || len(rw.calls) != 0 {
+		t.Fatalf("expected the legacy user to be extended, got extended %v, created %v", rw.extended, rw.calls)
+	}
+	if updates := s.updated[10]; updates["remnawave_uuid"] != legacyUuid {
+		t.Fatalf("expected the legacy subscription to store the uuid, got %#v", s.updated)
+	}
+}
+
+func TestProcessPurchaseById_RenewsBoundSubscription(t *testing.T) {
+	userUuid := uuid.New()
+	subscriptionID := int64(11)
+	expireAt := time.Now().AddDate(0, 2, 0)
+	p := &purchaseRepoMock{purchases: map[int64]*database.Purchase{
+		1: {ID: 1, CustomerID: 1, Kind: database.PurchaseKindSubscription, PlanID: "week", Days: 7, SubscriptionID: &subscriptionID, Status: database.PurchaseStatusPending},
+	}}
+	c := &customerRepoMock{customer: &database.Customer{ID: 1, TelegramID: 100}}
+	s := &subscriptionRepoMock{byID: map[int64]*database.Subscription{
+		11: {ID: 11, CustomerID: 1, IsActive: false, RemnawaveUUID: &userUuid},
+	}}
+	rw := &remnawaveMock{user: &remapi.User{UUID: userUuid, ShortUuid: "abc", SubscriptionUrl: "https://example/sub/abc", ExpireAt: expireAt}}
+
+	svc := newTestService(p, c, s, rw)
+	if err := svc.ProcessPurchaseById(context.Background(), 1); err != nil {
+		t.Fatalf("ProcessPurchaseById returned error: %v", err)
+	}
+
+	if len(rw.calls) != 0 {
+		t.Fatal("renewal must not create or look up the customer's user")
+	}
+	if rw.extended[userUuid] != 7 {
+		t.Fatalf("expected user %s to be extended by the 7 days of the purchase, got %v", userUuid, rw.extended)
+	}
+	if updates := s.updated[11]; updates["expire_at"] != expireAt {
+		t.Fatalf("expected subscription 11 to get the new expiration, got %#v", s.updated)
+	}
+	if len(s.activated) != 1 || s.activated[0] != 11 || len(s.created) != 0 {
+		t.Fatalf("expected subscription 11 to be reactivated without creating another, got %v, %d", s.activated, len(s.created))
+	}
+}
+
+func TestProcessPurchaseById_RetryAfterFailedPaymentMarkDoesNotExtendTwice(t *testing.T) {
+	userUuid := uuid.New()
+	subscriptionID := int64(11)
+	p := &purchaseRepoMock{failPaid: 1, purchases: map[int64]*database.Purchase{
+		1: {ID: 1, CustomerID: 1, Kind: database.PurchaseKindSubscription, PlanID: "week", Days: 7, SubscriptionID: &subscriptionID, Status: database.PurchaseStatusPending},
+	}}
+	c := &customerRepoMock{customer: &database.Customer{ID: 1, TelegramID: 100}}
+	s := &subscriptionRepoMock{byID: map[int64]*database.Subscription{
+		11: {ID: 11, CustomerID: 1, IsActive: true, RemnawaveUUID: &userUuid},
+	}}
+	rw := &remnawaveMock{
+		user:     &remapi.User{UUID: userUuid},
+		expireAt: map[uuid.UUID]time.Time{userUuid: time.Now().AddDate(0, 0, 10)},
+	}
+
+	svc := newTestService(p, c, s, rw)
+	if err := svc.ProcessPurchaseById(context.Background(), 1); err == nil {
+		t.Fatal("expected the first attempt to fail on marking the purchase paid")
+	}
+	if err := svc.ProcessPurchaseById(context.Background(), 1); err != nil {
+		t.Fatalf("ProcessPurchaseById returned error: %v", err)
+	}
+
+	if rw.extended[userUuid] != 17 {
+		t.Fatalf("expected the user to be extended by 7 days once, expires in %d days", rw.extended[userUuid])
+	}
+	if len(p.markedPaid) != 1 {
+		t.Fatalf("expected purchase to be marked paid once, got %v", p.markedPaid)
+	}
+}
+
+func TestProcessPurchaseById_RetryFindsCreatedCustomerUser(t *testing.T) {
+	userUuid := uuid.New()
+	p := &purchaseRepoMock{failPaid: 1, purchases: map[int64]*database.Purchase{
+		1: {ID: 1, CustomerID: 1, Kind: database.PurchaseKindSubscription, PlanID: "week", Days: 7, Status: database.PurchaseStatusPending},
+	}}
+	c := &customerRepoMock{customer: &database.Customer{ID: 1, TelegramID: 100}}
+	s := &subscriptionRepoMock{}
+	rw := &remnawaveMock{user: &remapi.User{UUID: userUuid, Username: "1_100"}}
+
+	svc := newTestService(p, c, s, rw)
+	if err := svc.ProcessPurchaseById(context.Background(), 1); err == nil {
+		t.Fatal("expected the first attempt to fail on marking the purchase paid")
+	}
+	// первая попытка успела создать пользователя в панели
+	rw.customerUser = rw.user
+	if err := svc.ProcessPurchaseById(context.Background(), 1); err != nil {
+		t.Fatalf("ProcessPurchaseById returned error: %v", err)
+	}
+
+	if len(rw.calls) != 1 {
+		t.Fatalf("expected the customer's user to be created once, got %v", rw.calls)
+	}
+	if rw.extended[userUuid] != 7 {
+		t.Fatalf("expected the retry to keep the expiration of the first attempt, expires in %d days", rw.extended[userUuid])
+	}
+}
+
+func TestProcessPurchaseById_RecreatesDeletedSubscriptionUser(t *testing.T) {
+	deletedUuid, newUuid := uuid.New(), uuid.New()
+	subscriptionID := int64(12)
+	p := &purchaseRepoMock{purchases: map[int64]*database.Purchase{
+		1: {ID: 1, CustomerID: 1, Kind: database.PurchaseKindSubscription, PlanID: "month", Days: 30, SubscriptionID: &subscriptionID, Status: database.PurchaseStatusPending},
+	}}
+	c := &customerRepoMock{customer: &database.Customer{ID: 1, TelegramID: 100}}
+	s := &subscriptionRepoMock{byID: map[int64]*database.Subscription{
+		12: {ID: 12, CustomerID: 1, IsActive: false, RemnawaveUUID: &deletedUuid},
+	}}
+	rw := &remnawaveMock{
+		user:    &remapi.User{UUID: newUuid, ShortUuid: "new", SubscriptionUrl: "https://example/sub/new", ExpireAt: time.Now().AddDate(0, 1, 0)},
+		deleted: map[uuid.UUID]bool{deletedUuid: true},
+	}
+
+	svc := newTestService(p, c, s, rw)
+	if err := svc.ProcessPurchaseById(context.Background(), 1); err != nil {
+		t.Fatalf("ProcessPurchaseById returned error: %v", err)
+	}
+
+	if len(rw.recreated) != 1 || rw.recreated[0] != 30 || len(rw.calls) != 0 {
+		t.Fatalf("expected a new user for the subscription, got recreated %v, customer user calls %v", rw.recreated, rw.calls)
+	}
+	if updates := s.updated[12]; updates["remnawave_uuid"] != newUuid {
+		t.Fatalf("expected subscription 12 to point to the new user, got %#v", s.updated)
+	}
+	if p.purchases[1].Status != database.PurchaseStatusPaid {
+		t.Fatalf("expected purchase to be paid, got %s", p.purchases[1].Status)
+	}
+}
+
+func TestProcessPurchaseById_AddsTrafficToSubscriptionUser(t *testing.T) {
+	userUuid := uuid.New()
+	subscriptionID := int64(10)
+	p := &purchaseRepoMock{purchases: map[int64]*database.Purchase{
+		1: {ID: 1, CustomerID: 1, Kind: database.PurchaseKindTraffic, SubscriptionID: &subscriptionID, TrafficGB: 50, Status: database.PurchaseStatusPending},
+	}}
+	c := &customerRepoMock{customer: &database.Customer{ID: 1, TelegramID: 100}}
+	s := &subscriptionRepoMock{byID: map[int64]*database.Subscription{
+		10: {ID: 10, CustomerID: 1, RemnawaveUUID: &userUuid},
+	}}
+	s.purchases = p
+	rw := &remnawaveMock{user: &remapi.User{UUID: userUuid}, limits: map[uuid.UUID]int{userUuid: 100 << 30}}
+	usage := &usageCacheMock{}
+
+	svc := NewPaymentService(translation.GetInstance(), p, rw, c, s, nil, nil, nil, nil, nil, nil, usage)
+	for i := 0; i < 2; i++ {
+		if err := svc.ProcessPurchaseById(context.Background(), 1); err != nil {
+			t.Fatalf("ProcessPurchaseById returned error: %v", err)
+		}
+	}
+
+	if rw.limits[userUuid] != 150<<30 {
+		t.Fatalf("expected 50 GB to be added once, limit is %d bytes", rw.limits[userUuid])
+	}
+	if len(rw.calls) != 0 || len(s.updated) != 0 || len(c.updates) != 0 {
+		t.Fatal("traffic purchase must not extend the subscription")
+	}
+	if len(p.markedPaid) != 1 || len(usage.invalidated) != 1 || usage.invalidated[0] != userUuid {
+		t.Fatalf("expected purchase to be paid and usage invalidated once, got %v, %v", p.markedPaid, usage.invalidated)
+	}
+}
+
+func TestProcessPurchaseById_TrafficRetryAfterFailedPaymentMarkAddsPackageOnce(t *testing.T) {
+	userUuid := uuid.New()
+	subscriptionID := int64(10)
+	p := &purchaseRepoMock{failPaid: 1, purchases: map[int64]*database.Purchase{
+		1: {ID: 1, CustomerID: 1, Kind: database.PurchaseKindTraffic, SubscriptionID: &subscriptionID, TrafficGB: 50, Status: database.PurchaseStatusPending},
+	}}
+	c := &customerRepoMock{customer: &database.Customer{ID: 1, TelegramID: 100}}
+	s := &subscriptionRepoMock{byID: map[int64]*database.Subscription{
+		10: {ID: 10, CustomerID: 1, RemnawaveUUID: &userUuid},
+	}, purchases: p}
+	rw := &remnawaveMock{user: &remapi.User{UUID: userUuid}, limits: map[uuid.UUID]int{userUuid: 100 << 30}}
+
+	svc := newTestService(p, c, s, rw)
+	if err := svc.ProcessPurchaseById(context.Background(), 1); err == nil {
+		t.Fatal("expected the first attempt to fail on marking the purchase paid")
+	}
+	if err := svc.ProcessPurchaseById(context.Background(), 1); err != nil {
+		t.Fatalf("ProcessPurchaseById returned error: %v", err)
+	}
+
+	if rw.limits[userUuid] != 150<<30 || s.byID[10].ExtraTrafficGB != 50 {
+		t.Fatalf("expected the package to be added once, limit %d bytes, extra %d GB", rw.limits[userUuid], s.byID[10].ExtraTrafficGB)
+	}
+}
+
+func TestProcessPurchaseById_CustomerPurchaseKeepsPurchasedTraffic(t *testing.T) {
+	ownUuid := uuid.New()
+	ownUsername := "1_100"
+	p := &purchaseRepoMock{purchases: map[int64]*database.Purchase{
+		1: {ID: 1, CustomerID: 1, Month: 1, Status: database.PurchaseStatusPending},
+	}}
+	c := &customerRepoMock{customer: &database.Customer{ID: 1, TelegramID: 100}}
+	s := &subscriptionRepoMock{active: []database.Subscription{
+		{ID: 10, CustomerID: 1, IsActive: true, RemnawaveUUID: &ownUuid, Username: &ownUsername, ExtraTrafficGB: 50},
+	}}
+	rw := &remnawaveMock{user: &remapi.User{UUID: ownUuid, Username: ownUsername, ExpireAt: time.Now()}}
+
+	svc := newTestService(p, c, s, rw)
+	if err := svc.ProcessPurchaseById(context.Background(), 1); err != nil {
+		t.Fatalf("ProcessPurchaseById returned error: %v", err)
+	}
+
+	if want := withExtraTraffic(config.MonthsPlan(1), 50).TrafficLimitGB; rw.limitGB[ownUuid] != want {
+		t.Fatalf("expected the purchase to keep the package, limit %d GB, got %d GB", want, rw.limitGB[ownUuid])
+	}
+}
+
+func TestProcessPurchaseById_RenewalKeepsPurchasedTraffic(t *testing.T) {
+	userUuid := uuid.New()
+	subscriptionID := int64(10)
+	p := &purchaseRepoMock{purchases: map[int64]*database.Purchase{
+		1: {ID: 1, CustomerID: 1, Kind: database.PurchaseKindTraffic, SubscriptionID: &subscriptionID, TrafficGB: 50, Status: database.PurchaseStatusPending},
+		2: {ID: 2, CustomerID: 1, Month: 1, SubscriptionID: &subscriptionID, Status: database.PurchaseStatusPending},
+	}}
+	c := &customerRepoMock{customer: &database.Customer{ID: 1, TelegramID: 100}}
+	s := &subscriptionRepoMock{byID: map[int64]*database.Subscription{
+		10: {ID: 10, CustomerID: 1, RemnawaveUUID: &userUuid, IsActive: true},
+	}, purchases: p}
+	rw := &remnawaveMock{user: &remapi.User{UUID: userUuid, ExpireAt: time.Now().AddDate(0, 1, 0)}, limits: map[uuid.UUID]int{userUuid: 100 << 30}}
+
+	svc := newTestService(p, c, s, rw)
+	for _, id := range []int64{1, 2} {
+		if err := svc.ProcessPurchaseById(context.Background(), id); err != nil {
+			t.Fatalf("ProcessPurchaseById(%d) returned error: %v", id, err)
+		}
+	}
+
+	if s.byID[10].ExtraTrafficGB != 50 {
+		t.Fatalf("expected 50 GB to be recorded on the subscription, got %d", s.byID[10].ExtraTrafficGB)
+	}
+	if want := withExtraTraffic(config.MonthsPlan(1), 50).TrafficLimitGB; rw.limitGB[userUuid] != want {
+		t.Fatalf("expected renewal to keep the package, limit %d GB, got %d GB", want, rw.limitGB[userUuid])
+	}
+}
+
+func TestWithExtraTraffic(t *testing.T) {
+	if got := withExtraTraffic(config.Plan{TrafficLimitGB: 100}, 50).TrafficLimitGB; got != 150 {
+		t.Fatalf("expected 150 GB, got %d", got)
+	}
+	if got := withExtraTraffic(config.Plan{}, 50).TrafficLimitGB; got != 0 {
+		t.Fatalf("unlimited plan must stay unlimited, got %d GB", got)
+	}
+}
+
+func TestProcessPurchaseById_RejectsTrafficForForeignSubscription(t *testing.T) {
+	userUuid := uuid.New()
+	subscriptionID := int64(10)
+	p := &purchaseRepoMock{purchases: map[int64]*database.Purchase{
+		1: {ID: 1, CustomerID: 1, Kind: database.PurchaseKindTraffic, SubscriptionID: &subscriptionID, TrafficGB: 50, Status: database.PurchaseStatusPending},
+	}}
+	s := &subscriptionRepoMock{byID: map[int64]*database.Subscription{
+		10: {ID: 10, CustomerID: 2, RemnawaveUUID: &userUuid},
+	}}
+	rw := &remnawaveMock{}
+
+	svc := newTestService(p, &customerRepoMock{customer: &database.Customer{ID: 1}}, s, rw)
+	if err := svc.ProcessPurchaseById(context.Background(), 1); err == nil {
+		t.Fatal("expected error for subscription of another customer")
+	}
+	if len(rw.limits) != 0 || len(p.markedPaid) != 0 {
+		t.Fatal("traffic must not be added to a foreign subscription")
+	}
+}
+
+func TestProcessPurchaseById_RewardsReferrersAndRedeemsPromoOnce(t *testing.T) {
+	p := &purchaseRepoMock{purchases: map[int64]*database.Purchase{
+		7: {ID: 7, CustomerID: 1, Month: 1, Status: database.PurchaseStatusPending},
+	}}
+	c := &customerRepoMock{customer: &database.Customer{ID: 1, TelegramID: 100}}
+	rw := &remnawaveMock{user: &remapi.User{UUID: uuid.New(), ExpireAt: time.Now()}}
+	rewards := &referralRewardsMock{}
+	promos := &promoDiscountsMock{}
+
+	svc := NewPaymentService(translation.GetInstance(), p, rw, c, &subscriptionRepoMock{}, rewards, promos, nil, nil, nil, nil, nil)
+	for i := 0; i < 2; i++ {
+		if err := svc.ProcessPurchaseById(context.Background(), 7); err != nil {
+			t.Fatalf("ProcessPurchaseById returned error: %v", err)
+		}
+	}
+
+	if len(rewards.purchases) != 1 || rewards.purchases[0] != 7 {
+		t.Fatalf("expected referral rewards for purchase 7 once, got %v", rewards.purchases)
+	}
+	if len(promos.paid) != 1 || promos.paid[0] != 7 {
+		t.Fatalf("expected the promo discount of purchase 7 to be redeemed once, got %v", promos.paid)
+	}
+}
+
+func TestCancelPayment_DoesNotCancelPaidPurchase(t *testing.T) {
+	p := &purchaseRepoMock{purchases: map[int64]*database.Purchase{
+		3: {ID: 3, Status: database.PurchaseStatusPaid},
+	}}
+	svc := newTestService(p, &customerRepoMock{}, &subscriptionRepoMock{}, &remnawaveMock{})
+
+	if err := svc.CancelPayment(context.Background(), 3); err != nil {
+		t.Fatalf("CancelPayment returned error: %v", err)
+	}
+	if p.purchases[3].Status != database.PurchaseStatusPaid {
+		t.Fatalf("paid purchase must stay paid, got %s", p.purchases[3].Status)
+	}
+}
+
+func TestStarsInvoicePayload_RoundTrip(t *testing.T) {
+	id, err := ParseStarsInvoicePayload(StarsInvoicePayload(42))
+	if err != nil || id != 42 {
+		t.Fatalf("expected 42, got %d (%v)", id, err)
+	}
+	if _, err := ParseStarsInvoicePayload("42"); err == nil {
+		t.Fatal("expected error for payload without purchaseId prefix")
+	}
+}
+
+func TestCreateTributePurchase_KeepsWebhookCurrency(t *testing.T) {
+	p := &purchaseRepoMock{purchases: map[int64]*database.Purchase{}}
+	svc := newTestService(p, &customerRepoMock{}, &subscriptionRepoMock{}, &remnawaveMock{})
+
+	id, err := svc.CreateTributePurchase(context.Background(), 5, "eur", 1, &database.Customer{ID: 1}, "new_subscription:1:100:1")
+	if err != nil {
+		t.Fatalf("CreateTributePurchase returned error: %v", err)
+	}
+	purchase := p.purchases[id]
+	if purchase.Currency != "EUR" || purchase.TributeEvent == nil || *purchase.TributeEvent != "new_subscription:1:100:1" {
+		t.Fatalf("unexpected purchase: %#v", purchase)
+	}
+}
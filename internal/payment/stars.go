@@ -0,0 +1,51 @@
+package payment
+
+import (
+	"context"
+	"log/slog"
+
+	"remnawave-tg-shop-bot/internal/database"
+	"remnawave-tg-shop-bot/utils"
+)
+
+type chargedPurchaseRepository interface {
+	FindChargedTelegramPurchases(ctx context.Context) (*[]database.Purchase, error)
+}
+
+type purchaseProcessor interface {
+	ProcessPurchaseById(ctx context.Context, purchaseId int64) error
+}
+
+// StarsChecker дообрабатывает покупки за звёзды: Telegram списывает оплату до того, как бот
+// выдаёт подписку, поэтому покупку с сохранённым списанием нужно довести до конца
+type StarsChecker struct {
+	purchaseRepository chargedPurchaseRepository
+	paymentProcessor   purchaseProcessor
+}
+
+func NewStarsChecker(purchaseRepository chargedPurchaseRepository, paymentProcessor purchaseProcessor) *StarsChecker {
+	return &StarsChecker{
+		purchaseRepository: purchaseRepository,
+		paymentProcessor:   paymentProcessor,
+	}
+}
+
+// CheckPending повторяет обработку оплаченных, но не выданных покупок за звёзды
+func (c *StarsChecker) CheckPending(ctx context.Context) error {
+	purchases, err := c.purchaseRepository.FindChargedTelegramPurchases(ctx)
+	if err != nil {
+		return err
+	}
+	if purchases == nil {
+		return nil
+	}
+
+	for _, purchase := range *purchases {
+		if err := c.paymentProcessor.ProcessPurchaseById(ctx, purchase.ID); err != nil {
+			slog.Error("error retrying stars purchase", "error", err, "purchase_id", utils.MaskHalfInt64(purchase.ID))
+			continue
+		}
+		slog.Info("stars purchase processed on retry", "purchase_id", utils.MaskHalfInt64(purchase.ID))
+	}
+	return nil
+}
@@ -0,0 +1,43 @@
+package payment
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"remnawave-tg-shop-bot/internal/database"
+)
+
+type chargedPurchaseRepoMock struct {
+	purchases []database.Purchase
+}
+
+func (m *chargedPurchaseRepoMock) FindChargedTelegramPurchases(ctx context.Context) (*[]database.Purchase, error) {
+	return &m.purchases, nil
+}
+
+type processorMock struct {
+	processed []int64
+	failing   map[int64]bool
+}
+
+func (m *processorMock) ProcessPurchaseById(ctx context.Context, purchaseId int64) error {
+	m.processed = append(m.processed, purchaseId)
+	if m.failing[purchaseId] {
+		return errors.New("panel unavailable")
+	}
+	return nil
+}
+
+func TestStarsChecker_RetriesChargedPurchases(t *testing.T) {
+	repo := &chargedPurchaseRepoMock{purchases: []database.Purchase{{ID: 1}, {ID: 2}}}
+	processor := &processorMock{failing: map[int64]bool{1: true}}
+
+	if err := NewStarsChecker(repo, processor).CheckPending(context.Background()); err != nil {
+		t.Fatalf("CheckPending returned error: %v", err)
+	}
+
+	if len(processor.processed) != 2 || processor.processed[0] != 1 || processor.processed[1] != 2 {
+		t.Fatalf("a failed purchase must not stop the others, got %#v", processor.processed)
+	}
+}
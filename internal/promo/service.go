@@ -0,0 +1,200 @@
+package promo
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"math"
+	"strings"
+	"time"
+
+	remapi "github.com/Jolymmiles/remnawave-api-go/v2/api"
+	"github.com/google/uuid"
+
+	"remnawave-tg-shop-bot/internal/config"
+	"remnawave-tg-shop-bot/internal/database"
+	"remnawave-tg-shop-bot/utils"
+)
+
+var (
+	ErrNotFound            = errors.New("promo code not found")
+	ErrExpired             = errors.New("promo code expired")
+	ErrDiscountActive      = errors.New("another discount is already active")
+	ErrNoSubscription      = errors.New("no subscription to apply the promo code to")
+	ErrSubscriptionInvalid = errors.New("subscription does not accept the promo code")
+)
+
+type promoRepository interface {
+	FindByCode(ctx context.Context, code string) (*database.PromoCode, error)
+	CheckLimits(ctx context.Context, promo *database.PromoCode, customerID int64) error
+	Redeem(ctx context.Context, redemption *database.PromoRedemption, apply func(ctx context.Context) error) error
+	FindAvailableDiscount(ctx context.Context, customerID int64) (*database.PromoRedemption, *database.PromoCode, error)
+	BindPurchase(ctx context.Context, redemptionID, purchaseID int64) (bool, error)
+	MarkRedeemedByPurchase(ctx context.Context, purchaseID int64) error
+}
+
+type subscriptionRepository interface {
+	UpdateSubscription(ctx context.Context, id int64, updates map[string]interface{}) error
+}
+
+type remnawaveClient interface {
+	ExtendUserDays(ctx context.Context, userUuid uuid.UUID, days int) (*remapi.User, error)
+	AddTraffic(ctx context.Context, userUuid uuid.UUID, bytes int) (*remapi.User, error)
+}
+
+// usageCache — кеш потребления трафика, сбрасывается после добавления трафика
+type usageCache interface {
+	Invalidate(userUuid uuid.UUID)
+}
+
+// Service проверяет и погашает промокоды: дни и трафик выдаются сразу на выбранную подписку,
+// скидка ждёт ближайшего счёта
+type Service struct {
+	promos        promoRepository
+	subscriptions subscriptionRepository
+	rw            remnawaveClient
+	usage         usageCache
+}
+
+func NewService(promos promoRepository, subscriptions subscriptionRepository, rw remnawaveClient, usage usageCache) *Service {
+	return &Service{promos: promos, subscriptions: subscriptions, rw: rw, usage: usage}
+}
+
+// NormalizeCode приводит введённый код к виду, в котором он хранится
+func NormalizeCode(code string) string {
+	return strings.ToUpper(strings.TrimSpace(code))
+}
+
+// Check находит промокод и проверяет срок и лимиты, ничего не погашая
+func (s *Service) Check(ctx context.Context, customer *database.Customer, code string) (*database.PromoCode, error) {
+	promo, err := s.promos.FindByCode(ctx, NormalizeCode(code))
+	if err != nil {
+		return nil, err
+	}
+	if promo == nil {
+		return nil, ErrNotFound
+	}
+	if promo.Expired(time.Now()) {
+		return nil, ErrExpired
+	}
+	if err := s.promos.CheckLimits(ctx, promo, customer.ID); err != nil {
+		return nil, err
+	}
+	return promo, nil
+}
+
+// ActivateDiscount закрепляет скидку за клиентом до ближайшего счёта. Одновременно у клиента
+// может быть только одна неоплаченная скидка.
+func (s *Service) ActivateDiscount(ctx context.Context, customer *database.Customer, promo *database.PromoCode) error {
+	err := s.promos.Redeem(ctx, &database.PromoRedemption{
+		Code:       promo.Code,
+		CustomerID: customer.ID,
+		Status:     database.PromoRedemptionStatusPending,
+	}, nil)
+	if errors.Is(err, database.ErrPromoPending) {
+		return ErrDiscountActive
+	}
+	return err
+}
+
+// ApplyToSubscription погашает промокод на дни или трафик для подписки клиента
+func (s *Service) ApplyToSubscription(ctx context.Context, customer *database.Customer, promo *database.PromoCode, sub *database.Subscription) error {
+	if sub.CustomerID != customer.ID || sub.RemnawaveUUID == nil || promo.Kind.IsDiscount() {
+		return ErrSubscriptionInvalid
+	}
+	now := time.Now()
+	return s.promos.Redeem(ctx, &database.PromoRedemption{
+		Code:           promo.Code,
+		CustomerID:     customer.ID,
+		SubscriptionID: &sub.ID,
+		Status:         database.PromoRedemptionStatusRedeemed,
+		RedeemedAt:     &now,
+	}, func(ctx context.Context) error {
+		if promo.Kind == database.PromoKindTraffic {
+			return s.addTraffic(ctx, sub, promo.Value)
+		}
+		return s.addDays(ctx, sub, promo.Value)
+	})
+}
+
+func (s *Service) addDays(ctx context.Context, sub *database.Subscription, days int) error {
+	user, err := s.rw.ExtendUserDays(ctx, *sub.RemnawaveUUID, days)
+	if err != nil {
+		return err
+	}
+	return s.subscriptions.UpdateSubscription(ctx, sub.ID, map[string]interface{}{
+		"expire_at":         user.ExpireAt,
+		"subscription_link": user.SubscriptionUrl,
+	})
+}
+
+func (s *Service) addTraffic(ctx context.Context, sub *database.Subscription, gb int) error {
+	// AddTraffic отказывает пользователям с безлимитным трафиком
+	if _, err := s.rw.AddTraffic(ctx, *sub.RemnawaveUUID, config.GigabytesToBytes(gb)); err != nil {
+		return errors.Join(ErrSubscriptionInvalid, err)
+	}
+	if s.usage != nil {
+		s.usage.Invalidate(*sub.RemnawaveUUID)
+	}
+	return nil
+}
+
+// ApplyDiscount уменьшает сумму счёта на активную скидку клиента и возвращает id погашения,
+// которое нужно привязать к покупке, или 0. Скидка действует только на подписки, фиксированная
+// скидка — только на рубли; итоговая сумма не меньше 1. Скидка входит в один счёт: следующий
+// выставляется без неё, пока первый не отменён.
+func (s *Service) ApplyDiscount(ctx context.Context, customer *database.Customer, purchase *database.Purchase) int64 {
+	if purchase.Kind != database.PurchaseKindSubscription {
+		return 0
+	}
+	redemption, promo, err := s.promos.FindAvailableDiscount(ctx, customer.ID)
+	if err != nil {
+		slog.Error("Error finding promo discount", "error", err)
+		return 0
+	}
+	if redemption == nil || (promo.PlanID != "" && promo.PlanID != purchase.PlanID) {
+		return 0
+	}
+	amount, ok := Discounted(promo, purchase.Amount, purchase.Currency)
+	if !ok {
+		return 0
+	}
+	slog.Info("promo discount applied", "code", promo.Code, "customer", utils.MaskHalfInt64(customer.ID), "amount", purchase.Amount, "discounted", amount)
+	purchase.Amount = amount
+	return redemption.ID
+}
+
+// Discounted — сумма со скидкой промокода, false если скидка к валюте не применима
+func Discounted(promo *database.PromoCode, amount float64, currency string) (float64, bool) {
+	switch promo.Kind {
+	case database.PromoKindPercent:
+		amount = math.Ceil(amount * float64(100-promo.Value) / 100)
+	case database.PromoKindAmount:
+		if currency != config.CurrencyRUB {
+			return 0, false
+		}
+		amount -= float64(promo.Value)
+	default:
+		return 0, false
+	}
+	return math.Max(amount, 1), true
+}
+
+// BindDiscount привязывает скидку к созданной покупке
+func (s *Service) BindDiscount(ctx context.Context, redemptionID, purchaseID int64) {
+	bound, err := s.promos.BindPurchase(ctx, redemptionID, purchaseID)
+	if err != nil {
+		slog.Error("Error binding promo discount", "error", err)
+		return
+	}
+	if !bound {
+		slog.Warn("promo discount already bound to another purchase", "redemption_id", redemptionID, "purchase_id", utils.MaskHalfInt64(purchaseID))
+	}
+}
+
+// OnPurchasePaid погашает скидку оплаченной покупки
+func (s *Service) OnPurchasePaid(ctx context.Context, purchase *database.Purchase) {
+	if err := s.promos.MarkRedeemedByPurchase(ctx, purchase.ID); err != nil {
+		slog.Error("Error redeeming promo discount", "error", err)
+	}
+}
@@ -0,0 +1,311 @@
+package promo
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	remapi "github.com/Jolymmiles/remnawave-api-go/v2/api"
+	"github.com/google/uuid"
+
+	"remnawave-tg-shop-bot/internal/config"
+	"remnawave-tg-shop-bot/internal/database"
+)
+
+// promoRepoMock проверяет лимиты и единственность неоплаченной скидки так же, как PromoRepository.Redeem
+type promoRepoMock struct {
+	codes       map[string]*database.PromoCode
+	redemptions []database.PromoRedemption
+	cancelled   map[int64]bool
+}
+
+func (m *promoRepoMock) FindByCode(ctx context.Context, code string) (*database.PromoCode, error) {
+	return m.codes[code], nil
+}
+
+// CheckLimits считает погашенные скидки и скидки в неотменённых счетах, как redemptionCounted
+func (m *promoRepoMock) CheckLimits(ctx context.Context, promo *database.PromoCode, customerID int64) error {
+	var total, byCustomer int
+	for i := range m.redemptions {
+		r := &m.redemptions[i]
+		if r.Code != promo.Code || (r.Status == database.PromoRedemptionStatusPending && m.unbound(r)) {
+			continue
+		}
+		total++
+		if r.CustomerID == customerID {
+			byCustomer++
+		}
+	}
+	if promo.MaxUses > 0 && total >= promo.MaxUses {
+		return database.ErrPromoExhausted
+	}
+	if promo.PerUserLimit > 0 && byCustomer >= promo.PerUserLimit {
+		return database.ErrPromoUserLimit
+	}
+	return nil
+}
+
+func (m *promoRepoMock) Redeem(ctx context.Context, redemption *database.PromoRedemption, apply func(ctx context.Context) error) error {
+	if err := m.CheckLimits(ctx, m.codes[redemption.Code], redemption.CustomerID); err != nil {
+		return err
+	}
+	for _, r := range m.redemptions {
+		if redemption.Status == database.PromoRedemptionStatusPending && r.Status == database.PromoRedemptionStatusPending && r.CustomerID == redemption.CustomerID {
+			return database.ErrPromoPending
+		}
+	}
+	if apply != nil {
+		if err := apply(ctx); err != nil {
+			return err
+		}
+	}
+	redemption.ID = int64(len(m.redemptions) + 1)
+	m.redemptions = append(m.redemptions, *redemption)
+	return nil
+}
+
+func (m *promoRepoMock) unbound(r *database.PromoRedemption) bool {
+	return r.PurchaseID == nil || m.cancelled[*r.PurchaseID]
+}
+
+func (m *promoRepoMock) FindAvailableDiscount(ctx context.Context, customerID int64) (*database.PromoRedemption, *database.PromoCode, error) {
+	for i := range m.redemptions {
+		r := &m.redemptions[i]
+		if r.CustomerID == customerID && r.Status == database.PromoRedemptionStatusPending && m.codes[r.Code].Kind.IsDiscount() && m.unbound(r) {
+			return r, m.codes[r.Code], nil
+		}
+	}
+	return nil, nil, nil
+}
+
+func (m *promoRepoMock) BindPurchase(ctx context.Context, redemptionID, purchaseID int64) (bool, error) {
+	for i := range m.redemptions {
+		r := &m.redemptions[i]
+		if r.ID == redemptionID && r.Status == database.PromoRedemptionStatusPending && m.unbound(r) {
+			r.PurchaseID = &purchaseID
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+func (m *promoRepoMock) MarkRedeemedByPurchase(ctx context.Context, purchaseID int64) error {
+	for i := range m.redemptions {
+		r := &m.redemptions[i]
+		if r.PurchaseID != nil && *r.PurchaseID == purchaseID && r.Status == database.PromoRedemptionStatusPending {
+			r.Status = database.PromoRedemptionStatusRedeemed
+		}
+	}
+	return nil
+}
+
+type subscriptionRepoMock struct {
+	updated map[int64]map[string]interface{}
+}
+
+func (m *subscriptionRepoMock) UpdateSubscription(ctx context.Context, id int64, updates map[string]interface{}) error {
+	if m.updated == nil {
+		m.updated = make(map[int64]map[string]interface{})
+	}
+	m.updated[id] = updates
+	return nil
+}
+
+type remnawaveMock struct {
+	user         *remapi.User
+	err          error
+	extended     map[uuid.UUID]int
+	trafficAdded map[uuid.UUID]int
+}
+
+func (m *remnawaveMock) ExtendUserDays(ctx context.Context, userUuid uuid.UUID, days int) (*remapi.User, error) {
+	if m.err != nil {
+		return nil, m.err
+	}
+	if m.extended == nil {
+		m.extended = make(map[uuid.UUID]int)
+	}
+	m.extended[userUuid] += days
+	return m.user, nil
+}
+
+func (m *remnawaveMock) AddTraffic(ctx context.Context, userUuid uuid.UUID, bytes int) (*remapi.User, error) {
+	if m.err != nil {
+		return nil, m.err
+	}
+	if m.trafficAdded == nil {
+		m.trafficAdded = make(map[uuid.UUID]int)
+	}
+	m.trafficAdded[userUuid] += bytes
+	return m.user, nil
+}
+
+func newTestService(codes ...*database.PromoCode) (*Service, *promoRepoMock, *subscriptionRepoMock, *remnawaveMock) {
+	repo := &promoRepoMock{codes: map[string]*database.PromoCode{}}
+	for _, c := range codes {
+		repo.codes[c.Code] = c
+	}
+	subs := &subscriptionRepoMock{}
+	rw := &remnawaveMock{user: &remapi.User{SubscriptionUrl: "https://example/sub", ExpireAt: time.Now().AddDate(0, 0, 37)}}
+	return NewService(repo, subs, rw, nil), repo, subs, rw
+}
+
+func TestCheck(t *testing.T) {
+	past := time.Now().Add(-time.Hour)
+	svc, repo, _, _ := newTestService(
+		&database.PromoCode{Code: "GIFT", Kind: database.PromoKindDays, Value: 7, PerUserLimit: 1},
+		&database.PromoCode{Code: "OLD", Kind: database.PromoKindDays, Value: 7, ExpiresAt: &past},
+		&database.PromoCode{Code: "LAST", Kind: database.PromoKindDays, Value: 7, MaxUses: 1},
+	)
+	repo.redemptions = []database.PromoRedemption{{Code: "GIFT", CustomerID: 1}, {Code: "LAST", CustomerID: 2}}
+	customer := &database.Customer{ID: 1}
+
+	cases := map[string]error{"gift": database.ErrPromoUserLimit, "OLD": ErrExpired, "LAST": database.ErrPromoExhausted, "NOPE": ErrNotFound}
+	for code, want := range cases {
+		if _, err := svc.Check(context.Background(), customer, code); !errors.Is(err, want) {
+			t.Errorf("Check(%q) error = %v, want %v", code, err, want)
+		}
+	}
+	if promo, err := svc.Check(context.Background(), &database.Customer{ID: 3}, " gift "); err != nil || promo.Code != "GIFT" {
+		t.Fatalf("expected GIFT to be valid for another customer, got %v, %v", promo, err)
+	}
+}
+
+func TestApplyToSubscription_ExtendsChosenSubscriptionOnce(t *testing.T) {
+	gift := &database.PromoCode{Code: "GIFT", Kind: database.PromoKindDays, Value: 7, PerUserLimit: 1}
+	svc, repo, subs, rw := newTestService(gift)
+	userUUID := uuid.New()
+	customer := &database.Customer{ID: 1}
+	sub := &database.Subscription{ID: 10, CustomerID: 1, RemnawaveUUID: &userUUID}
+
+	if err := svc.ApplyToSubscription(context.Background(), customer, gift, sub); err != nil {
+		t.Fatalf("ApplyToSubscription returned error: %v", err)
+	}
+	if err := svc.ApplyToSubscription(context.Background(), customer, gift, sub); !errors.Is(err, database.ErrPromoUserLimit) {
+		t.Fatalf("expected the per-user limit on the second use, got %v", err)
+	}
+
+	if rw.extended[userUUID] != 7 || subs.updated[10]["expire_at"] != rw.user.ExpireAt {
+		t.Fatalf("expected subscription 10 to be extended by 7 days, got %v, %#v", rw.extended, subs.updated)
+	}
+	if len(repo.redemptions) != 1 || *repo.redemptions[0].SubscriptionID != 10 {
+		t.Fatalf("expected one redemption for subscription 10, got %#v", repo.redemptions)
+	}
+}
+
+func TestApplyToSubscription_PanelFailureDoesNotRedeem(t *testing.T) {
+	traffic := &database.PromoCode{Code: "GB", Kind: database.PromoKindTraffic, Value: 5, PerUserLimit: 1}
+	svc, repo, _, rw := newTestService(traffic)
+	rw.err = errors.New("unlimited traffic")
+	userUUID := uuid.New()
+
+	err := svc.ApplyToSubscription(context.Background(), &database.Customer{ID: 1}, traffic, &database.Subscription{ID: 10, CustomerID: 1, RemnawaveUUID: &userUUID})
+	if !errors.Is(err, ErrSubscriptionInvalid) || len(repo.redemptions) != 0 {
+		t.Fatalf("expected no redemption when traffic cannot be added, got %v, %#v", err, repo.redemptions)
+	}
+}
+
+func TestApplyDiscount(t *testing.T) {
+	percent := &database.PromoCode{Code: "SALE", Kind: database.PromoKindPercent, Value: 15, PerUserLimit: 1}
+	amount := &database.PromoCode{Code: "MINUS", Kind: database.PromoKindAmount, Value: 50, PerUserLimit: 1}
+	svc, repo, _, _ := newTestService(percent, amount)
+	customer := &database.Customer{ID: 1}
+
+	if err := svc.ActivateDiscount(context.Background(), customer, percent); err != nil {
+		t.Fatalf("ActivateDiscount returned error: %v", err)
+	}
+	if err := svc.ActivateDiscount(context.Background(), customer, amount); !errors.Is(err, ErrDiscountActive) {
+		t.Fatalf("expected one pending discount at a time, got %v", err)
+	}
+
+	traffic := &database.Purchase{Kind: database.PurchaseKindTraffic, Amount: 100, Currency: config.CurrencyRUB}
+	if id := svc.ApplyDiscount(context.Background(), customer, traffic); id != 0 || traffic.Amount != 100 {
+		t.Fatalf("discount must not apply to traffic, got %d, %v", id, traffic.Amount)
+	}
+
+	purchase := &database.Purchase{Kind: database.PurchaseKindSubscription, Amount: 199, Currency: config.CurrencyRUB}
+	id := svc.ApplyDiscount(context.Background(), customer, purchase)
+	if id == 0 || purchase.Amount != 170 {
+		t.Fatalf("expected 15%% off 199 rounded up to 170, got %d, %v", id, purchase.Amount)
+	}
+
+	svc.BindDiscount(context.Background(), id, 55)
+	svc.OnPurchasePaid(context.Background(), &database.Purchase{ID: 55})
+	if repo.redemptions[0].Status != database.PromoRedemptionStatusRedeemed {
+		t.Fatalf("expected the discount to be redeemed after payment, got %#v", repo.redemptions[0])
+	}
+	next := &database.Purchase{Kind: database.PurchaseKindSubscription, Amount: 199, Currency: config.CurrencyRUB}
+	if id := svc.ApplyDiscount(context.Background(), customer, next); id != 0 || next.Amount != 199 {
+		t.Fatalf("a redeemed discount must not apply again, got %d, %v", id, next.Amount)
+	}
+}
+
+func TestApplyDiscount_OneInvoiceAtATime(t *testing.T) {
+	percent := &database.PromoCode{Code: "SALE", Kind: database.PromoKindPercent, Value: 15, PerUserLimit: 1}
+	svc, repo, _, _ := newTestService(percent)
+	customer := &database.Customer{ID: 1}
+	if err := svc.ActivateDiscount(context.Background(), customer, percent); err != nil {
+		t.Fatalf("ActivateDiscount returned error: %v", err)
+	}
+
+	first := &database.Purchase{Kind: database.PurchaseKindSubscription, Amount: 199, Currency: config.CurrencyRUB}
+	id := svc.ApplyDiscount(context.Background(), customer, first)
+	svc.BindDiscount(context.Background(), id, 55)
+	second := &database.Purchase{Kind: database.PurchaseKindSubscription, Amount: 199, Currency: config.CurrencyRUB}
+	if id := svc.ApplyDiscount(context.Background(), customer, second); id != 0 || second.Amount != 199 {
+		t.Fatalf("the discount must not apply to a second invoice, got %d, %v", id, second.Amount)
+	}
+
+	repo.cancelled = map[int64]bool{55: true}
+	third := &database.Purchase{Kind: database.PurchaseKindSubscription, Amount: 199, Currency: config.CurrencyRUB}
+	id = svc.ApplyDiscount(context.Background(), customer, third)
+	if id == 0 || third.Amount != 170 {
+		t.Fatalf("expected the discount back after the first invoice was cancelled, got %d, %v", id, third.Amount)
+	}
+	svc.BindDiscount(context.Background(), id, 56)
+	svc.OnPurchasePaid(context.Background(), &database.Purchase{ID: 55})
+	if repo.redemptions[0].Status != database.PromoRedemptionStatusPending {
+		t.Fatal("a cancelled invoice must not redeem the rebound discount")
+	}
+	svc.OnPurchasePaid(context.Background(), &database.Purchase{ID: 56})
+	if repo.redemptions[0].Status != database.PromoRedemptionStatusRedeemed {
+		t.Fatalf("expected the discount to be redeemed with the third invoice, got %#v", repo.redemptions[0])
+	}
+}
+
+func TestCheck_OnlyInvoicedDiscountTakesUse(t *testing.T) {
+	last := &database.PromoCode{Code: "LAST", Kind: database.PromoKindPercent, Value: 15, MaxUses: 1}
+	svc, repo, _, _ := newTestService(last)
+	if err := svc.ActivateDiscount(context.Background(), &database.Customer{ID: 1}, last); err != nil {
+		t.Fatalf("ActivateDiscount returned error: %v", err)
+	}
+	other := &database.Customer{ID: 2}
+	if _, err := svc.Check(context.Background(), other, "LAST"); err != nil {
+		t.Fatalf("a discount outside an invoice must not take the last use, got %v", err)
+	}
+
+	purchaseID := int64(55)
+	repo.redemptions[0].PurchaseID = &purchaseID
+	if _, err := svc.Check(context.Background(), other, "LAST"); !errors.Is(err, database.ErrPromoExhausted) {
+		t.Fatalf("expected the invoiced discount to take the last use, got %v", err)
+	}
+	repo.cancelled = map[int64]bool{55: true}
+	if _, err := svc.Check(context.Background(), other, "LAST"); err != nil {
+		t.Fatalf("a cancelled invoice must release the use, got %v", err)
+	}
+}
+
+func TestDiscounted(t *testing.T) {
+	amount := &database.PromoCode{Kind: database.PromoKindAmount, Value: 500}
+	if got, ok := Discounted(amount, 199, config.CurrencyRUB); !ok || got != 1 {
+		t.Errorf("expected the amount to stay at least 1, got %v, %v", got, ok)
+	}
+	if _, ok := Discounted(amount, 100, config.CurrencyStars); ok {
+		t.Error("a ruble discount must not apply to Stars")
+	}
+	percent := &database.PromoCode{Kind: database.PromoKindPercent, Value: 10}
+	if got, ok := Discounted(percent, 75, config.CurrencyStars); !ok || got != 68 {
+		t.Errorf("expected 10%% off 75 Stars to be 68, got %v, %v", got, ok)
+	}
+}
@@ -0,0 +1,76 @@
+package promo
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"remnawave-tg-shop-bot/internal/database"
+	"remnawave-tg-shop-bot/internal/deeplink"
+)
+
+// ParseSpec разбирает аргументы /promo_add: код и параметры key=value, например
+// SPRING days=7 uses=100 per_user=1 expires=2026-12-31. Вид задаётся одним из ключей
+// days, percent, amount или traffic; plan ограничивает скидку тарифом.
+func ParseSpec(args []string) (*database.PromoCode, error) {
+	if len(args) < 2 {
+		return nil, fmt.Errorf("expected a code and a value")
+	}
+	code := NormalizeCode(args[0])
+	if !deeplink.ValidCode(code) {
+		return nil, fmt.Errorf("invalid code %q: up to 32 latin letters, digits and _", args[0])
+	}
+
+	promo := &database.PromoCode{Code: code, PerUserLimit: 1}
+	for _, arg := range args[1:] {
+		key, value, ok := strings.Cut(arg, "=")
+		if !ok {
+			return nil, fmt.Errorf("invalid parameter %q, expected key=value", arg)
+		}
+		switch key {
+		case "days", "percent", "amount", "traffic":
+			if promo.Kind != "" {
+				return nil, fmt.Errorf("only one of days, percent, amount and traffic can be set")
+			}
+			n, err := strconv.Atoi(value)
+			if err != nil || n <= 0 {
+				return nil, fmt.Errorf("invalid %s %q", key, value)
+			}
+			promo.Kind, promo.Value = database.PromoKind(key), n
+		case "uses", "per_user":
+			n, err := strconv.Atoi(value)
+			if err != nil || n < 0 {
+				return nil, fmt.Errorf("invalid %s %q", key, value)
+			}
+			if key == "uses" {
+				promo.MaxUses = n
+			} else {
+				promo.PerUserLimit = n
+			}
+		case "expires":
+			date, err := time.ParseInLocation("2006-01-02", value, time.Local)
+			if err != nil {
+				return nil, fmt.Errorf("invalid expires %q, expected YYYY-MM-DD", value)
+			}
+			// код действует весь указанный день
+			expiresAt := date.AddDate(0, 0, 1)
+			promo.ExpiresAt = &expiresAt
+		case "plan":
+			promo.PlanID = value
+		default:
+			return nil, fmt.Errorf("unknown parameter %q", key)
+		}
+	}
+
+	if promo.Kind == "" {
+		return nil, fmt.Errorf("one of days, percent, amount or traffic is required")
+	}
+	if promo.Kind == database.PromoKindPercent && promo.Value >= 100 {
+		return nil, fmt.Errorf("percent must be below 100")
+	}
+	if promo.PlanID != "" && !promo.Kind.IsDiscount() {
+		return nil, fmt.Errorf("plan restriction applies to discounts only")
+	}
+	return promo, nil
+}
@@ -0,0 +1,42 @@
+package promo
+
+import (
+	"strings"
+	"testing"
+
+	"remnawave-tg-shop-bot/internal/database"
+)
+
+func TestParseSpec(t *testing.T) {
+	promo, err := ParseSpec(strings.Fields("spring_25 percent=25 uses=100 per_user=2 expires=2026-12-31 plan=month_1"))
+	if err != nil {
+		t.Fatalf("ParseSpec returned error: %v", err)
+	}
+	if promo.Code != "SPRING_25" || promo.Kind != database.PromoKindPercent || promo.Value != 25 || promo.MaxUses != 100 || promo.PerUserLimit != 2 || promo.PlanID != "month_1" {
+		t.Fatalf("unexpected promo code: %+v", promo)
+	}
+	if promo.ExpiresAt == nil || promo.ExpiresAt.Format("2006-01-02") != "2027-01-01" {
+		t.Fatalf("expected the code to work through 2026-12-31, got %v", promo.ExpiresAt)
+	}
+
+	promo, err = ParseSpec([]string{"GIFT", "days=7"})
+	if err != nil || promo.PerUserLimit != 1 || promo.MaxUses != 0 {
+		t.Fatalf("expected one use per user without a total limit, got %+v, %v", promo, err)
+	}
+
+	for _, spec := range []string{
+		"GIFT",
+		"GIFT uses=5",
+		"GIFT days=7 traffic=5",
+		"GIFT days=0",
+		"GIFT percent=100",
+		"GIFT days=7 plan=month_1",
+		"GIFT days=7 expires=31.12.2026",
+		"GIFT days=7 color=red",
+		"BAD-CODE days=7",
+	} {
+		if _, err := ParseSpec(strings.Fields(spec)); err == nil {
+			t.Errorf("ParseSpec(%q) expected an error", spec)
+		}
+	}
+}
@@ -0,0 +1,38 @@
+package referral
+
+import (
+	"fmt"
+	"strconv"
+
+	"remnawave-tg-shop-bot/internal/config"
+)
+
+// FormatReward — "+3 дн.", "+5 ГБ" или "+14.9 ₽"
+func FormatReward(t Translator, lang string, kind string, amount float64) string {
+	switch config.ReferralRewardKind(kind) {
+	case config.ReferralRewardDays:
+		return fmt.Sprintf(t.GetText(lang, "referral_reward_days"), int(amount))
+	case config.ReferralRewardTraffic:
+		return fmt.Sprintf(t.GetText(lang, "referral_reward_traffic"), int(amount))
+	default:
+		return fmt.Sprintf(t.GetText(lang, "referral_reward_balance"), FormatAmount(amount))
+	}
+}
+
+// FormatAmount печатает сумму без лишних нулей: 15, 14.9, 14.95
+func FormatAmount(amount float64) string {
+	return strconv.FormatFloat(amount, 'f', -1, 64)
+}
+
+// FormatRule описывает правило для экрана реферальной программы
+func FormatRule(t Translator, lang string, rule config.ReferralRule) string {
+	reward := FormatReward(t, lang, string(rule.Kind), float64(rule.Amount))
+	if rule.Percent {
+		reward = fmt.Sprintf(t.GetText(lang, "referral_reward_percent"), rule.Amount)
+	}
+	text := fmt.Sprintf(t.GetText(lang, "referral_rule_"+string(rule.Event)), reward)
+	if rule.Level == 2 {
+		text += " " + t.GetText(lang, "referral_rule_second_level")
+	}
+	return text
+}
@@ -0,0 +1,416 @@
+package referral
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"math"
+
+	remapi "github.com/Jolymmiles/remnawave-api-go/v2/api"
+	"github.com/go-telegram/bot"
+	"github.com/go-telegram/bot/models"
+	"github.com/google/uuid"
+
+	"remnawave-tg-shop-bot/internal/config"
+	"remnawave-tg-shop-bot/internal/database"
+	"remnawave-tg-shop-bot/internal/remnawave"
+	"remnawave-tg-shop-bot/utils"
+)
+
+// ErrNoTrafficSubscription — трафик некуда добавить: у пригласившего нет действующей подписки
+// с ограниченным трафиком. Награда ждёт в pending до его следующей оплаты.
+var ErrNoTrafficSubscription = errors.New("no active subscription with limited traffic")
+
+var (
+	ErrSelfReferral       = errors.New("user cannot invite themselves")
+	ErrReferrerNotFound   = errors.New("referrer not found")
+	ErrAlreadyReferred    = errors.New("user is already invited")
+	ErrRefereeHasPurchase = errors.New("user has already paid")
+	ErrReferralCycle      = errors.New("referral cycle")
+)
+
+// maxChainDepth — на сколько приглашений вверх проверяется цикл при создании реферала
+const maxChainDepth = 32
+
+type Translator interface{ GetText(lang, key string) string }
+
+type referralRepository interface {
+	Create(ctx context.Context, referrerID, refereeID int64) (*database.Referral, error)
+	FindByReferee(ctx context.Context, refereeID int64) (*database.Referral, error)
+	MarkBonusGranted(ctx context.Context, referralID int64) error
+}
+
+type rewardRepository interface {
+	Grant(ctx context.Context, reward *database.ReferralReward, apply func(ctx context.Context) error) (bool, error)
+	GrantPending(ctx context.Context, reward *database.ReferralReward, apply func(ctx context.Context) error) (bool, error)
+	FindPending(ctx context.Context, referrerID int64) ([]database.ReferralReward, error)
+	Balance(ctx context.Context, referrerID, customerID int64) (float64, error)
+}
+
+type customerRepository interface {
+	FindByTelegramId(ctx context.Context, telegramId int64) (*database.Customer, error)
+}
+
+type purchaseRepository interface {
+	HasPaidPurchase(ctx context.Context, customerID int64) (bool, error)
+}
+
+type subscriptionRepository interface {
+	GetActiveSubscriptions(ctx context.Context, customerID int64) ([]database.Subscription, error)
+	CreateSubscription(ctx context.Context, subscription *database.Subscription) (*database.Subscription, error)
+	UpdateSubscription(ctx context.Context, id int64, updates map[string]interface{}) error
+}
+
+type remnawaveClient interface {
+	ExtendUserDays(ctx context.Context, userUuid uuid.UUID, days int) (*remapi.User, error)
+	AddTraffic(ctx context.Context, userUuid uuid.UUID, bytes int) (*remapi.User, error)
+	CreateUserForSubscription(ctx context.Context, customerId int64, telegramId int64, profile remnawave.PlanProfile, days int, seq int) (*remapi.User, error)
+}
+
+// Service начисляет награды реферальной программы по правилам REFERRAL_REWARDS
+type Service struct {
+	referrals     referralRepository
+	rewards       rewardRepository
+	customers     customerRepository
+	purchases     purchaseRepository
+	subscriptions subscriptionRepository
+	rw            remnawaveClient
+	translation   Translator
+	telegramBot   *bot.Bot
+	rules         []config.ReferralRule
+}
+
+func NewService(
+	referrals referralRepository,
+	rewards rewardRepository,
+	customers customerRepository,
+	purchases purchaseRepository,
+	subscriptions subscriptionRepository,
+	rw remnawaveClient,
+	translation Translator,
+	telegramBot *bot.Bot,
+	rules []config.ReferralRule,
+) *Service {
+	return &Service{
+		referrals:     referrals,
+		rewards:       rewards,
+		customers:     customers,
+		purchases:     purchases,
+		subscriptions: subscriptions,
+		rw:            rw,
+		translation:   translation,
+		telegramBot:   telegramBot,
+		rules:         rules,
+	}
+}
+
+// Attach записывает, что referee пришёл по ссылке referrerID. Пригласить можно только клиента,
+// которого ещё никто не пригласил и который ещё ничего не оплачивал; себя пригласить нельзя,
+// как и того, кто сам стоит выше по цепочке приглашений.
+func (s *Service) Attach(ctx context.Context, referee *database.Customer, referrerID int64) (*database.Referral, error) {
+	if referrerID == referee.TelegramID {
+		return nil, ErrSelfReferral
+	}
+	referrer, err := s.customers.FindByTelegramId(ctx, referrerID)
+	if err != nil {
+		return nil, err
+	}
+	if referrer == nil {
+		return nil, ErrReferrerNotFound
+	}
+	existing, err := s.referrals.FindByReferee(ctx, referee.TelegramID)
+	if err != nil {
+		return nil, err
+	}
+	if existing != nil {
+		return nil, ErrAlreadyReferred
+	}
+	paid, err := s.purchases.HasPaidPurchase(ctx, referee.ID)
+	if err != nil {
+		return nil, err
+	}
+	if paid {
+		return nil, ErrRefereeHasPurchase
+	}
+
+	invited := referrerID
+	for i := 0; i < maxChainDepth; i++ {
+		ref, err := s.referrals.FindByReferee(ctx, invited)
+		if err != nil {
+			return nil, err
+		}
+		if ref == nil {
+			break
+		}
+		if ref.ReferrerID == referee.TelegramID {
+			return nil, ErrReferralCycle
+		}
+		invited = ref.ReferrerID
+	}
+
+	return s.referrals.Create(ctx, referrerID, referee.TelegramID)
+}
+
+// OnTrial начисляет награды за пробный период приглашённого
+func (s *Service) OnTrial(ctx context.Context, referee *database.Customer) {
+	s.reward(ctx, referee, config.ReferralEventTrial, nil)
+}
+
+// OnPurchase начисляет награды за оплаченную покупку приглашённого и применяет отложенные
+// награды самого покупателя: после оплаты у него может появиться подписка для трафика.
+// Ошибки не отменяют покупку, они только пишутся в лог.
+func (s *Service) OnPurchase(ctx context.Context, customer *database.Customer, purchase *database.Purchase) {
+	s.grantPending(ctx, customer)
+	s.reward(ctx, customer, config.ReferralEventFirstPurchase, purchase)
+	s.reward(ctx, customer, config.ReferralEventPurchase, purchase)
+}
+
+// ApplyBalance вычитает реферальный баланс клиента из суммы счёта в рублях. Списываются целые
+// рубли, сумма счёта не становится меньше 1; списанная часть сохраняется в покупке и
+// возвращается на баланс, если счёт отменён.
+func (s *Service) ApplyBalance(ctx context.Context, customer *database.Customer, purchase *database.Purchase) {
+	if purchase.Currency != config.CurrencyRUB || purchase.Amount <= 1 {
+		return
+	}
+	balance, err := s.rewards.Balance(ctx, customer.TelegramID, customer.ID)
+	if err != nil {
+		slog.Error("Error finding referral balance", "error", err)
+		return
+	}
+	used := math.Floor(math.Min(balance, purchase.Amount-1))
+	if used <= 0 {
+		return
+	}
+	slog.Info("referral balance applied", "customer", utils.MaskHalfInt64(customer.ID), "amount", purchase.Amount, "used", used)
+	purchase.Amount -= used
+	purchase.BalanceUsed = used
+}
+
+func (s *Service) reward(ctx context.Context, referee *database.Customer, event config.ReferralEvent, purchase *database.Purchase) {
+	var rules []config.ReferralRule
+	for _, rule := range s.rules {
+		if rule.Event == event {
+			rules = append(rules, rule)
+		}
+	}
+	if len(rules) == 0 {
+		return
+	}
+
+	chain, err := s.chain(ctx, referee.TelegramID)
+	if err != nil {
+		slog.Error("Error finding referrers", "referee", utils.MaskHalfInt64(referee.TelegramID), "error", err)
+		return
+	}
+	if len(chain) == 0 {
+		return
+	}
+	// bonus_granted отмечает, что первая покупка приглашённого уже вознаграждена
+	if event == config.ReferralEventFirstPurchase && chain[0].BonusGranted {
+		return
+	}
+
+	for _, rule := range rules {
+		if rule.Level > len(chain) {
+			continue
+		}
+		amount := rewardAmount(rule, purchase)
+		if amount <= 0 {
+			continue
+		}
+		reward := &database.ReferralReward{
+			ReferralID: chain[0].ID,
+			ReferrerID: chain[rule.Level-1].ReferrerID,
+			Level:      rule.Level,
+			Event:      string(event),
+			Kind:       string(rule.Kind),
+			Amount:     amount,
+		}
+		if event == config.ReferralEventPurchase {
+			reward.PurchaseID = purchase.ID
+		}
+		s.grant(ctx, reward)
+	}
+
+	if event == config.ReferralEventFirstPurchase {
+		if err := s.referrals.MarkBonusGranted(ctx, chain[0].ID); err != nil {
+			slog.Error("Error marking referral bonus granted", "referral_id", chain[0].ID, "error", err)
+		}
+	}
+}
+
+// chain возвращает приглашения вверх по дереву: [0] — кто пригласил referee, [1] — кто пригласил
+// его. Цепочка обрывается на пользователе, который уже встречался в ней.
+func (s *Service) chain(ctx context.Context, refereeID int64) ([]database.Referral, error) {
+	maxLevel := 0
+	for _, rule := range s.rules {
+		maxLevel = max(maxLevel, rule.Level)
+	}
+
+	var chain []database.Referral
+	seen := map[int64]bool{refereeID: true}
+	invited := refereeID
+	for level := 1; level <= maxLevel; level++ {
+		ref, err := s.referrals.FindByReferee(ctx, invited)
+		if err != nil {
+			return nil, err
+		}
+		if ref == nil || seen[ref.ReferrerID] {
+			break
+		}
+		seen[ref.ReferrerID] = true
+		chain = append(chain, *ref)
+		invited = ref.ReferrerID
+	}
+	return chain, nil
+}
+
+// rewardAmount — размер награды по правилу. Процент считается от оплаченной суммы в рублях,
+// покупки за Telegram Stars процентных наград не дают.
+func rewardAmount(rule config.ReferralRule, purchase *database.Purchase) float64 {
+	if !rule.Percent {
+		return float64(rule.Amount)
+	}
+	if purchase == nil || purchase.Currency != config.CurrencyRUB {
+		return 0
+	}
+	return math.Floor(purchase.Amount*float64(rule.Amount)) / 100
+}
+
+func (s *Service) grant(ctx context.Context, reward *database.ReferralReward) {
+	referrer, err := s.customers.FindByTelegramId(ctx, reward.ReferrerID)
+	if err != nil || referrer == nil {
+		slog.Error("Referrer not found", "referrer", utils.MaskHalfInt64(reward.ReferrerID), "error", err)
+		return
+	}
+
+	created, err := s.rewards.Grant(ctx, reward, func(ctx context.Context) error {
+		return s.apply(ctx, referrer, reward)
+	})
+	if err != nil {
+		slog.Warn("referral reward is pending", "referrer", utils.MaskHalfInt64(reward.ReferrerID), "kind", reward.Kind, "amount", reward.Amount, "error", err)
+		return
+	}
+	if !created {
+		return
+	}
+	slog.Info("referral reward granted", "referrer", utils.MaskHalfInt64(reward.ReferrerID), "level", reward.Level, "event", reward.Event, "kind", reward.Kind, "amount", reward.Amount)
+	s.notify(ctx, referrer, reward)
+}
+
+// grantPending повторно применяет отложенные награды клиента
+func (s *Service) grantPending(ctx context.Context, customer *database.Customer) {
+	pending, err := s.rewards.FindPending(ctx, customer.TelegramID)
+	if err != nil {
+		slog.Error("Error finding pending referral rewards", "error", err)
+		return
+	}
+	for i := range pending {
+		reward := &pending[i]
+		granted, err := s.rewards.GrantPending(ctx, reward, func(ctx context.Context) error {
+			return s.apply(ctx, customer, reward)
+		})
+		if err != nil {
+			slog.Warn("referral reward is still pending", "reward_id", reward.ID, "error", err)
+			continue
+		}
+		if granted {
+			s.notify(ctx, customer, reward)
+		}
+	}
+}
+
+// apply выдаёт награду: дни продлевают самую новую активную подписку (или создают бонусную),
+// трафик добавляется к подписке с ограниченным трафиком, баланс — сумма выданных наград,
+// которая тратится при выставлении счетов (ApplyBalance)
+func (s *Service) apply(ctx context.Context, referrer *database.Customer, reward *database.ReferralReward) error {
+	switch config.ReferralRewardKind(reward.Kind) {
+	case config.ReferralRewardDays:
+		return s.addDays(ctx, referrer, int(reward.Amount))
+	case config.ReferralRewardTraffic:
+		return s.addTraffic(ctx, referrer, int(reward.Amount))
+	case config.ReferralRewardBalance:
+		return nil
+	default:
+		return fmt.Errorf("unknown referral reward kind %q", reward.Kind)
+	}
+}
+
+func (s *Service) addDays(ctx context.Context, referrer *database.Customer, days int) error {
+	active, err := s.subscriptions.GetActiveSubscriptions(ctx, referrer.ID)
+	if err != nil {
+		return err
+	}
+	// подписки приходят от новых к старым
+	for _, sub := range active {
+		if sub.RemnawaveUUID == nil {
+			continue
+		}
+		user, err := s.rw.ExtendUserDays(ctx, *sub.RemnawaveUUID, days)
+		if err != nil {
+			return err
+		}
+		return s.subscriptions.UpdateSubscription(ctx, sub.ID, map[string]interface{}{
+			"expire_at":         user.ExpireAt,
+			"subscription_link": user.SubscriptionUrl,
+		})
+	}
+
+	user, err := s.rw.CreateUserForSubscription(ctx, referrer.ID, referrer.TelegramID, remnawave.PlanReferralBonus, days, len(active)+1)
+	if err != nil {
+		return err
+	}
+	_, err = s.subscriptions.CreateSubscription(ctx, &database.Subscription{
+		CustomerID:       referrer.ID,
+		SubscriptionLink: user.SubscriptionUrl,
+		ExpireAt:         user.ExpireAt,
+		IsActive:         true,
+		Name:             s.translation.GetText(referrer.Language, "referral_bonus_subscription"),
+		Description:      s.translation.GetText(referrer.Language, "referral_bonus_description"),
+		RemnawaveUUID:    &user.UUID,
+		ShortUUID:        &user.ShortUuid,
+		Username:         &user.Username,
+	})
+	return err
+}
+
+func (s *Service) addTraffic(ctx context.Context, referrer *database.Customer, gb int) error {
+	active, err := s.subscriptions.GetActiveSubscriptions(ctx, referrer.ID)
+	if err != nil {
+		return err
+	}
+	for _, sub := range active {
+		if sub.RemnawaveUUID == nil {
+			continue
+		}
+		// у пользователя с безлимитным трафиком AddTraffic возвращает ошибку, пробуем следующую подписку
+		if _, err := s.rw.AddTraffic(ctx, *sub.RemnawaveUUID, config.GigabytesToBytes(gb)); err != nil {
+			slog.Warn("could not add referral traffic", "subscription_id", sub.ID, "error", err)
+			continue
+		}
+		return nil
+	}
+	return ErrNoTrafficSubscription
+}
+
+// notify сообщает пригласившему о выданной награде
+func (s *Service) notify(ctx context.Context, referrer *database.Customer, reward *database.ReferralReward) {
+	if s.telegramBot == nil {
+		return
+	}
+	text := s.translation.GetText(referrer.Language, "referral_bonus_granted") + "\n" + FormatReward(s.translation, referrer.Language, reward.Kind, reward.Amount)
+	_, err := s.telegramBot.SendMessage(ctx, &bot.SendMessageParams{
+		ChatID:    referrer.TelegramID,
+		Text:      text,
+		ParseMode: models.ParseModeHTML,
+		ReplyMarkup: models.InlineKeyboardMarkup{
+			InlineKeyboard: [][]models.InlineKeyboardButton{
+				{{Text: s.translation.GetText(referrer.Language, "referral_button"), CallbackData: "referral"}},
+			},
+		},
+	})
+	if err != nil {
+		slog.Error("Error sending referral reward message", "error", err)
+	}
+}
@@ -0,0 +1,373 @@
+package referral
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	remapi "github.com/Jolymmiles/remnawave-api-go/v2/api"
+	"github.com/google/uuid"
+
+	"remnawave-tg-shop-bot/internal/config"
+	"remnawave-tg-shop-bot/internal/database"
+	"remnawave-tg-shop-bot/internal/remnawave"
+	"remnawave-tg-shop-bot/internal/translation"
+)
+
+type referralRepoMock struct {
+	referrals []database.Referral
+}
+
+func (m *referralRepoMock) FindByReferee(ctx context.Context, refereeID int64) (*database.Referral, error) {
+	for i := range m.referrals {
+		if m.referrals[i].RefereeID == refereeID {
+			ref := m.referrals[i]
+			return &ref, nil
+		}
+	}
+	return nil, nil
+}
+
+func (m *referralRepoMock) Create(ctx context.Context, referrerID, refereeID int64) (*database.Referral, error) {
+	ref := database.Referral{ID: int64(len(m.referrals) + 1), ReferrerID: referrerID, RefereeID: refereeID}
+	m.referrals = append(m.referrals, ref)
+	return &ref, nil
+}
+
+func (m *referralRepoMock) MarkBonusGranted(ctx context.Context, referralID int64) error {
+	for i := range m.referrals {
+		if m.referrals[i].ID == referralID {
+			m.referrals[i].BonusGranted = true
+		}
+	}
+	return nil
+}
+
+// rewardRepoMock повторяет уникальность и статусы таблицы referral_reward
+type rewardRepoMock struct {
+	rewards []database.ReferralReward
+	// spent — баланс, списанный в неотменённые счета, по id клиента
+	spent map[int64]float64
+}
+
+func (m *rewardRepoMock) Grant(ctx context.Context, reward *database.ReferralReward, apply func(ctx context.Context) error) (bool, error) {
+	for _, r := range m.rewards {
+		if r.ReferralID == reward.ReferralID && r.Level == reward.Level && r.Event == reward.Event && r.PurchaseID == reward.PurchaseID && r.Kind == reward.Kind {
+			return false, nil
+		}
+	}
+	reward.ID = int64(len(m.rewards) + 1)
+	reward.Status = database.ReferralRewardStatusPending
+	err := apply(ctx)
+	if err == nil {
+		reward.Status = database.ReferralRewardStatusGranted
+	}
+	m.rewards = append(m.rewards, *reward)
+	return true, err
+}
+
+func (m *rewardRepoMock) GrantPending(ctx context.Context, reward *database.ReferralReward, apply func(ctx context.Context) error) (bool, error) {
+	for i := range m.rewards {
+		if m.rewards[i].ID != reward.ID || m.rewards[i].Status != database.ReferralRewardStatusPending {
+			continue
+		}
+		if err := apply(ctx); err != nil {
+			return false, err
+		}
+		m.rewards[i].Status = database.ReferralRewardStatusGranted
+		return true, nil
+	}
+	return false, nil
+}
+
+func (m *rewardRepoMock) FindPending(ctx context.Context, referrerID int64) ([]database.ReferralReward, error) {
+	var pending []database.ReferralReward
+	for _, r := range m.rewards {
+		if r.ReferrerID == referrerID && r.Status == database.ReferralRewardStatusPending {
+			pending = append(pending, r)
+		}
+	}
+	return pending, nil
+}
+
+func (m *rewardRepoMock) Balance(ctx context.Context, referrerID, customerID int64) (float64, error) {
+	var balance float64
+	for _, r := range m.rewards {
+		if r.ReferrerID == referrerID && r.Kind == string(config.ReferralRewardBalance) && r.Status == database.ReferralRewardStatusGranted {
+			balance += r.Amount
+		}
+	}
+	return max(balance-m.spent[customerID], 0), nil
+}
+
+type customerRepoMock struct {
+	customers map[int64]*database.Customer
+}
+
+func (m *customerRepoMock) FindByTelegramId(ctx context.Context, telegramId int64) (*database.Customer, error) {
+	return m.customers[telegramId], nil
+}
+
+type purchaseRepoMock struct {
+	paid map[int64]bool
+}
+
+func (m *purchaseRepoMock) HasPaidPurchase(ctx context.Context, customerID int64) (bool, error) {
+	return m.paid[customerID], nil
+}
+
+type subscriptionRepoMock struct {
+	active  map[int64][]database.Subscription
+	created []*database.Subscription
+	updated map[int64]map[string]interface{}
+}
+
+func (m *subscriptionRepoMock) GetActiveSubscriptions(ctx context.Context, customerID int64) ([]database.Subscription, error) {
+	return m.active[customerID], nil
+}
+
+func (m *subscriptionRepoMock) CreateSubscription(ctx context.Context, subscription *database.Subscription) (*database.Subscription, error) {
+	m.created = append(m.created, subscription)
+	return subscription, nil
+}
+
+func (m *subscriptionRepoMock) UpdateSubscription(ctx context.Context, id int64, updates map[string]interface{}) error {
+	if m.updated == nil {
+		m.updated = make(map[int64]map[string]interface{})
+	}
+	m.updated[id] = updates
+	return nil
+}
+
+type remnawaveMock struct {
+	user         *remapi.User
+	err          error
+	extended     map[uuid.UUID]int
+	trafficAdded map[uuid.UUID]int
+	created      []int
+	profiles     []remnawave.PlanProfile
+}
+
+func (m *remnawaveMock) ExtendUserDays(ctx context.Context, userUuid uuid.UUID, days int) (*remapi.User, error) {
+	if m.err != nil {
+		return nil, m.err
+	}
+	if m.extended == nil {
+		m.extended = make(map[uuid.UUID]int)
+	}
+	m.extended[userUuid] += days
+	return m.user, nil
+}
+
+func (m *remnawaveMock) AddTraffic(ctx context.Context, userUuid uuid.UUID, bytes int) (*remapi.User, error) {
+	if m.err != nil {
+		return nil, m.err
+	}
+	if m.trafficAdded == nil {
+		m.trafficAdded = make(map[uuid.UUID]int)
+	}
+	m.trafficAdded[userUuid] += bytes
+	return m.user, nil
+}
+
+func (m *remnawaveMock) CreateUserForSubscription(ctx context.Context, customerId int64, telegramId int64, profile remnawave.PlanProfile, days int, seq int) (*remapi.User, error) {
+	if m.err != nil {
+		return nil, m.err
+	}
+	m.profiles = append(m.profiles, profile)
+	m.created = append(m.created, days)
+	return m.user, nil
+}
+
+type fixture struct {
+	referrals     *referralRepoMock
+	rewards       *rewardRepoMock
+	purchases     *purchaseRepoMock
+	subscriptions *subscriptionRepoMock
+	rw            *remnawaveMock
+	svc           *Service
+}
+
+// newFixture: 300 пригласил 200, 200 пригласил 100
+func newFixture(rules ...config.ReferralRule) *fixture {
+	f := &fixture{
+		referrals: &referralRepoMock{referrals: []database.Referral{
+			{ID: 1, ReferrerID: 200, RefereeID: 100},
+			{ID: 2, ReferrerID: 300, RefereeID: 200},
+		}},
+		rewards:       &rewardRepoMock{},
+		purchases:     &purchaseRepoMock{paid: map[int64]bool{}},
+		subscriptions: &subscriptionRepoMock{active: map[int64][]database.Subscription{}},
+		rw:            &remnawaveMock{user: &remapi.User{UUID: uuid.New(), SubscriptionUrl: "https://example/sub/new", ExpireAt: time.Now().AddDate(0, 0, 10)}},
+	}
+	customers := &customerRepoMock{customers: map[int64]*database.Customer{
+		100: {ID: 1, TelegramID: 100},
+		200: {ID: 2, TelegramID: 200},
+		300: {ID: 3, TelegramID: 300},
+		400: {ID: 4, TelegramID: 400},
+	}}
+	f.svc = NewService(f.referrals, f.rewards, customers, f.purchases, f.subscriptions, f.rw, translation.GetInstance(), nil, rules)
+	return f
+}
+
+func TestOnPurchase_ExtendsNewestSubscriptionOnce(t *testing.T) {
+	f := newFixture(config.ReferralRule{Event: config.ReferralEventFirstPurchase, Level: 1, Kind: config.ReferralRewardDays, Amount: 7})
+	newest, older := uuid.New(), uuid.New()
+	f.subscriptions.active[2] = []database.Subscription{
+		{ID: 20, CustomerID: 2},
+		{ID: 21, CustomerID: 2, RemnawaveUUID: &newest},
+		{ID: 22, CustomerID: 2, RemnawaveUUID: &older},
+	}
+
+	referee := &database.Customer{ID: 1, TelegramID: 100}
+	f.svc.OnPurchase(context.Background(), referee, &database.Purchase{ID: 1, Amount: 100, Currency: config.CurrencyRUB})
+	f.svc.OnPurchase(context.Background(), referee, &database.Purchase{ID: 2, Amount: 100, Currency: config.CurrencyRUB})
+
+	if len(f.rw.extended) != 1 || f.rw.extended[newest] != 7 {
+		t.Fatalf("expected the newest subscription to be extended by 7 days once, got %v", f.rw.extended)
+	}
+	if f.subscriptions.updated[21]["expire_at"] != f.rw.user.ExpireAt {
+		t.Fatalf("expected subscription 21 to get the new expiration, got %#v", f.subscriptions.updated)
+	}
+	if !f.referrals.referrals[0].BonusGranted || len(f.rewards.rewards) != 1 {
+		t.Fatalf("expected one granted first purchase reward, got %#v", f.rewards.rewards)
+	}
+}
+
+func TestOnPurchase_CreatesBonusSubscription(t *testing.T) {
+	f := newFixture(config.ReferralRule{Event: config.ReferralEventFirstPurchase, Level: 1, Kind: config.ReferralRewardDays, Amount: 7})
+
+	f.svc.OnPurchase(context.Background(), &database.Customer{ID: 1, TelegramID: 100}, &database.Purchase{ID: 1})
+
+	if len(f.rw.profiles) != 1 || f.rw.profiles[0] != remnawave.PlanReferralBonus || f.rw.created[0] != 7 {
+		t.Fatalf("expected a referral bonus user for 7 days, got %v, %v", f.rw.profiles, f.rw.created)
+	}
+	if len(f.subscriptions.created) != 1 || f.subscriptions.created[0].CustomerID != 2 {
+		t.Fatalf("expected a bonus subscription for the referrer, got %#v", f.subscriptions.created)
+	}
+}
+
+func TestOnPurchase_RetriesPendingRewardOnReferrerPayment(t *testing.T) {
+	f := newFixture(config.ReferralRule{Event: config.ReferralEventFirstPurchase, Level: 1, Kind: config.ReferralRewardTraffic, Amount: 5})
+
+	// у пригласившего нет подписки, трафик добавить некуда
+	f.svc.OnPurchase(context.Background(), &database.Customer{ID: 1, TelegramID: 100}, &database.Purchase{ID: 1})
+	if len(f.rewards.rewards) != 1 || f.rewards.rewards[0].Status != database.ReferralRewardStatusPending {
+		t.Fatalf("expected a pending reward, got %#v", f.rewards.rewards)
+	}
+
+	userUUID := uuid.New()
+	f.subscriptions.active[2] = []database.Subscription{{ID: 21, CustomerID: 2, RemnawaveUUID: &userUUID}}
+	f.svc.OnPurchase(context.Background(), &database.Customer{ID: 2, TelegramID: 200}, &database.Purchase{ID: 2})
+
+	if f.rewards.rewards[0].Status != database.ReferralRewardStatusGranted || f.rw.trafficAdded[userUUID] != config.GigabytesToBytes(5) {
+		t.Fatalf("expected the pending reward to be granted on the referrer's payment, got %#v, %v", f.rewards.rewards, f.rw.trafficAdded)
+	}
+}
+
+func TestOnPurchase_PercentRewardsOnTwoLevels(t *testing.T) {
+	f := newFixture(
+		config.ReferralRule{Event: config.ReferralEventPurchase, Level: 1, Kind: config.ReferralRewardBalance, Amount: 10, Percent: true},
+		config.ReferralRule{Event: config.ReferralEventPurchase, Level: 2, Kind: config.ReferralRewardBalance, Amount: 50},
+	)
+
+	referee := &database.Customer{ID: 1, TelegramID: 100}
+	f.svc.OnPurchase(context.Background(), referee, &database.Purchase{ID: 5, Amount: 199, Currency: config.CurrencyRUB})
+	f.svc.OnPurchase(context.Background(), referee, &database.Purchase{ID: 5, Amount: 199, Currency: config.CurrencyRUB})
+	f.svc.OnPurchase(context.Background(), referee, &database.Purchase{ID: 6, Amount: 100, Currency: config.CurrencyStars})
+
+	got := map[int64]float64{}
+	for _, r := range f.rewards.rewards {
+		got[r.ReferrerID] += r.Amount
+	}
+	if got[200] != 19.9 || got[300] != 100 {
+		t.Fatalf("expected 19.9 to the first level and 2x50 to the second, got %v", got)
+	}
+}
+
+func TestApplyBalance(t *testing.T) {
+	f := newFixture(config.ReferralRule{Event: config.ReferralEventPurchase, Level: 1, Kind: config.ReferralRewardBalance, Amount: 10, Percent: true})
+	f.svc.OnPurchase(context.Background(), &database.Customer{ID: 1, TelegramID: 100}, &database.Purchase{ID: 5, Amount: 999, Currency: config.CurrencyRUB})
+	referrer := &database.Customer{ID: 2, TelegramID: 200}
+
+	stars := &database.Purchase{Amount: 100, Currency: config.CurrencyStars}
+	f.svc.ApplyBalance(context.Background(), referrer, stars)
+	if stars.Amount != 100 || stars.BalanceUsed != 0 {
+		t.Fatalf("balance must not apply to Stars, got %#v", stars)
+	}
+
+	purchase := &database.Purchase{Amount: 199, Currency: config.CurrencyRUB}
+	f.svc.ApplyBalance(context.Background(), referrer, purchase)
+	if purchase.Amount != 100 || purchase.BalanceUsed != 99 {
+		t.Fatalf("expected 99 whole rubles of 99.9 to be used, got %v, %v", purchase.Amount, purchase.BalanceUsed)
+	}
+
+	f.rewards.spent = map[int64]float64{2: purchase.BalanceUsed}
+	small := &database.Purchase{Amount: 50, Currency: config.CurrencyRUB}
+	f.svc.ApplyBalance(context.Background(), referrer, small)
+	if small.Amount != 50 || small.BalanceUsed != 0 {
+		t.Fatalf("the rest of the balance is less than a ruble, got %v, %v", small.Amount, small.BalanceUsed)
+	}
+}
+
+func TestOnTrial_StopsOnReferralCycle(t *testing.T) {
+	f := newFixture(
+		config.ReferralRule{Event: config.ReferralEventTrial, Level: 1, Kind: config.ReferralRewardBalance, Amount: 10},
+		config.ReferralRule{Event: config.ReferralEventTrial, Level: 2, Kind: config.ReferralRewardBalance, Amount: 5},
+	)
+	f.referrals.referrals[1].ReferrerID = 100
+
+	f.svc.OnTrial(context.Background(), &database.Customer{ID: 1, TelegramID: 100})
+
+	if len(f.rewards.rewards) != 1 || f.rewards.rewards[0].ReferrerID != 200 {
+		t.Fatalf("expected only the first level reward, got %#v", f.rewards.rewards)
+	}
+}
+
+func TestOnPurchase_PanelFailureKeepsRewardPending(t *testing.T) {
+	f := newFixture(config.ReferralRule{Event: config.ReferralEventFirstPurchase, Level: 1, Kind: config.ReferralRewardDays, Amount: 7})
+	f.rw.err = errors.New("panel is down")
+
+	f.svc.OnPurchase(context.Background(), &database.Customer{ID: 1, TelegramID: 100}, &database.Purchase{ID: 1})
+
+	if len(f.rewards.rewards) != 1 || f.rewards.rewards[0].Status != database.ReferralRewardStatusPending {
+		t.Fatalf("expected the reward to stay pending, got %#v", f.rewards.rewards)
+	}
+}
+
+func TestAttach(t *testing.T) {
+	tests := []struct {
+		name       string
+		referee    *database.Customer
+		referrerID int64
+		paid       bool
+		wantErr    error
+	}{
+		{name: "new user", referee: &database.Customer{ID: 4, TelegramID: 400}, referrerID: 100},
+		{name: "self", referee: &database.Customer{ID: 4, TelegramID: 400}, referrerID: 400, wantErr: ErrSelfReferral},
+		{name: "unknown referrer", referee: &database.Customer{ID: 4, TelegramID: 400}, referrerID: 999, wantErr: ErrReferrerNotFound},
+		{name: "already invited", referee: &database.Customer{ID: 1, TelegramID: 100}, referrerID: 300, wantErr: ErrAlreadyReferred},
+		{name: "paid before", referee: &database.Customer{ID: 4, TelegramID: 400}, referrerID: 100, paid: true, wantErr: ErrRefereeHasPurchase},
+		// 300 пригласил 200, 200 пригласил 100: 300 не может прийти по ссылке 100
+		{name: "cycle", referee: &database.Customer{ID: 3, TelegramID: 300}, referrerID: 100, wantErr: ErrReferralCycle},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f := newFixture()
+			f.purchases.paid[tt.referee.ID] = tt.paid
+
+			ref, err := f.svc.Attach(context.Background(), tt.referee, tt.referrerID)
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("Attach() error = %v, want %v", err, tt.wantErr)
+			}
+			if tt.wantErr == nil && (ref == nil || ref.ReferrerID != tt.referrerID || len(f.referrals.referrals) != 3) {
+				t.Fatalf("expected a new referral, got %#v", ref)
+			}
+			if tt.wantErr != nil && len(f.referrals.referrals) != 2 {
+				t.Fatalf("expected no new referrals, got %#v", f.referrals.referrals)
+			}
+		})
+	}
+}
@@ -9,7 +9,6 @@ import (
 	"remnawave-tg-shop-bot/internal/config"
 	"remnawave-tg-shop-bot/utils"
 	"strconv"
-	"strings"
 	"time"
 
 	remapi "github.com/Jolymmiles/remnawave-api-go/v2/api"
@@ -90,38 +89,11 @@ func (r *Client) GetUsers(ctx context.Context) (*[]remapi.User, error) {
 	return &users, nil
 }
 
-func (r *Client) DecreaseSubscription(ctx context.Context, telegramId int64, trafficLimit int, days int) (*time.Time, error) {
-
-	resp, err := r.client.Users().GetUserByTelegramId(ctx, strconv.FormatInt(telegramId, 10))
-	if err != nil {
-		return nil, err
-	}
-
-	usersResp, ok := resp.(*remapi.UsersResponse)
-	if !ok {
-		return nil, errors.New("unknown response type")
-	}
-
-	users := usersResp.GetResponse()
-	if len(users) == 0 {
-		return nil, fmt.Errorf("user with telegramId %d not found", telegramId)
-	}
-
-	var existingUser *remapi.User
-	suffix := fmt.Sprintf("_%d", telegramId)
-
-	for i := range users {
-		if strings.Contains(users[i].Username, suffix) {
-			existingUser = &users[i]
-			break
-		}
-	}
-
-	if existingUser == nil {
-		existingUser = &users[0]
-	}
-
-	updated, err := r.updateUser(ctx, existingUser, trafficLimit, days)
+// DecreaseSubscription shortens (negative days) or extends the user by its uuid
+func (r *Client) DecreaseSubscription(ctx context.Context, userUuid uuid.UUID, trafficLimit int, days int) (*time.Time, error) {
+	settings := PlanPaid.settings()
+	settings.trafficLimit = trafficLimit
+	updated, err := r.extendUser(ctx, userUuid, settings, days)
 	if err != nil {
 		return nil, err
 	}
@@ -129,7 +101,16 @@ func (r *Client) DecreaseSubscription(ctx context.Context, telegramId int64, tra
 	return &updated.ExpireAt, nil
 }
 
-func (r *Client) CreateOrUpdateUser(ctx context.Context, customerId int64, telegramId int64, trafficLimit int, days int, isTrialUser bool) (*remapi.User, error) {
+// CreateCustomerUser creates the customer's own user ({customerId}_{telegramId}) with the plan settings
+// and the given expiration
+func (r *Client) CreateCustomerUser(ctx context.Context, customerId int64, telegramId int64, plan config.Plan, expireAt time.Time) (*remapi.User, error) {
+	return r.createUser(ctx, customerId, telegramId, planSettingsOf(plan), expireAt)
+}
+
+// FindCustomerUser looks the customer's own user up by telegram id. Only subscriptions stored
+// before the user's uuid was kept need it; the user must carry exactly the customer's username,
+// otherwise nil is returned without error.
+func (r *Client) FindCustomerUser(ctx context.Context, customerId int64, telegramId int64) (*remapi.User, error) {
 	resp, err := r.client.Users().GetUserByTelegramId(ctx, strconv.FormatInt(telegramId, 10))
 	if err != nil {
 		return nil, err
@@ -140,32 +121,17 @@ func (r *Client) CreateOrUpdateUser(ctx context.Context, customerId int64, teleg
 		return nil, errors.New("unknown response type")
 	}
 
+	username := CustomerUsername(customerId, telegramId)
 	users := usersResp.GetResponse()
-	if len(users) == 0 {
-		return r.createUser(ctx, customerId, telegramId, trafficLimit, days, isTrialUser)
-	}
-
-	var existingUser *remapi.User
-	suffix := fmt.Sprintf("_%d", telegramId)
-
 	for i := range users {
-		if strings.Contains(users[i].Username, suffix) {
-			existingUser = &users[i]
-			break
+		if users[i].Username == username {
+			return &users[i], nil
 		}
 	}
-
-	if existingUser == nil {
-		existingUser = &users[0]
-	}
-
-	return r.updateUser(ctx, existingUser, trafficLimit, days)
+	return nil, nil
 }
 
-func (r *Client) updateUser(ctx context.Context, existingUser *remapi.User, trafficLimit int, days int) (*remapi.User, error) {
-
-	newExpire := getNewExpire(days, existingUser.ExpireAt)
-
+func (r *Client) updateUser(ctx context.Context, existingUser *remapi.User, settings planSettings, newExpire time.Time) (*remapi.User, error) {
 	resp, err := r.client.InternalSquad().GetInternalSquads(ctx)
 	if err != nil {
 		return nil, err
@@ -173,38 +139,25 @@ func (r *Client) updateUser(ctx context.Context, existingUser *remapi.User, traf
 
 	squads := resp.(*remapi.InternalSquadsResponse).GetResponse()
 
-	selectedSquads := config.SquadUUIDs()
-
-	squadId := make([]uuid.UUID, 0, len(selectedSquads))
-	for _, squad := range squads.GetInternalSquads() {
-		if selectedSquads != nil && len(selectedSquads) > 0 {
-			if _, isExist := selectedSquads[squad.UUID]; !isExist {
-				continue
-			} else {
-				squadId = append(squadId, squad.UUID)
-			}
-		} else {
-			squadId = append(squadId, squad.UUID)
-		}
-	}
+	squadId := selectSquads(squads.GetInternalSquads(), settings.squads)
 
 	userUpdate := &remapi.UpdateUserRequestDto{
 		UUID:                 remapi.NewOptUUID(existingUser.UUID),
 		ExpireAt:             remapi.NewOptDateTime(newExpire),
 		Status:               remapi.NewOptUpdateUserRequestDtoStatus(remapi.UpdateUserRequestDtoStatusACTIVE),
-		TrafficLimitBytes:    remapi.NewOptInt(trafficLimit),
+		TrafficLimitBytes:    remapi.NewOptInt(settings.trafficLimit),
 		ActiveInternalSquads: squadId,
-		TrafficLimitStrategy: remapi.NewOptUpdateUserRequestDtoTrafficLimitStrategy(getUpdateStrategy(config.TrafficLimitResetStrategy())),
+		TrafficLimitStrategy: remapi.NewOptUpdateUserRequestDtoTrafficLimitStrategy(getUpdateStrategy(settings.strategy)),
 	}
 
-	externalSquad := config.ExternalSquadUUID()
-	if externalSquad != uuid.Nil {
-		userUpdate.ExternalSquadUuid = remapi.NewOptNilUUID(externalSquad)
+	if settings.externalSquad != uuid.Nil {
+		userUpdate.ExternalSquadUuid = remapi.NewOptNilUUID(settings.externalSquad)
 	}
-
-	tag := config.RemnawaveTag()
-	if tag != "" {
-		userUpdate.Tag = remapi.NewOptNilString(tag)
+	if settings.tag != "" {
+		userUpdate.Tag = remapi.NewOptNilString(settings.tag)
+	}
+	if settings.deviceLimit > 0 {
+		userUpdate.HwidDeviceLimit = remapi.NewOptNilInt(settings.deviceLimit)
 	}
 
 	var username string
@@ -224,13 +177,12 @@ func (r *Client) updateUser(ctx context.Context, existingUser *remapi.User, traf
 	}
 
 	tgid, _ := existingUser.TelegramId.Get()
-	slog.Info("updated user", "telegramId", utils.MaskHalf(strconv.Itoa(tgid)), "username", utils.MaskHalf(username), "days", days)
+	slog.Info("updated user", "telegramId", utils.MaskHalf(strconv.Itoa(tgid)), "username", utils.MaskHalf(username), "expireAt", newExpire)
 	return &updateUser.(*remapi.UserResponse).Response, nil
 }
 
-func (r *Client) createUser(ctx context.Context, customerId int64, telegramId int64, trafficLimit int, days int, isTrialUser bool) (*remapi.User, error) {
-	expireAt := time.Now().UTC().AddDate(0, 0, days)
-	username := generateUsername(customerId, telegramId)
+func (r *Client) createUser(ctx context.Context, customerId int64, telegramId int64, settings planSettings, expireAt time.Time) (*remapi.User, error) {
+	username := CustomerUsername(customerId, telegramId)
 
 	resp, err := r.client.InternalSquad().GetInternalSquads(ctx)
 	if err != nil {
@@ -239,33 +191,7 @@ func (r *Client) createUser(ctx context.Context, customerId int64, telegramId in
 
 	squads := resp.(*remapi.InternalSquadsResponse).GetResponse()
 
-	selectedSquads := config.SquadUUIDs()
-	if isTrialUser {
-		selectedSquads = config.TrialInternalSquads()
-	}
-
-	squadId := make([]uuid.UUID, 0, len(selectedSquads))
-	for _, squad := range squads.GetInternalSquads() {
-		if selectedSquads != nil && len(selectedSquads) > 0 {
-			if _, isExist := selectedSquads[squad.UUID]; !isExist {
-				continue
-			} else {
-				squadId = append(squadId, squad.UUID)
-			}
-		} else {
-			squadId = append(squadId, squad.UUID)
-		}
-	}
-
-	externalSquad := config.ExternalSquadUUID()
-	if isTrialUser {
-		externalSquad = config.TrialExternalSquadUUID()
-	}
-
-	strategy := config.TrafficLimitResetStrategy()
-	if isTrialUser {
-		strategy = config.TrialTrafficLimitResetStrategy()
-	}
+	squadId := selectSquads(squads.GetInternalSquads(), settings.squads)
 
 	createUserRequestDto := remapi.CreateUserRequestDto{
 		Username:             username,
@@ -273,19 +199,10 @@ func (r *Client) createUser(ctx context.Context, customerId int64, telegramId in
 		Status:               remapi.NewOptCreateUserRequestDtoStatus(remapi.CreateUserRequestDtoStatusACTIVE),
 		TelegramId:           remapi.NewOptNilInt(int(telegramId)),
 		ExpireAt:             expireAt,
-		TrafficLimitStrategy: remapi.NewOptCreateUserRequestDtoTrafficLimitStrategy(getCreateStrategy(strategy)),
-		TrafficLimitBytes:    remapi.NewOptInt(trafficLimit),
-	}
-	if externalSquad != uuid.Nil {
-		createUserRequestDto.ExternalSquadUuid = remapi.NewOptNilUUID(externalSquad)
-	}
-	tag := config.RemnawaveTag()
-	if isTrialUser {
-		tag = config.TrialRemnawaveTag()
-	}
-	if tag != "" {
-		createUserRequestDto.Tag = remapi.NewOptNilString(tag)
+		TrafficLimitStrategy: remapi.NewOptCreateUserRequestDtoTrafficLimitStrategy(getCreateStrategy(settings.strategy)),
+		TrafficLimitBytes:    remapi.NewOptInt(settings.trafficLimit),
 	}
+	settings.applyToCreate(&createUserRequestDto)
 
 	var tgUsername string
 	if ctx.Value("username") != nil {
@@ -299,15 +216,18 @@ func (r *Client) createUser(ctx context.Context, customerId int64, telegramId in
 	if err != nil {
 		return nil, err
 	}
-	slog.Info("created user", "telegramId", utils.MaskHalf(strconv.FormatInt(telegramId, 10)), "username", utils.MaskHalf(tgUsername), "days", days)
+	slog.Info("created user", "telegramId", utils.MaskHalf(strconv.FormatInt(telegramId, 10)), "username", utils.MaskHalf(tgUsername), "expireAt", expireAt)
 	return &userCreate.(*remapi.UserResponse).Response, nil
 }
 
-func generateUsername(customerId int64, telegramId int64) string {
+// CustomerUsername is the username of the customer's own user
+func CustomerUsername(customerId int64, telegramId int64) string {
 	return fmt.Sprintf("%d_%d", customerId, telegramId)
 }
 
-func getNewExpire(daysToAdd int, currentExpire time.Time) time.Time {
+// NewExpire adds days to the current expiration, or to now when it has already passed.
+// Negative days shorten it, but never below tomorrow.
+func NewExpire(daysToAdd int, currentExpire time.Time) time.Time {
 	if daysToAdd <= 0 {
 		if currentExpire.AddDate(0, 0, daysToAdd).Before(time.Now()) {
 			return time.Now().UTC().AddDate(0, 0, 1)
@@ -0,0 +1,90 @@
+package remnawave
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+
+	remapi "github.com/Jolymmiles/remnawave-api-go/v2/api"
+	"github.com/google/uuid"
+	"remnawave-tg-shop-bot/internal/config"
+)
+
+// stubTelegramUsers serves the users found by telegram id
+func stubTelegramUsers(t *testing.T, usernames ...string) *Client {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet || r.URL.Path != "/api/users/by-telegram-id/100" {
+			t.Errorf("unexpected request %s %s", r.Method, r.URL.Path)
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		users := make([]remapi.User, 0, len(usernames))
+		for _, username := range usernames {
+			users = append(users, remapi.User{UUID: uuid.New(), Username: username, Email: remapi.NilString{Null: true}})
+		}
+		body, _ := (&remapi.UsersResponse{Response: users}).MarshalJSON()
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = w.Write(body)
+	}))
+	t.Cleanup(server.Close)
+	return NewClient(server.URL, "token", "remote")
+}
+
+func TestFindCustomerUser(t *testing.T) {
+	tests := []struct {
+		name     string
+		users    []string
+		expected string
+	}{
+		{"exact username", []string{"5_100_1_a1b2c3", "legacy", "5_100"}, "5_100"},
+		{"other users of the telegram id are never picked", []string{"5_100_1_a1b2c3", "legacy"}, ""},
+		{"user of an old customer id", []string{"3_100"}, ""},
+	}
+
+	for _, tt := range tests {
+		client := stubTelegramUsers(t, tt.users...)
+
+		got, err := client.FindCustomerUser(context.Background(), 5, 100)
+		if err != nil {
+			t.Fatalf("%s: unexpected error: %v", tt.name, err)
+		}
+		if tt.expected == "" {
+			if got != nil {
+				t.Errorf("%s: expected no user, got %s", tt.name, got.Username)
+			}
+			continue
+		}
+		if got == nil || got.Username != tt.expected {
+			t.Errorf("%s: expected %s, got %v", tt.name, tt.expected, got)
+		}
+	}
+}
+
+func TestCreatePlanUserForSubscription_ReturnsUserOfPreviousAttempt(t *testing.T) {
+	expireAt := time.Date(2026, 11, 1, 12, 0, 0, 0, time.UTC)
+	username := subscriptionUsername(5, 100, 2, strconv.FormatInt(expireAt.Unix(), 10))
+	existing := uuid.New()
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet || r.URL.Path != "/api/users/by-username/"+username {
+			t.Errorf("unexpected request %s %s", r.Method, r.URL.Path)
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		body, _ := (&remapi.UserResponse{Response: remapi.User{UUID: existing, Username: username, ExpireAt: expireAt, Email: remapi.NilString{Null: true}}}).MarshalJSON()
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = w.Write(body)
+	}))
+	t.Cleanup(server.Close)
+	client := NewClient(server.URL, "token", "remote")
+
+	user, err := client.CreatePlanUserForSubscription(context.Background(), 5, 100, config.Plan{ID: "month", Days: 30}, 2, expireAt)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if user.UUID != existing {
+		t.Fatalf("expected the user of the previous attempt, got %s", user.UUID)
+	}
+}
@@ -0,0 +1,43 @@
+package remnawave
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+
+	remapi "github.com/Jolymmiles/remnawave-api-go/v2/api"
+	"github.com/google/uuid"
+)
+
+// GetUserDevices returns the HWID devices bound to the user, nil without error when the panel has no such user
+func (r *Client) GetUserDevices(ctx context.Context, userUuid uuid.UUID) ([]remapi.Device, error) {
+	resp, err := r.client.HwidUserDevices().GetUserHwidDevices(ctx, userUuid.String())
+	if err != nil {
+		return nil, err
+	}
+	switch v := resp.(type) {
+	case *remapi.HwidDevicesResponse:
+		return v.Response.Devices, nil
+	case *remapi.NotFoundError:
+		return nil, nil
+	default:
+		return nil, fmt.Errorf("unexpected response getting user devices: %T", resp)
+	}
+}
+
+// DeleteUserDevice unbinds the device from the user, the device can connect again while
+// the user is below the device limit
+func (r *Client) DeleteUserDevice(ctx context.Context, userUuid uuid.UUID, hwid string) error {
+	resp, err := r.client.HwidUserDevices().DeleteUserHwidDevice(ctx, &remapi.DeleteUserHwidDeviceRequestDto{
+		UserUuid: userUuid,
+		Hwid:     hwid,
+	})
+	if err != nil {
+		return err
+	}
+	if _, ok := resp.(*remapi.HwidDevicesResponse); !ok {
+		return fmt.Errorf("unexpected response deleting user device: %T", resp)
+	}
+	slog.Info("deleted user device", "uuid", userUuid)
+	return nil
+}
@@ -0,0 +1,87 @@
+package remnawave
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	remapi "github.com/Jolymmiles/remnawave-api-go/v2/api"
+	"github.com/google/uuid"
+)
+
+// stubDevicesPanel serves the user's devices and removes the deleted ones from them
+func stubDevicesPanel(t *testing.T, userUuid uuid.UUID, devices []remapi.Device) *Client {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var resp json.Marshaler
+		switch {
+		case r.Method == http.MethodGet && r.URL.Path == "/api/hwid/devices/"+userUuid.String():
+		case r.Method == http.MethodPost && r.URL.Path == "/api/hwid/devices/delete":
+			var req remapi.DeleteUserHwidDeviceRequestDto
+			body, _ := io.ReadAll(r.Body)
+			if err := req.UnmarshalJSON(body); err != nil {
+				t.Errorf("failed to decode delete device request: %v", err)
+			}
+			if req.UserUuid != userUuid {
+				t.Errorf("unexpected user %s", req.UserUuid)
+			}
+			kept := devices[:0]
+			for _, device := range devices {
+				if device.Hwid != req.Hwid {
+					kept = append(kept, device)
+				}
+			}
+			devices = kept
+		default:
+			t.Errorf("unexpected request %s %s", r.Method, r.URL.Path)
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		resp = &remapi.HwidDevicesResponse{Response: remapi.AllHwidDevices{Devices: devices, Total: float64(len(devices))}}
+		w.Header().Set("Content-Type", "application/json")
+		body, _ := resp.MarshalJSON()
+		_, _ = w.Write(body)
+	}))
+	t.Cleanup(server.Close)
+	return NewClient(server.URL, "token", "remote")
+}
+
+func TestUserDevices(t *testing.T) {
+	userUuid := uuid.New()
+	device := func(hwid string) remapi.Device {
+		return remapi.Device{
+			Hwid:        hwid,
+			UserUuid:    userUuid,
+			Platform:    remapi.NewNilString("iOS"),
+			OsVersion:   remapi.NilString{Null: true},
+			DeviceModel: remapi.NilString{Null: true},
+			UserAgent:   remapi.NilString{Null: true},
+			CreatedAt:   time.Now(),
+			UpdatedAt:   time.Now(),
+		}
+	}
+	client := stubDevicesPanel(t, userUuid, []remapi.Device{device("phone"), device("laptop")})
+	ctx := context.Background()
+
+	devices, err := client.GetUserDevices(ctx, userUuid)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(devices) != 2 || devices[0].Hwid != "phone" || devices[0].Platform.Value != "iOS" {
+		t.Fatalf("unexpected devices %#v", devices)
+	}
+
+	if err := client.DeleteUserDevice(ctx, userUuid, "phone"); err != nil {
+		t.Fatalf("unexpected error deleting device: %v", err)
+	}
+	devices, err = client.GetUserDevices(ctx, userUuid)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(devices) != 1 || devices[0].Hwid != "laptop" {
+		t.Errorf("expected only the laptop to stay bound, got %#v", devices)
+	}
+}
@@ -0,0 +1,97 @@
+package remnawave
+
+import (
+	remapi "github.com/Jolymmiles/remnawave-api-go/v2/api"
+	"github.com/google/uuid"
+	"remnawave-tg-shop-bot/internal/config"
+)
+
+// PlanProfile is the kind of subscription a panel user is created for
+type PlanProfile int
+
+const (
+	PlanPaid PlanProfile = iota
+	PlanTrial
+	// PlanReferralBonus is a subscription granted for an invited friend, it gets the paid settings
+	PlanReferralBonus
+)
+
+func (p PlanProfile) String() string {
+	switch p {
+	case PlanTrial:
+		return "trial"
+	case PlanReferralBonus:
+		return "referral_bonus"
+	default:
+		return "paid"
+	}
+}
+
+// planSettings are the panel settings a profile selects for a new user
+type planSettings struct {
+	// squads limits the internal squads, empty means all squads of the panel
+	squads        map[uuid.UUID]uuid.UUID
+	externalSquad uuid.UUID
+	tag           string
+	trafficLimit  int
+	strategy      string
+	// deviceLimit is 0 to keep the panel default
+	deviceLimit int
+}
+
+func (p PlanProfile) settings() planSettings {
+	if p == PlanTrial {
+		return planSettings{
+			squads:        config.TrialInternalSquads(),
+			externalSquad: config.TrialExternalSquadUUID(),
+			tag:           config.TrialRemnawaveTag(),
+			trafficLimit:  config.TrialTrafficLimit(),
+			strategy:      config.TrialTrafficLimitResetStrategy(),
+			deviceLimit:   config.TrialDeviceLimit(),
+		}
+	}
+	return planSettings{
+		squads:        config.SquadUUIDs(),
+		externalSquad: config.ExternalSquadUUID(),
+		tag:           config.RemnawaveTag(),
+		trafficLimit:  config.TrafficLimit(),
+		strategy:      config.TrafficLimitResetStrategy(),
+		deviceLimit:   config.DeviceLimit(),
+	}
+}
+
+// planSettingsOf returns the settings of a catalog plan, the global paid settings fill
+// what the plan leaves empty
+func planSettingsOf(plan config.Plan) planSettings {
+	settings := PlanPaid.settings()
+	settings.trafficLimit = plan.TrafficLimitBytes()
+	if plan.DeviceLimit > 0 {
+		settings.deviceLimit = plan.DeviceLimit
+	}
+	if len(plan.InternalSquads) > 0 {
+		settings.squads = make(map[uuid.UUID]uuid.UUID, len(plan.InternalSquads))
+		for _, squad := range plan.InternalSquads {
+			settings.squads[squad] = squad
+		}
+	}
+	if plan.ExternalSquad != uuid.Nil {
+		settings.externalSquad = plan.ExternalSquad
+	}
+	if plan.TrafficLimitResetStrategy != "" {
+		settings.strategy = plan.TrafficLimitResetStrategy
+	}
+	return settings
+}
+
+// applyToCreate sets the optional settings on a create user request
+func (s planSettings) applyToCreate(dto *remapi.CreateUserRequestDto) {
+	if s.externalSquad != uuid.Nil {
+		dto.ExternalSquadUuid = remapi.NewOptNilUUID(s.externalSquad)
+	}
+	if s.tag != "" {
+		dto.Tag = remapi.NewOptNilString(s.tag)
+	}
+	if s.deviceLimit > 0 {
+		dto.HwidDeviceLimit = remapi.NewOptInt(s.deviceLimit)
+	}
+}
@@ -0,0 +1,180 @@
+package remnawave
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	remapi "github.com/Jolymmiles/remnawave-api-go/v2/api"
+	"github.com/google/uuid"
+	"remnawave-tg-shop-bot/internal/config"
+)
+
+var (
+	paidSquad     = uuid.MustParse("11111111-1111-1111-1111-111111111111")
+	trialSquad    = uuid.MustParse("22222222-2222-2222-2222-222222222222")
+	otherSquad    = uuid.MustParse("33333333-3333-3333-3333-333333333333")
+	paidExternal  = uuid.MustParse("44444444-4444-4444-4444-444444444444")
+	trialExternal = uuid.MustParse("55555555-5555-5555-5555-555555555555")
+	initConfig    sync.Once
+)
+
+// initPlanConfig loads a config with different paid and trial panel settings
+func initPlanConfig(t *testing.T) {
+	env := map[string]string{
+		"DISABLE_ENV_FILE":                   "true",
+		"ADMIN_TELEGRAM_ID":                  "1",
+		"TELEGRAM_TOKEN":                     "token",
+		"PRICE_1":                            "100",
+		"PRICE_3":                            "300",
+		"PRICE_6":                            "600",
+		"PRICE_12":                           "1200",
+		"REMNAWAVE_URL":                      "http://panel",
+		"REMNAWAVE_TOKEN":                    "token",
+		"DATABASE_URL":                       "postgres://localhost/db",
+		"TRAFFIC_LIMIT":                      "100",
+		"REFERRAL_DAYS":                      "7",
+		"TRIAL_TRAFFIC_LIMIT":                "10",
+		"TRIAL_DAYS":                         "3",
+		"REMNAWAVE_TAG":                      "PAID",
+		"TRIAL_REMNAWAVE_TAG":                "TRIAL",
+		"SQUAD_UUIDS":                        paidSquad.String(),
+		"TRIAL_INTERNAL_SQUADS":              trialSquad.String(),
+		"EXTERNAL_SQUAD_UUID":                paidExternal.String(),
+		"TRIAL_EXTERNAL_SQUAD_UUID":          trialExternal.String(),
+		"TRAFFIC_LIMIT_RESET_STRATEGY":       "MONTH",
+		"TRIAL_TRAFFIC_LIMIT_RESET_STRATEGY": "NO_RESET",
+		"DEVICE_LIMIT":                       "5",
+		"TRIAL_DEVICE_LIMIT":                 "1",
+	}
+	for key, value := range env {
+		t.Setenv(key, value)
+	}
+	initConfig.Do(config.InitConfig)
+}
+
+// stubPanel serves internal squads and records the create user request
+func stubPanel(t *testing.T, created *remapi.CreateUserRequestDto) *Client {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var resp json.Marshaler
+		status := http.StatusOK
+		switch {
+		case r.Method == http.MethodGet && r.URL.Path == "/api/internal-squads":
+			squads := []remapi.InternalSquad{{UUID: paidSquad}, {UUID: trialSquad}, {UUID: otherSquad}}
+			resp = &remapi.InternalSquadsResponse{Response: remapi.InternalSquadsResponseResponse{Total: 3, InternalSquads: squads}}
+		case r.Method == http.MethodPost && r.URL.Path == "/api/users":
+			body, _ := io.ReadAll(r.Body)
+			if err := created.UnmarshalJSON(body); err != nil {
+				t.Errorf("failed to decode create user request: %v", err)
+			}
+			status = http.StatusCreated
+			resp = &remapi.UserResponse{Response: remapi.User{UUID: uuid.New(), Username: created.Username, ExpireAt: created.ExpireAt, SubscriptionUrl: "https://sub/1", Email: remapi.NilString{Null: true}}}
+		default:
+			t.Errorf("unexpected request %s %s", r.Method, r.URL.Path)
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(status)
+		body, _ := resp.MarshalJSON()
+		_, _ = w.Write(body)
+	}))
+	t.Cleanup(server.Close)
+	return NewClient(server.URL, "token", "remote")
+}
+
+func TestCreateUserForSubscription_AppliesProfile(t *testing.T) {
+	initPlanConfig(t)
+
+	tests := []struct {
+		profile  PlanProfile
+		squad    uuid.UUID
+		external uuid.UUID
+		tag      string
+		limit    int
+		strategy remapi.CreateUserRequestDtoTrafficLimitStrategy
+		devices  int
+	}{
+		{PlanTrial, trialSquad, trialExternal, "TRIAL", 10 << 30, remapi.CreateUserRequestDtoTrafficLimitStrategyNORESET, 1},
+		{PlanPaid, paidSquad, paidExternal, "PAID", 100 << 30, remapi.CreateUserRequestDtoTrafficLimitStrategyMONTH, 5},
+		{PlanReferralBonus, paidSquad, paidExternal, "PAID", 100 << 30, remapi.CreateUserRequestDtoTrafficLimitStrategyMONTH, 5},
+	}
+	for _, tt := range tests {
+		var created remapi.CreateUserRequestDto
+		client := stubPanel(t, &created)
+
+		user, err := client.CreateUserForSubscription(context.Background(), 5, 100, tt.profile, 3, 2)
+		if err != nil {
+			t.Fatalf("%s: unexpected error: %v", tt.profile, err)
+		}
+		if user.SubscriptionUrl != "https://sub/1" {
+			t.Errorf("%s: unexpected user %#v", tt.profile, user)
+		}
+
+		if len(created.ActiveInternalSquads) != 1 || created.ActiveInternalSquads[0] != tt.squad {
+			t.Errorf("%s: expected squad %s, got %v", tt.profile, tt.squad, created.ActiveInternalSquads)
+		}
+		if external, _ := created.ExternalSquadUuid.Get(); external != tt.external {
+			t.Errorf("%s: expected external squad %s, got %s", tt.profile, tt.external, external)
+		}
+		if tag, _ := created.Tag.Get(); tag != tt.tag {
+			t.Errorf("%s: expected tag %s, got %s", tt.profile, tt.tag, tag)
+		}
+		if limit, _ := created.TrafficLimitBytes.Get(); limit != tt.limit {
+			t.Errorf("%s: expected traffic limit %d, got %d", tt.profile, tt.limit, limit)
+		}
+		if strategy, _ := created.TrafficLimitStrategy.Get(); strategy != tt.strategy {
+			t.Errorf("%s: expected strategy %s, got %s", tt.profile, tt.strategy, strategy)
+		}
+		if devices, _ := created.HwidDeviceLimit.Get(); devices != tt.devices {
+			t.Errorf("%s: expected device limit %d, got %d", tt.profile, tt.devices, devices)
+		}
+		if days := time.Until(created.ExpireAt).Hours() / 24; days < 2.9 || days > 3 {
+			t.Errorf("%s: expected expiration in 3 days, got %.2f", tt.profile, days)
+		}
+	}
+}
+
+func TestSelectSquads(t *testing.T) {
+	squads := []remapi.InternalSquad{{UUID: paidSquad}, {UUID: trialSquad}}
+
+	if got := selectSquads(squads, nil); len(got) != 2 {
+		t.Errorf("expected all squads without a selection, got %v", got)
+	}
+	if got := selectSquads(squads, map[uuid.UUID]uuid.UUID{trialSquad: trialSquad, otherSquad: otherSquad}); len(got) != 1 || got[0] != trialSquad {
+		t.Errorf("expected only the selected squad present in the panel, got %v", got)
+	}
+}
+
+func TestPlanSettingsOf(t *testing.T) {
+	initPlanConfig(t)
+	planSquad := uuid.New()
+	planExternal := uuid.New()
+
+	settings := planSettingsOf(config.Plan{
+		TrafficLimitGB:            50,
+		TrafficLimitResetStrategy: "WEEK",
+		InternalSquads:            []uuid.UUID{planSquad},
+		ExternalSquad:             planExternal,
+		DeviceLimit:               3,
+	})
+	if _, ok := settings.squads[planSquad]; !ok || len(settings.squads) != 1 {
+		t.Errorf("expected plan squads, got %v", settings.squads)
+	}
+	if settings.externalSquad != planExternal || settings.strategy != "WEEK" || settings.deviceLimit != 3 || settings.trafficLimit != 50<<30 {
+		t.Errorf("unexpected plan settings: %#v", settings)
+	}
+
+	settings = planSettingsOf(config.Plan{})
+	if _, ok := settings.squads[paidSquad]; !ok || settings.externalSquad != paidExternal || settings.strategy != "MONTH" || settings.tag != "PAID" {
+		t.Errorf("expected global paid settings for an empty plan, got %#v", settings)
+	}
+	if settings.trafficLimit != 0 || settings.deviceLimit != 5 {
+		t.Errorf("expected unlimited traffic and DEVICE_LIMIT devices, got %#v", settings)
+	}
+}
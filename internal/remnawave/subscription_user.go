@@ -4,9 +4,11 @@ import (
 	"context"
 	"crypto/sha1"
 	"encoding/hex"
+	"errors"
 	"fmt"
 	"log/slog"
 	"strconv"
+	"strings"
 	"time"
 
 	remapi "github.com/Jolymmiles/remnawave-api-go/v2/api"
@@ -15,51 +17,64 @@ import (
 	"remnawave-tg-shop-bot/utils"
 )
 
+// ErrUserNotFound is returned when the panel has no user with the given uuid, e.g. it was
+// deleted after the subscription expired
+var ErrUserNotFound = errors.New("user not found")
+
 // shortHash returns 6-char hex of SHA1 over input
 func shortHash(s string) string {
 	sum := sha1.Sum([]byte(s))
 	return hex.EncodeToString(sum[:])[:6]
 }
 
-// CreateUserForSubscription creates a fresh user for a new subscription to ensure unique credentials/URL per subscription
-func (r *Client) CreateUserForSubscription(ctx context.Context, customerId int64, telegramId int64, trafficLimit int, days int, seq int) (*remapi.User, error) {
-	// Build base and add short hash to avoid username collisions: {customerId}_{telegramId}_{seq}_{hash}
+// CreateUserForSubscription creates a fresh user for a new subscription to ensure unique credentials/URL per subscription.
+// The profile selects squads, external squad, tag, traffic limit and its reset strategy.
+func (r *Client) CreateUserForSubscription(ctx context.Context, customerId int64, telegramId int64, profile PlanProfile, days int, seq int) (*remapi.User, error) {
+	username := subscriptionUsername(customerId, telegramId, seq, strconv.FormatInt(time.Now().UnixNano(), 10))
+	return r.createSubscriptionUser(ctx, username, telegramId, profile.settings(), time.Now().UTC().AddDate(0, 0, days), seq, profile.String())
+}
+
+// CreatePlanUserForSubscription creates a fresh user with the catalog plan settings for an existing
+// subscription whose user is gone from the panel. The username is derived from the expiration,
+// so a retry with the same expiration returns the user created by the first attempt.
+func (r *Client) CreatePlanUserForSubscription(ctx context.Context, customerId int64, telegramId int64, plan config.Plan, seq int, expireAt time.Time) (*remapi.User, error) {
+	username := subscriptionUsername(customerId, telegramId, seq, strconv.FormatInt(expireAt.Unix(), 10))
+	existing, err := r.GetUserByUsername(ctx, username)
+	if err != nil {
+		return nil, err
+	}
+	if existing != nil {
+		return existing, nil
+	}
+	return r.createSubscriptionUser(ctx, username, telegramId, planSettingsOf(plan), expireAt, seq, plan.ID)
+}
+
+// subscriptionUsername builds {customerId}_{telegramId}_{seq}_{hash}, the hash over salt avoids collisions
+func subscriptionUsername(customerId int64, telegramId int64, seq int, salt string) string {
 	base := fmt.Sprintf("%d_%d_%d", customerId, telegramId, seq)
-	h := shortHash(fmt.Sprintf("%s_%d", base, time.Now().UnixNano()))
-	username := fmt.Sprintf("%s_%s", base, h)
-	expireAt := time.Now().UTC().AddDate(0, 0, days)
+	return fmt.Sprintf("%s_%s", base, shortHash(fmt.Sprintf("%s_%s", base, salt)))
+}
 
+func (r *Client) createSubscriptionUser(ctx context.Context, username string, telegramId int64, settings planSettings, expireAt time.Time, seq int, profile string) (*remapi.User, error) {
 	resp, err := r.client.InternalSquad().GetInternalSquads(ctx)
 	if err != nil {
 		return nil, err
 	}
-
-	squads := resp.(*remapi.InternalSquadsResponse).GetResponse()
-	squadId := make([]uuid.UUID, 0, len(config.SquadUUIDs()))
-	for _, squad := range squads.GetInternalSquads() {
-		if config.SquadUUIDs() != nil && len(config.SquadUUIDs()) > 0 {
-			if _, isExist := config.SquadUUIDs()[squad.UUID]; !isExist {
-				continue
-			} else {
-				squadId = append(squadId, squad.UUID)
-			}
-		} else {
-			squadId = append(squadId, squad.UUID)
-		}
+	squads, ok := resp.(*remapi.InternalSquadsResponse)
+	if !ok {
+		return nil, fmt.Errorf("unexpected response getting internal squads: %T", resp)
 	}
 
 	createUserRequestDto := remapi.CreateUserRequestDto{
 		Username:             username,
-		ActiveInternalSquads: squadId,
+		ActiveInternalSquads: selectSquads(squads.Response.InternalSquads, settings.squads),
 		Status:               remapi.NewOptCreateUserRequestDtoStatus(remapi.CreateUserRequestDtoStatusACTIVE),
 		TelegramId:           remapi.NewOptNilInt(int(telegramId)),
 		ExpireAt:             expireAt,
-		TrafficLimitStrategy: remapi.NewOptCreateUserRequestDtoTrafficLimitStrategy(remapi.CreateUserRequestDtoTrafficLimitStrategyMONTH),
-		TrafficLimitBytes:    remapi.NewOptInt(trafficLimit),
-	}
-	if config.RemnawaveTag() != "" {
-		createUserRequestDto.Tag = remapi.NewOptNilString(config.RemnawaveTag())
+		TrafficLimitStrategy: remapi.NewOptCreateUserRequestDtoTrafficLimitStrategy(getCreateStrategy(settings.strategy)),
+		TrafficLimitBytes:    remapi.NewOptInt(settings.trafficLimit),
 	}
+	settings.applyToCreate(&createUserRequestDto)
 
 	if ctx.Value("username") != nil {
 		createUserRequestDto.Description = remapi.NewOptString(ctx.Value("username").(string))
@@ -69,6 +84,189 @@ func (r *Client) CreateUserForSubscription(ctx context.Context, customerId int64
 	if err != nil {
 		return nil, err
 	}
-	slog.Info("created subscription user", "telegramId", utils.MaskHalf(strconv.FormatInt(telegramId, 10)), "username", utils.MaskHalf(username), "days", days, "seq", seq)
-	return &userCreate.(*remapi.UserResponse).Response, nil
+	created, ok := userCreate.(*remapi.UserResponse)
+	if !ok {
+		return nil, fmt.Errorf("unexpected response creating user: %T", userCreate)
+	}
+	slog.Info("created subscription user", "telegramId", utils.MaskHalf(strconv.FormatInt(telegramId, 10)), "username", utils.MaskHalf(username), "expireAt", expireAt, "seq", seq, "profile", profile)
+	return &created.Response, nil
+}
+
+// selectSquads returns the panel squads present in selected, all of them when selected is empty
+func selectSquads(squads []remapi.InternalSquad, selected map[uuid.UUID]uuid.UUID) []uuid.UUID {
+	squadId := make([]uuid.UUID, 0, len(squads))
+	for _, squad := range squads {
+		if len(selected) > 0 {
+			if _, isExist := selected[squad.UUID]; !isExist {
+				continue
+			}
+		}
+		squadId = append(squadId, squad.UUID)
+	}
+	return squadId
+}
+
+// GetUserByUsername returns the user or nil without error when the panel has no such user
+func (r *Client) GetUserByUsername(ctx context.Context, username string) (*remapi.User, error) {
+	resp, err := r.client.Users().GetUserByUsername(ctx, username)
+	if err != nil {
+		return nil, err
+	}
+	switch v := resp.(type) {
+	case *remapi.UserResponse:
+		return &v.Response, nil
+	case *remapi.NotFoundError:
+		return nil, nil
+	default:
+		return nil, fmt.Errorf("unexpected response getting user by username: %T", resp)
+	}
+}
+
+// GetUserByUUID returns the user or nil without error when the panel has no such user
+func (r *Client) GetUserByUUID(ctx context.Context, userUuid uuid.UUID) (*remapi.User, error) {
+	resp, err := r.client.Users().GetUserByUuid(ctx, userUuid.String())
+	if err != nil {
+		return nil, err
+	}
+	switch v := resp.(type) {
+	case *remapi.UserResponse:
+		return &v.Response, nil
+	case *remapi.NotFoundError:
+		return nil, nil
+	default:
+		return nil, fmt.Errorf("unexpected response getting user by uuid: %T", resp)
+	}
+}
+
+// FindSubscriptionUser returns the user backing a subscription: by its uuid when stored,
+// otherwise by the short uuid in the subscription link (rows created before the uuid was stored).
+// Returns nil without error when the panel has no such user.
+func (r *Client) FindSubscriptionUser(ctx context.Context, userUuid *uuid.UUID, link string) (*remapi.User, error) {
+	if userUuid != nil {
+		return r.GetUserByUUID(ctx, *userUuid)
+	}
+
+	trimmed := strings.TrimRight(link, "/")
+	shortUuid := trimmed[strings.LastIndex(trimmed, "/")+1:]
+	if shortUuid == "" {
+		return nil, fmt.Errorf("no short uuid in subscription link")
+	}
+
+	resp, err := r.client.Users().GetUserByShortUuid(ctx, shortUuid)
+	if err != nil {
+		return nil, err
+	}
+	switch v := resp.(type) {
+	case *remapi.UserResponse:
+		return &v.Response, nil
+	case *remapi.NotFoundError:
+		return nil, nil
+	default:
+		return nil, fmt.Errorf("unexpected response getting user by short uuid: %T", resp)
+	}
+}
+
+// ExtendUserTo applies the plan settings to the user and sets its expiration. The expiration is
+// absolute, so repeating the call does not extend the user again.
+func (r *Client) ExtendUserTo(ctx context.Context, user *remapi.User, plan config.Plan, expireAt time.Time) (*remapi.User, error) {
+	return r.updateUser(ctx, user, planSettingsOf(plan), expireAt)
+}
+
+func (r *Client) extendUser(ctx context.Context, userUuid uuid.UUID, settings planSettings, days int) (*remapi.User, error) {
+	user, err := r.GetUserByUUID(ctx, userUuid)
+	if err != nil {
+		return nil, err
+	}
+	if user == nil {
+		return nil, fmt.Errorf("%w: %s", ErrUserNotFound, userUuid)
+	}
+	return r.updateUser(ctx, user, settings, NewExpire(days, user.ExpireAt))
+}
+
+// AddTraffic raises the user's traffic limit by the given number of bytes. Users with
+// unlimited traffic have nothing to add to, that is reported as an error.
+func (r *Client) AddTraffic(ctx context.Context, userUuid uuid.UUID, bytes int) (*remapi.User, error) {
+	user, err := r.GetUserByUUID(ctx, userUuid)
+	if err != nil {
+		return nil, err
+	}
+	if user == nil {
+		return nil, fmt.Errorf("%w: %s", ErrUserNotFound, userUuid)
+	}
+	limit := user.TrafficLimitBytes.Or(0)
+	if limit == 0 {
+		return nil, fmt.Errorf("user %s has unlimited traffic", userUuid)
+	}
+	return r.SetTrafficLimit(ctx, userUuid, limit+bytes)
+}
+
+// SetTrafficLimit sets the user's traffic limit in bytes. The limit is absolute, so repeating
+// the call does not raise it again.
+func (r *Client) SetTrafficLimit(ctx context.Context, userUuid uuid.UUID, limit int) (*remapi.User, error) {
+	resp, err := r.client.Users().UpdateUser(ctx, &remapi.UpdateUserRequestDto{
+		UUID:              remapi.NewOptUUID(userUuid),
+		TrafficLimitBytes: remapi.NewOptInt(limit),
+	})
+	if err != nil {
+		return nil, err
+	}
+	updated, ok := resp.(*remapi.UserResponse)
+	if !ok {
+		return nil, fmt.Errorf("unexpected response updating traffic limit: %T", resp)
+	}
+	slog.Info("set traffic limit", "uuid", userUuid, "limit", limit)
+	return &updated.Response, nil
+}
+
+// DisableUser disables the user in the panel, the subscription link stops working but the user is kept
+func (r *Client) DisableUser(ctx context.Context, userUuid uuid.UUID) error {
+	resp, err := r.client.Users().DisableUser(ctx, userUuid.String())
+	if err != nil {
+		return err
+	}
+	if _, ok := resp.(*remapi.UserResponse); !ok {
+		return fmt.Errorf("unexpected response disabling user: %T", resp)
+	}
+	return nil
+}
+
+// DeleteUser removes the user from the panel
+func (r *Client) DeleteUser(ctx context.Context, userUuid uuid.UUID) error {
+	resp, err := r.client.Users().DeleteUser(ctx, userUuid.String())
+	if err != nil {
+		return err
+	}
+	switch resp.(type) {
+	case *remapi.DeleteResponse, *remapi.NotFoundError:
+		return nil
+	default:
+		return fmt.Errorf("unexpected response deleting user: %T", resp)
+	}
+}
+
+// ExtendUserDays moves the user's expiration by days (see NewExpire) and activates it,
+// the user's squads and limits are kept
+func (r *Client) ExtendUserDays(ctx context.Context, userUuid uuid.UUID, days int) (*remapi.User, error) {
+	user, err := r.GetUserByUUID(ctx, userUuid)
+	if err != nil {
+		return nil, err
+	}
+	if user == nil {
+		return nil, fmt.Errorf("%w: %s", ErrUserNotFound, userUuid)
+	}
+
+	resp, err := r.client.Users().UpdateUser(ctx, &remapi.UpdateUserRequestDto{
+		UUID:     remapi.NewOptUUID(userUuid),
+		ExpireAt: remapi.NewOptDateTime(NewExpire(days, user.ExpireAt)),
+		Status:   remapi.NewOptUpdateUserRequestDtoStatus(remapi.UpdateUserRequestDtoStatusACTIVE),
+	})
+	if err != nil {
+		return nil, err
+	}
+	updated, ok := resp.(*remapi.UserResponse)
+	if !ok {
+		return nil, fmt.Errorf("unexpected response extending user: %T", resp)
+	}
+	slog.Info("extended user", "uuid", userUuid, "days", days)
+	return &updated.Response, nil
 }
@@ -0,0 +1,125 @@
+package remnawave
+
+import (
+	"context"
+	"log/slog"
+	"sync"
+	"time"
+
+	remapi "github.com/Jolymmiles/remnawave-api-go/v2/api"
+	"github.com/google/uuid"
+)
+
+// onlineWindow — how recent the last activity must be for the user to count as online
+const onlineWindow = 3 * time.Minute
+
+// Usage is the traffic and activity of a single user
+type Usage struct {
+	UsedBytes int64
+	// LimitBytes is 0 for unlimited traffic
+	LimitBytes int64
+	Online     bool
+	// LastOnlineAt is nil when the user has never connected
+	LastOnlineAt *time.Time
+}
+
+// UsageFromUser builds the usage from a user returned by the panel
+func UsageFromUser(user *remapi.User, now time.Time) Usage {
+	usage := Usage{
+		UsedBytes:  int64(user.UserTraffic.UsedTrafficBytes),
+		LimitBytes: int64(user.TrafficLimitBytes.Or(0)),
+	}
+	if onlineAt, ok := user.UserTraffic.OnlineAt.Get(); ok && !onlineAt.IsZero() {
+		usage.LastOnlineAt = &onlineAt
+		usage.Online = now.Sub(onlineAt) < onlineWindow
+	}
+	return usage
+}
+
+type userGetter interface {
+	GetUserByUUID(ctx context.Context, userUuid uuid.UUID) (*remapi.User, error)
+}
+
+type usageEntry struct {
+	usage     *Usage
+	expiresAt time.Time
+}
+
+// UsageCache keeps users' traffic usage for a short time so that rendering a list of
+// subscriptions does not query the panel for every subscription on every click
+type UsageCache struct {
+	client userGetter
+	ttl    time.Duration
+
+	mu      sync.Mutex
+	entries map[uuid.UUID]usageEntry
+}
+
+func NewUsageCache(client *Client, ttl time.Duration) *UsageCache {
+	return &UsageCache{client: client, ttl: ttl, entries: make(map[uuid.UUID]usageEntry)}
+}
+
+// Get returns the usage of the user, nil without error when the panel has no such user
+func (c *UsageCache) Get(ctx context.Context, userUuid uuid.UUID) (*Usage, error) {
+	now := time.Now()
+	c.mu.Lock()
+	entry, ok := c.entries[userUuid]
+	c.mu.Unlock()
+	if ok && now.Before(entry.expiresAt) {
+		return entry.usage, nil
+	}
+
+	user, err := c.client.GetUserByUUID(ctx, userUuid)
+	if err != nil {
+		return nil, err
+	}
+	var usage *Usage
+	if user != nil {
+		u := UsageFromUser(user, now)
+		usage = &u
+	}
+
+	c.mu.Lock()
+	c.entries[userUuid] = usageEntry{usage: usage, expiresAt: now.Add(c.ttl)}
+	for id, e := range c.entries {
+		if now.After(e.expiresAt) {
+			delete(c.entries, id)
+		}
+	}
+	c.mu.Unlock()
+	return usage, nil
+}
+
+// GetMany fetches usage of several users in parallel. Users whose usage could not be
+// fetched are missing from the result.
+func (c *UsageCache) GetMany(ctx context.Context, userUuids []uuid.UUID) map[uuid.UUID]Usage {
+	result := make(map[uuid.UUID]Usage, len(userUuids))
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	for _, userUuid := range userUuids {
+		wg.Add(1)
+		go func(userUuid uuid.UUID) {
+			defer wg.Done()
+			usage, err := c.Get(ctx, userUuid)
+			if err != nil {
+				slog.Error("failed to get user usage", "uuid", userUuid, "error", err)
+				return
+			}
+			if usage == nil {
+				return
+			}
+			mu.Lock()
+			result[userUuid] = *usage
+			mu.Unlock()
+		}(userUuid)
+	}
+	wg.Wait()
+	return result
+}
+
+// Invalidate drops the cached usage, e.g. after the user's limit has changed
+func (c *UsageCache) Invalidate(userUuid uuid.UUID) {
+	c.mu.Lock()
+	delete(c.entries, userUuid)
+	c.mu.Unlock()
+}
@@ -0,0 +1,64 @@
+package remnawave
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	remapi "github.com/Jolymmiles/remnawave-api-go/v2/api"
+	"github.com/google/uuid"
+)
+
+type userGetterMock struct {
+	user  *remapi.User
+	calls int
+}
+
+func (m *userGetterMock) GetUserByUUID(ctx context.Context, userUuid uuid.UUID) (*remapi.User, error) {
+	m.calls++
+	return m.user, nil
+}
+
+func TestUsageFromUser(t *testing.T) {
+	now := time.Now()
+	user := &remapi.User{
+		TrafficLimitBytes: remapi.NewOptInt(100 << 30),
+		UserTraffic: remapi.UserTrafficItem{
+			UsedTrafficBytes: 5 << 30,
+			OnlineAt:         remapi.NewNilDateTime(now.Add(-time.Minute)),
+		},
+	}
+
+	usage := UsageFromUser(user, now)
+	if usage.UsedBytes != 5<<30 || usage.LimitBytes != 100<<30 || !usage.Online || usage.LastOnlineAt == nil {
+		t.Fatalf("unexpected usage: %#v", usage)
+	}
+
+	usage = UsageFromUser(&remapi.User{}, now)
+	if usage.LimitBytes != 0 || usage.Online || usage.LastOnlineAt != nil {
+		t.Fatalf("expected unlimited never connected user, got %#v", usage)
+	}
+}
+
+func TestUsageCache_CachesUntilInvalidated(t *testing.T) {
+	getter := &userGetterMock{user: &remapi.User{}}
+	cache := &UsageCache{client: getter, ttl: time.Minute, entries: make(map[uuid.UUID]usageEntry)}
+	userUuid := uuid.New()
+
+	for i := 0; i < 3; i++ {
+		if _, err := cache.Get(context.Background(), userUuid); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	}
+	if getter.calls != 1 {
+		t.Fatalf("expected one panel call, got %d", getter.calls)
+	}
+
+	cache.Invalidate(userUuid)
+	if usage := cache.GetMany(context.Background(), []uuid.UUID{userUuid}); len(usage) != 1 {
+		t.Fatalf("expected usage of one user, got %#v", usage)
+	}
+	if getter.calls != 2 {
+		t.Fatalf("expected panel to be queried again after invalidation, got %d calls", getter.calls)
+	}
+}
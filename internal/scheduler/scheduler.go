@@ -0,0 +1,214 @@
+package scheduler
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+var (
+	ErrJobNotFound = errors.New("job not found")
+	ErrJobRunning  = errors.New("job is already running")
+)
+
+// JobFunc — работа, которую выполняет задача. Контекст отменяется при остановке приложения.
+type JobFunc func(ctx context.Context) error
+
+// JobStatus — состояние задачи на момент вызова Status
+type JobStatus struct {
+	Name         string
+	Spec         string
+	Running      bool
+	LastRun      time.Time
+	LastDuration time.Duration
+	LastError    error
+	NextRun      time.Time
+}
+
+type job struct {
+	name     string
+	spec     string
+	schedule Schedule
+	run      JobFunc
+	running  atomic.Bool
+
+	mu           sync.Mutex
+	lastRun      time.Time
+	lastDuration time.Duration
+	lastError    error
+	nextRun      time.Time
+}
+
+// Scheduler запускает задачи по расписанию внутри процесса. Каждая задача выполняется
+// не более чем в одном экземпляре: если прошлый запуск ещё идёт, очередной пропускается.
+type Scheduler struct {
+	mu      sync.Mutex
+	jobs    []*job
+	started bool
+	wg      sync.WaitGroup
+}
+
+func New() *Scheduler {
+	return &Scheduler{}
+}
+
+// Add регистрирует задачу. Пустое расписание означает, что задача выключена.
+func (s *Scheduler) Add(name string, spec string, run JobFunc) error {
+	if spec == "" {
+		slog.Info("scheduler job disabled", "job", name)
+		return nil
+	}
+
+	schedule, err := Parse(spec)
+	if err != nil {
+		return fmt.Errorf("job %s: %w", name, err)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.started {
+		return fmt.Errorf("job %s: scheduler already started", name)
+	}
+	for _, j := range s.jobs {
+		if j.name == name {
+			return fmt.Errorf("job %s: already registered", name)
+		}
+	}
+	s.jobs = append(s.jobs, &job{name: name, spec: spec, schedule: schedule, run: run})
+	return nil
+}
+
+// Start запускает все задачи и возвращает управление сразу. Задачи останавливаются
+// при отмене ctx, дождаться их завершения можно через Wait.
+func (s *Scheduler) Start(ctx context.Context) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.started {
+		return
+	}
+	s.started = true
+
+	for _, j := range s.jobs {
+		s.wg.Add(1)
+		go func(j *job) {
+			defer s.wg.Done()
+			s.loop(ctx, j)
+		}(j)
+	}
+	slog.Info("scheduler started", "jobs", len(s.jobs))
+}
+
+// Wait блокируется до завершения всех циклов и выполняющихся задач
+func (s *Scheduler) Wait() {
+	s.wg.Wait()
+}
+
+// Trigger выполняет задачу немедленно в текущей горутине, не дожидаясь расписания
+func (s *Scheduler) Trigger(ctx context.Context, name string) error {
+	j := s.find(name)
+	if j == nil {
+		return ErrJobNotFound
+	}
+	if !s.execute(ctx, j) {
+		return ErrJobRunning
+	}
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	return j.lastError
+}
+
+// Status возвращает состояние всех задач в порядке регистрации
+func (s *Scheduler) Status() []JobStatus {
+	s.mu.Lock()
+	jobs := append([]*job(nil), s.jobs...)
+	s.mu.Unlock()
+
+	statuses := make([]JobStatus, 0, len(jobs))
+	for _, j := range jobs {
+		j.mu.Lock()
+		statuses = append(statuses, JobStatus{
+			Name:         j.name,
+			Spec:         j.spec,
+			Running:      j.running.Load(),
+			LastRun:      j.lastRun,
+			LastDuration: j.lastDuration,
+			LastError:    j.lastError,
+			NextRun:      j.nextRun,
+		})
+		j.mu.Unlock()
+	}
+	return statuses
+}
+
+func (s *Scheduler) find(name string) *job {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, j := range s.jobs {
+		if j.name == name {
+			return j
+		}
+	}
+	return nil
+}
+
+func (s *Scheduler) loop(ctx context.Context, j *job) {
+	for {
+		next := j.schedule.Next(time.Now())
+		if next.IsZero() {
+			slog.Error("scheduler job will never run", "job", j.name, "spec", j.spec)
+			return
+		}
+		j.mu.Lock()
+		j.nextRun = next
+		j.mu.Unlock()
+
+		timer := time.NewTimer(time.Until(next))
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return
+		case <-timer.C:
+			if !s.execute(ctx, j) {
+				slog.Warn("scheduler job skipped, previous run is still in progress", "job", j.name)
+			}
+		}
+	}
+}
+
+// execute запускает задачу, если она не выполняется прямо сейчас, и сохраняет результат
+func (s *Scheduler) execute(ctx context.Context, j *job) bool {
+	if !j.running.CompareAndSwap(false, true) {
+		return false
+	}
+	defer j.running.Store(false)
+
+	start := time.Now()
+	err := s.safeRun(ctx, j)
+	duration := time.Since(start)
+
+	j.mu.Lock()
+	j.lastRun = start
+	j.lastDuration = duration
+	j.lastError = err
+	j.mu.Unlock()
+
+	if err != nil {
+		slog.Error("scheduler job failed", "job", j.name, "duration", duration, "error", err)
+	} else {
+		slog.Info("scheduler job finished", "job", j.name, "duration", duration)
+	}
+	return true
+}
+
+func (s *Scheduler) safeRun(ctx context.Context, j *job) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("panic: %v", r)
+		}
+	}()
+	return j.run(ctx)
+}
@@ -0,0 +1,122 @@
+package scheduler
+
+import (
+	"context"
+	"errors"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestParse_Next(t *testing.T) {
+	base := time.Date(2025, time.January, 15, 10, 30, 0, 0, time.UTC) // среда
+
+	tests := []struct {
+		spec     string
+		expected time.Time
+	}{
+		{"0 16 * * *", time.Date(2025, time.January, 15, 16, 0, 0, 0, time.UTC)},
+		{"*/15 * * * *", time.Date(2025, time.January, 15, 10, 45, 0, 0, time.UTC)},
+		{"0 9 * * 1-5", time.Date(2025, time.January, 16, 9, 0, 0, 0, time.UTC)},
+		{"0 0 1 * *", time.Date(2025, time.February, 1, 0, 0, 0, 0, time.UTC)},
+		{"30 10 * * 7", time.Date(2025, time.January, 19, 10, 30, 0, 0, time.UTC)},
+		{"@daily", time.Date(2025, time.January, 16, 0, 0, 0, 0, time.UTC)},
+		{"@every 30s", base.Add(30 * time.Second)},
+	}
+
+	for _, tt := range tests {
+		schedule, err := Parse(tt.spec)
+		if err != nil {
+			t.Fatalf("Parse(%q) returned error: %v", tt.spec, err)
+		}
+		if got := schedule.Next(base); !got.Equal(tt.expected) {
+			t.Errorf("Parse(%q).Next() = %v, want %v", tt.spec, got, tt.expected)
+		}
+	}
+}
+
+func TestParse_Invalid(t *testing.T) {
+	for _, spec := range []string{"", "* * * *", "60 * * * *", "*/0 * * * *", "5-1 * * * *", "@every -1s", "@every soon"} {
+		if _, err := Parse(spec); err == nil {
+			t.Errorf("Parse(%q) expected error", spec)
+		}
+	}
+}
+
+func TestTrigger_SkipsWhileRunning(t *testing.T) {
+	s := New()
+	started := make(chan struct{})
+	release := make(chan struct{})
+	if err := s.Add("slow", "@every 1h", func(ctx context.Context) error {
+		close(started)
+		<-release
+		return nil
+	}); err != nil {
+		t.Fatalf("Add returned error: %v", err)
+	}
+
+	done := make(chan error)
+	go func() { done <- s.Trigger(context.Background(), "slow") }()
+	<-started
+
+	if err := s.Trigger(context.Background(), "slow"); !errors.Is(err, ErrJobRunning) {
+		t.Fatalf("expected ErrJobRunning, got %v", err)
+	}
+
+	close(release)
+	if err := <-done; err != nil {
+		t.Fatalf("first run returned error: %v", err)
+	}
+}
+
+func TestTrigger_RecordsLastRunAndError(t *testing.T) {
+	s := New()
+	jobErr := errors.New("boom")
+	if err := s.Add("failing", "@every 1h", func(ctx context.Context) error { return jobErr }); err != nil {
+		t.Fatalf("Add returned error: %v", err)
+	}
+
+	if err := s.Trigger(context.Background(), "failing"); !errors.Is(err, jobErr) {
+		t.Fatalf("expected job error, got %v", err)
+	}
+
+	status := s.Status()
+	if len(status) != 1 || status[0].LastRun.IsZero() || !errors.Is(status[0].LastError, jobErr) {
+		t.Fatalf("unexpected status: %#v", status)
+	}
+	if err := s.Trigger(context.Background(), "missing"); !errors.Is(err, ErrJobNotFound) {
+		t.Fatalf("expected ErrJobNotFound, got %v", err)
+	}
+}
+
+func TestStart_RunsOnScheduleAndStopsOnCancel(t *testing.T) {
+	s := New()
+	var runs atomic.Int32
+	if err := s.Add("tick", "@every 10ms", func(ctx context.Context) error {
+		runs.Add(1)
+		return nil
+	}); err != nil {
+		t.Fatalf("Add returned error: %v", err)
+	}
+	if err := s.Add("disabled", "", func(ctx context.Context) error {
+		t.Error("disabled job must not run")
+		return nil
+	}); err != nil {
+		t.Fatalf("Add returned error: %v", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	s.Start(ctx)
+	time.Sleep(55 * time.Millisecond)
+	cancel()
+	s.Wait()
+
+	if runs.Load() == 0 {
+		t.Fatal("expected job to run at least once")
+	}
+	stopped := runs.Load()
+	time.Sleep(30 * time.Millisecond)
+	if runs.Load() != stopped {
+		t.Fatal("job kept running after cancel")
+	}
+}
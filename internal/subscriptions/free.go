@@ -2,7 +2,11 @@ package subscriptions
 
 import (
 	"context"
+	"errors"
 	"fmt"
+	"log/slog"
+	"time"
+
 	"remnawave-tg-shop-bot/internal/config"
 	"remnawave-tg-shop-bot/internal/database"
 	"remnawave-tg-shop-bot/internal/remnawave"
@@ -10,27 +14,77 @@ import (
 
 type Translator interface{ GetText(lang, key string) string }
 
+// ChannelMembers проверяет подписку пользователя на канал из TRIAL_REQUIRED_CHANNEL
+type ChannelMembers interface {
+	IsChannelMember(ctx context.Context, telegramID int64) (bool, error)
+}
+
+var (
+	ErrTrialUsed            = errors.New("trial already used")
+	ErrTrialAccountTooNew   = errors.New("account is too new for trial")
+	ErrTrialChannelRequired = errors.New("channel membership is required for trial")
+)
+
+// ReferralRewards начисляет пригласившему награду за пробный период
+type ReferralRewards interface {
+	OnTrial(ctx context.Context, referee *database.Customer)
+}
+
 type Service struct {
 	SubsRepo    *database.SubscriptionRepository
 	Customers   *database.CustomerRepository
+	Trials      *database.TrialUsageRepository
 	RW          *remnawave.Client
 	Translate   Translator
+	Members     ChannelMembers
+	Referrals   ReferralRewards
 }
 
+// ActivateFree выдаёт пробную подписку, если telegram-аккаунт её ещё не получал и проходит
+// проверки канала и возраста
 func (s *Service) ActivateFree(ctx context.Context, customerTelegramID int64) (string, error) {
 	if config.TrialDays() == 0 { return "", nil }
 	customer, err := s.Customers.FindByTelegramId(ctx, customerTelegramID)
 	if err != nil { return "", err }
 	if customer == nil { return "", fmt.Errorf("customer %d not found", customerTelegramID) }
 
-	active, err := s.SubsRepo.GetActiveSubscriptions(ctx, customer.ID)
+	if !trialAccountOldEnough(customer.CreatedAt, time.Now(), config.TrialMinAccountAgeHours()) { return "", ErrTrialAccountTooNew }
+	used, err := s.Trials.IsUsed(ctx, customerTelegramID)
 	if err != nil { return "", err }
+	if used { return "", ErrTrialUsed }
+	if config.TrialRequiredChannel() != "" && s.Members != nil {
+		member, err := s.Members.IsChannelMember(ctx, customerTelegramID)
+		if err != nil { return "", err }
+		if !member { return "", ErrTrialChannelRequired }
+	}
+	// отметка ставится до создания пользователя, чтобы повторные нажатия не выдали второй период
+	ok, err := s.Trials.TryUse(ctx, customerTelegramID)
+	if err != nil { return "", err }
+	if !ok { return "", ErrTrialUsed }
+
+	active, err := s.SubsRepo.GetActiveSubscriptions(ctx, customer.ID)
+	if err != nil { return "", s.releaseTrial(ctx, customerTelegramID, err) }
 	seq := len(active)+1
 
-	user, err := s.RW.CreateUserForSubscription(ctx, customer.ID, customer.TelegramID, config.TrialTrafficLimit(), config.TrialDays(), seq)
-	if err != nil { return "", err }
+	user, err := s.RW.CreateUserForSubscription(ctx, customer.ID, customer.TelegramID, remnawave.PlanTrial, config.TrialDays(), seq)
+	if err != nil { return "", s.releaseTrial(ctx, customerTelegramID, err) }
 
-	sub := &database.Subscription{ CustomerID: customer.ID, SubscriptionLink: user.SubscriptionUrl, ExpireAt: user.ExpireAt, IsActive: true, Name: fmt.Sprintf("%s #%d", s.Translate.GetText(customer.Language, "subscription_name"), seq), Description: s.Translate.GetText(customer.Language, "trial_subscription_description") }
+	sub := &database.Subscription{ CustomerID: customer.ID, SubscriptionLink: user.SubscriptionUrl, ExpireAt: user.ExpireAt, IsActive: true, Name: fmt.Sprintf("%s #%d", s.Translate.GetText(customer.Language, "subscription_name"), seq), Description: s.Translate.GetText(customer.Language, "trial_subscription_description"), RemnawaveUUID: &user.UUID, ShortUUID: &user.ShortUuid, Username: &user.Username }
 	if _, err := s.SubsRepo.CreateSubscription(ctx, sub); err != nil { return "", err }
+	if s.Referrals != nil { s.Referrals.OnTrial(ctx, customer) }
 	return user.SubscriptionUrl, nil
 }
+
+// releaseTrial возвращает пробный период, если пользователь в панели так и не был создан
+func (s *Service) releaseTrial(ctx context.Context, telegramID int64, cause error) error {
+	if _, err := s.Trials.Reset(ctx, telegramID); err != nil {
+		slog.Error("Error releasing trial", "error", err)
+	}
+	return cause
+}
+
+// trialAccountOldEnough — Telegram не сообщает дату регистрации, поэтому возраст аккаунта
+// считается с первого /start в боте
+func trialAccountOldEnough(createdAt, now time.Time, minHours int) bool {
+	return minHours == 0 || now.Sub(createdAt) >= time.Duration(minHours)*time.Hour
+}
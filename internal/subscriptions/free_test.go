@@ -0,0 +1,25 @@
+package subscriptions
+
+import (
+	"testing"
+	"time"
+)
+
+func TestTrialAccountOldEnough(t *testing.T) {
+	now := time.Now()
+	cases := []struct {
+		createdAt time.Time
+		minHours  int
+		want      bool
+	}{
+		{now, 0, true},
+		{now.Add(-time.Hour), 24, false},
+		{now.Add(-24 * time.Hour), 24, true},
+		{now.Add(-48 * time.Hour), 24, true},
+	}
+	for _, c := range cases {
+		if got := trialAccountOldEnough(c.createdAt, now, c.minHours); got != c.want {
+			t.Errorf("trialAccountOldEnough(%v, %d) = %v, want %v", now.Sub(c.createdAt), c.minHours, got, c.want)
+		}
+	}
+}
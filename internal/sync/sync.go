@@ -2,19 +2,35 @@ package sync
 
 import (
 	"context"
+	"errors"
+	"fmt"
 	"log/slog"
+	"remnawave-tg-shop-bot/internal/config"
 	"remnawave-tg-shop-bot/internal/database"
 	"remnawave-tg-shop-bot/internal/remnawave"
+	"remnawave-tg-shop-bot/internal/translation"
+	"sync/atomic"
+	"time"
+
+	remapi "github.com/Jolymmiles/remnawave-api-go/v2/api"
+	"github.com/google/uuid"
 )
 
+// ErrSyncRunning — синхронизация уже выполняется: по расписанию или по команде админа
+var ErrSyncRunning = errors.New("sync is already running")
+
 type SyncService struct {
-	client             *remnawave.Client
-	customerRepository *database.CustomerRepository
+	client                 *remnawave.Client
+	customerRepository     *database.CustomerRepository
+	subscriptionRepository *database.SubscriptionRepository
+	translation            *translation.Manager
+	running                *atomic.Bool
 }
 
-func NewSyncService(client *remnawave.Client, customerRepository *database.CustomerRepository) *SyncService {
+func NewSyncService(client *remnawave.Client, customerRepository *database.CustomerRepository, subscriptionRepository *database.SubscriptionRepository, translation *translation.Manager) *SyncService {
 	return &SyncService{
-		client: client, customerRepository: customerRepository,
+		client: client, customerRepository: customerRepository, subscriptionRepository: subscriptionRepository, translation: translation,
+		running: &atomic.Bool{},
 	}
 }
 
@@ -23,85 +39,392 @@ func (s *SyncService) GetClient() *remnawave.Client {
 	return s.client
 }
 
-func (s SyncService) Sync() {
-	slog.Info("Starting sync")
-	ctx := context.Background()
-	var telegramIDs []int64
-	telegramIDsSet := make(map[int64]int64)
-	var mappedUsers []database.Customer
+// Result — сколько подписок синхронизация создала, обновила и деактивировала
+type Result struct {
+	Created     int
+	Updated     int
+	Deactivated int
+}
+
+// Options — режим запуска синхронизации
+type Options struct {
+	// DryRun — только посчитать изменения, ничего не записывая
+	DryRun bool
+	// ConfirmedDeletes — сколько удалений админ подтвердил сверх SYNC_DELETE_THRESHOLD
+	ConfirmedDeletes int
+}
+
+// Report — что синхронизация сделала или, в режиме dry-run, собирается сделать
+type Report struct {
+	DryRun bool
+	// DeletesPending — удаления пропущены: их больше порога, нужно подтверждение админа
+	DeletesPending bool
+	SoftDelete     bool
+	// CustomersCreated и CustomersDeleted — telegram id клиентов
+	CustomersCreated []int64
+	CustomersUpdated int
+	CustomersDeleted []int64
+	// SubscriptionsDeactivated — id подписок оставшихся клиентов, которые нужно деактивировать
+	SubscriptionsDeactivated []int64
+	Subscriptions            Result
+}
+
+// Deletes — число удалений, на которое действует порог подтверждения
+func (r Report) Deletes() int {
+	return len(r.CustomersDeleted) + len(r.SubscriptionsDeactivated)
+}
+
+// subscriptionUpdate — изменения одной подписки: поля из панели и, возможно, повторная активация
+type subscriptionUpdate struct {
+	subscription database.Subscription
+	fields       map[string]interface{}
+	activate     bool
+}
+
+// plan — изменения таблицы подписок, которые нужно внести, чтобы она совпала с панелью
+type plan struct {
+	create     []database.Subscription
+	update     []subscriptionUpdate
+	deactivate []database.Subscription
+}
+
+// customerDiff — изменения таблицы клиентов
+type customerDiff struct {
+	telegramIDs []int64
+	create      []database.Customer
+	update      []database.Customer
+	delete      []database.Customer
+}
+
+// Sync приводит клиентов и подписки в соответствие с панелью: каждому пользователю remnawave
+// с telegramId соответствует своя подписка. Подписки, чей пользователь удалён из панели
+// или отключён, деактивируются, клиенты, которых нет в панели, удаляются (или помечаются
+// удалёнными при SYNC_DELETE_MODE=soft). Если удалений больше SYNC_DELETE_THRESHOLD,
+// они не выполняются без подтверждения: неполный ответ панели или неверный REMNAWAVE_TAG
+// иначе удалили бы клиентов вместе с покупками и рефералами. Одновременно выполняется
+// только одна синхронизация, остальные получают ErrSyncRunning.
+func (s SyncService) Sync(ctx context.Context, opts Options) (Report, error) {
+	if !s.running.CompareAndSwap(false, true) {
+		return Report{}, ErrSyncRunning
+	}
+	defer s.running.Store(false)
+
+	slog.Info("Starting sync", "dry_run", opts.DryRun)
 	users, err := s.client.GetUsers(ctx)
 	if err != nil {
-		slog.Error("Error while getting users from remnawave", "error", err)
-		return
+		return Report{}, fmt.Errorf("failed to get users from remnawave: %w", err)
 	}
 	if users == nil || len(*users) == 0 {
-		slog.Error("No users found in remnawave")
-		return
+		return Report{}, errors.New("no users found in remnawave")
 	}
 
-	for _, user := range *users {
-		if user.TelegramId.Null {
-			continue
+	diff, err := s.diffCustomers(ctx, *users)
+	if err != nil {
+		return Report{}, err
+	}
+	subscriptions, err := s.subscriptionRepository.FindAll(ctx)
+	if err != nil {
+		return Report{}, err
+	}
+
+	// у новых клиентов ещё нет id, в предварительном плане их подписки без customer_id
+	customers := make(map[int64]database.Customer, len(diff.telegramIDs))
+	for _, cust := range append(diff.create, diff.update...) {
+		customers[cust.TelegramID] = cust
+	}
+	preview := s.plan(*users, customers, subscriptions, time.Now())
+
+	report := Report{DryRun: opts.DryRun, SoftDelete: config.SyncSoftDelete(), CustomersUpdated: len(diff.update)}
+	deleted := make(map[int64]bool, len(diff.delete))
+	for _, cust := range diff.create {
+		report.CustomersCreated = append(report.CustomersCreated, cust.TelegramID)
+	}
+	for _, cust := range diff.delete {
+		deleted[cust.ID] = true
+		report.CustomersDeleted = append(report.CustomersDeleted, cust.TelegramID)
+	}
+	for _, sub := range preview.deactivate {
+		if !deleted[sub.CustomerID] {
+			report.SubscriptionsDeactivated = append(report.SubscriptionsDeactivated, sub.ID)
 		}
-		if _, exists := telegramIDsSet[int64(user.TelegramId.Value)]; exists {
+	}
+	report.DeletesPending = report.Deletes() > max(config.SyncDeleteThreshold(), opts.ConfirmedDeletes)
+
+	if opts.DryRun {
+		report.Subscriptions = Result{Created: len(preview.create), Updated: len(preview.update), Deactivated: len(report.SubscriptionsDeactivated)}
+		return report, nil
+	}
+
+	if report.DeletesPending {
+		slog.Warn("Sync deletes require confirmation", "customers", len(report.CustomersDeleted), "subscriptions", len(report.SubscriptionsDeactivated))
+		diff.delete = nil
+	}
+	customers, err = s.applyCustomers(ctx, diff, report.SoftDelete)
+	if err != nil {
+		return report, err
+	}
+
+	subscriptions, err = s.subscriptionRepository.FindAll(ctx)
+	if err != nil {
+		return report, err
+	}
+	p := s.plan(*users, customers, subscriptions, time.Now())
+	if report.DeletesPending {
+		p.deactivate = nil
+	}
+
+	report.Subscriptions, err = s.apply(ctx, p)
+	slog.Info("Synchronization completed", "created", report.Subscriptions.Created, "updated", report.Subscriptions.Updated, "deactivated", report.Subscriptions.Deactivated)
+	return report, err
+}
+
+// diffCustomers сопоставляет пользователей панели с клиентами по telegramId. Если у клиента
+// несколько пользователей, в карточку клиента попадает подписка, которая заканчивается позже всех.
+func (s SyncService) diffCustomers(ctx context.Context, users []remapi.User) (customerDiff, error) {
+	var diff customerDiff
+	mappedUsers := make(map[int64]database.Customer)
+
+	for i := range users {
+		user := &users[i]
+		if user.TelegramId.Null {
 			continue
 		}
+		telegramID := int64(user.TelegramId.Value)
 
-		telegramIDsSet[int64(user.TelegramId.Value)] = int64(user.TelegramId.Value)
-
-		telegramIDs = append(telegramIDs, int64(user.TelegramId.Value))
+		if existing, exists := mappedUsers[telegramID]; exists {
+			if existing.ExpireAt.After(user.ExpireAt) {
+				continue
+			}
+		} else {
+			diff.telegramIDs = append(diff.telegramIDs, telegramID)
+		}
 
-		mappedUsers = append(mappedUsers, database.Customer{
-			TelegramID:       int64(user.TelegramId.Value),
+		mappedUsers[telegramID] = database.Customer{
+			TelegramID:       telegramID,
 			ExpireAt:         &user.ExpireAt,
 			SubscriptionLink: &user.SubscriptionUrl,
-		})
+		}
 	}
 
-	existingCustomers, err := s.customerRepository.FindByTelegramIds(ctx, telegramIDs)
+	existingCustomers, err := s.customerRepository.FindByTelegramIds(ctx, diff.telegramIDs)
 	if err != nil {
-		slog.Error("Error while searching users by telegram ids")
-		return
+		return diff, fmt.Errorf("failed to find customers by telegram ids: %w", err)
 	}
 	existingMap := make(map[int64]database.Customer)
 	for _, cust := range existingCustomers {
 		existingMap[cust.TelegramID] = cust
 	}
 
-	var toCreate []database.Customer
-	var toUpdate []database.Customer
-
-	for _, cust := range mappedUsers {
+	for _, telegramID := range diff.telegramIDs {
+		cust := mappedUsers[telegramID]
 		if existing, found := existingMap[cust.TelegramID]; found {
 			cust.ID = existing.ID
 			cust.CreatedAt = existing.CreatedAt
 			cust.Language = existing.Language
-			toUpdate = append(toUpdate, cust)
+			diff.update = append(diff.update, cust)
 		} else {
-			toCreate = append(toCreate, cust)
+			diff.create = append(diff.create, cust)
 		}
 	}
 
-	err = s.customerRepository.DeleteByNotInTelegramIds(ctx, telegramIDs)
+	diff.delete, err = s.customerRepository.FindByNotInTelegramIds(ctx, diff.telegramIDs)
 	if err != nil {
-		slog.Error("Error while deleting users")
+		return diff, fmt.Errorf("failed to find customers missing in panel: %w", err)
 	}
-	slog.Info("Deleted clients which not exist in panel")
+	return diff, nil
+}
 
-	if len(toCreate) > 0 {
-		if err := s.customerRepository.CreateBatch(ctx, toCreate); err != nil {
-			slog.Error("Error while creating users")
+// applyCustomers записывает изменения клиентов и возвращает клиентов панели по telegramId
+func (s SyncService) applyCustomers(ctx context.Context, diff customerDiff, softDelete bool) (map[int64]database.Customer, error) {
+	if len(diff.delete) > 0 {
+		ids := make([]int64, 0, len(diff.delete))
+		for _, cust := range diff.delete {
+			ids = append(ids, cust.ID)
+		}
+		if softDelete {
+			err := s.customerRepository.SoftDeleteByIds(ctx, ids)
+			if err != nil {
+				return nil, fmt.Errorf("failed to soft delete customers: %w", err)
+			}
 		} else {
-			slog.Info("Created clients", "count", len(toCreate))
+			err := s.customerRepository.DeleteByIds(ctx, ids)
+			if err != nil {
+				return nil, fmt.Errorf("failed to delete customers: %w", err)
+			}
 		}
+		slog.Info("Deleted clients which not exist in panel", "count", len(ids), "soft", softDelete)
 	}
 
-	if len(toUpdate) > 0 {
-		if err := s.customerRepository.UpdateBatch(ctx, toUpdate); err != nil {
-			slog.Error("Error while updating users")
-		} else {
-			slog.Info("Updated clients", "count", len(toUpdate))
+	if len(diff.create) > 0 {
+		if err := s.customerRepository.CreateBatch(ctx, diff.create); err != nil {
+			return nil, fmt.Errorf("failed to create customers: %w", err)
+		}
+		slog.Info("Created clients", "count", len(diff.create))
+	}
+
+	if len(diff.update) > 0 {
+		if err := s.customerRepository.UpdateBatch(ctx, diff.update); err != nil {
+			return nil, fmt.Errorf("failed to update customers: %w", err)
+		}
+		slog.Info("Updated clients", "count", len(diff.update))
+	}
+
+	// у только что созданных клиентов появились id
+	customers, err := s.customerRepository.FindByTelegramIds(ctx, diff.telegramIDs)
+	if err != nil {
+		return nil, fmt.Errorf("failed to find customers by telegram ids: %w", err)
+	}
+	byTelegramID := make(map[int64]database.Customer, len(customers))
+	for _, cust := range customers {
+		byTelegramID[cust.TelegramID] = cust
+	}
+	return byTelegramID, nil
+}
+
+// plan сопоставляет пользователей панели с подписками: по remnawave_uuid, а у подписок,
+// созданных до его появления, — по short_uuid
+func (s SyncService) plan(users []remapi.User, customers map[int64]database.Customer, subscriptions []database.Subscription, now time.Time) plan {
+	byUUID := make(map[uuid.UUID][]int)
+	byShortUUID := make(map[string][]int)
+	subscriptionsCount := make(map[int64]int)
+	for i, sub := range subscriptions {
+		if sub.RemnawaveUUID != nil {
+			byUUID[*sub.RemnawaveUUID] = append(byUUID[*sub.RemnawaveUUID], i)
+		} else if sub.ShortUUID != nil && *sub.ShortUUID != "" {
+			byShortUUID[*sub.ShortUUID] = append(byShortUUID[*sub.ShortUUID], i)
+		}
+		if sub.IsActive {
+			subscriptionsCount[sub.CustomerID]++
+		}
+	}
+
+	var p plan
+	matched := make(map[int64]bool, len(subscriptions))
+	for i := range users {
+		user := &users[i]
+		disabled := isDisabled(user)
+
+		indexes := append(append([]int(nil), byUUID[user.UUID]...), byShortUUID[user.ShortUuid]...)
+		for _, idx := range indexes {
+			sub := subscriptions[idx]
+			matched[sub.ID] = true
+
+			if disabled {
+				if sub.IsActive {
+					p.deactivate = append(p.deactivate, sub)
+				}
+				continue
+			}
+
+			fields := changedFields(sub, user)
+			activate := !sub.IsActive && user.ExpireAt.After(now)
+			if len(fields) > 0 || activate {
+				p.update = append(p.update, subscriptionUpdate{subscription: sub, fields: fields, activate: activate})
+			}
+		}
+
+		if len(indexes) > 0 || disabled || user.TelegramId.Null {
+			continue
+		}
+		customer, ok := customers[int64(user.TelegramId.Value)]
+		if !ok {
+			continue
 		}
+		subscriptionsCount[customer.ID]++
+		p.create = append(p.create, database.Subscription{
+			CustomerID:       customer.ID,
+			SubscriptionLink: user.SubscriptionUrl,
+			ExpireAt:         user.ExpireAt,
+			IsActive:         true,
+			Name:             fmt.Sprintf("%s #%d", s.translation.GetText(customer.Language, "subscription_name"), subscriptionsCount[customer.ID]),
+			RemnawaveUUID:    &user.UUID,
+			ShortUUID:        &user.ShortUuid,
+			Username:         &user.Username,
+		})
 	}
-	slog.Info("Synchronization completed")
+
+	for _, sub := range subscriptions {
+		if !sub.IsActive || matched[sub.ID] {
+			continue
+		}
+		// подписку без uuid и short_uuid не с чем сопоставить, её не трогаем
+		if sub.RemnawaveUUID == nil && (sub.ShortUUID == nil || *sub.ShortUUID == "") {
+			continue
+		}
+		p.deactivate = append(p.deactivate, sub)
+	}
+
+	return p
+}
+
+func (s SyncService) apply(ctx context.Context, p plan) (Result, error) {
+	var result Result
+	failed := 0
+
+	for i := range p.create {
+		if _, err := s.subscriptionRepository.CreateSubscription(ctx, &p.create[i]); err != nil {
+			slog.Error("Error while creating subscription", "customer_id", p.create[i].CustomerID, "error", err)
+			failed++
+			continue
+		}
+		result.Created++
+	}
+
+	for _, update := range p.update {
+		if len(update.fields) > 0 {
+			if err := s.subscriptionRepository.UpdateSubscription(ctx, update.subscription.ID, update.fields); err != nil {
+				slog.Error("Error while updating subscription", "subscription_id", update.subscription.ID, "error", err)
+				failed++
+				continue
+			}
+		}
+		if update.activate {
+			if err := s.subscriptionRepository.ActivateSubscription(ctx, update.subscription.ID); err != nil {
+				slog.Error("Error while activating subscription", "subscription_id", update.subscription.ID, "error", err)
+				failed++
+				continue
+			}
+		}
+		result.Updated++
+	}
+
+	for _, sub := range p.deactivate {
+		if err := s.subscriptionRepository.DeactivateSubscription(ctx, sub.ID); err != nil {
+			slog.Error("Error while deactivating subscription", "subscription_id", sub.ID, "error", err)
+			failed++
+			continue
+		}
+		result.Deactivated++
+	}
+
+	if failed > 0 {
+		return result, fmt.Errorf("%d subscription changes failed", failed)
+	}
+	return result, nil
+}
+
+// changedFields возвращает поля подписки, которые отличаются от пользователя панели
+func changedFields(sub database.Subscription, user *remapi.User) map[string]interface{} {
+	fields := make(map[string]interface{})
+	if !sub.ExpireAt.Equal(user.ExpireAt) {
+		fields["expire_at"] = user.ExpireAt
+	}
+	if sub.SubscriptionLink != user.SubscriptionUrl {
+		fields["subscription_link"] = user.SubscriptionUrl
+	}
+	if sub.RemnawaveUUID == nil || *sub.RemnawaveUUID != user.UUID {
+		fields["remnawave_uuid"] = user.UUID
+	}
+	if sub.ShortUUID == nil || *sub.ShortUUID != user.ShortUuid {
+		fields["short_uuid"] = user.ShortUuid
+	}
+	if sub.Username == nil || *sub.Username != user.Username {
+		fields["username"] = user.Username
+	}
+	return fields
+}
+
+func isDisabled(user *remapi.User) bool {
+	status, ok := user.Status.Get()
+	return ok && status == remapi.UserStatusDISABLED
 }
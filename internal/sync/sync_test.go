@@ -0,0 +1,84 @@
+package sync
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	remapi "github.com/Jolymmiles/remnawave-api-go/v2/api"
+	"github.com/google/uuid"
+
+	"remnawave-tg-shop-bot/internal/database"
+	"remnawave-tg-shop-bot/internal/translation"
+)
+
+func strPtr(s string) *string { return &s }
+
+func TestPlan(t *testing.T) {
+	now := time.Now()
+	expireAt := now.AddDate(0, 1, 0)
+	knownUuid, legacyUuid, disabledUuid, newUuid, orphanUuid := uuid.New(), uuid.New(), uuid.New(), uuid.New(), uuid.New()
+
+	users := []remapi.User{
+		{UUID: knownUuid, ShortUuid: "known", Username: "1_100", SubscriptionUrl: "https://sub/known", ExpireAt: expireAt, TelegramId: remapi.NewNilInt(100)},
+		{UUID: legacyUuid, ShortUuid: "legacy", Username: "1_100_2_abcdef", SubscriptionUrl: "https://sub/legacy", ExpireAt: expireAt, TelegramId: remapi.NewNilInt(100)},
+		{UUID: disabledUuid, ShortUuid: "disabled", SubscriptionUrl: "https://sub/disabled", ExpireAt: expireAt, TelegramId: remapi.NewNilInt(100), Status: remapi.NewOptUserStatus(remapi.UserStatusDISABLED)},
+		{UUID: newUuid, ShortUuid: "new", Username: "1_100_3_123456", SubscriptionUrl: "https://sub/new", ExpireAt: expireAt, TelegramId: remapi.NewNilInt(100)},
+	}
+	customers := map[int64]database.Customer{100: {ID: 1, TelegramID: 100}}
+	subscriptions := []database.Subscription{
+		{ID: 1, CustomerID: 1, IsActive: true, SubscriptionLink: "https://sub/known", ExpireAt: expireAt, RemnawaveUUID: &knownUuid, ShortUUID: strPtr("known"), Username: strPtr("1_100")},
+		{ID: 2, CustomerID: 1, IsActive: true, SubscriptionLink: "https://old/legacy", ExpireAt: now, ShortUUID: strPtr("legacy")},
+		{ID: 3, CustomerID: 1, IsActive: true, SubscriptionLink: "https://sub/disabled", ExpireAt: expireAt, RemnawaveUUID: &disabledUuid},
+		{ID: 4, CustomerID: 1, IsActive: true, SubscriptionLink: "https://sub/orphan", ExpireAt: expireAt, RemnawaveUUID: &orphanUuid},
+		{ID: 5, CustomerID: 1, IsActive: true, SubscriptionLink: ""},
+	}
+
+	p := SyncService{translation: translation.GetInstance()}.plan(users, customers, subscriptions, now)
+
+	if len(p.update) != 1 || p.update[0].subscription.ID != 2 {
+		t.Fatalf("expected only legacy subscription 2 to be updated, got %#v", p.update)
+	}
+	fields := p.update[0].fields
+	if fields["remnawave_uuid"] != legacyUuid || fields["subscription_link"] != "https://sub/legacy" || fields["expire_at"] != expireAt {
+		t.Errorf("unexpected update fields: %#v", fields)
+	}
+
+	if len(p.deactivate) != 2 || p.deactivate[0].ID != 3 || p.deactivate[1].ID != 4 {
+		t.Errorf("expected disabled and orphaned subscriptions 3, 4 to be deactivated, got %#v", p.deactivate)
+	}
+
+	if len(p.create) != 1 || p.create[0].CustomerID != 1 || *p.create[0].RemnawaveUUID != newUuid {
+		t.Fatalf("expected one subscription for the new user, got %#v", p.create)
+	}
+}
+
+func TestPlan_ReactivatesEnabledUser(t *testing.T) {
+	now := time.Now()
+	userUuid := uuid.New()
+	users := []remapi.User{
+		{UUID: userUuid, ShortUuid: "s", Username: "u", SubscriptionUrl: "https://sub/s", ExpireAt: now.AddDate(0, 0, 10), TelegramId: remapi.NewNilInt(100)},
+	}
+	subscriptions := []database.Subscription{
+		{ID: 1, CustomerID: 1, IsActive: false, SubscriptionLink: "https://sub/s", ExpireAt: now.AddDate(0, 0, 10), RemnawaveUUID: &userUuid, ShortUUID: strPtr("s"), Username: strPtr("u")},
+	}
+
+	p := SyncService{translation: translation.GetInstance()}.plan(users, nil, subscriptions, now)
+
+	if len(p.update) != 1 || !p.update[0].activate || len(p.update[0].fields) != 0 {
+		t.Fatalf("expected subscription to be reactivated without field changes, got %#v", p.update)
+	}
+	if len(p.create) != 0 || len(p.deactivate) != 0 {
+		t.Fatalf("unexpected changes: %#v", p)
+	}
+}
+
+func TestSync_RejectsConcurrentRun(t *testing.T) {
+	s := NewSyncService(nil, nil, nil, nil)
+	s.running.Store(true)
+
+	if _, err := s.Sync(context.Background(), Options{}); !errors.Is(err, ErrSyncRunning) {
+		t.Fatalf("expected ErrSyncRunning, got %v", err)
+	}
+}
@@ -1,15 +1,209 @@
 package tribute
 
 import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
 	"net/http"
+	"strings"
+	"time"
+
+	"remnawave-tg-shop-bot/internal/database"
+	"remnawave-tg-shop-bot/utils"
+)
+
+const (
+	EventNewSubscription       = "new_subscription"
+	EventCancelledSubscription = "cancelled_subscription"
+	SignatureHeader            = "trbt-signature"
 )
 
-type Client struct{}
+type customerRepository interface {
+	FindByTelegramId(ctx context.Context, telegramId int64) (*database.Customer, error)
+}
+
+type purchaseRepository interface {
+	FindLatestActiveTributesByCustomerIDs(ctx context.Context, customerIDs []int64) (*[]database.Purchase, error)
+	FindByTributeEvent(ctx context.Context, event string) (*database.Purchase, error)
+	UpdateFields(ctx context.Context, id int64, updates map[string]interface{}) error
+}
+
+type paymentProcessor interface {
+	CreateTributePurchase(ctx context.Context, amount float64, currency string, months int, customer *database.Customer, event string) (int64, error)
+	ProcessPurchaseById(ctx context.Context, purchaseId int64) error
+}
+
+// Client принимает вебхуки Tribute о подписках на канал и отражает их в покупках
+type Client struct {
+	apiKey             string
+	paymentService     paymentProcessor
+	customerRepository customerRepository
+	purchaseRepository purchaseRepository
+}
 
-func NewClient(_ interface{}, _ interface{}) *Client { return &Client{} }
+func NewClient(apiKey string, paymentService paymentProcessor, customerRepository customerRepository, purchaseRepository purchaseRepository) *Client {
+	return &Client{
+		apiKey:             apiKey,
+		paymentService:     paymentService,
+		customerRepository: customerRepository,
+		purchaseRepository: purchaseRepository,
+	}
+}
 
 func (c *Client) WebHookHandler() http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+
+		body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, 1<<20))
+		if err != nil {
+			slog.Error("error reading tribute webhook", "error", err)
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+
+		if !VerifySignature(c.apiKey, body, r.Header.Get(SignatureHeader)) {
+			slog.Warn("tribute webhook with invalid signature")
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+
+		var webhook SubscriptionWebhook
+		if err := json.Unmarshal(body, &webhook); err != nil {
+			slog.Error("error decoding tribute webhook", "error", err)
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+
+		ctx, cancel := context.WithTimeout(r.Context(), 60*time.Second)
+		defer cancel()
+
+		switch webhook.Name {
+		case EventNewSubscription:
+			err = c.handleNewSubscription(ctx, webhook)
+		case EventCancelledSubscription:
+			err = c.handleCancelledSubscription(ctx, webhook)
+		default:
+			w.WriteHeader(http.StatusOK)
+			return
+		}
+
+		if err != nil {
+			slog.Error("error handling tribute webhook", "error", err, "event", webhook.Name)
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+
 		w.WriteHeader(http.StatusOK)
 	})
 }
+
+func (c *Client) handleNewSubscription(ctx context.Context, webhook SubscriptionWebhook) error {
+	customer, err := c.customerRepository.FindByTelegramId(ctx, webhook.Payload.TelegramUserID)
+	if err != nil {
+		return err
+	}
+	if customer == nil {
+		slog.Warn("customer for tribute subscription not found", "telegramId", utils.MaskHalfInt64(webhook.Payload.TelegramUserID))
+		return nil
+	}
+
+	// Tribute повторяет доставку, пока не получит 200: покупка по событию создаётся один раз,
+	// уникальный ключ события отсекает и параллельные доставки. Уже оплаченную покупку второй раз
+	// не продлеваем, а неоплаченную — обрабатываем заново.
+	event := eventKey(webhook)
+	amount := float64(webhook.Payload.Amount) / 100
+	purchaseId, err := c.paymentService.CreateTributePurchase(ctx, amount, webhook.Payload.Currency, periodToMonths(webhook.Payload.Period), customer, event)
+	if errors.Is(err, database.ErrTributeEventExists) {
+		existing, findErr := c.purchaseRepository.FindByTributeEvent(ctx, event)
+		if findErr != nil {
+			return findErr
+		}
+		if existing == nil {
+			return err
+		}
+		if existing.Status == database.PurchaseStatusPaid {
+			slog.Info("tribute subscription already processed", "purchase_id", utils.MaskHalfInt64(existing.ID))
+			return nil
+		}
+		slog.Info("retrying tribute purchase", "purchase_id", utils.MaskHalfInt64(existing.ID), "status", existing.Status)
+		purchaseId, err = existing.ID, nil
+	}
+	if err != nil {
+		return err
+	}
+
+	return c.paymentService.ProcessPurchaseById(ctx, purchaseId)
+}
+
+// eventKey — ключ события подписки: повторные доставки одного события приходят с тем же created_at
+func eventKey(webhook SubscriptionWebhook) string {
+	return fmt.Sprintf("%s:%d:%d:%d", webhook.Name, webhook.Payload.SubscriptionID, webhook.Payload.TelegramUserID, webhook.CreatedAt.UnixNano())
+}
+
+func (c *Client) handleCancelledSubscription(ctx context.Context, webhook SubscriptionWebhook) error {
+	customer, err := c.customerRepository.FindByTelegramId(ctx, webhook.Payload.TelegramUserID)
+	if err != nil {
+		return err
+	}
+	if customer == nil {
+		slog.Warn("customer for cancelled tribute subscription not found", "telegramId", utils.MaskHalfInt64(webhook.Payload.TelegramUserID))
+		return nil
+	}
+
+	latest, err := c.latestActiveTribute(ctx, customer.ID)
+	if err != nil {
+		return err
+	}
+	if latest == nil {
+		return nil
+	}
+
+	// оплаченный период остаётся за пользователем, отмена лишь выключает автопродление
+	return c.purchaseRepository.UpdateFields(ctx, latest.ID, map[string]interface{}{
+		"status": database.PurchaseStatusCancel,
+	})
+}
+
+func (c *Client) latestActiveTribute(ctx context.Context, customerID int64) (*database.Purchase, error) {
+	purchases, err := c.purchaseRepository.FindLatestActiveTributesByCustomerIDs(ctx, []int64{customerID})
+	if err != nil {
+		return nil, err
+	}
+	if purchases == nil || len(*purchases) == 0 {
+		return nil, nil
+	}
+	return &(*purchases)[0], nil
+}
+
+func periodToMonths(period string) int {
+	switch strings.ToLower(period) {
+	case "quarterly", "3-month", "3_months":
+		return 3
+	case "halfyearly", "half-yearly", "6-month", "6_months":
+		return 6
+	case "yearly", "annual", "annually", "12-month", "12_months":
+		return 12
+	default:
+		return 1
+	}
+}
+
+// VerifySignature проверяет заголовок trbt-signature: HMAC-SHA256 тела с ключом API
+func VerifySignature(apiKey string, body []byte, signature string) bool {
+	expected, err := hex.DecodeString(signature)
+	if err != nil || len(expected) == 0 {
+		return false
+	}
+	mac := hmac.New(sha256.New, []byte(apiKey))
+	mac.Write(body)
+	return hmac.Equal(mac.Sum(nil), expected)
+}
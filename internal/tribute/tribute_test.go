@@ -0,0 +1,216 @@
+package tribute
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"remnawave-tg-shop-bot/internal/database"
+)
+
+const testAPIKey = "tribute-key"
+
+type customerRepoMock struct {
+	customers map[int64]*database.Customer
+}
+
+func (m *customerRepoMock) FindByTelegramId(ctx context.Context, telegramId int64) (*database.Customer, error) {
+	return m.customers[telegramId], nil
+}
+
+type purchaseRepoMock struct {
+	purchases []database.Purchase
+	updates   map[int64]map[string]interface{}
+}
+
+func (m *purchaseRepoMock) FindLatestActiveTributesByCustomerIDs(ctx context.Context, customerIDs []int64) (*[]database.Purchase, error) {
+	var result []database.Purchase
+	for _, p := range m.purchases {
+		if p.CustomerID == customerIDs[0] && p.Status != database.PurchaseStatusCancel {
+			result = append(result, p)
+		}
+	}
+	return &result, nil
+}
+
+func (m *purchaseRepoMock) FindByTributeEvent(ctx context.Context, event string) (*database.Purchase, error) {
+	for i := range m.purchases {
+		if e := m.purchases[i].TributeEvent; e != nil && *e == event {
+			p := m.purchases[i]
+			return &p, nil
+		}
+	}
+	return nil, nil
+}
+
+func (m *purchaseRepoMock) UpdateFields(ctx context.Context, id int64, updates map[string]interface{}) error {
+	if m.updates == nil {
+		m.updates = make(map[int64]map[string]interface{})
+	}
+	m.updates[id] = updates
+	return nil
+}
+
+type paymentMock struct {
+	repo      *purchaseRepoMock
+	created   []database.Purchase
+	processed []int64
+	failures  int
+}
+
+// CreateTributePurchase отклоняет повторное событие, как уникальный индекс tribute_event
+func (m *paymentMock) CreateTributePurchase(ctx context.Context, amount float64, currency string, months int, customer *database.Customer, event string) (int64, error) {
+	if existing, _ := m.repo.FindByTributeEvent(ctx, event); existing != nil {
+		return 0, database.ErrTributeEventExists
+	}
+	p := database.Purchase{
+		ID:           int64(len(m.repo.purchases) + 1),
+		Amount:       amount,
+		Currency:     currency,
+		Month:        months,
+		CustomerID:   customer.ID,
+		InvoiceType:  database.InvoiceTypeTribute,
+		Status:       database.PurchaseStatusPending,
+		CreatedAt:    time.Now(),
+		TributeEvent: &event,
+	}
+	m.repo.purchases = append(m.repo.purchases, p)
+	m.created = append(m.created, p)
+	return p.ID, nil
+}
+
+func (m *paymentMock) ProcessPurchaseById(ctx context.Context, purchaseId int64) error {
+	m.processed = append(m.processed, purchaseId)
+	if m.failures > 0 {
+		m.failures--
+		return errors.New("panel unavailable")
+	}
+	for i := range m.repo.purchases {
+		if m.repo.purchases[i].ID == purchaseId {
+			m.repo.purchases[i].Status = database.PurchaseStatusPaid
+		}
+	}
+	return nil
+}
+
+func postWebhook(t *testing.T, handler http.Handler, webhook SubscriptionWebhook, key string) int {
+	t.Helper()
+	body, err := json.Marshal(webhook)
+	if err != nil {
+		t.Fatalf("marshal webhook: %v", err)
+	}
+	mac := hmac.New(sha256.New, []byte(key))
+	mac.Write(body)
+
+	req := httptest.NewRequest(http.MethodPost, "/tribute", bytes.NewReader(body))
+	req.Header.Set(SignatureHeader, hex.EncodeToString(mac.Sum(nil)))
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, req)
+	return rec.Code
+}
+
+func newTestClient() (*Client, *purchaseRepoMock, *paymentMock) {
+	purchases := &purchaseRepoMock{}
+	payments := &paymentMock{repo: purchases}
+	customers := &customerRepoMock{customers: map[int64]*database.Customer{
+		100: {ID: 1, TelegramID: 100},
+	}}
+	return NewClient(testAPIKey, payments, customers, purchases), purchases, payments
+}
+
+func TestWebHookHandler_NewSubscriptionCreatesPaidPurchaseOnce(t *testing.T) {
+	client, _, payments := newTestClient()
+	webhook := SubscriptionWebhook{
+		Name:      EventNewSubscription,
+		CreatedAt: time.Now().Add(-time.Minute),
+		Payload:   Payload{TelegramUserID: 100, Amount: 50000, Currency: "EUR", Period: "quarterly"},
+	}
+
+	for i := 0; i < 2; i++ {
+		if code := postWebhook(t, client.WebHookHandler(), webhook, testAPIKey); code != http.StatusOK {
+			t.Fatalf("expected 200, got %d", code)
+		}
+	}
+
+	if len(payments.created) != 1 {
+		t.Fatalf("expected one purchase for a redelivered webhook, got %d", len(payments.created))
+	}
+	created := payments.created[0]
+	if created.InvoiceType != database.InvoiceTypeTribute || created.Month != 3 || created.Amount != 500 || created.Currency != "EUR" {
+		t.Fatalf("unexpected purchase: %#v", created)
+	}
+	if len(payments.processed) != 1 || payments.processed[0] != created.ID {
+		t.Fatalf("expected purchase %d to be processed, got %#v", created.ID, payments.processed)
+	}
+}
+
+func TestWebHookHandler_NewSubscriptionRetriesFailedPurchase(t *testing.T) {
+	client, purchases, payments := newTestClient()
+	payments.failures = 1
+	webhook := SubscriptionWebhook{
+		Name:      EventNewSubscription,
+		CreatedAt: time.Now().Add(-time.Minute),
+		Payload:   Payload{TelegramUserID: 100, Amount: 50000, Period: "monthly"},
+	}
+
+	if code := postWebhook(t, client.WebHookHandler(), webhook, testAPIKey); code != http.StatusInternalServerError {
+		t.Fatalf("expected 500 for a failed first attempt, got %d", code)
+	}
+	if code := postWebhook(t, client.WebHookHandler(), webhook, testAPIKey); code != http.StatusOK {
+		t.Fatalf("expected 200 for the retry, got %d", code)
+	}
+
+	if len(payments.created) != 1 {
+		t.Fatalf("retry must reuse the purchase, got %d purchases", len(payments.created))
+	}
+	id := payments.created[0].ID
+	if len(payments.processed) != 2 || payments.processed[0] != id || payments.processed[1] != id {
+		t.Fatalf("expected purchase %d to be processed twice, got %#v", id, payments.processed)
+	}
+	if purchases.purchases[0].Status != database.PurchaseStatusPaid {
+		t.Fatalf("expected purchase to be paid after retry, got %s", purchases.purchases[0].Status)
+	}
+}
+
+func TestWebHookHandler_CancelledSubscriptionCancelsLatestTribute(t *testing.T) {
+	client, purchases, _ := newTestClient()
+	purchases.purchases = []database.Purchase{
+		{ID: 7, CustomerID: 1, InvoiceType: database.InvoiceTypeTribute, Status: database.PurchaseStatusPaid},
+	}
+
+	code := postWebhook(t, client.WebHookHandler(), SubscriptionWebhook{
+		Name:    EventCancelledSubscription,
+		Payload: Payload{TelegramUserID: 100},
+	}, testAPIKey)
+
+	if code != http.StatusOK {
+		t.Fatalf("expected 200, got %d", code)
+	}
+	if purchases.updates[7]["status"] != database.PurchaseStatusCancel {
+		t.Fatalf("expected purchase 7 to be cancelled, got %#v", purchases.updates)
+	}
+}
+
+func TestWebHookHandler_RejectsInvalidSignature(t *testing.T) {
+	client, _, payments := newTestClient()
+
+	code := postWebhook(t, client.WebHookHandler(), SubscriptionWebhook{
+		Name:    EventNewSubscription,
+		Payload: Payload{TelegramUserID: 100, Amount: 100},
+	}, "wrong-key")
+
+	if code != http.StatusUnauthorized {
+		t.Fatalf("expected 401, got %d", code)
+	}
+	if len(payments.created) != 0 {
+		t.Fatalf("unsigned webhook must not create purchases, got %#v", payments.created)
+	}
+}
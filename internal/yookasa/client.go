@@ -38,12 +38,8 @@ func NewClient(baseURL, shopID, secretKey string) *Client {
 	}
 }
 
-func (c *Client) CreateInvoice(ctx context.Context, amount int, month int, customerId int64, purchaseId int64) (*Payment, error) {
-	rub := Amount{
-		Value:    strconv.Itoa(amount),
-		Currency: "RUB",
-	}
-
+// SubscriptionDescription — описание платежа за подписку на month месяцев
+func SubscriptionDescription(month int) string {
 	var monthString string
 	switch month {
 	case 1:
@@ -53,8 +49,25 @@ func (c *Client) CreateInvoice(ctx context.Context, amount int, month int, custo
 	default:
 		monthString = "месяцев"
 	}
+	return fmt.Sprintf("Подписка на %d %s", month, monthString)
+}
+
+// SubscriptionDaysDescription — описание платежа за тариф, заданный в днях
+func SubscriptionDaysDescription(days int) string {
+	return fmt.Sprintf("Подписка на %d дн.", days)
+}
+
+// TrafficDescription — описание платежа за пакет трафика
+func TrafficDescription(gb int) string {
+	return fmt.Sprintf("Дополнительный трафик %d ГБ", gb)
+}
+
+func (c *Client) CreateInvoice(ctx context.Context, amount int, description string, customerId int64, purchaseId int64) (*Payment, error) {
+	rub := Amount{
+		Value:    strconv.Itoa(amount),
+		Currency: "RUB",
+	}
 
-	description := fmt.Sprintf("Подписка на %d %s", month, monthString)
 	receipt := &Receipt{
 		Customer: &Customer{
 			Email: config.YookasaEmail(),
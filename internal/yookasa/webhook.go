@@ -0,0 +1,219 @@
+package yookasa
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+
+	"remnawave-tg-shop-bot/internal/database"
+	"remnawave-tg-shop-bot/utils"
+)
+
+const (
+	EventPaymentSucceeded = "payment.succeeded"
+	EventPaymentCanceled  = "payment.canceled"
+)
+
+// trustedNetworks — адреса, с которых ЮKassa присылает уведомления
+// https://yookassa.ru/developers/using-api/webhooks#ip
+var trustedNetworks = mustParseNetworks(
+	"185.71.76.0/27",
+	"185.71.77.0/27",
+	"77.75.153.0/25",
+	"77.75.156.11/32",
+	"77.75.156.35/32",
+	"77.75.154.128/25",
+	"2a02:5180::/32",
+)
+
+type Notification struct {
+	Type   string  `json:"type"`
+	Event  string  `json:"event"`
+	Object Payment `json:"object"`
+}
+
+type purchaseRepository interface {
+	FindByYookasaID(ctx context.Context, yookasaID uuid.UUID) (*database.Purchase, error)
+	FindByInvoiceTypeAndStatus(ctx context.Context, invoiceType database.InvoiceType, status database.PurchaseStatus) (*[]database.Purchase, error)
+}
+
+type paymentProcessor interface {
+	ProcessPurchaseById(ctx context.Context, purchaseId int64) error
+	CancelPayment(ctx context.Context, purchaseId int64) error
+}
+
+// PaymentConfirmer подтверждает платежи ЮKassa: всегда перечитывает платёж через API,
+// а не доверяет телу уведомления.
+type PaymentConfirmer struct {
+	api                paymentGetter
+	purchaseRepository purchaseRepository
+	paymentProcessor   paymentProcessor
+	trustForwardedFor  bool
+}
+
+type paymentGetter interface {
+	GetPayment(ctx context.Context, paymentID uuid.UUID) (*Payment, error)
+}
+
+func NewPaymentConfirmer(api paymentGetter, purchaseRepository purchaseRepository, paymentProcessor paymentProcessor, trustForwardedFor bool) *PaymentConfirmer {
+	return &PaymentConfirmer{
+		api:                api,
+		purchaseRepository: purchaseRepository,
+		paymentProcessor:   paymentProcessor,
+		trustForwardedFor:  trustForwardedFor,
+	}
+}
+
+// WebHookHandler принимает уведомления payment.succeeded и payment.canceled
+func (c *PaymentConfirmer) WebHookHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+
+		ip := c.remoteIP(r)
+		if !IsTrustedIP(ip) {
+			slog.Warn("yookasa webhook from untrusted ip", "ip", ip)
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+
+		var notification Notification
+		if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 1<<20)).Decode(&notification); err != nil {
+			slog.Error("error decoding yookasa notification", "error", err)
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+
+		if notification.Event != EventPaymentSucceeded && notification.Event != EventPaymentCanceled {
+			w.WriteHeader(http.StatusOK)
+			return
+		}
+
+		ctx, cancel := context.WithTimeout(r.Context(), 60*time.Second)
+		defer cancel()
+
+		purchase, err := c.purchaseRepository.FindByYookasaID(ctx, notification.Object.ID)
+		if err != nil {
+			slog.Error("error finding purchase by yookasa id", "error", err)
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		if purchase == nil {
+			slog.Warn("purchase for yookasa payment not found", "paymentId", notification.Object.ID)
+			w.WriteHeader(http.StatusOK)
+			return
+		}
+
+		if err := c.confirm(ctx, purchase); err != nil {
+			slog.Error("error confirming yookasa payment", "error", err, "purchase_id", utils.MaskHalfInt64(purchase.ID))
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+
+		w.WriteHeader(http.StatusOK)
+	})
+}
+
+// CheckPending опрашивает ЮKassa по всем ожидающим покупкам. Нужен для установок,
+// где вебхук недоступен снаружи, и как страховка от потерянных уведомлений.
+func (c *PaymentConfirmer) CheckPending(ctx context.Context) error {
+	purchases, err := c.purchaseRepository.FindByInvoiceTypeAndStatus(ctx, database.InvoiceTypeYookasa, database.PurchaseStatusPending)
+	if err != nil {
+		return fmt.Errorf("failed to find pending yookasa purchases: %w", err)
+	}
+
+	for _, purchase := range *purchases {
+		if purchase.YookasaID == nil {
+			continue
+		}
+		if err := c.confirm(ctx, &purchase); err != nil {
+			slog.Error("error checking yookasa payment", "error", err, "purchase_id", utils.MaskHalfInt64(purchase.ID))
+		}
+	}
+	return nil
+}
+
+func (c *PaymentConfirmer) confirm(ctx context.Context, purchase *database.Purchase) error {
+	if purchase.Status == database.PurchaseStatusPaid || purchase.Status == database.PurchaseStatusCancel {
+		return nil
+	}
+
+	payment, err := c.api.GetPayment(ctx, *purchase.YookasaID)
+	if err != nil {
+		return err
+	}
+
+	switch {
+	case payment.Status == "succeeded" && payment.Paid:
+		if !amountMatches(payment.Amount, purchase.Amount, purchase.Currency) {
+			return fmt.Errorf("amount mismatch: paid %s %s, expected %.2f %s", payment.Amount.Value, payment.Amount.Currency, purchase.Amount, purchase.Currency)
+		}
+		return c.paymentProcessor.ProcessPurchaseById(ctx, purchase.ID)
+	case payment.IsCancelled():
+		return c.paymentProcessor.CancelPayment(ctx, purchase.ID)
+	default:
+		return nil
+	}
+}
+
+// amountMatches сверяет оплаченную сумму и валюту с покупкой; счета ЮKassa выставляются только в рублях
+func amountMatches(amount Amount, expected float64, currency string) bool {
+	if amount.Currency != "RUB" || currency != "RUB" {
+		return false
+	}
+	value, err := strconv.ParseFloat(amount.Value, 64)
+	if err != nil {
+		return false
+	}
+	return value+0.005 >= expected
+}
+
+func (c *PaymentConfirmer) remoteIP(r *http.Request) net.IP {
+	if c.trustForwardedFor {
+		if forwarded := r.Header.Get("X-Forwarded-For"); forwarded != "" {
+			parts := strings.Split(forwarded, ",")
+			return net.ParseIP(strings.TrimSpace(parts[len(parts)-1]))
+		}
+	}
+
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	return net.ParseIP(host)
+}
+
+// IsTrustedIP проверяет, принадлежит ли адрес диапазонам ЮKassa
+func IsTrustedIP(ip net.IP) bool {
+	if ip == nil {
+		return false
+	}
+	for _, network := range trustedNetworks {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+func mustParseNetworks(cidrs ...string) []*net.IPNet {
+	networks := make([]*net.IPNet, 0, len(cidrs))
+	for _, cidr := range cidrs {
+		_, network, err := net.ParseCIDR(cidr)
+		if err != nil {
+			panic(err)
+		}
+		networks = append(networks, network)
+	}
+	return networks
+}
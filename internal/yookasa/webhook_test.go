@@ -0,0 +1,218 @@
+package yookasa
+
+import (
+	"context"
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/google/uuid"
+
+	"remnawave-tg-shop-bot/internal/database"
+)
+
+type purchaseRepoMock struct {
+	purchases []database.Purchase
+}
+
+func (m *purchaseRepoMock) FindByYookasaID(ctx context.Context, yookasaID uuid.UUID) (*database.Purchase, error) {
+	for i := range m.purchases {
+		if m.purchases[i].YookasaID != nil && *m.purchases[i].YookasaID == yookasaID {
+			p := m.purchases[i]
+			return &p, nil
+		}
+	}
+	return nil, nil
+}
+
+func (m *purchaseRepoMock) FindByInvoiceTypeAndStatus(ctx context.Context, invoiceType database.InvoiceType, status database.PurchaseStatus) (*[]database.Purchase, error) {
+	var result []database.Purchase
+	for _, p := range m.purchases {
+		if p.InvoiceType == invoiceType && p.Status == status {
+			result = append(result, p)
+		}
+	}
+	return &result, nil
+}
+
+type processorMock struct {
+	processed []int64
+	cancelled []int64
+}
+
+func (m *processorMock) ProcessPurchaseById(ctx context.Context, purchaseId int64) error {
+	m.processed = append(m.processed, purchaseId)
+	return nil
+}
+
+func (m *processorMock) CancelPayment(ctx context.Context, purchaseId int64) error {
+	m.cancelled = append(m.cancelled, purchaseId)
+	return nil
+}
+
+// newYookasaStub поднимает заглушку API ЮKassa, отдающую платежи из payments
+func newYookasaStub(t *testing.T, payments map[uuid.UUID]Payment) *httptest.Server {
+	t.Helper()
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id, err := uuid.Parse(strings.TrimPrefix(r.URL.Path, "/payments/"))
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		payment, ok := payments[id]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		_ = json.NewEncoder(w).Encode(payment)
+	}))
+	t.Cleanup(server.Close)
+	return server
+}
+
+func postNotification(t *testing.T, handler http.Handler, remoteAddr string, notification Notification) int {
+	t.Helper()
+	body, err := json.Marshal(notification)
+	if err != nil {
+		t.Fatalf("marshal notification: %v", err)
+	}
+	req := httptest.NewRequest(http.MethodPost, "/yookasa", strings.NewReader(string(body)))
+	req.RemoteAddr = remoteAddr
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, req)
+	return rec.Code
+}
+
+func TestWebHookHandler_ConfirmsPaymentViaAPI(t *testing.T) {
+	paidID := uuid.New()
+	server := newYookasaStub(t, map[uuid.UUID]Payment{
+		paidID: {ID: paidID, Status: "succeeded", Paid: true, Amount: Amount{Value: "99.00", Currency: "RUB"}},
+	})
+
+	repo := &purchaseRepoMock{purchases: []database.Purchase{
+		{ID: 5, Amount: 99, Status: database.PurchaseStatusPending, Currency: "RUB", InvoiceType: database.InvoiceTypeYookasa, YookasaID: &paidID},
+	}}
+	processor := &processorMock{}
+	confirmer := NewPaymentConfirmer(NewClient(server.URL, "shop", "secret"), repo, processor, false)
+
+	code := postNotification(t, confirmer.WebHookHandler(), "185.71.76.10:443", Notification{
+		Type:   "notification",
+		Event:  EventPaymentSucceeded,
+		Object: Payment{ID: paidID, Status: "succeeded", Paid: true},
+	})
+
+	if code != http.StatusOK {
+		t.Fatalf("expected 200, got %d", code)
+	}
+	if len(processor.processed) != 1 || processor.processed[0] != 5 {
+		t.Fatalf("expected purchase 5 to be processed, got %#v", processor.processed)
+	}
+}
+
+func TestWebHookHandler_IgnoresForgedSuccess(t *testing.T) {
+	pendingID := uuid.New()
+	server := newYookasaStub(t, map[uuid.UUID]Payment{
+		pendingID: {ID: pendingID, Status: "pending", Amount: Amount{Value: "99.00", Currency: "RUB"}},
+	})
+
+	repo := &purchaseRepoMock{purchases: []database.Purchase{
+		{ID: 6, Amount: 99, Status: database.PurchaseStatusPending, Currency: "RUB", InvoiceType: database.InvoiceTypeYookasa, YookasaID: &pendingID},
+	}}
+	processor := &processorMock{}
+	confirmer := NewPaymentConfirmer(NewClient(server.URL, "shop", "secret"), repo, processor, false)
+
+	code := postNotification(t, confirmer.WebHookHandler(), "185.71.76.10:443", Notification{
+		Event:  EventPaymentSucceeded,
+		Object: Payment{ID: pendingID, Status: "succeeded", Paid: true},
+	})
+
+	if code != http.StatusOK {
+		t.Fatalf("expected 200, got %d", code)
+	}
+	if len(processor.processed) != 0 {
+		t.Fatalf("payment must not be processed while API reports pending, got %#v", processor.processed)
+	}
+}
+
+func TestWebHookHandler_IgnoresOtherCurrency(t *testing.T) {
+	paidID := uuid.New()
+	server := newYookasaStub(t, map[uuid.UUID]Payment{
+		paidID: {ID: paidID, Status: "succeeded", Paid: true, Amount: Amount{Value: "99.00", Currency: "USD"}},
+	})
+
+	repo := &purchaseRepoMock{purchases: []database.Purchase{
+		{ID: 7, Amount: 99, Status: database.PurchaseStatusPending, Currency: "RUB", InvoiceType: database.InvoiceTypeYookasa, YookasaID: &paidID},
+	}}
+	processor := &processorMock{}
+	confirmer := NewPaymentConfirmer(NewClient(server.URL, "shop", "secret"), repo, processor, false)
+
+	postNotification(t, confirmer.WebHookHandler(), "185.71.76.10:443", Notification{
+		Event:  EventPaymentSucceeded,
+		Object: Payment{ID: paidID, Status: "succeeded", Paid: true},
+	})
+
+	if len(processor.processed) != 0 {
+		t.Fatalf("payment in another currency must not be processed, got %#v", processor.processed)
+	}
+}
+
+func TestWebHookHandler_RejectsUntrustedIP(t *testing.T) {
+	processor := &processorMock{}
+	confirmer := NewPaymentConfirmer(nil, &purchaseRepoMock{}, processor, false)
+
+	code := postNotification(t, confirmer.WebHookHandler(), "203.0.113.7:443", Notification{Event: EventPaymentSucceeded})
+	if code != http.StatusForbidden {
+		t.Fatalf("expected 403, got %d", code)
+	}
+}
+
+func TestCheckPending_ProcessesAndCancels(t *testing.T) {
+	paidID, canceledID, waitingID := uuid.New(), uuid.New(), uuid.New()
+	server := newYookasaStub(t, map[uuid.UUID]Payment{
+		paidID:     {ID: paidID, Status: "succeeded", Paid: true, Amount: Amount{Value: "321.00", Currency: "RUB"}},
+		canceledID: {ID: canceledID, Status: "canceled"},
+		waitingID:  {ID: waitingID, Status: "pending"},
+	})
+
+	repo := &purchaseRepoMock{purchases: []database.Purchase{
+		{ID: 1, Amount: 321, Status: database.PurchaseStatusPending, Currency: "RUB", InvoiceType: database.InvoiceTypeYookasa, YookasaID: &paidID},
+		{ID: 2, Amount: 99, Status: database.PurchaseStatusPending, Currency: "RUB", InvoiceType: database.InvoiceTypeYookasa, YookasaID: &canceledID},
+		{ID: 3, Amount: 99, Status: database.PurchaseStatusPending, Currency: "RUB", InvoiceType: database.InvoiceTypeYookasa, YookasaID: &waitingID},
+		{ID: 4, Amount: 99, Status: database.PurchaseStatusPending, InvoiceType: database.InvoiceTypeCrypto},
+	}}
+	processor := &processorMock{}
+	confirmer := NewPaymentConfirmer(NewClient(server.URL, "shop", "secret"), repo, processor, false)
+
+	if err := confirmer.CheckPending(context.Background()); err != nil {
+		t.Fatalf("CheckPending returned error: %v", err)
+	}
+
+	if len(processor.processed) != 1 || processor.processed[0] != 1 {
+		t.Fatalf("expected purchase 1 to be processed, got %#v", processor.processed)
+	}
+	if len(processor.cancelled) != 1 || processor.cancelled[0] != 2 {
+		t.Fatalf("expected purchase 2 to be cancelled, got %#v", processor.cancelled)
+	}
+}
+
+func TestIsTrustedIP(t *testing.T) {
+	tests := []struct {
+		ip       string
+		expected bool
+	}{
+		{"185.71.76.1", true},
+		{"77.75.156.11", true},
+		{"77.75.156.12", false},
+		{"2a02:5180::1", true},
+		{"8.8.8.8", false},
+	}
+
+	for _, tt := range tests {
+		if got := IsTrustedIP(net.ParseIP(tt.ip)); got != tt.expected {
+			t.Errorf("IsTrustedIP(%s) = %v, want %v", tt.ip, got, tt.expected)
+		}
+	}
+}
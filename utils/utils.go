@@ -1,6 +1,7 @@
 package utils
 
 import (
+	"fmt"
 	"strconv"
 	"strings"
 )
@@ -25,3 +26,29 @@ func MaskHalf(input string) string {
 	maskedLength := length - visibleLength
 	return input[:visibleLength] + strings.Repeat("*", maskedLength)
 }
+
+// FormatBytes переводит байты в читаемый вид: "512.0 MB", "1.25 GB"
+func FormatBytes(bytes int64) string {
+	const (
+		mb = 1 << 20
+		gb = 1 << 30
+		tb = 1 << 40
+	)
+	switch {
+	case bytes >= tb:
+		return fmt.Sprintf("%.2f TB", float64(bytes)/tb)
+	case bytes >= gb:
+		return fmt.Sprintf("%.2f GB", float64(bytes)/gb)
+	default:
+		return fmt.Sprintf("%.1f MB", float64(bytes)/mb)
+	}
+}
+
+// ProgressBar рисует заполненность used/total из width делений, например "▰▰▰▱▱▱▱▱▱▱"
+func ProgressBar(used, total int64, width int) string {
+	filled := 0
+	if total > 0 {
+		filled = int(min(used, total) * int64(width) / total)
+	}
+	return strings.Repeat("▰", filled) + strings.Repeat("▱", width-filled)
+}
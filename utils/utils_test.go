@@ -0,0 +1,36 @@
+package utils
+
+import "testing"
+
+func TestFormatBytes(t *testing.T) {
+	tests := map[int64]string{
+		0:                "0.0 MB",
+		512 << 20:        "512.0 MB",
+		5 << 29:          "2.50 GB",
+		3 << 40:          "3.00 TB",
+		(1 << 30) - 1024: "1024.0 MB",
+	}
+	for bytes, expected := range tests {
+		if got := FormatBytes(bytes); got != expected {
+			t.Errorf("FormatBytes(%d) = %q, want %q", bytes, got, expected)
+		}
+	}
+}
+
+func TestProgressBar(t *testing.T) {
+	tests := []struct {
+		used, total int64
+		expected    string
+	}{
+		{0, 100, "▱▱▱▱▱▱▱▱▱▱"},
+		{25, 100, "▰▰▱▱▱▱▱▱▱▱"},
+		{100, 100, "▰▰▰▰▰▰▰▰▰▰"},
+		{150, 100, "▰▰▰▰▰▰▰▰▰▰"},
+		{10, 0, "▱▱▱▱▱▱▱▱▱▱"},
+	}
+	for _, tt := range tests {
+		if got := ProgressBar(tt.used, tt.total, 10); got != tt.expected {
+			t.Errorf("ProgressBar(%d, %d) = %q, want %q", tt.used, tt.total, got, tt.expected)
+		}
+	}
+}